@@ -1,8 +1,13 @@
 package main
 
 // Since go is a compiled language the deamon have to know
-// what applications that are available and their configuration
-// name that will be referenced in yaml config "app: appname"
+// what applications that are available. Apps register with the
+// name that will be referenced in yaml config "app: appname" from
+// the init function of their package:
 //
-// Everytime you add a new app in go-daemon this list must be added
-var apps = map[string]interface{}{}
+//	func init() {
+//		daemon.Register("appname", func() daemon.DaemonApplication { return &App{} })
+//	}
+//
+// Everytime you add a new app package in go-daemon it must be imported here
+// like _ "github.com/helto4real/go-daemon/example/app"
@@ -0,0 +1,310 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EntityID is an entity id in format "domain.object_id" that is validated
+// when used in a typed app configuration
+type EntityID string
+
+var entityIDPattern = regexp.MustCompile(`^[a-z0-9_]+\.[a-z0-9_]+$`)
+
+// Validate returns error if the entity id is not in format "domain.object_id"
+func (a EntityID) Validate() error {
+	if !entityIDPattern.MatchString(string(a)) {
+		return fmt.Errorf("invalid entity id %q, expected format domain.object_id", string(a))
+	}
+	return nil
+}
+
+// Domain returns the domain part of the entity id, like "light"
+func (a EntityID) Domain() string {
+	return strings.SplitN(string(a), ".", 2)[0]
+}
+
+// Validator is implemented by config types that validates their value
+type Validator interface {
+	Validate() error
+}
+
+// FieldError is returned when a property can not be decoded into the app config
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (a *FieldError) Error() string {
+	return fmt.Sprintf("property %q: %v", a.Field, a.Err)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// DecodeProperties decodes the app properties into the struct out points to.
+//
+// Fields are matched by the yaml tag name. Use the tag `default:"value"` to
+// set a default value and `validate:"required"` for properties that has to
+// be present. Durations are parsed like "5m" or as seconds if a number.
+// Unknown properties is an error to catch typos
+func DecodeProperties(properties map[string]interface{}, out interface{}) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config must be a pointer to a struct, got %T", out)
+	}
+	if properties == nil {
+		properties = map[string]interface{}{}
+	}
+	return decodeStruct("", properties, rv.Elem())
+}
+
+// NormalizeYAML converts the map[interface{}]interface{} that yaml produces
+// to map[string]interface{} recursively so values can be used as json
+func NormalizeYAML(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[fmt.Sprint(key)] = NormalizeYAML(item)
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[key] = NormalizeYAML(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = NormalizeYAML(item)
+		}
+		return result
+	}
+	return value
+}
+
+func fieldPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func decodeStruct(path string, values map[string]interface{}, rv reflect.Value) error {
+	rt := rv.Type()
+	known := map[string]bool{}
+
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if field.PkgPath != "" {
+			// Unexported field
+			continue
+		}
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		known[name] = true
+		path := fieldPath(path, name)
+
+		value, ok := values[name]
+		if !ok || value == nil {
+			if defaultValue, hasDefault := field.Tag.Lookup("default"); hasDefault {
+				value, ok = defaultValue, true
+			}
+		}
+		if !ok || value == nil {
+			if field.Tag.Get("validate") == "required" {
+				return &FieldError{Field: path, Err: fmt.Errorf("required property is missing")}
+			}
+			continue
+		}
+		if err := decodeValue(path, value, rv.Field(i)); err != nil {
+			return err
+		}
+	}
+
+	unknown := []string{}
+	for key := range values {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return &FieldError{Field: fieldPath(path, unknown[0]), Err: fmt.Errorf("unknown property")}
+	}
+	return nil
+}
+
+func decodeValue(path string, value interface{}, rv reflect.Value) error {
+	if err := decodeKind(path, value, rv); err != nil {
+		return err
+	}
+	if validator, ok := rv.Interface().(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return &FieldError{Field: path, Err: err}
+		}
+	}
+	return nil
+}
+
+func decodeKind(path string, value interface{}, rv reflect.Value) error {
+	typeError := func() error {
+		return &FieldError{Field: path, Err: fmt.Errorf("cannot use %v (%T) as %s", value, value, rv.Type())}
+	}
+
+	if rv.Type() == durationType {
+		switch v := value.(type) {
+		case string:
+			duration, err := time.ParseDuration(v)
+			if err != nil {
+				return &FieldError{Field: path, Err: fmt.Errorf("invalid duration %q, use format like 30s, 5m or 1h", v)}
+			}
+			rv.SetInt(int64(duration))
+			return nil
+		case int:
+			rv.SetInt(int64(time.Duration(v) * time.Second))
+			return nil
+		case float64:
+			rv.SetInt(int64(v * float64(time.Second)))
+			return nil
+		}
+		return typeError()
+	}
+
+	switch rv.Kind() {
+	case reflect.Ptr:
+		ptr := reflect.New(rv.Type().Elem())
+		if err := decodeValue(path, value, ptr.Elem()); err != nil {
+			return err
+		}
+		rv.Set(ptr)
+	case reflect.Interface:
+		rv.Set(reflect.ValueOf(NormalizeYAML(value)))
+	case reflect.String:
+		switch value.(type) {
+		case string, int, float64, bool:
+			rv.SetString(fmt.Sprint(value))
+		default:
+			return typeError()
+		}
+	case reflect.Bool:
+		switch v := value.(type) {
+		case bool:
+			rv.SetBool(v)
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return typeError()
+			}
+			rv.SetBool(b)
+		default:
+			return typeError()
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch v := value.(type) {
+		case int:
+			i = int64(v)
+		case float64:
+			if v != math.Trunc(v) {
+				return typeError()
+			}
+			i = int64(v)
+		case string:
+			parsed, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return typeError()
+			}
+			i = parsed
+		default:
+			return typeError()
+		}
+		if rv.OverflowInt(i) {
+			return &FieldError{Field: path, Err: fmt.Errorf("value %d out of range", i)}
+		}
+		rv.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var i int64
+		switch v := value.(type) {
+		case int:
+			i = int64(v)
+		case string:
+			parsed, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return typeError()
+			}
+			i = parsed
+		default:
+			return typeError()
+		}
+		if i < 0 || rv.OverflowUint(uint64(i)) {
+			return &FieldError{Field: path, Err: fmt.Errorf("value %d out of range", i)}
+		}
+		rv.SetUint(uint64(i))
+	case reflect.Float32, reflect.Float64:
+		switch v := value.(type) {
+		case int:
+			rv.SetFloat(float64(v))
+		case float64:
+			rv.SetFloat(v)
+		case string:
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return typeError()
+			}
+			rv.SetFloat(f)
+		default:
+			return typeError()
+		}
+	case reflect.Slice:
+		items, ok := value.([]interface{})
+		if !ok {
+			return typeError()
+		}
+		slice := reflect.MakeSlice(rv.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := decodeValue(fmt.Sprintf("%s[%d]", path, i), item, slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		rv.Set(slice)
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return &FieldError{Field: path, Err: fmt.Errorf("only maps with string keys are supported")}
+		}
+		values, ok := NormalizeYAML(value).(map[string]interface{})
+		if !ok {
+			return typeError()
+		}
+		m := reflect.MakeMapWithSize(rv.Type(), len(values))
+		for key, item := range values {
+			elem := reflect.New(rv.Type().Elem()).Elem()
+			if err := decodeValue(fieldPath(path, key), item, elem); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()), elem)
+		}
+		rv.Set(m)
+	case reflect.Struct:
+		values, ok := NormalizeYAML(value).(map[string]interface{})
+		if !ok {
+			return typeError()
+		}
+		return decodeStruct(path, values, rv)
+	default:
+		return &FieldError{Field: path, Err: fmt.Errorf("unsupported type %s", rv.Type())}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package config_test
+
+import (
+	"testing"
+	"time"
+
+	c "github.com/helto4real/go-daemon/daemon/config"
+	h "github.com/helto4real/go-daemon/daemon/test"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type nestedConfig struct {
+	Name  string `yaml:"name" validate:"required"`
+	Level int    `yaml:"level" default:"3"`
+}
+
+type typedConfig struct {
+	Light     c.EntityID            `yaml:"light" validate:"required"`
+	Sensors   []c.EntityID          `yaml:"sensors"`
+	Delay     time.Duration         `yaml:"delay" default:"2m"`
+	Threshold float64               `yaml:"threshold"`
+	Count     int                   `yaml:"count"`
+	Enabled   bool                  `yaml:"enabled" default:"true"`
+	Nested    nestedConfig          `yaml:"nested"`
+	Scenes    map[string]c.EntityID `yaml:"scenes"`
+	Optional  *int                  `yaml:"optional"`
+}
+
+func decodeYaml(t *testing.T, yml string, out interface{}) error {
+	raw := map[string]interface{}{}
+	h.Ok(t, yaml.Unmarshal([]byte(yml), &raw))
+	return c.DecodeProperties(c.NormalizeYAML(raw).(map[string]interface{}), out)
+}
+
+func TestDecodeProperties(t *testing.T) {
+	cfg := typedConfig{}
+	err := decodeYaml(t, `
+light: light.livingroom
+sensors:
+  - binary_sensor.motion1
+  - binary_sensor.motion2
+threshold: 21.5
+count: 4
+nested:
+  name: test
+scenes:
+  evening: scene.evening
+`, &cfg)
+	h.Ok(t, err)
+	h.Equals(t, c.EntityID("light.livingroom"), cfg.Light)
+	h.Equals(t, "light", cfg.Light.Domain())
+	h.Equals(t, []c.EntityID{"binary_sensor.motion1", "binary_sensor.motion2"}, cfg.Sensors)
+	h.Equals(t, 2*time.Minute, cfg.Delay)
+	h.Equals(t, 21.5, cfg.Threshold)
+	h.Equals(t, 4, cfg.Count)
+	h.Equals(t, true, cfg.Enabled)
+	h.Equals(t, "test", cfg.Nested.Name)
+	h.Equals(t, 3, cfg.Nested.Level)
+	h.Equals(t, c.EntityID("scene.evening"), cfg.Scenes["evening"])
+	h.Equals(t, (*int)(nil), cfg.Optional)
+}
+
+func TestDecodePropertiesDurations(t *testing.T) {
+	cfg := typedConfig{}
+	h.Ok(t, decodeYaml(t, "light: light.l\ndelay: 30", &cfg))
+	h.Equals(t, 30*time.Second, cfg.Delay)
+
+	err := decodeYaml(t, "light: light.l\ndelay: 5 minutes", &cfg)
+	h.Equals(t, `property "delay": invalid duration "5 minutes", use format like 30s, 5m or 1h`, err.Error())
+}
+
+func TestDecodePropertiesErrors(t *testing.T) {
+	tests := []struct {
+		yml string
+		err string
+	}{
+		{"sensors: []", `property "light": required property is missing`},
+		{"light: livingroom", `property "light": invalid entity id "livingroom", expected format domain.object_id`},
+		{"light: light.l\nsensors:\n  - binary_sensor.ok\n  - Not valid", `property "sensors[1]": invalid entity id "Not valid", expected format domain.object_id`},
+		{"light: light.l\ncount: many", `property "count": cannot use many (string) as int`},
+		{"light: light.l\nnested:\n  level: 1", `property "nested.name": required property is missing`},
+		{"light: light.l\nligth: light.typo", `property "ligth": unknown property`},
+		{"light: light.l\nsensors: binary_sensor.one", `property "sensors": cannot use binary_sensor.one (string) as []config.EntityID`},
+	}
+	for _, test := range tests {
+		cfg := typedConfig{}
+		err := decodeYaml(t, test.yml, &cfg)
+		h.Assert(t, err != nil, "Expected error for %q", test.yml)
+		h.Equals(t, test.err, err.Error())
+	}
+}
+
+func TestDecodePropertiesNotPointer(t *testing.T) {
+	err := c.DecodeProperties(map[string]interface{}{}, typedConfig{})
+	h.Assert(t, err != nil, "Expected error when not pointer to struct")
+}
@@ -3,7 +3,7 @@ package config
 import (
 	"io"
 	"io/ioutil"
-	"os"
+	"path/filepath"
 
 	yaml "gopkg.in/yaml.v2"
 )
@@ -13,24 +13,50 @@ type Configuration struct {
 }
 
 // Open configuration from disk.
+//
+// "!secret name" is replaced from secrets.yaml in the same folder and
+// ${ENV_VAR} from environment. The regions of the tracking regions_file
+// are added to the regions.
 func (a *Configuration) Open() (*Config, error) {
-	file, err := os.Open(a.configPath)
+	data, err := ioutil.ReadFile(a.configPath)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-	return a.OpenReader(file)
+	secrets, err := LoadSecrets(a.SecretsPath())
+	if err != nil {
+		return nil, err
+	}
+	if data, err = Expand(data, secrets); err != nil {
+		return nil, err
+	}
+	config, err := getRawConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.loadRegionsFile(config); err != nil {
+		return nil, err
+	}
+	return config, nil
 }
 
-// Open configuration from a reader.
+// Open configuration from a reader. Only ${ENV_VAR} is replaced since
+// there are no secrets file.
 func (a *Configuration) OpenReader(r io.Reader) (*Config, error) {
 	data, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
+	if data, err = Expand(data, nil); err != nil {
+		return nil, err
+	}
 	return getRawConfig(data)
 }
 
+// SecretsPath returns the path to the secrets.yaml used with the configuration
+func (a *Configuration) SecretsPath() string {
+	return filepath.Join(filepath.Dir(a.configPath), "secrets.yaml")
+}
+
 func getRawConfig(data []byte) (*Config, error) {
 	//log.Print("\r\n", string(data))
 	config := &Config{}
@@ -2,36 +2,161 @@ package config
 
 // Config is the main configuration data structure
 type Config struct {
-	HomeAssistant HomeAssistantConfig      `yaml:"home_assistant"`
-	Settings      *SettingsConfig          `yaml:"settings"`
-	People        map[string]*PeopleConfig `yaml:"people"`
+	HomeAssistant HomeAssistantConfig      `yaml:"home_assistant" json:"home_assistant"`
+	HTTP          *HTTPConfig              `yaml:"http" json:"http,omitempty"`
+	Logging       *LoggingConfig           `yaml:"logging" json:"logging,omitempty"`
+	History       *HistoryConfig           `yaml:"history" json:"history,omitempty"`
+	Settings      *SettingsConfig          `yaml:"settings" json:"settings,omitempty"`
+	People        map[string]*PeopleConfig `yaml:"people" json:"people,omitempty"`
+	// DefaultApps configures the default applications by instance name, like people_app
+	DefaultApps map[string]*DefaultAppConfig `yaml:"default_apps" json:"default_apps,omitempty"`
+}
+
+// DefaultAppConfig is the configuration of a default application
+type DefaultAppConfig struct {
+	// Enabled starts or not starts the application, the default of the application is used if not set
+	Enabled *bool `yaml:"enabled" json:"enabled,omitempty"`
+	// Properties is the config of the application like properties in app yaml files
+	Properties map[string]interface{} `yaml:"properties" json:"properties,omitempty"`
+	DependsOn  []string               `yaml:"depends_on" json:"depends_on,omitempty"`
+	Trace      bool                   `yaml:"trace" json:"trace"`
 }
 
 // HomeAssistantConfig is the configuration for the Home Assistant platform integration
 type HomeAssistantConfig struct {
-	IP    string `yaml:"ip"`
-	SSL   bool   `yaml:"ssl"`
-	Token string `yaml:"token"`
+	IP    string `yaml:"ip" json:"ip"`
+	SSL   bool   `yaml:"ssl" json:"ssl"`
+	Token string `yaml:"token" json:"token"`
+}
+
+// HTTPConfig is the configuration for the embedded status and control API
+type HTTPConfig struct {
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	Address string `yaml:"address" json:"address"`
+	// StaleEventTimeout is the seconds without events before health fails,
+	// default 900, negative disables
+	StaleEventTimeout int `yaml:"stale_event_timeout" json:"stale_event_timeout"`
+	// Token is the bearer token needed to control apps, reload the config
+	// and read people, those requests are forbidden if not set
+	Token string `yaml:"token" json:"token"`
+}
+
+// LoggingConfig is the configuration of the logging
+type LoggingConfig struct {
+	// Format is "text" (default) or "json"
+	Format string `yaml:"format" json:"format"`
+	Level  string `yaml:"level" json:"level"`
+	// File logs to file instead of stdout if set
+	File string `yaml:"file" json:"file"`
+	// MaxSize is the size in megabytes before the log file is rotated, 0 disables rotation
+	MaxSize    int `yaml:"max_size" json:"max_size"`
+	MaxBackups int `yaml:"max_backups" json:"max_backups"`
+	// Apps is the log level per application instance or app name
+	Apps map[string]string `yaml:"apps" json:"apps,omitempty"`
+	// TraceSize is the number of trace entries kept per traced application
+	TraceSize int `yaml:"trace_size" json:"trace_size"`
+}
+
+// HistoryConfig is the configuration of the state history kept for subscribed entities
+type HistoryConfig struct {
+	// Size is the max number of states kept per entity, default 100
+	Size int `yaml:"size" json:"size"`
+	// MaxAge is the max age in seconds of kept states, 0 keeps states until size is reached
+	MaxAge int `yaml:"max_age" json:"max_age"`
+	// Seed reads the history of subscribed entities from Home Assistant when apps are loaded
+	Seed bool `yaml:"seed" json:"seed"`
 }
 
 type TrackingStateSettingsConfig struct {
-	JustArrivedTime  int    `yaml:"just_arrived_time"`
-	JustLeftTime     int    `yaml:"just_left_time"`
-	HomeState        string `yaml:"home_state"`
-	JustLeftState    string `yaml:"just_left_state"`
-	JustArrivedState string `yaml:"just_arrived_state"`
-	AwayState        string `yaml:"away_state"`
+	JustArrivedTime  int    `yaml:"just_arrived_time" json:"just_arrived_time"`
+	JustLeftTime     int    `yaml:"just_left_time" json:"just_left_time"`
+	HomeState        string `yaml:"home_state" json:"home_state"`
+	JustLeftState    string `yaml:"just_left_state" json:"just_left_state"`
+	JustArrivedState string `yaml:"just_arrived_state" json:"just_arrived_state"`
+	AwayState        string `yaml:"away_state" json:"away_state"`
+	// Zones are the Home Assistant zones tracked like home, the key is the
+	// zone entity id like zone.work
+	Zones map[string]*ZoneConfig `yaml:"zones" json:"zones,omitempty"`
+	// Fusion is how the states of the devices of people are combined
+	Fusion *FusionConfig `yaml:"fusion" json:"fusion,omitempty"`
+	// Units is metric (default) or imperial for distances and speeds
+	Units string `yaml:"units" json:"units"`
+	// Proximity are the triggers sent when people get near or far from home
+	Proximity []*ProximityConfig `yaml:"proximity" json:"proximity,omitempty"`
+	// Regions are named polygon geofences, the key is the name of the region
+	Regions map[string]*RegionConfig `yaml:"regions" json:"regions,omitempty"`
+	// RegionsFile is a GeoJSON file with more regions, relative to the config folder
+	RegionsFile string `yaml:"regions_file" json:"regions_file"`
+	// PersonEntities reads people and their device trackers from the Home
+	// Assistant person entities, devices in people are added to those
+	PersonEntities bool `yaml:"person_entities" json:"person_entities"`
+	// PersonSyncInterval is the seconds between reading person entities to
+	// find added and removed persons, default 300
+	PersonSyncInterval int `yaml:"person_sync_interval" json:"person_sync_interval"`
+}
+
+// RegionConfig is a polygon geofence
+type RegionConfig struct {
+	// Polygon is the corners of the region as [latitude, longitude] pairs
+	Polygon [][]float64 `yaml:"polygon" json:"polygon"`
+}
+
+// ProximityConfig is a trigger for people within a distance from home
+type ProximityConfig struct {
+	Name string `yaml:"name" json:"name"`
+	// Distance is the distance from home in the units of tracking
+	Distance float64 `yaml:"distance" json:"distance"`
+	// Direction is towards, away_from or any (default)
+	Direction string `yaml:"direction" json:"direction"`
+	// People are the people of the trigger, all people if empty
+	People []string `yaml:"people" json:"people,omitempty"`
+}
+
+// FusionConfig is how the states of the devices of a person are combined
+// into one presence state
+type FusionConfig struct {
+	// Weights is the weight of devices by entity id or source type, like gps,
+	// router, bluetooth or bluetooth_le. Devices without weight has weight 1
+	Weights map[string]float64 `yaml:"weights" json:"weights,omitempty"`
+	// StaleTimes is the seconds per source type after the last update that a
+	// device is ignored, default 3600 for gps
+	StaleTimes map[string]int `yaml:"stale_times" json:"stale_times,omitempty"`
+	// MaxGPSAccuracy ignores gps devices with gps_accuracy over the meters, 0
+	// is no limit. The tracking setting is used if not set for the person
+	MaxGPSAccuracy *float64 `yaml:"max_gps_accuracy" json:"max_gps_accuracy,omitempty"`
+	// HomeThreshold is the share, 0 to 1, of the total weight that has to be
+	// home. 0 means any device home is enough. The tracking setting is used
+	// if not set for the person
+	HomeThreshold *float64 `yaml:"home_threshold" json:"home_threshold,omitempty"`
+}
+
+// ZoneConfig is a Home Assistant zone tracked by the people app
+type ZoneConfig struct {
+	// State is the state of people in the zone, the friendly name of the zone if empty
+	State string `yaml:"state" json:"state"`
 }
 
 // SettingsConfig let you tweak the settings of the daemon
 type SettingsConfig struct {
-	TrackingSettings *TrackingStateSettingsConfig `yaml:"tracking"`
+	TrackingSettings *TrackingStateSettingsConfig `yaml:"tracking" json:"tracking,omitempty"`
+	// Household enables the household presence entities of the people app
+	Household *HouseholdConfig `yaml:"household" json:"household,omitempty"`
+}
+
+// HouseholdConfig is the presence aggregated over all people and named groups of people
+type HouseholdConfig struct {
+	// Name is the prefix of the household entities, default household
+	Name string `yaml:"name" json:"name"`
+	// Groups are named groups of people with own aggregated entities, like adults
+	Groups map[string][]string `yaml:"groups" json:"groups,omitempty"`
 }
 
 // PeopleConfig is the configuration for the Home Assistant platform integration
 type PeopleConfig struct {
-	FriendlyName string   `yaml:"friendly_name"`
-	Devices      []string `yaml:"devices"`
-	State        string
-	Attributes   map[string]interface{}
+	FriendlyName string                 `yaml:"friendly_name" json:"friendly_name"`
+	Devices      []string               `yaml:"devices" json:"devices"`
+	State        string                 `json:"state"`
+	Attributes   map[string]interface{} `json:"attributes"`
+	// Fusion overrides the fusion settings in tracking for the person
+	Fusion *FusionConfig `yaml:"fusion" json:"fusion,omitempty"`
 }
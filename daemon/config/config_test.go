@@ -85,3 +85,19 @@ func TestHassioOptionsConfig(t *testing.T) {
 	h.Equals(t, "Just arrived", options.Tracking.JustArrivedState)
 	h.Equals(t, "Just left", options.Tracking.JustLeftState)
 }
+
+func TestOpenWithRegionsFile(t *testing.T) {
+	configuration := c.NewConfiguration("testdata/regions/go-daemon.yaml")
+	config, err := configuration.Open()
+	h.Ok(t, err)
+	regions := config.Settings.TrackingSettings.Regions
+	h.Equals(t, 2, len(regions))
+	// Regions in go-daemon.yaml are used before the regions file
+	h.Equals(t, [][]float64{{1, 1}, {1, 2}, {2, 2}}, regions["park"].Polygon)
+	// GeoJSON positions are swapped to latitude, longitude
+	h.Equals(t, []float64{50, 10}, regions["school"].Polygon[0])
+	h.Equals(t, 5, len(regions["school"].Polygon))
+
+	_, err = c.LoadRegions("testdata/regions/missing.geojson")
+	h.NotEquals(t, nil, err)
+}
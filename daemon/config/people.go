@@ -0,0 +1,52 @@
+package config
+
+// Copy returns a deep copy of the person so it can be changed or read
+// without sharing maps and slices
+func (a *PeopleConfig) Copy() *PeopleConfig {
+	person := *a
+	person.Devices = append([]string(nil), a.Devices...)
+	person.Attributes = map[string]interface{}{}
+	for key, value := range a.Attributes {
+		person.Attributes[key] = copyValue(value)
+	}
+	if a.Fusion != nil {
+		fusion := *a.Fusion
+		person.Fusion = &fusion
+	}
+	return &person
+}
+
+// CopyPeople returns a deep copy of people
+func CopyPeople(people map[string]*PeopleConfig) map[string]*PeopleConfig {
+	if people == nil {
+		return nil
+	}
+	result := make(map[string]*PeopleConfig, len(people))
+	for name, person := range people {
+		if person == nil {
+			person = &PeopleConfig{}
+		}
+		result[name] = person.Copy()
+	}
+	return result
+}
+
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[key] = copyValue(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = copyValue(item)
+		}
+		return result
+	case []string:
+		return append([]string(nil), v...)
+	}
+	return value
+}
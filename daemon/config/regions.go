@@ -0,0 +1,92 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// geoJSON is the part of a GeoJSON FeatureCollection used for regions
+type geoJSON struct {
+	Type     string `json:"type"`
+	Features []struct {
+		Properties struct {
+			Name string `json:"name"`
+		} `json:"properties"`
+		Geometry struct {
+			Type        string        `json:"type"`
+			Coordinates [][][]float64 `json:"coordinates"`
+		} `json:"geometry"`
+	} `json:"features"`
+}
+
+// LoadRegions reads the polygon features of a GeoJSON FeatureCollection,
+// the name property is the name of the region
+//
+// GeoJSON positions are [longitude, latitude], the corners of the regions
+// are swapped to [latitude, longitude] like in go-daemon.yaml
+func LoadRegions(path string) (map[string]*RegionConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	collection := geoJSON{}
+	if err := json.Unmarshal(data, &collection); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON in %s: %v", path, err)
+	}
+	if collection.Type != "FeatureCollection" {
+		return nil, fmt.Errorf("%s has to be a GeoJSON FeatureCollection, got %q", path, collection.Type)
+	}
+	regions := map[string]*RegionConfig{}
+	for i, feature := range collection.Features {
+		name := feature.Properties.Name
+		if name == "" {
+			return nil, fmt.Errorf("feature %d in %s has no name property", i, path)
+		}
+		if feature.Geometry.Type != "Polygon" || len(feature.Geometry.Coordinates) == 0 {
+			return nil, fmt.Errorf("region %s in %s has to be a Polygon, got %q", name, path, feature.Geometry.Type)
+		}
+		region := &RegionConfig{}
+		// Only the outer ring is used, holes are not supported
+		for _, position := range feature.Geometry.Coordinates[0] {
+			if len(position) < 2 {
+				return nil, fmt.Errorf("region %s in %s has invalid position %v", name, path, position)
+			}
+			region.Polygon = append(region.Polygon, []float64{position[1], position[0]})
+		}
+		regions[name] = region
+	}
+	return regions, nil
+}
+
+// loadRegionsFile adds the regions of the regions file in tracking, the
+// regions in go-daemon.yaml are used if the same name is in both
+func (a *Configuration) loadRegionsFile(config *Config) error {
+	if config.Settings == nil || config.Settings.TrackingSettings == nil ||
+		config.Settings.TrackingSettings.RegionsFile == "" {
+		return nil
+	}
+	tracking := config.Settings.TrackingSettings
+	regions, err := LoadRegions(a.RegionsPath(tracking.RegionsFile))
+	if err != nil {
+		return err
+	}
+	if tracking.Regions == nil {
+		tracking.Regions = map[string]*RegionConfig{}
+	}
+	for name, region := range regions {
+		if _, ok := tracking.Regions[name]; !ok {
+			tracking.Regions[name] = region
+		}
+	}
+	return nil
+}
+
+// RegionsPath returns the path of a regions file, relative paths are relative to the config folder
+func (a *Configuration) RegionsPath(file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(filepath.Dir(a.configPath), file)
+}
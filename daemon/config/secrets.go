@@ -0,0 +1,268 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Redacted replaces secret values in logs and api output
+const Redacted = "**********"
+
+// minSecretLength is the shortest secret value that is redacted, shorter
+// values would redact common words in the logs
+const minSecretLength = 4
+
+// Secrets are the named values from secrets.yaml used with "!secret name"
+type Secrets map[string]string
+
+// referencePattern matches "!secret name" and ${ENV_VAR}
+var referencePattern = regexp.MustCompile(`!secret[ \t]+([A-Za-z0-9_\-.]+)|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ExpandError is returned from Expand when a secret or environment variable is
+// missing or its value can not be used where it is referenced
+type ExpandError struct {
+	// Reference is the text that could not be expanded, like "!secret token"
+	Reference string
+	Name      string
+	Secret    bool
+	// Unquoted is true if the value needs quotes around the yaml value
+	Unquoted bool
+}
+
+func (a *ExpandError) Error() string {
+	name := "environment variable " + a.Name
+	if a.Secret {
+		name = "secret " + a.Name
+	}
+	switch {
+	case a.Unquoted:
+		return fmt.Sprintf("the value of %s has to be quoted where %s is used", name, a.Reference)
+	case a.Secret:
+		return fmt.Sprintf("%s not found in secrets.yaml", name)
+	}
+	return fmt.Sprintf("%s is not set", name)
+}
+
+// LoadSecrets reads the secrets file in path, a missing file returns no secrets
+func LoadSecrets(path string) (Secrets, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return Secrets{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	raw := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse secrets file %s: %v", path, err)
+	}
+	secrets := make(Secrets, len(raw))
+	for name, value := range raw {
+		switch value.(type) {
+		case string, int, float64, bool:
+			secrets[name] = fmt.Sprint(value)
+			RegisterSecret(secrets[name])
+		default:
+			return nil, fmt.Errorf("secret %s in %s has to be a single value", name, path)
+		}
+	}
+	return secrets, nil
+}
+
+// Expand replaces "!secret name" with the secret and ${ENV_VAR} with the value
+// of the environment variable in yaml data. Only the original text is
+// expanded, references in comments are kept. The values are escaped so they
+// can not change the yaml structure: secrets are always strings, environment
+// variables are inserted as is if that is safe and quoted otherwise. Using
+// missing secrets or environment variables that are not set is an error
+func Expand(data []byte, secrets Secrets) ([]byte, error) {
+	var err *ExpandError
+	var result bytes.Buffer
+	last := 0
+	for _, match := range referencePattern.FindAllSubmatchIndex(data, -1) {
+		start, end := match[0], match[1]
+		lineStart := bytes.LastIndexByte(data[:start], '\n') + 1
+		lineEnd := len(data)
+		if i := bytes.IndexByte(data[end:], '\n'); i >= 0 {
+			lineEnd = end + i
+		}
+		line := data[lineStart:lineEnd]
+		context, atStart := yamlContext(line, start-lineStart)
+		if context == yamlComment {
+			continue
+		}
+		result.Write(data[last:start])
+		last = end
+
+		reference := &ExpandError{Reference: string(data[start:end]), Secret: match[2] >= 0}
+		var value string
+		var ok bool
+		if reference.Secret {
+			reference.Name = string(data[match[2]:match[3]])
+			value, ok = secrets[reference.Name]
+		} else {
+			reference.Name = string(data[match[4]:match[5]])
+			value, ok = os.LookupEnv(reference.Name)
+		}
+		// The value is the whole yaml value if nothing but a comment follows
+		whole := atStart && blankOrComment(line[end-lineStart:])
+		escaped, safe := escapeValue(value, context, whole, reference.Secret)
+		if !ok || !safe {
+			reference.Unquoted = ok
+			if err == nil {
+				err = reference
+			}
+			result.WriteString(reference.Reference)
+			continue
+		}
+		result.WriteString(escaped)
+	}
+	result.Write(data[last:])
+	if err != nil {
+		return result.Bytes(), err
+	}
+	return result.Bytes(), nil
+}
+
+// The yaml contexts a reference can be in
+const (
+	yamlPlain = iota
+	yamlDoubleQuoted
+	yamlSingleQuoted
+	yamlComment
+)
+
+// yamlContext returns the context at position pos of the yaml line and if
+// pos is at the start of a value
+func yamlContext(line []byte, pos int) (context int, atStart bool) {
+	context, atStart = yamlPlain, true
+	flowDepth := 0
+	for i := 0; i < pos; i++ {
+		ch := line[i]
+		switch context {
+		case yamlDoubleQuoted:
+			if ch == '\\' {
+				i++
+			} else if ch == '"' {
+				context, atStart = yamlPlain, false
+			}
+		case yamlSingleQuoted:
+			if ch == '\'' && i+1 < len(line) && line[i+1] == '\'' {
+				i++
+			} else if ch == '\'' {
+				context, atStart = yamlPlain, false
+			}
+		default:
+			followedBySpace := i+1 == len(line) || line[i+1] == ' ' || line[i+1] == '\t'
+			switch {
+			case ch == ' ' || ch == '\t':
+			case ch == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+				return yamlComment, false
+			case atStart && ch == '"':
+				context = yamlDoubleQuoted
+			case atStart && ch == '\'':
+				context = yamlSingleQuoted
+			case ch == ':' && followedBySpace, ch == '-' && atStart && followedBySpace:
+				atStart = true
+			case (ch == '[' || ch == '{') && atStart:
+				flowDepth++
+			case (ch == ']' || ch == '}') && flowDepth > 0:
+				flowDepth--
+				atStart = false
+			case ch == ',' && flowDepth > 0:
+				atStart = true
+			default:
+				atStart = false
+			}
+		}
+	}
+	return context, atStart
+}
+
+// blankOrComment returns true if text is only spaces and a comment
+func blankOrComment(text []byte) bool {
+	trimmed := bytes.TrimLeft(text, " \t\r")
+	return len(trimmed) == 0 || (trimmed[0] == '#' && len(trimmed) < len(text))
+}
+
+// escapeValue returns value escaped for the yaml context. In a plain value
+// the value is quoted if it is the whole value, alwaysQuote or unsafe as a
+// plain value. Returns false if value can not be used in the context
+func escapeValue(value string, context int, whole bool, alwaysQuote bool) (string, bool) {
+	// A json string is a valid yaml double quoted string
+	quoted, _ := json.Marshal(value)
+	switch context {
+	case yamlDoubleQuoted:
+		return string(quoted[1 : len(quoted)-1]), true
+	case yamlSingleQuoted:
+		return strings.Replace(value, "'", "''", -1), !strings.ContainsAny(value, "\r\n")
+	}
+	if whole && (alwaysQuote || !safePlainValue(value)) {
+		return string(quoted), true
+	}
+	return value, value == "" || safePlainValue(value)
+}
+
+// safePlainValue returns true if value is the same text as an unquoted yaml
+// value, like numbers, booleans and urls
+func safePlainValue(value string) bool {
+	return value != "" && strings.TrimSpace(value) == value &&
+		!strings.ContainsAny(value, "\r\n#,[]{}\"'") &&
+		!strings.Contains(value, ": ") && !strings.HasSuffix(value, ":") &&
+		!strings.ContainsAny(value[:1], "-?:&*!|>%@`")
+}
+
+var (
+	secretsMutex    sync.RWMutex
+	secretValues    = map[string]bool{}
+	secretsReplacer = strings.NewReplacer()
+)
+
+// RegisterSecret makes the value redacted by Redact
+func RegisterSecret(value string) {
+	if len(value) < minSecretLength {
+		return
+	}
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	if secretValues[value] {
+		return
+	}
+	secretValues[value] = true
+
+	values := make([]string, 0, len(secretValues))
+	for secret := range secretValues {
+		values = append(values, secret)
+	}
+	// Longest first so a secret containing another secret is fully redacted
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	pairs := make([]string, 0, 2*len(values))
+	for _, secret := range values {
+		pairs = append(pairs, secret, Redacted)
+	}
+	secretsReplacer = strings.NewReplacer(pairs...)
+}
+
+// ClearSecrets removes all registered secret values, call before registering
+// the secrets of a reloaded configuration
+func ClearSecrets() {
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	secretValues = map[string]bool{}
+	secretsReplacer = strings.NewReplacer()
+}
+
+// Redact replaces all registered secret values in text
+func Redact(text string) string {
+	secretsMutex.RLock()
+	defer secretsMutex.RUnlock()
+	return secretsReplacer.Replace(text)
+}
@@ -0,0 +1,83 @@
+package config_test
+
+import (
+	"os"
+	"testing"
+
+	c "github.com/helto4real/go-daemon/daemon/config"
+	h "github.com/helto4real/go-daemon/daemon/test"
+)
+
+func TestOpenConfigWithSecretsAndEnv(t *testing.T) {
+	os.Setenv("GO_DAEMON_TEST_SSL", "true")
+	defer os.Unsetenv("GO_DAEMON_TEST_SSL")
+
+	conf, err := c.NewConfiguration("testdata/secrets/go-daemon.yaml").Open()
+	h.Ok(t, err)
+	h.Equals(t, "192.168.0.100:8123", conf.HomeAssistant.IP)
+	h.Equals(t, true, conf.HomeAssistant.SSL)
+	h.Equals(t, "secret-token-1234", conf.HomeAssistant.Token)
+
+	// Secrets from secrets.yaml are redacted
+	h.Equals(t, "token: "+c.Redacted, c.Redact("token: secret-token-1234"))
+}
+
+func TestExpandErrors(t *testing.T) {
+	_, err := c.Expand([]byte("token: !secret missing"), c.Secrets{})
+	h.Equals(t, "secret missing not found in secrets.yaml", err.Error())
+	h.Equals(t, "!secret missing", err.(*c.ExpandError).Reference)
+
+	_, err = c.Expand([]byte("ip: ${GO_DAEMON_TEST_NOT_SET}"), nil)
+	h.Equals(t, "environment variable GO_DAEMON_TEST_NOT_SET is not set", err.Error())
+}
+
+func TestExpandQuotesSecrets(t *testing.T) {
+	data, err := c.Expand([]byte("token: !secret token"), c.Secrets{"token": "a: \"quoted\" value"})
+	h.Ok(t, err)
+	h.Equals(t, `token: "a: \"quoted\" value"`, string(data))
+}
+
+func TestExpandEscapesValues(t *testing.T) {
+	defer os.Unsetenv("GO_DAEMON_TEST_VALUE")
+	for _, test := range []struct {
+		yaml, value, expected string
+	}{
+		{"ssl: ${GO_DAEMON_TEST_VALUE}", "true", "ssl: true"},
+		{"ip: ${GO_DAEMON_TEST_VALUE} # comment", "a: b", `ip: "a: b" # comment`},
+		{"- ${GO_DAEMON_TEST_VALUE}", "a\nkey: value", `- "a\nkey: value"`},
+		{"url: http://${GO_DAEMON_TEST_VALUE}:8123", "host", "url: http://host:8123"},
+		{`name: "a ${GO_DAEMON_TEST_VALUE}"`, `b" #c`, `name: "a b\" #c"`},
+		{"name: 'a ${GO_DAEMON_TEST_VALUE}'", "it's", "name: 'a it''s'"},
+		{"list: [${GO_DAEMON_TEST_VALUE}, b]", "a", "list: [a, b]"},
+		// Comments are not expanded
+		{"# ${GO_DAEMON_TEST_NOT_SET}", "", "# ${GO_DAEMON_TEST_NOT_SET}"},
+	} {
+		os.Setenv("GO_DAEMON_TEST_VALUE", test.value)
+		data, err := c.Expand([]byte(test.yaml), nil)
+		h.Ok(t, err)
+		h.Equals(t, test.expected, string(data))
+	}
+
+	os.Setenv("GO_DAEMON_TEST_VALUE", "a #b")
+	_, err := c.Expand([]byte("url: http://${GO_DAEMON_TEST_VALUE}"), nil)
+	h.Equals(t, "the value of environment variable GO_DAEMON_TEST_VALUE has to be quoted where ${GO_DAEMON_TEST_VALUE} is used",
+		err.Error())
+	h.Equals(t, true, err.(*c.ExpandError).Unquoted)
+
+	// Values of secrets are not expanded again
+	data, err := c.Expand([]byte("token: !secret token"), c.Secrets{"token": "${GO_DAEMON_TEST_VALUE}"})
+	h.Ok(t, err)
+	h.Equals(t, `token: "${GO_DAEMON_TEST_VALUE}"`, string(data))
+}
+
+func TestClearSecrets(t *testing.T) {
+	c.RegisterSecret("clear-secret-value")
+	h.Equals(t, c.Redacted, c.Redact("clear-secret-value"))
+	c.ClearSecrets()
+	h.Equals(t, "clear-secret-value", c.Redact("clear-secret-value"))
+}
+
+func TestRedactShortValues(t *testing.T) {
+	c.RegisterSecret("on")
+	h.Equals(t, "light is on", c.Redact("light is on"))
+}
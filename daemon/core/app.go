@@ -0,0 +1,296 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	"github.com/helto4real/go-hassclient/client"
+	"github.com/sirupsen/logrus"
+)
+
+type appState string
+
+const (
+	appStateStopped appState = "stopped"
+	appStateRunning appState = "running"
+	appStateFailed  appState = "failed"
+)
+
+// appInstance keeps track of a loaded application instance, its configuration
+// and the subscriptions it has made through its helper
+type appInstance struct {
+	name       string
+	configFile string
+	config     d.DeamonAppConfig
+	newApp     func() (d.DaemonApplication, bool)
+	app        d.DaemonApplication
+	state      appState
+	logger     *logrus.Entry
+	trace      *traceBuffer
+
+	stateSubscriptions       map[string][]chan client.HassEntity
+	callServiceSubscriptions map[string][]chan client.HassCallServiceEvent
+	eventSubscriptions       map[string][]chan d.HassEvent
+}
+
+func newAppInstance(name string, configFile string, config d.DeamonAppConfig,
+	newApp func() (d.DaemonApplication, bool)) *appInstance {
+	config.Name = name
+	return &appInstance{
+		name:                     name,
+		configFile:               configFile,
+		config:                   config,
+		newApp:                   newApp,
+		state:                    appStateStopped,
+		stateSubscriptions:       map[string][]chan client.HassEntity{},
+		callServiceSubscriptions: map[string][]chan client.HassCallServiceEvent{},
+		eventSubscriptions:       map[string][]chan d.HassEvent{}}
+}
+
+// appHelper is the DaemonAppHelper handed out to each application instance.
+// It records the subscriptions made so they can be listed and removed when
+// the single application is stopped
+type appHelper struct {
+	*ApplicationDaemon
+	instance *appInstance
+}
+
+// ListenState start listen to state changes from entity
+//
+// Any changes is reported back to the provided channel
+func (a *appHelper) ListenState(entity string, stateChannel chan client.HassEntity) {
+	if !a.listenState(entity, stateChannel) {
+		return
+	}
+	a.listenerMutex.Lock()
+	defer a.listenerMutex.Unlock()
+	entityLower := strings.ToLower(entity)
+	a.instance.stateSubscriptions[entityLower] =
+		append(a.instance.stateSubscriptions[entityLower], stateChannel)
+	if a.stateChannelOwners == nil {
+		a.stateChannelOwners = make(map[chan client.HassEntity]*appInstance)
+	}
+	a.stateChannelOwners[stateChannel] = a.instance
+}
+
+// ListenCallServiceEvent listens to call_service events
+//
+// Any events is reported back to the provided channel
+func (a *appHelper) ListenCallServiceEvent(domain string, service string, callServiceChannel chan client.HassCallServiceEvent) {
+	if !a.listenCallServiceEvent(domain, service, callServiceChannel) {
+		return
+	}
+	a.listenerMutex.Lock()
+	defer a.listenerMutex.Unlock()
+	key := strings.ToLower(domain) + "." + strings.ToLower(service)
+	a.instance.callServiceSubscriptions[key] =
+		append(a.instance.callServiceSubscriptions[key], callServiceChannel)
+	if a.callServiceChannelOwners == nil {
+		a.callServiceChannelOwners = make(map[chan client.HassCallServiceEvent]*appInstance)
+	}
+	a.callServiceChannelOwners[callServiceChannel] = a.instance
+}
+
+// ListenEvent listens to events of eventType fired in Home Assistant
+//
+// Any events is reported back to the provided channel
+func (a *appHelper) ListenEvent(eventType string, eventChannel chan d.HassEvent) {
+	if !a.listenEvent(eventType, eventChannel) {
+		return
+	}
+	a.listenerMutex.Lock()
+	defer a.listenerMutex.Unlock()
+	a.instance.eventSubscriptions[eventType] = append(a.instance.eventSubscriptions[eventType], eventChannel)
+	if a.eventChannelOwners == nil {
+		a.eventChannelOwners = make(map[chan d.HassEvent]*appInstance)
+	}
+	a.eventChannelOwners[eventChannel] = a.instance
+}
+
+// UnlistenState stops sending the state changes of entity to the channel
+func (a *appHelper) UnlistenState(entity string, stateChannel chan client.HassEntity) {
+	a.removeStateListener(entity, stateChannel, a.instance)
+}
+
+// UnlistenCallServiceEvent stops sending the call_service events of domain.service to the channel
+func (a *appHelper) UnlistenCallServiceEvent(domain string, service string, callServiceChannel chan client.HassCallServiceEvent) {
+	a.removeCallServiceListener(domain, service, callServiceChannel, a.instance)
+}
+
+// UnlistenEvent stops sending the events of eventType to the channel
+func (a *appHelper) UnlistenEvent(eventType string, eventChannel chan d.HassEvent) {
+	a.removeEventListener(eventType, eventChannel, a.instance)
+}
+
+// hasStateChannel returns true if the instance listens to any entity on the
+// channel, listenerMutex must be held
+func (a *appInstance) hasStateChannel(stateChannel chan client.HassEntity) bool {
+	for _, channels := range a.stateSubscriptions {
+		for _, ch := range channels {
+			if ch == stateChannel {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasCallServiceChannel returns true if the instance listens to any service
+// on the channel, listenerMutex must be held
+func (a *appInstance) hasCallServiceChannel(callServiceChannel chan client.HassCallServiceEvent) bool {
+	for _, channels := range a.callServiceSubscriptions {
+		for _, ch := range channels {
+			if ch == callServiceChannel {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasEventChannel returns true if the instance listens to any event type on
+// the channel, listenerMutex must be held
+func (a *appInstance) hasEventChannel(eventChannel chan d.HassEvent) bool {
+	for _, channels := range a.eventSubscriptions {
+		for _, ch := range channels {
+			if ch == eventChannel {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// traceCause records an event or timer in the trace if enabled for the instance
+func (a *appInstance) traceCause(kind traceKind, format string, args ...interface{}) {
+	if a == nil || a.trace == nil {
+		return
+	}
+	a.trace.recordCause(kind, fmt.Sprintf(format, args...))
+}
+
+// traceCall records an outgoing call in the trace if enabled for the instance
+func (a *appInstance) traceCall(format string, args ...interface{}) {
+	if a == nil || a.trace == nil {
+		return
+	}
+	a.trace.recordCall(fmt.Sprintf(format, args...))
+}
+
+// GetLogger returns the logger of the application instance
+func (a *appHelper) GetLogger() *logrus.Entry {
+	return a.instance.logger
+}
+
+// Publish sends message to all running applications subscribed to topic
+func (a *appHelper) Publish(topic string, message interface{}) error {
+	a.instance.traceCall("publish %s: %v", topic, message)
+	return a.ApplicationDaemon.Publish(topic, message)
+}
+
+// Subscribe receives messages published to topic on channel while the application is running
+func (a *appHelper) Subscribe(topic string, channel interface{}) error {
+	return a.bus.subscribe(topic, channel, a.instance)
+}
+
+// HandleRequest handles requests sent to topic while the application is running
+func (a *appHelper) HandleRequest(topic string, handler func(request interface{}) (interface{}, error)) error {
+	return a.bus.handleRequest(topic, handler, a.instance)
+}
+
+// Request sends request to the handler of topic and waits for the reply
+func (a *appHelper) Request(topic string, request interface{}, timeout time.Duration) (interface{}, error) {
+	a.instance.traceCall("request %s: %v", topic, request)
+	return a.ApplicationDaemon.Request(topic, request, timeout)
+}
+
+// WaitForState blocks until the state of entity matches predicate
+func (a *appHelper) WaitForState(ctx context.Context, entity string,
+	predicate func(entity client.HassEntity) bool, timeout time.Duration) (client.HassEntity, error) {
+	a.instance.traceCall("wait_for_state %s", entity)
+	return a.waitForState(ctx, entity, predicate, timeout, a.instance)
+}
+
+// ListenThreshold sends an event on channel when the value of entity crosses the thresholds while the application is running
+func (a *appHelper) ListenThreshold(entity string, trigger d.ThresholdTrigger, channel chan d.ThresholdEvent) error {
+	return a.listenThreshold(entity, trigger, channel, a.instance)
+}
+
+// RegisterService handles calls to domain.service from Home Assistant while the application is running
+func (a *appHelper) RegisterService(domain string, service string, schema interface{},
+	handler func(data interface{}) (interface{}, error)) error {
+	s, err := newAppService(domain, service, schema, handler, a.instance)
+	if err != nil {
+		return err
+	}
+	return a.services.register(s)
+}
+
+// CallService calls domain.service in Home Assistant with service data
+func (a *appHelper) CallService(domain string, service string, data map[string]interface{}) error {
+	serviceCalls.Inc(a.instance.name, domain+"."+service)
+	a.instance.traceCall("call_service %s.%s %v", domain, service, data)
+	return a.ApplicationDaemon.CallService(domain, service, data)
+}
+
+// GetEntities reads the states of all entities in domain from Home Assistant
+func (a *appHelper) GetEntities(domain string) ([]*client.HassEntity, error) {
+	a.instance.traceCall("get_entities %s", domain)
+	return a.ApplicationDaemon.GetEntities(domain)
+}
+
+// FireEvent fires eventType in Home Assistant with the event data
+func (a *appHelper) FireEvent(eventType string, data map[string]interface{}) error {
+	a.instance.traceCall("fire_event %s %v", eventType, data)
+	return a.ApplicationDaemon.FireEvent(eventType, data)
+}
+
+// TurnOn turns on an entity with no attributes
+func (a *appHelper) TurnOn(entity string) {
+	serviceCalls.Inc(a.instance.name, "turn_on")
+	a.instance.traceCall("turn_on %s", entity)
+	a.ApplicationDaemon.TurnOn(entity)
+}
+
+// TurnOff turns off an entity with no attributes
+func (a *appHelper) TurnOff(entity string) {
+	serviceCalls.Inc(a.instance.name, "turn_off")
+	a.instance.traceCall("turn_off %s", entity)
+	a.ApplicationDaemon.TurnOff(entity)
+}
+
+// Toggle toggles an entity with no attributes
+func (a *appHelper) Toggle(entity string) {
+	serviceCalls.Inc(a.instance.name, "toggle")
+	a.instance.traceCall("toggle %s", entity)
+	a.ApplicationDaemon.Toggle(entity)
+}
+
+// SetEntity creates or updates existing entity
+func (a *appHelper) SetEntity(entity *client.HassEntity) bool {
+	a.instance.traceCall("set_entity %s: %s", entity.ID, entity.New.State)
+	return a.ApplicationDaemon.SetEntity(entity)
+}
+
+// AtSunset sends a message on provided channel at sunset
+//
+// You can set a positive or negative offset from sunset
+func (a *appHelper) AtSunset(offset time.Duration, sunsetChannel chan bool) *time.Timer {
+	return a.atSunset(offset, func() {
+		a.instance.traceCause(traceTimer, "sunset offset %v", offset)
+		sunsetChannel <- true
+	})
+}
+
+// AtSunrise sends a message on provided channel at sunrise
+//
+// You can set a positive or negative offset from sunrise
+func (a *appHelper) AtSunrise(offset time.Duration, sunriseChannel chan bool) *time.Timer {
+	return a.atSunrise(offset, func() {
+		a.instance.traceCause(traceTimer, "sunrise offset %v", offset)
+		sunriseChannel <- true
+	})
+}
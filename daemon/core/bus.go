@@ -0,0 +1,217 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	d "github.com/helto4real/go-daemon/daemon"
+)
+
+// busSubscription is a channel subscribing to a topic and the application
+// instance that subscribed, owner is nil for subscriptions made directly on
+// the daemon
+type busSubscription struct {
+	channel reflect.Value
+	owner   *appInstance
+}
+
+type busRequestHandler struct {
+	handler func(request interface{}) (interface{}, error)
+	owner   *appInstance
+}
+
+// messageBus is the in-process pub/sub between applications. The zero value
+// is ready to use. Subscriptions and request handlers are removed when the
+// application owning them is stopped so messages are only delivered to
+// running applications
+type messageBus struct {
+	mutex         sync.RWMutex
+	topicTypes    map[string]reflect.Type
+	subscriptions map[string][]busSubscription
+	handlers      map[string]busRequestHandler
+}
+
+// bindType sets the message type of topic if not set, returns error if the
+// topic already has another message type. mutex must be held
+func (a *messageBus) bindType(topic string, messageType reflect.Type) error {
+	if a.topicTypes == nil {
+		a.topicTypes = map[string]reflect.Type{}
+	}
+	topicType, ok := a.topicTypes[topic]
+	if !ok {
+		a.topicTypes[topic] = messageType
+		return nil
+	}
+	if topicType != messageType && !messageType.AssignableTo(topicType) {
+		return fmt.Errorf("topic %s has message type %s, got %s", topic, topicType, messageType)
+	}
+	return nil
+}
+
+func (a *messageBus) subscribe(topic string, channel interface{}, owner *appInstance) error {
+	ch := reflect.ValueOf(channel)
+	if ch.Kind() != reflect.Chan || ch.Type().ChanDir()&reflect.SendDir == 0 || ch.IsNil() {
+		return fmt.Errorf("subscribe to topic %s needs a channel to send messages on, got %T", topic, channel)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if topicType, ok := a.topicTypes[topic]; ok && topicType != ch.Type().Elem() {
+		return fmt.Errorf("topic %s has message type %s, got channel of %s", topic, topicType, ch.Type().Elem())
+	}
+	if err := a.bindType(topic, ch.Type().Elem()); err != nil {
+		return err
+	}
+	for _, subscription := range a.subscriptions[topic] {
+		if subscription.channel.Pointer() == ch.Pointer() {
+			return fmt.Errorf("channel already subscribes to topic %s", topic)
+		}
+	}
+	if a.subscriptions == nil {
+		a.subscriptions = map[string][]busSubscription{}
+	}
+	a.subscriptions[topic] = append(a.subscriptions[topic], busSubscription{channel: ch, owner: owner})
+	return nil
+}
+
+// publish checks the message type and sends message to the subscriptions of
+// topic without blocking. The mutex is held while sending so no message is
+// sent to a subscription after it is removed. Returns the subscriptions that
+// got the message and the subscriptions with full channels
+func (a *messageBus) publish(topic string, message interface{}) (sent, full []busSubscription, err error) {
+	if message == nil {
+		return nil, nil, fmt.Errorf("can not publish nil message to topic %s", topic)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if err := a.bindType(topic, reflect.TypeOf(message)); err != nil {
+		return nil, nil, err
+	}
+	value := reflect.ValueOf(message)
+	for _, subscription := range a.subscriptions[topic] {
+		if subscription.channel.TrySend(value) {
+			sent = append(sent, subscription)
+		} else {
+			full = append(full, subscription)
+		}
+	}
+	return sent, full, nil
+}
+
+func (a *messageBus) handleRequest(topic string, handler func(request interface{}) (interface{}, error),
+	owner *appInstance) error {
+	if handler == nil {
+		return fmt.Errorf("request handler for topic %s is nil", topic)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if existing, ok := a.handlers[topic]; ok {
+		name := "daemon"
+		if existing.owner != nil {
+			name = existing.owner.name
+		}
+		return fmt.Errorf("requests on topic %s are already handled by %s", topic, name)
+	}
+	if a.handlers == nil {
+		a.handlers = map[string]busRequestHandler{}
+	}
+	a.handlers[topic] = busRequestHandler{handler: handler, owner: owner}
+	return nil
+}
+
+func (a *messageBus) requestHandler(topic string) (busRequestHandler, bool) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	handler, ok := a.handlers[topic]
+	return handler, ok
+}
+
+// removeOwner removes all subscriptions and request handlers of the application instance
+func (a *messageBus) removeOwner(owner *appInstance) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for topic, subscriptions := range a.subscriptions {
+		kept := []busSubscription{}
+		for _, subscription := range subscriptions {
+			if subscription.owner != owner {
+				kept = append(kept, subscription)
+			}
+		}
+		a.subscriptions[topic] = kept
+	}
+	for topic, handler := range a.handlers {
+		if handler.owner == owner {
+			delete(a.handlers, topic)
+		}
+	}
+}
+
+// reset removes all subscriptions, handlers and message types
+func (a *messageBus) reset() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.topicTypes = nil
+	a.subscriptions = nil
+	a.handlers = nil
+}
+
+// Publish sends message to all running applications subscribed to topic.
+// Publish does not wait for the subscribers, the message is dropped for
+// subscribers with a full channel
+func (a *ApplicationDaemon) Publish(topic string, message interface{}) error {
+	sent, full, err := a.bus.publish(topic, message)
+	if err != nil {
+		return err
+	}
+	for _, subscription := range sent {
+		subscription.owner.traceCause(traceMessage, "%s: %v", topic, message)
+	}
+	for range full {
+		// This should never happen incase the app does not read the messages
+		channelFullTimeouts.Inc("message")
+		log.Errorf("Channel full, dropping message, please check receiver channel of topic: %s", topic)
+	}
+	return nil
+}
+
+// Subscribe receives messages published to topic on channel
+func (a *ApplicationDaemon) Subscribe(topic string, channel interface{}) error {
+	return a.bus.subscribe(topic, channel, nil)
+}
+
+// HandleRequest handles requests sent to topic
+func (a *ApplicationDaemon) HandleRequest(topic string, handler func(request interface{}) (interface{}, error)) error {
+	return a.bus.handleRequest(topic, handler, nil)
+}
+
+// Request sends request to the handler of topic and waits for the reply
+func (a *ApplicationDaemon) Request(topic string, request interface{}, timeout time.Duration) (interface{}, error) {
+	handler, ok := a.bus.requestHandler(topic)
+	if !ok {
+		return nil, d.ErrNoRequestHandler
+	}
+
+	type reply struct {
+		value interface{}
+		err   error
+	}
+	replyChannel := make(chan reply, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				replyChannel <- reply{err: fmt.Errorf("request handler of topic %s panicked: %v", topic, r)}
+			}
+		}()
+		handler.owner.traceCause(traceMessage, "request %s: %v", topic, request)
+		value, err := handler.handler(request)
+		replyChannel <- reply{value: value, err: err}
+	}()
+
+	select {
+	case r := <-replyChannel:
+		return r.value, r.err
+	case <-time.After(timeout):
+		return nil, d.ErrRequestTimeout
+	}
+}
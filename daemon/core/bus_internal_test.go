@@ -0,0 +1,117 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	h "github.com/helto4real/go-daemon/daemon/test"
+)
+
+type presenceMessage struct {
+	Person string
+	Home   bool
+}
+
+func newBusTestHelper(daemon *ApplicationDaemon, name string) *appHelper {
+	instance := newAppInstance(name, "", d.DeamonAppConfig{}, nil)
+	instance.state = appStateRunning
+	return &appHelper{ApplicationDaemon: daemon, instance: instance}
+}
+
+func TestBusPublishToSubscribers(t *testing.T) {
+	daemon := NewApplicationDaemon()
+	lighting := newBusTestHelper(daemon, "lighting")
+	presence := newBusTestHelper(daemon, "presence")
+
+	ch := make(chan presenceMessage, 1)
+	h.Ok(t, lighting.Subscribe("presence", ch))
+	h.Ok(t, presence.Publish("presence", presenceMessage{Person: "thomas", Home: true}))
+
+	h.Equals(t, presenceMessage{Person: "thomas", Home: true}, <-ch)
+}
+
+func TestBusTypedTopics(t *testing.T) {
+	daemon := NewApplicationDaemon()
+	helper := newBusTestHelper(daemon, "app")
+
+	h.Ok(t, helper.Subscribe("presence", make(chan presenceMessage, 1)))
+	h.Assert(t, helper.Publish("presence", "thomas is home") != nil, "Expected error publishing wrong type")
+	h.Assert(t, helper.Subscribe("presence", make(chan string, 1)) != nil, "Expected error subscribing with wrong type")
+	h.Assert(t, helper.Subscribe("other", "not a channel") != nil, "Expected error subscribing without channel")
+	h.Assert(t, helper.Publish("presence", nil) != nil, "Expected error publishing nil")
+}
+
+func TestBusDeliversOnlyToRunningApps(t *testing.T) {
+	daemon := NewApplicationDaemon()
+	stopped := newBusTestHelper(daemon, "stopped_app")
+	publisher := newBusTestHelper(daemon, "publisher")
+	daemon.applications = []*appInstance{stopped.instance, publisher.instance}
+
+	ch := make(chan presenceMessage, 1)
+	h.Ok(t, stopped.Subscribe("presence", ch))
+	h.Ok(t, stopped.HandleRequest("who_is_home", func(request interface{}) (interface{}, error) {
+		return []string{"thomas"}, nil
+	}))
+	h.Equals(t, true, daemon.StopApplication("stopped_app"))
+
+	h.Ok(t, publisher.Publish("presence", presenceMessage{Person: "thomas"}))
+	h.Equals(t, 0, len(ch))
+	_, err := publisher.Request("who_is_home", nil, time.Second)
+	h.Equals(t, d.ErrNoRequestHandler, err)
+}
+
+func TestBusPublishDoesNotBlock(t *testing.T) {
+	daemon := NewApplicationDaemon()
+	lighting := newBusTestHelper(daemon, "lighting")
+	presence := newBusTestHelper(daemon, "presence")
+
+	full := make(chan presenceMessage)
+	ch := make(chan presenceMessage, 2)
+	h.Ok(t, newBusTestHelper(daemon, "slow_app").Subscribe("presence", full))
+	h.Ok(t, lighting.Subscribe("presence", ch))
+
+	start := time.Now()
+	h.Ok(t, presence.Publish("presence", presenceMessage{Person: "thomas", Home: true}))
+	h.Ok(t, presence.Publish("presence", presenceMessage{Person: "thomas"}))
+	h.Assert(t, time.Since(start) < time.Second, "Expected publish not to wait for the full channel")
+	h.Equals(t, presenceMessage{Person: "thomas", Home: true}, <-ch)
+	h.Equals(t, presenceMessage{Person: "thomas"}, <-ch)
+}
+
+func TestBusRequestReply(t *testing.T) {
+	daemon := NewApplicationDaemon()
+	presence := newBusTestHelper(daemon, "presence")
+	lighting := newBusTestHelper(daemon, "lighting")
+
+	h.Ok(t, presence.HandleRequest("is_home", func(request interface{}) (interface{}, error) {
+		if request.(string) == "unknown" {
+			return nil, errors.New("unknown person")
+		}
+		return request.(string) == "thomas", nil
+	}))
+	h.Assert(t, lighting.HandleRequest("is_home", func(interface{}) (interface{}, error) { return nil, nil }) != nil,
+		"Expected error when topic already handled")
+
+	reply, err := lighting.Request("is_home", "thomas", time.Second)
+	h.Ok(t, err)
+	h.Equals(t, true, reply)
+
+	_, err = lighting.Request("is_home", "unknown", time.Second)
+	h.Equals(t, "unknown person", err.Error())
+}
+
+func TestBusRequestTimeout(t *testing.T) {
+	daemon := NewApplicationDaemon()
+	helper := newBusTestHelper(daemon, "slow")
+	release := make(chan bool)
+	defer close(release)
+
+	h.Ok(t, helper.HandleRequest("slow", func(request interface{}) (interface{}, error) {
+		<-release
+		return nil, nil
+	}))
+	_, err := helper.Request("slow", nil, 10*time.Millisecond)
+	h.Equals(t, d.ErrRequestTimeout, err)
+}
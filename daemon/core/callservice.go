@@ -0,0 +1,112 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	"github.com/helto4real/go-hassclient/client"
+)
+
+// hassHTTPClient is used for calls to the Home Assistant REST API
+var hassHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// CallService calls domain.service in Home Assistant with the service data
+func (a *ApplicationDaemon) CallService(domain string, service string, data map[string]interface{}) error {
+	if domain == "" || service == "" {
+		return fmt.Errorf("call service needs both domain and service, got %s.%s", domain, service)
+	}
+	if err := a.postHassAPI("/services/"+domain+"/"+service, data); err != nil {
+		return fmt.Errorf("failed to call service %s.%s: %v", domain, service, err)
+	}
+	return nil
+}
+
+// FireEvent fires eventType in Home Assistant with the event data, uses the
+// Home Assistant client if it can fire events and the REST API if not
+func (a *ApplicationDaemon) FireEvent(eventType string, data map[string]interface{}) error {
+	if eventType == "" {
+		return fmt.Errorf("fire event needs an event type")
+	}
+	if firer, ok := a.hassClient.(d.EventFirer); ok {
+		if !firer.FireEvent(eventType, data) {
+			return fmt.Errorf("failed to fire event %s", eventType)
+		}
+		return nil
+	}
+	if err := a.postHassAPI("/events/"+eventType, data); err != nil {
+		return fmt.Errorf("failed to fire event %s: %v", eventType, err)
+	}
+	return nil
+}
+
+// GetEntities reads the states of all entities in domain from the Home Assistant REST API
+func (a *ApplicationDaemon) GetEntities(domain string) ([]*client.HassEntity, error) {
+	u := a.hassAPIURL("/states")
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.getConfig().HomeAssistant.Token)
+	resp, err := hassHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read states: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to read states: status %d", resp.StatusCode)
+	}
+
+	states := []struct {
+		EntityID string `json:"entity_id"`
+		historyState
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&states); err != nil {
+		return nil, fmt.Errorf("failed to read states: %v", err)
+	}
+	entities := []*client.HassEntity{}
+	for _, s := range states {
+		if !strings.HasPrefix(s.EntityID, domain+".") {
+			continue
+		}
+		entities = append(entities, client.NewHassEntity(s.EntityID, s.EntityID, client.HassEntityState{},
+			client.HassEntityState{
+				State:       s.State,
+				Attributes:  s.Attributes,
+				LastChanged: s.LastChanged,
+				LastUpdated: s.LastUpdated}))
+	}
+	return entities, nil
+}
+
+// postHassAPI posts data as json to the path of the Home Assistant REST API
+func (a *ApplicationDaemon) postHassAPI(path string, data map[string]interface{}) error {
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	body, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("invalid data: %v", err)
+	}
+
+	u := a.hassAPIURL(path)
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.getConfig().HomeAssistant.Token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := hassHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
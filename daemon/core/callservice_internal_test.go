@@ -0,0 +1,99 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/helto4real/go-daemon/daemon/config"
+	"github.com/helto4real/go-daemon/daemon/defaultapps"
+	h "github.com/helto4real/go-daemon/daemon/test"
+)
+
+func TestCallService(t *testing.T) {
+	var request *http.Request
+	body := map[string]interface{}{}
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	daemon := NewApplicationDaemon()
+	daemon.config = &config.Config{
+		HomeAssistant: config.HomeAssistantConfig{IP: strings.TrimPrefix(server.URL, "http://"), Token: "token"}}
+
+	h.Ok(t, daemon.CallService("light", "turn_on", map[string]interface{}{"entity_id": "light.hallway", "brightness": 128}))
+	h.Equals(t, "/api/services/light/turn_on", request.URL.Path)
+	h.Equals(t, "Bearer token", request.Header.Get("Authorization"))
+	h.Equals(t, map[string]interface{}{"entity_id": "light.hallway", "brightness": 128.0}, body)
+
+	status = http.StatusBadRequest
+	h.NotEquals(t, nil, daemon.CallService("light", "turn_on", nil))
+	h.NotEquals(t, nil, daemon.CallService("", "turn_on", nil))
+}
+
+func TestNewDaemonAppBuiltinApps(t *testing.T) {
+	daemon := &ApplicationDaemon{availableApps: map[string]interface{}{"testapp": testapp{}}}
+	app, ok := daemon.NewDaemonApp("rules")
+	h.Equals(t, true, ok)
+	_, ok = app.(*defaultapps.RulesApp)
+	h.Equals(t, true, ok)
+
+	_, ok = daemon.NewDaemonApp("testapp")
+	h.Equals(t, true, ok)
+	_, ok = daemon.NewDaemonApp("missing")
+	h.Equals(t, false, ok)
+}
+
+func TestFireEvent(t *testing.T) {
+	var request *http.Request
+	body := map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	// Clients that can not fire events uses the REST API
+	daemon := NewApplicationDaemon()
+	daemon.hassClient = &fakeHassClient{}
+	daemon.config = &config.Config{
+		HomeAssistant: config.HomeAssistantConfig{IP: strings.TrimPrefix(server.URL, "http://"), Token: "token"}}
+	h.Ok(t, daemon.FireEvent("go_daemon_presence", map[string]interface{}{"person": "person1"}))
+	h.Equals(t, "/api/events/go_daemon_presence", request.URL.Path)
+	h.Equals(t, map[string]interface{}{"person": "person1"}, body)
+
+	hass := &firingHassClient{}
+	daemon.hassClient = hass
+	h.Ok(t, daemon.FireEvent("go_daemon_presence", map[string]interface{}{"person": "person2"}))
+	h.Equals(t, []map[string]interface{}{{"person": "person2", "event_type": "go_daemon_presence"}}, hass.events)
+
+	h.NotEquals(t, nil, daemon.FireEvent("", nil))
+}
+
+func TestGetEntities(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.Equals(t, "/api/states", r.URL.Path)
+		w.Write([]byte(`[
+			{"entity_id": "person.thomas", "state": "home", "attributes": {"device_trackers": ["device_tracker.phone"]}},
+			{"entity_id": "light.hallway", "state": "on", "attributes": {}},
+			{"entity_id": "person.anna", "state": "not_home", "attributes": {}}]`))
+	}))
+	defer server.Close()
+
+	daemon := NewApplicationDaemon()
+	daemon.config = &config.Config{
+		HomeAssistant: config.HomeAssistantConfig{IP: strings.TrimPrefix(server.URL, "http://"), Token: "token"}}
+	entities, err := daemon.GetEntities("person")
+	h.Ok(t, err)
+	h.Equals(t, 2, len(entities))
+	h.Equals(t, "person.thomas", entities[0].ID)
+	h.Equals(t, "home", entities[0].New.State)
+	h.Equals(t, []interface{}{"device_tracker.phone"}, entities[0].New.Attributes["device_trackers"])
+	h.Equals(t, "person.anna", entities[1].ID)
+}
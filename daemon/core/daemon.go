@@ -7,13 +7,14 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	d "github.com/helto4real/go-daemon/daemon"
 	"github.com/helto4real/go-daemon/daemon/config"
-	"github.com/helto4real/go-daemon/daemon/defaultapps"
+	"github.com/helto4real/go-daemon/daemon/logging"
 	"github.com/helto4real/go-hassclient/client"
 	c "github.com/helto4real/go-hassclient/client"
 	"github.com/sirupsen/logrus"
@@ -33,14 +34,45 @@ const (
 type ApplicationDaemon struct {
 	hassClient                c.HomeAssistant
 	config                    *config.Config
+	secrets                   config.Secrets
 	cancel                    context.CancelFunc
 	cancelContext             context.Context
 	configPath                string
 	commandChannel            chan DaemonCommand
-	applications              []d.DaemonApplication
+	applications              []*appInstance
+	appMutex                  sync.Mutex
+	controlMutex              sync.Mutex
 	availableApps             map[string]interface{}
 	stateListeners            map[string][]chan client.HassEntity
 	callServiceEventListeners map[string]map[string][]chan client.HassCallServiceEvent
+	stateChannelOwners        map[chan client.HassEntity]*appInstance
+	callServiceChannelOwners  map[chan client.HassCallServiceEvent]*appInstance
+	listenerMutex             sync.RWMutex
+	statusServer              *statusServer
+	hasBeenConnected          bool
+	healthMutex               sync.Mutex
+	connected                 bool
+	appsInitialized           bool
+	lastEventTime             time.Time
+	bus                       messageBus
+	services                  serviceRegistry
+	history                   stateHistory
+	triggers                  triggerRegistry
+	// waitChannels are the channels of WaitForState, sent to without blocking
+	waitChannels map[chan client.HassEntity]bool
+	// configMutex guards config that is replaced when reloaded
+	configMutex sync.RWMutex
+	// eventListeners are the channels of ListenEvent by event type, guarded by listenerMutex
+	eventListeners     map[string][]chan d.HassEvent
+	eventChannelOwners map[chan d.HassEvent]*appInstance
+	// eventTypesChannel tells the event stream that the listened event types changed
+	eventTypesChannel chan bool
+}
+
+// peopleStatusApp is implemented by the people app to show the current states
+// of people in the status api
+type peopleStatusApp interface {
+	PeopleStatus() map[string]*config.PeopleConfig
 }
 
 func NewApplicationDaemonRunner() d.ApplicationDaemonRunner {
@@ -53,11 +85,16 @@ func NewApplicationDaemon() *ApplicationDaemon {
 	appdaemon.commandChannel = make(chan DaemonCommand)
 	appdaemon.cancelContext = ctx
 	appdaemon.cancel = cancel
-	appdaemon.applications = []d.DaemonApplication{}
+	appdaemon.applications = []*appInstance{}
 
 	appdaemon.stateListeners = make(map[string][]chan client.HassEntity)
 	appdaemon.callServiceEventListeners =
 		make(map[string]map[string][]chan client.HassCallServiceEvent)
+	appdaemon.stateChannelOwners = make(map[chan client.HassEntity]*appInstance)
+	appdaemon.callServiceChannelOwners = make(map[chan client.HassCallServiceEvent]*appInstance)
+	appdaemon.eventListeners = make(map[string][]chan d.HassEvent)
+	appdaemon.eventChannelOwners = make(map[chan d.HassEvent]*appInstance)
+	appdaemon.eventTypesChannel = make(chan bool, 1)
 
 	return appdaemon
 }
@@ -68,14 +105,64 @@ func (a *ApplicationDaemon) Start(configPath string, hassClient c.HomeAssistant,
 	a.configPath = configPath
 	a.availableApps = availableApps
 
-	configuration := config.NewConfiguration(filepath.Join(configPath, "config", "go-daemon.yaml"))
-	conf, err := configuration.Open()
-
+	err := a.loadConfig()
 	if err != nil {
 		log.Error("Failed to open config file, ending -> ", err)
 		return false
 	}
+	conf := a.getConfig()
+
+	go a.receiveHassLoop()
+	go a.eventStreamLoop()
+	go a.applicationDaemonLoop()
+
+	if conf.HTTP != nil && conf.HTTP.Enabled {
+		a.statusServer = newStatusServer(a, conf.HTTP.Address)
+		a.statusServer.start()
+	}
+	a.hassClient.Start(conf.HomeAssistant.IP, conf.HomeAssistant.SSL, conf.HomeAssistant.Token)
+
+	return true
+}
+
+// Stop the daemon, only use in main function
+func (a *ApplicationDaemon) Stop() {
+	a.cancel()
+	if a.statusServer != nil {
+		a.statusServer.stop()
+	}
+	a.hassClient.Stop()
+
+}
+
+// loadConfig reads the go-daemon.yaml configuration and applies defaults,
+// hassio options and the token from environment if not set
+func (a *ApplicationDaemon) loadConfig() error {
+	configuration := config.NewConfiguration(filepath.Join(a.configPath, "config", "go-daemon.yaml"))
+	conf, err := configuration.Open()
+
+	if err != nil {
+		return err
+	}
+	// Secrets are used in the app yaml files too
+	secrets, err := config.LoadSecrets(configuration.SecretsPath())
+	if err != nil {
+		return err
+	}
+	// Readers get the new configuration when defaults and options are applied
+	a.configMutex.Lock()
+	defer a.configMutex.Unlock()
 	a.config = conf
+	a.secrets = secrets
+	// Values removed from secrets.yaml are not redacted after a reload
+	config.ClearSecrets()
+	for _, value := range secrets {
+		config.RegisterSecret(value)
+	}
+
+	if err := logging.Setup(conf.Logging); err != nil {
+		log.Errorln("Failed to setup logging from config: ", err)
+	}
 
 	a.setDefaultSettings()
 
@@ -83,8 +170,6 @@ func (a *ApplicationDaemon) Start(configPath string, hassClient c.HomeAssistant,
 		// It is a hassio plugin
 		a.checkHassioOptionsConfig()
 	}
-	go a.receiveHassLoop()
-	go a.applicationDaemonLoop()
 	if len(conf.HomeAssistant.Token) == 0 {
 		// Check if we have hassio env set
 		envHassioToken := os.Getenv("HASSIO_TOKEN")
@@ -93,16 +178,25 @@ func (a *ApplicationDaemon) Start(configPath string, hassClient c.HomeAssistant,
 		}
 		conf.HomeAssistant.Token = envHassioToken
 	}
-	a.hassClient.Start(conf.HomeAssistant.IP, conf.HomeAssistant.SSL, conf.HomeAssistant.Token)
-
-	return true
+	config.RegisterSecret(conf.HomeAssistant.Token)
+	if conf.HTTP != nil {
+		config.RegisterSecret(conf.HTTP.Token)
+	}
+	return nil
 }
 
-// Stop the daemon, only use in main function
-func (a *ApplicationDaemon) Stop() {
-	a.cancel()
-	a.hassClient.Stop()
-
+// reloadConfig reads the configuration from disk and restarts all applications
+// so they pick up the new configuration
+func (a *ApplicationDaemon) reloadConfig() error {
+	ha := a.getConfig().HomeAssistant
+	if err := a.loadConfig(); err != nil {
+		return err
+	}
+	if a.getConfig().HomeAssistant != ha {
+		log.Warnln("Changes to home_assistant settings needs a restart of go-daemon to take effect")
+	}
+	a.commandChannel <- ReStartApplications
+	return nil
 }
 
 var optionsPath = "/data/options.json"
@@ -140,6 +234,13 @@ func (a *ApplicationDaemon) setDefaultSettings() {
 		if a.config.Settings.TrackingSettings.AwayState == "" {
 			a.config.Settings.TrackingSettings.AwayState = "Away"
 		}
+		if a.config.Settings.TrackingSettings.PersonSyncInterval == 0 {
+			a.config.Settings.TrackingSettings.PersonSyncInterval = 300
+		}
+		if a.config.Settings.TrackingSettings.PersonEntities && a.config.People == nil {
+			// The people app adds the people of the person entities
+			a.config.People = map[string]*config.PeopleConfig{}
+		}
 	}
 
 }
@@ -214,6 +315,11 @@ func (a *ApplicationDaemon) GetLocation() d.Location {
 //
 // You can set a positive or negative offset from sunset
 func (a *ApplicationDaemon) AtSunset(offset time.Duration, sunsetChannel chan bool) *time.Timer {
+	return a.atSunset(offset, func() { sunsetChannel <- true })
+}
+
+// atSunset calls fire at sunset with offset
+func (a *ApplicationDaemon) atSunset(offset time.Duration, fire func()) *time.Timer {
 	sun, ok := a.GetEntity("sun.sun")
 	if !ok {
 		log.Errorln("Failed to get sun.sun entity, cant set AtSunset!")
@@ -243,15 +349,18 @@ func (a *ApplicationDaemon) AtSunset(offset time.Duration, sunsetChannel chan bo
 	dur := toffset.Sub(time.Now())
 	log.Debugf("Next sunset event at %v, in %v ", toffset.Format("2006-01-02 15:04:05"), dur.Round(time.Second))
 
-	return time.AfterFunc(dur, func() {
-		sunsetChannel <- true
-	})
+	return time.AfterFunc(dur, fire)
 }
 
 // AtSunrise sends a message on provided channel at sunset
 //
 // You can set a positive or negative offset from sunset
 func (a *ApplicationDaemon) AtSunrise(offset time.Duration, sunriseChannel chan bool) *time.Timer {
+	return a.atSunrise(offset, func() { sunriseChannel <- true })
+}
+
+// atSunrise calls fire at sunrise with offset
+func (a *ApplicationDaemon) atSunrise(offset time.Duration, fire func()) *time.Timer {
 	sun, ok := a.GetEntity("sun.sun")
 	if !ok {
 		log.Errorln("Failed to get sun.sun entity, cant set AtSunrise!")
@@ -281,15 +390,56 @@ func (a *ApplicationDaemon) AtSunrise(offset time.Duration, sunriseChannel chan
 	dur := toffset.Sub(time.Now())
 
 	log.Debugf("Next surise event at %v, in %v ", toffset.Format("2006-01-02 15:04:05"), dur.Round(time.Second))
-	return time.AfterFunc(dur, func() {
-		sunriseChannel <- true
-	})
+	return time.AfterFunc(dur, fire)
 }
 
-// ListenState start listen to state changes from entity
+// ListenCallServiceEvent listens to call_service events
 //
-// Any changes is reported back to the provided channel
+// Any events is reported back to the provided channel
 func (a *ApplicationDaemon) ListenCallServiceEvent(domain string, service string, callServiceChannel chan client.HassCallServiceEvent) {
+	a.listenCallServiceEvent(domain, service, callServiceChannel)
+}
+
+// UnlistenState stops sending the state changes of entity to the channel
+func (a *ApplicationDaemon) UnlistenState(entity string, stateChannel chan client.HassEntity) {
+	a.removeStateListener(entity, stateChannel, nil)
+}
+
+// UnlistenCallServiceEvent stops sending the call_service events of domain.service to the channel
+func (a *ApplicationDaemon) UnlistenCallServiceEvent(domain string, service string, callServiceChannel chan client.HassCallServiceEvent) {
+	a.removeCallServiceListener(domain, service, callServiceChannel, nil)
+}
+
+// removeCallServiceListener removes the channel registered with listenCallServiceEvent
+func (a *ApplicationDaemon) removeCallServiceListener(domain string, service string,
+	callServiceChannel chan client.HassCallServiceEvent, owner *appInstance) {
+	a.listenerMutex.Lock()
+	defer a.listenerMutex.Unlock()
+	domain = strings.ToLower(domain)
+	service = strings.ToLower(service)
+	if listeners, ok := a.callServiceEventListeners[domain]; ok {
+		listeners[service] = removeCallServiceChannel(listeners[service], callServiceChannel)
+		if len(listeners[service]) == 0 {
+			delete(listeners, service)
+		}
+	}
+	if owner != nil {
+		key := domain + "." + service
+		owner.callServiceSubscriptions[key] = removeCallServiceChannel(owner.callServiceSubscriptions[key], callServiceChannel)
+		if len(owner.callServiceSubscriptions[key]) == 0 {
+			delete(owner.callServiceSubscriptions, key)
+		}
+	}
+	// The channel can be used for other services by the same owner
+	if owner == nil || !owner.hasCallServiceChannel(callServiceChannel) {
+		delete(a.callServiceChannelOwners, callServiceChannel)
+	}
+}
+
+// listenCallServiceEvent registers the channel and returns false if already registered
+func (a *ApplicationDaemon) listenCallServiceEvent(domain string, service string, callServiceChannel chan client.HassCallServiceEvent) bool {
+	a.listenerMutex.Lock()
+	defer a.listenerMutex.Unlock()
 	// Convert to lower case if some noob wrote it wrong
 	domain = strings.ToLower(domain)
 	service = strings.ToLower(service)
@@ -306,25 +456,33 @@ func (a *ApplicationDaemon) ListenCallServiceEvent(domain string, service string
 		// First time we need to create the array
 		domainCallServiceEventChannels[service] =
 			[]chan client.HassCallServiceEvent{callServiceChannel}
-		return
+		return true
 	}
 	// We have existing, make sure channel not registered already
 	for _, csChannel := range serviceChannels {
 		if csChannel == callServiceChannel {
 			// Allreade registered so return
 			log.Errorf("ListenCallServiceEvent: Already registered on %s on current channel", service)
-			return
+			return false
 		}
 	}
 
 	// Add the new channel
 	domainCallServiceEventChannels[service] = append(serviceChannels, callServiceChannel)
+	return true
 }
 
 // ListenState start listen to state changes from entity
 //
 // Any changes is reported back to the provided channel
 func (a *ApplicationDaemon) ListenState(entity string, stateChannel chan client.HassEntity) {
+	a.listenState(entity, stateChannel)
+}
+
+// listenState registers the channel and returns false if already registered
+func (a *ApplicationDaemon) listenState(entity string, stateChannel chan client.HassEntity) bool {
+	a.listenerMutex.Lock()
+	defer a.listenerMutex.Unlock()
 	// Convert to lower case if some noob wrote it wrong
 	entityLower := strings.ToLower(entity)
 
@@ -332,19 +490,20 @@ func (a *ApplicationDaemon) ListenState(entity string, stateChannel chan client.
 	if !ok {
 		// First time we need to create the array
 		a.stateListeners[entityLower] = []chan client.HassEntity{stateChannel}
-		return
+		return true
 	}
 	// We have existing, make sure channel not registered already
 	for _, sChannel := range stateChannels {
 		if sChannel == stateChannel {
 			// Allreade registered so return
 			log.Errorf("Listen state already registered on %s on current channel", entity)
-			return
+			return false
 		}
 	}
 
 	// Add the new channel
 	a.stateListeners[entityLower] = append(stateChannels, stateChannel)
+	return true
 }
 
 // GetCancelContext gets the context for goroutines to use as cancel context
@@ -383,31 +542,65 @@ func (a *ApplicationDaemon) Toggle(entity string) {
 	a.hassClient.CallService("toggle", map[string]string{"entity_id": entity})
 }
 
+// GetPeople returns a copy of the configured people, the app changing
+// states of people works on its own copy
 func (a *ApplicationDaemon) GetPeople() map[string]*config.PeopleConfig {
+	return config.CopyPeople(a.getConfig().People)
+}
 
-	// First make sure that the yaml config doesent make nil map
-	for _, personConfig := range a.config.People {
-		if personConfig.Attributes == nil {
-			personConfig.Attributes = map[string]interface{}{}
+// getPeopleStatus returns the people with states from the running people app,
+// the configured people if not running
+func (a *ApplicationDaemon) getPeopleStatus() map[string]*config.PeopleConfig {
+	a.appMutex.Lock()
+	defer a.appMutex.Unlock()
+	for _, instance := range a.applications {
+		if app, ok := instance.app.(peopleStatusApp); ok && instance.state == appStateRunning {
+			if people := app.PeopleStatus(); people != nil {
+				return people
+			}
 		}
-
 	}
-	return a.config.People
+	return a.GetPeople()
 }
 
 func (a *ApplicationDaemon) GetSettings() *config.SettingsConfig {
-	return a.config.Settings
+	return a.getConfig().Settings
 }
 
+// getConfig returns the current configuration, it is replaced and not
+// changed when reloaded
+func (a *ApplicationDaemon) getConfig() *config.Config {
+	a.configMutex.RLock()
+	defer a.configMutex.RUnlock()
+	return a.config
+}
+
+// GetLogger returns the daemon logger, applications get their own logger
+func (a *ApplicationDaemon) GetLogger() *logrus.Entry {
+	return log
+}
+
+// NewDaemonApp returns a new instance of the app from the available apps
+// given to Start or the apps registered with Register
 func (a *ApplicationDaemon) NewDaemonApp(appName string) (d.DaemonApplication, bool) {
-	if f, exist := a.availableApps[appName]; exist {
-		instance := reflect.New(reflect.TypeOf(f)).Interface()
-		dApp, ok := instance.(d.DaemonApplication)
-		if ok {
-			return dApp, true
+	factory, exist := d.RegisteredApp(appName)
+	if app, available := a.availableApps[appName]; available {
+		var err error
+		if factory, err = d.NewAppFactory(app); err != nil {
+			log.Errorf("Failed to create app {%s}: %v", appName, err)
+			return nil, false
 		}
+		exist = true
 	}
-	return nil, false
+	if !exist {
+		return nil, false
+	}
+	dApp := factory()
+	if dApp == nil {
+		log.Errorf("Failed to create app {%s}: factory returned nil", appName)
+		return nil, false
+	}
+	return dApp, true
 }
 
 func (a *ApplicationDaemon) receiveHassLoop() {
@@ -420,10 +613,18 @@ func (a *ApplicationDaemon) receiveHassLoop() {
 			if mc {
 				if status {
 					// We got connected
+					hassConnected.Set(1)
+					a.setConnected(true)
+					if a.hasBeenConnected {
+						hassReconnects.Inc()
+					}
+					a.hasBeenConnected = true
 					//a.loadDaemonApplications()
 					commandChannel <- StartApplications
 				} else {
 					// We disconnected
+					hassConnected.Set(0)
+					a.setConnected(false)
 					//a.unloadDaemonApplications()
 					commandChannel <- StopApplications
 				}
@@ -431,14 +632,14 @@ func (a *ApplicationDaemon) receiveHassLoop() {
 		case message, mc := <-hassChannel:
 			if mc {
 				//log.Info(message)
+				a.eventReceived()
 				switch m := message.(type) {
 				case c.HassEntity:
-					if m.Old.State != "" {
-						// We do this in own go-routine so we never block main thread
-						go a.handleEntity(&m)
-					}
+					eventsReceived.Inc("state_changed", strings.Split(m.ID, ".")[0])
+					a.handleStateChanged(&m)
 
 				case c.HassCallServiceEvent:
+					eventsReceived.Inc("call_service", m.Domain)
 					go a.handleCallServiceEvent(&m)
 				default:
 					log.Errorf("Unexpected message type: %v", message)
@@ -456,20 +657,48 @@ func (a *ApplicationDaemon) receiveHassLoop() {
 
 var defaultTimeoutForFullChannel = 5
 
+// handleStateChanged handles a state change from the receive loop
+func (a *ApplicationDaemon) handleStateChanged(entity *c.HassEntity) {
+	if entity.Old.State == "" {
+		return
+	}
+	// Thresholds and history are handled here so they follow the order of the updates
+	a.handleThresholds(entity)
+	a.recordHistory(entity)
+	// We do this in own go-routine so we never block main thread
+	go a.handleEntity(entity)
+}
+
 func (a *ApplicationDaemon) handleCallServiceEvent(callServiceEvent *c.HassCallServiceEvent) {
+	start := time.Now()
+	defer func() { dispatchLatency.Observe(time.Since(start).Seconds(), "call_service") }()
+	a.handleServiceCall(callServiceEvent)
+
+	a.listenerMutex.RLock()
 	domainServiceCallListeners, exists := a.callServiceEventListeners[callServiceEvent.Domain]
 	if !exists {
+		a.listenerMutex.RUnlock()
 		return
 	}
 
 	// Check listen to status changes
 	csl, exists := domainServiceCallListeners[callServiceEvent.Service]
+	// Copy so we do not hold the lock while sending on channels
+	csl = append([]chan client.HassCallServiceEvent(nil), csl...)
+	owners := make([]*appInstance, len(csl))
+	for i, ch := range csl {
+		owners[i] = a.callServiceChannelOwners[ch]
+	}
+	a.listenerMutex.RUnlock()
 	if exists {
-		for _, callServiceEventChannel := range csl {
+		for i, callServiceEventChannel := range csl {
 			select {
 			case callServiceEventChannel <- *callServiceEvent:
+				owners[i].traceCause(traceCallService, "%s.%s %v",
+					callServiceEvent.Domain, callServiceEvent.Service, callServiceEvent.ServiceData)
 			case <-time.After(time.Second * time.Duration(defaultTimeoutForFullChannel)):
 				// This should never happen incase the app does not read the messages
+				channelFullTimeouts.Inc("call_service")
 				log.Errorf("Channel full, please check recevicer channel: %s", callServiceEvent.Service)
 			case <-a.cancelContext.Done():
 				// Exit cause of exit to os
@@ -479,40 +708,65 @@ func (a *ApplicationDaemon) handleCallServiceEvent(callServiceEvent *c.HassCallS
 	}
 }
 func (a *ApplicationDaemon) handleEntity(entity *c.HassEntity) {
-	// Check listen to status changes
+	start := time.Now()
+	defer func() { dispatchLatency.Observe(time.Since(start).Seconds(), "state_changed") }()
+	// Also check for plattform entitites
+	platform := strings.Split(entity.ID, ".")[0]
+
+	// Copy the listeners so we do not hold the lock while sending on channels
+	a.listenerMutex.RLock()
 	sl, exists := a.stateListeners[entity.ID]
+	sl = append([]chan client.HassEntity(nil), sl...)
+	pl, plExists := a.stateListeners[platform]
+	pl = append([]chan client.HassEntity(nil), pl...)
+	owners := map[chan client.HassEntity]*appInstance{}
+	waiters := map[chan client.HassEntity]bool{}
+	for _, ch := range append(append([]chan client.HassEntity(nil), sl...), pl...) {
+		owners[ch] = a.stateChannelOwners[ch]
+		waiters[ch] = a.waitChannels[ch]
+	}
+	a.listenerMutex.RUnlock()
+
+	// Check listen to status changes
 	if exists {
 		for _, chEntity := range sl {
-			select {
-			case chEntity <- *entity:
-			case <-time.After(time.Second * time.Duration(defaultTimeoutForFullChannel)):
-				// This should never happen incase the app does not read the messages
-				log.Errorf("Channel full, please check recevicer channel: %s", entity.ID)
-			case <-a.cancelContext.Done():
-				// Exit cause of exit to os
+			if !a.sendEntity(chEntity, entity, owners[chEntity], waiters[chEntity], "state", entity.ID) {
 				return
 			}
 		}
 	}
-	// Also check for plattform entitites
-	platform := strings.Split(entity.ID, ".")[0]
-
-	pl, exists := a.stateListeners[platform]
-	if exists {
+	if plExists {
 		for _, chPlatform := range pl {
-			select {
-			case chPlatform <- *entity:
-			case <-time.After(time.Second * time.Duration(defaultTimeoutForFullChannel)):
-				// This should never happen incase the app does not read the messages
-				log.Errorf("Platform channel full, please check recevicer channel: %s", platform)
-			case <-a.cancelContext.Done():
-				// Exit cause of exit to os
+			if !a.sendEntity(chPlatform, entity, owners[chPlatform], waiters[chPlatform], "platform", platform) {
 				return
 			}
 		}
 	}
 }
 
+// sendEntity sends the changed entity to a state listener, waiters get it without
+// blocking. Returns false if the daemon is cancelled
+func (a *ApplicationDaemon) sendEntity(ch chan client.HassEntity, entity *c.HassEntity,
+	owner *appInstance, waiter bool, kind string, listened string) bool {
+	if waiter {
+		sendWaiter(ch, *entity)
+		owner.traceCause(traceEvent, "%s: %s -> %s", entity.ID, entity.Old.State, entity.New.State)
+		return true
+	}
+	select {
+	case ch <- *entity:
+		owner.traceCause(traceEvent, "%s: %s -> %s", entity.ID, entity.Old.State, entity.New.State)
+	case <-time.After(time.Second * time.Duration(defaultTimeoutForFullChannel)):
+		// This should never happen incase the app does not read the messages
+		channelFullTimeouts.Inc(kind)
+		log.Errorf("Channel full, please check recevicer channel: %s", listened)
+	case <-a.cancelContext.Done():
+		// Exit cause of exit to os
+		return false
+	}
+	return true
+}
+
 func (a *ApplicationDaemon) applicationDaemonLoop() {
 	commandChannel := a.commandChannel
 	for {
@@ -525,6 +779,8 @@ func (a *ApplicationDaemon) applicationDaemonLoop() {
 					a.loadDaemonApplications()
 				case StopApplications:
 					a.unloadDaemonApplications()
+				case ReStartApplications:
+					a.loadDaemonApplications()
 				}
 			}
 		case <-a.cancelContext.Done():
@@ -535,25 +791,429 @@ func (a *ApplicationDaemon) applicationDaemonLoop() {
 
 func (a *ApplicationDaemon) loadDaemonApplications() {
 	log.Debugln("Loading applications...")
-	if len(a.applications) > 0 {
-		a.unloadDaemonApplications()
+	a.controlMutex.Lock()
+	defer a.controlMutex.Unlock()
+	a.appMutex.Lock()
+	loaded := len(a.applications) > 0
+	a.appMutex.Unlock()
+	if loaded {
+		a.unloadApplications()
+	}
+
+	instances := a.instanceAllApplications()
+	ordered, failed := orderApplications(instances)
+
+	a.appMutex.Lock()
+	for _, instance := range instances {
+		if reason, ok := failed[instance]; ok {
+			log.Errorf("Failed to load application {%s}, %s, please check config in [%s]", instance.name, reason, instance.configFile)
+			instance.state = appStateFailed
+			ordered = append(ordered, instance)
+		}
+	}
+	// Keep the start order, failed instances last, so the status lists them in order
+	a.applications = ordered
+	a.appMutex.Unlock()
+	for _, instance := range ordered {
+		if a.canStart(instance, "load") {
+			a.startApplication(instance)
+		}
+	}
+	a.setAppsInitialized(true)
+	if conf := a.getConfig(); conf != nil && conf.History != nil && conf.History.Seed {
+		go a.seedHistory(a.historyEntities(), a.history.currentGeneration())
+	}
+}
+
+// canStart returns true if instance has not failed and the instances it depends
+// on are running, else the instance is failed. action is used in the log
+func (a *ApplicationDaemon) canStart(instance *appInstance, action string) bool {
+	a.appMutex.Lock()
+	defer a.appMutex.Unlock()
+	if instance.state == appStateFailed {
+		return false
+	}
+	if dependency, ok := a.failedDependency(instance); ok {
+		log.Errorf("Failed to %s application {%s}, dependency %s is not running", action, instance.name, dependency)
+		instance.state = appStateFailed
+		return false
 	}
+	return true
+}
 
-	a.applications = a.instanceAllApplications()
+// failedDependency returns the first dependency of instance that is not running, appMutex must be held
+func (a *ApplicationDaemon) failedDependency(instance *appInstance) (string, bool) {
+	for _, dependency := range instance.config.DependsOn {
+		dependencyInstance, ok := a.getApplication(dependency)
+		if !ok || dependencyInstance.state != appStateRunning {
+			return dependency, true
+		}
+	}
+	return "", false
 }
 func (a *ApplicationDaemon) unloadDaemonApplications() {
 	log.Debugln("Unloading applications...")
+	a.controlMutex.Lock()
+	defer a.controlMutex.Unlock()
+	a.unloadApplications()
+}
+
+// unloadApplications stops all applications and removes all subscriptions,
+// controlMutex must be held
+func (a *ApplicationDaemon) unloadApplications() {
+	a.setAppsInitialized(false)
+	a.appMutex.Lock()
+	applications := a.applications
+	a.appMutex.Unlock()
+	// Remove the applications in reverse start order so apps are stopped
+	// before the apps they depend on
+	for i := len(applications) - 1; i >= 0; i-- {
+		a.stopApplication(applications[i])
+	}
+	// Get new instance of empty list
+	a.appMutex.Lock()
+	a.applications = []*appInstance{}
+	a.appMutex.Unlock()
 	// Remove all subscriptions here
+	a.listenerMutex.Lock()
 	a.stateListeners = make(map[string][]chan client.HassEntity)
-	// Remove the applications
-	if len(a.applications) > 0 {
-		for _, app := range a.applications {
-			app.Cancel()
+	a.callServiceEventListeners =
+		make(map[string]map[string][]chan client.HassCallServiceEvent)
+	a.stateChannelOwners = make(map[chan client.HassEntity]*appInstance)
+	a.waitChannels = make(map[chan client.HassEntity]bool)
+	a.callServiceChannelOwners = make(map[chan client.HassCallServiceEvent]*appInstance)
+	a.eventListeners = make(map[string][]chan d.HassEvent)
+	a.eventChannelOwners = make(map[chan d.HassEvent]*appInstance)
+	a.listenerMutex.Unlock()
+	a.eventTypesChanged()
+	a.bus.reset()
+	a.services.reset()
+	a.triggers.reset()
+	// The history is seeded again, if configured, when the applications are loaded
+	a.history.reset()
+}
+
+// startApplication makes a new application and initializes it. controlMutex
+// must be held but not appMutex, Initialize is called without appMutex so the
+// status is available while apps start
+func (a *ApplicationDaemon) startApplication(instance *appInstance) {
+	app, ok := a.newApplication(instance)
+	if !ok {
+		return
+	}
+	initialized := a.initializeApplication(instance, app)
+
+	a.appMutex.Lock()
+	defer a.appMutex.Unlock()
+	if initialized {
+		instance.state = appStateRunning
+		return
+	}
+	log.Errorf("Application {%s} failed to initialize", instance.name)
+	instance.state = appStateFailed
+	// Only running applications receives messages and service calls
+	a.bus.removeOwner(instance)
+	a.services.removeOwner(instance)
+	a.triggers.removeOwner(instance)
+}
+
+// newApplication makes a new application for instance, false if the instance
+// is running or the application fails to load
+func (a *ApplicationDaemon) newApplication(instance *appInstance) (d.DaemonApplication, bool) {
+	a.appMutex.Lock()
+	defer a.appMutex.Unlock()
+	if instance.state == appStateRunning {
+		return nil, false
+	}
+	app, ok := instance.newApp()
+	if !ok {
+		log.Errorf("Did not find the application {%s}, please check config in [%s] ", instance.config.App, instance.configFile)
+		instance.state = appStateFailed
+		return nil, false
+	}
+	if configurable, ok := app.(d.ConfigurableApplication); ok {
+		err := config.DecodeProperties(instance.config.RawProperties, configurable.Config())
+		if err != nil {
+			log.Errorf("Failed to load application {%s}, invalid config in [%s]: %v", instance.name, instance.configFile, err)
+			instance.state = appStateFailed
+			return nil, false
+		}
+	}
+	log.Infoln("Loading application: ", instance.name)
+	instance.app = app
+	var loggingConfig *config.LoggingConfig
+	if conf := a.getConfig(); conf != nil {
+		loggingConfig = conf.Logging
+	}
+	instance.logger = logging.NewAppLogger(instance.config.App, instance.name, loggingConfig)
+	instance.trace = nil
+	if instance.config.Trace {
+		traceSize := 0
+		if loggingConfig != nil {
+			traceSize = loggingConfig.TraceSize
+		}
+		instance.trace = newTraceBuffer(traceSize, instance.logger)
+	}
+	return app, true
+}
+
+// stopApplication cancels the application and removes all its subscriptions.
+// controlMutex must be held but not appMutex, the application is taken out
+// under appMutex and cancelled after releasing it
+func (a *ApplicationDaemon) stopApplication(instance *appInstance) {
+	a.appMutex.Lock()
+	app := instance.app
+	active := app != nil && instance.state != appStateStopped
+	instance.app = nil
+	instance.state = appStateStopped
+	a.appMutex.Unlock()
+
+	if active {
+		a.cancelApplication(instance, app)
+	}
+	a.bus.removeOwner(instance)
+	a.services.removeOwner(instance)
+	a.triggers.removeOwner(instance)
+
+	a.listenerMutex.Lock()
+	defer a.listenerMutex.Unlock()
+	for entity, channels := range instance.stateSubscriptions {
+		for _, ch := range channels {
+			a.stateListeners[entity] = removeStateChannel(a.stateListeners[entity], ch)
+			delete(a.stateChannelOwners, ch)
+		}
+		if len(a.stateListeners[entity]) == 0 {
+			delete(a.stateListeners, entity)
+		}
+	}
+	for key, channels := range instance.callServiceSubscriptions {
+		domainService := strings.SplitN(key, ".", 2)
+		listeners, ok := a.callServiceEventListeners[domainService[0]]
+		if !ok {
+			continue
+		}
+		for _, ch := range channels {
+			listeners[domainService[1]] = removeCallServiceChannel(listeners[domainService[1]], ch)
+			delete(a.callServiceChannelOwners, ch)
+		}
+		if len(listeners[domainService[1]]) == 0 {
+			delete(listeners, domainService[1])
+		}
+	}
+	for eventType, channels := range instance.eventSubscriptions {
+		for _, ch := range channels {
+			a.eventListeners[eventType] = removeEventChannel(a.eventListeners[eventType], ch)
+			delete(a.eventChannelOwners, ch)
+		}
+		if len(a.eventListeners[eventType]) == 0 {
+			delete(a.eventListeners, eventType)
+		}
+	}
+	instance.stateSubscriptions = map[string][]chan client.HassEntity{}
+	instance.callServiceSubscriptions = map[string][]chan client.HassCallServiceEvent{}
+	instance.eventSubscriptions = map[string][]chan d.HassEvent{}
+	a.eventTypesChanged()
+}
+
+// getApplication returns the application instance with name, appMutex must be held
+func (a *ApplicationDaemon) getApplication(name string) (*appInstance, bool) {
+	for _, instance := range a.applications {
+		if instance.name == name {
+			return instance, true
+		}
+	}
+	return nil, false
+}
+
+// lockedApplication returns the application instance with name
+func (a *ApplicationDaemon) lockedApplication(name string) (*appInstance, bool) {
+	a.appMutex.Lock()
+	defer a.appMutex.Unlock()
+	return a.getApplication(name)
+}
+
+// StartApplication starts a stopped application instance, the instances it
+// depends on are started first
+func (a *ApplicationDaemon) StartApplication(name string) bool {
+	a.controlMutex.Lock()
+	defer a.controlMutex.Unlock()
+	instance, ok := a.lockedApplication(name)
+	if !ok {
+		return false
+	}
+	a.startWithDependencies(instance)
+	return true
+}
+
+// StopApplication stops a running application instance, the instances
+// depending on it are stopped first
+func (a *ApplicationDaemon) StopApplication(name string) bool {
+	a.controlMutex.Lock()
+	defer a.controlMutex.Unlock()
+	instance, ok := a.lockedApplication(name)
+	if !ok {
+		return false
+	}
+	a.stopWithDependents(instance)
+	return true
+}
+
+// RestartApplication stops and starts an application instance, the running
+// instances depending on it are restarted too
+func (a *ApplicationDaemon) RestartApplication(name string) bool {
+	a.controlMutex.Lock()
+	defer a.controlMutex.Unlock()
+	a.appMutex.Lock()
+	instance, ok := a.getApplication(name)
+	if !ok {
+		a.appMutex.Unlock()
+		return false
+	}
+	dependents := a.dependents(instance)
+	running := map[*appInstance]bool{instance: true}
+	for _, dependent := range dependents {
+		running[dependent] = running[dependent] || dependent.state == appStateRunning
+	}
+	a.appMutex.Unlock()
+
+	a.stopWithDependents(instance)
+	for _, dependent := range dependents {
+		if running[dependent] {
+			a.startWithDependencies(dependent)
+		}
+	}
+	appRestarts.Inc(name)
+	return true
+}
+
+// startWithDependencies starts the instances instance depends on and then
+// instance, controlMutex must be held
+func (a *ApplicationDaemon) startWithDependencies(instance *appInstance) {
+	a.appMutex.Lock()
+	ordered, failed := orderApplications(a.dependencies(instance))
+	if reason, ok := failed[instance]; ok {
+		log.Errorf("Failed to start application {%s}, %s", instance.name, reason)
+		instance.state = appStateFailed
+		a.appMutex.Unlock()
+		return
+	}
+	a.appMutex.Unlock()
+	for _, dependency := range ordered {
+		if a.canStart(dependency, "start") {
+			a.startApplication(dependency)
+		}
+	}
+}
+
+// stopWithDependents stops the instances depending on instance and then
+// instance, controlMutex must be held
+func (a *ApplicationDaemon) stopWithDependents(instance *appInstance) {
+	a.appMutex.Lock()
+	dependents := a.dependents(instance)
+	a.appMutex.Unlock()
+	for i := len(dependents) - 1; i >= 0; i-- {
+		a.stopApplication(dependents[i])
+	}
+}
+
+// dependencies returns instance and the instances it depends on, directly or
+// through other instances, appMutex must be held
+func (a *ApplicationDaemon) dependencies(instance *appInstance) []*appInstance {
+	included := map[string]bool{instance.name: true}
+	for changed := true; changed; {
+		changed = false
+		for _, other := range a.applications {
+			if !included[other.name] {
+				continue
+			}
+			for _, dependency := range other.config.DependsOn {
+				if !included[dependency] {
+					included[dependency] = true
+					changed = true
+				}
+			}
+		}
+	}
+	return a.applicationsNamed(included)
+}
+
+// dependents returns instance and the instances depending on it, directly or
+// through other instances, in start order, appMutex must be held
+func (a *ApplicationDaemon) dependents(instance *appInstance) []*appInstance {
+	included := map[string]bool{instance.name: true}
+	for changed := true; changed; {
+		changed = false
+		for _, other := range a.applications {
+			if included[other.name] {
+				continue
+			}
+			for _, dependency := range other.config.DependsOn {
+				if included[dependency] {
+					included[other.name] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return a.applicationsNamed(included)
+}
+
+// applicationsNamed returns the instances with the names, in start order
+func (a *ApplicationDaemon) applicationsNamed(names map[string]bool) []*appInstance {
+	instances := []*appInstance{}
+	for _, instance := range a.applications {
+		if names[instance.name] {
+			instances = append(instances, instance)
+		}
+	}
+	return instances
+}
+
+// initializeApplication initializes the application and recovers if it panics
+func (a *ApplicationDaemon) initializeApplication(instance *appInstance, app d.DaemonApplication) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			appPanics.Inc(instance.name)
+			log.Errorf("Application {%s} panicked during initialize: %v", instance.name, r)
+			ok = false
+		}
+	}()
+	return app.Initialize(&appHelper{ApplicationDaemon: a, instance: instance}, instance.config)
+}
+
+// cancelApplication cancels the application and recovers if it panics
+func (a *ApplicationDaemon) cancelApplication(instance *appInstance, app d.DaemonApplication) {
+	defer func() {
+		if r := recover(); r != nil {
+			appPanics.Inc(instance.name)
+			log.Errorf("Application {%s} panicked during cancel: %v", instance.name, r)
+		}
+	}()
+	app.Cancel()
+}
+
+func removeStateChannel(channels []chan client.HassEntity, channel chan client.HassEntity) []chan client.HassEntity {
+	result := channels[:0]
+	for _, ch := range channels {
+		if ch != channel {
+			result = append(result, ch)
+		}
+	}
+	return result
+}
+
+func removeCallServiceChannel(channels []chan client.HassCallServiceEvent,
+	channel chan client.HassCallServiceEvent) []chan client.HassCallServiceEvent {
+	result := channels[:0]
+	for _, ch := range channels {
+		if ch != channel {
+			result = append(result, ch)
 		}
-		// Get new instance of empty list
-		a.applications = []d.DaemonApplication{}
 	}
+	return result
 }
+
 func (a *ApplicationDaemon) getAllApplicationConfigFilePaths() []string {
 	fileList := []string{}
 	pathAppDir := filepath.Join(a.configPath, "app")
@@ -580,6 +1240,11 @@ func (a *ApplicationDaemon) getConfigFromFile(path string) (map[string]d.DeamonA
 		log.Error("Failed to read app yaml file", path, err)
 		return nil, false
 	}
+	data, err = config.Expand(data, a.secrets)
+	if err != nil {
+		log.Error("Failed to expand secrets and environment in app yaml file", path, err)
+		return nil, false
+	}
 	err = yaml.Unmarshal(data, i)
 	if err != nil {
 		log.Error("Failed to parse app yaml file", path, err)
@@ -593,31 +1258,30 @@ func (a *ApplicationDaemon) NewEntity(id string, daemonHelper d.DaemonAppHelper,
 	return NewEntity(id, daemonHelper, autoRespondServiceCall, changedEntityChannel)
 }
 
-func (a *ApplicationDaemon) instanceAllApplications() []d.DaemonApplication {
-	applicationInstances := []d.DaemonApplication{}
+// instanceAllApplications returns all application instances from configuration, not started
+func (a *ApplicationDaemon) instanceAllApplications() []*appInstance {
+	applicationInstances := []*appInstance{}
 
 	allApplicationConfigs := a.getAllApplicationConfigFilePaths()
 
-	// Add the standard applications
-	if len(a.config.People) > 0 {
-		var peopleApp d.DaemonApplication = &defaultapps.PeopleApp{}
-		applicationInstances = append(applicationInstances, peopleApp)
-		log.Infoln("Loading default application: people_app")
-		peopleApp.Initialize(a, d.DeamonAppConfig{})
-	}
+	// Add the default applications first
+	applicationInstances = append(applicationInstances, defaultAppInstances(a.getConfig())...)
 
 	for _, configFile := range allApplicationConfigs {
 		cfgList, ok := a.getConfigFromFile(configFile)
 		if ok {
-			for _, appCfg := range cfgList {
-				app, ok := a.NewDaemonApp(appCfg.App)
-				if ok {
-					log.Infoln("Loading application: ", appCfg.App)
-					applicationInstances = append(applicationInstances, app)
-					app.Initialize(a, appCfg)
-				} else {
-					log.Errorf("Did not find the application {%s}, please check config in [%s] ", appCfg.App, configFile)
-				}
+			// Sort the instances so the start order does not depend on map order
+			names := make([]string, 0, len(cfgList))
+			for name := range cfgList {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				appCfg := cfgList[name]
+				appName := appCfg.App
+				applicationInstances = append(applicationInstances,
+					newAppInstance(name, configFile, appCfg,
+						func() (d.DaemonApplication, bool) { return a.NewDaemonApp(appName) }))
 			}
 		}
 
@@ -2,6 +2,7 @@ package core
 
 import (
 	"context"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -9,6 +10,7 @@ import (
 
 	d "github.com/helto4real/go-daemon/daemon"
 	"github.com/helto4real/go-daemon/daemon/config"
+	"github.com/helto4real/go-daemon/daemon/defaultapps"
 	h "github.com/helto4real/go-daemon/daemon/test"
 	"github.com/helto4real/go-hassclient/client"
 	"github.com/sirupsen/logrus"
@@ -44,6 +46,30 @@ func TestGetConfigFromFile(t *testing.T) {
 	h.Equals(t, "light.light1", instance.Properties["thelight"])
 }
 
+func TestLoadConfigReplacesSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	h.Ok(t, err)
+	defer os.RemoveAll(dir)
+	defer config.ClearSecrets()
+	h.Ok(t, os.Mkdir(filepath.Join(dir, "config"), 0755))
+	h.Ok(t, ioutil.WriteFile(filepath.Join(dir, "config", "go-daemon.yaml"),
+		[]byte("home_assistant:\n  ip: localhost\n  token: token-value\n"), 0644))
+	secrets := filepath.Join(dir, "config", "secrets.yaml")
+	h.Ok(t, ioutil.WriteFile(secrets, []byte("old: old-secret-value\n"), 0644))
+
+	daemon := NewApplicationDaemon()
+	daemon.configPath = dir
+	h.Ok(t, daemon.loadConfig())
+	h.Equals(t, config.Redacted, config.Redact("old-secret-value"))
+
+	// Secrets removed from secrets.yaml are no longer redacted after reload
+	h.Ok(t, ioutil.WriteFile(secrets, []byte("new: new-secret-value\n"), 0644))
+	h.Ok(t, daemon.loadConfig())
+	h.Equals(t, "old-secret-value", config.Redact("old-secret-value"))
+	h.Equals(t, config.Redacted, config.Redact("new-secret-value"))
+	h.Equals(t, config.Redacted, config.Redact("token-value"))
+}
+
 func TestGetInstance(t *testing.T) {
 	daemon := ApplicationDaemon{
 		availableApps: map[string]interface{}{
@@ -64,6 +90,25 @@ func TestGetInstanceTypeMissing(t *testing.T) {
 	h.Equals(t, nil, app)
 }
 
+func TestGetInstanceRegistered(t *testing.T) {
+	daemon := ApplicationDaemon{}
+
+	app, ok := daemon.NewDaemonApp("rules")
+	h.Equals(t, true, ok)
+	_, isRules := app.(*defaultapps.RulesApp)
+	h.Equals(t, true, isRules)
+}
+
+func TestGetInstanceNotAnApp(t *testing.T) {
+	daemon := ApplicationDaemon{
+		availableApps: map[string]interface{}{
+			"notanapp": struct{}{}}}
+
+	app, ok := daemon.NewDaemonApp("notanapp")
+	h.Equals(t, false, ok)
+	h.Equals(t, nil, app)
+}
+
 func TestHandleEntity(t *testing.T) {
 	entity := client.HassEntity{
 		ID:   "light.testentity",
@@ -251,3 +296,35 @@ func (a testapp) Initialize(helper d.DaemonAppHelper, config d.DeamonAppConfig)
 func (a testapp) Cancel() {
 
 }
+
+type configtestapp struct {
+	config struct {
+		Light  config.EntityID   `yaml:"light" validate:"required"`
+		Lights []config.EntityID `yaml:"lights"`
+	}
+}
+
+func (a *configtestapp) Initialize(helper d.DaemonAppHelper, config d.DeamonAppConfig) bool {
+	return true
+}
+
+func (a *configtestapp) Cancel() {}
+
+func (a *configtestapp) Config() interface{} { return &a.config }
+
+func TestStartApplicationTypedConfig(t *testing.T) {
+	daemon := NewApplicationDaemon()
+	daemon.availableApps = map[string]interface{}{"configapp": configtestapp{}}
+
+	newApp := func() (d.DaemonApplication, bool) { return daemon.NewDaemonApp("configapp") }
+	instance := newAppInstance("config_instance", "app.yaml",
+		d.DeamonAppConfig{App: "configapp", RawProperties: map[string]interface{}{"light": "light.light1"}}, newApp)
+	daemon.startApplication(instance)
+	h.Equals(t, appStateRunning, instance.state)
+	h.Equals(t, config.EntityID("light.light1"), instance.app.(*configtestapp).config.Light)
+
+	invalid := newAppInstance("invalid_instance", "app.yaml",
+		d.DeamonAppConfig{App: "configapp", RawProperties: map[string]interface{}{"light": "not valid"}}, newApp)
+	daemon.startApplication(invalid)
+	h.Equals(t, appStateFailed, invalid.state)
+}
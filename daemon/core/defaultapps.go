@@ -0,0 +1,102 @@
+package core
+
+import (
+	"fmt"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	"github.com/helto4real/go-daemon/daemon/config"
+	"github.com/helto4real/go-daemon/daemon/defaultapps"
+)
+
+// defaultApp is a built in application started without app yaml files,
+// configured in the default_apps section of go-daemon.yaml
+type defaultApp struct {
+	// name is the instance name and the key in default_apps
+	name string
+	// app is the app name used for logging
+	app string
+	// title and configuredBy describes the application in validation errors
+	title        string
+	configuredBy string
+	newApp       func() d.DaemonApplication
+	// enabled returns true if the application starts when enabled is not set in default_apps
+	enabled func(conf *config.Config) bool
+}
+
+// defaultApps are the registered default applications in start order
+var defaultApps []*defaultApp
+
+// registerDefaultApp adds a default application, panics if the name is already registered
+func registerDefaultApp(app *defaultApp) {
+	if _, ok := findDefaultApp(app.name); ok {
+		panic(fmt.Sprintf("default app %s is already registered", app.name))
+	}
+	defaultApps = append(defaultApps, app)
+}
+
+// findDefaultApp returns the registered default application with the instance name
+func findDefaultApp(name string) (*defaultApp, bool) {
+	for _, app := range defaultApps {
+		if app.name == name {
+			return app, true
+		}
+	}
+	return nil, false
+}
+
+// defaultAppEnabled returns true if the default application should start with the configuration
+func defaultAppEnabled(app *defaultApp, conf *config.Config) bool {
+	if appConfig, ok := conf.DefaultApps[app.name]; ok && appConfig != nil && appConfig.Enabled != nil {
+		return *appConfig.Enabled
+	}
+	return app.enabled(conf)
+}
+
+// defaultAppInstances returns instances of the enabled default applications, not started
+func defaultAppInstances(conf *config.Config) []*appInstance {
+	instances := []*appInstance{}
+	for _, app := range defaultApps {
+		if !defaultAppEnabled(app, conf) {
+			continue
+		}
+		newApp := app.newApp
+		instances = append(instances, newAppInstance(app.name, "", defaultAppConfig(app, conf),
+			func() (d.DaemonApplication, bool) { return newApp(), true }))
+	}
+	return instances
+}
+
+// defaultAppConfig returns the app config of the default application from default_apps
+func defaultAppConfig(app *defaultApp, conf *config.Config) d.DeamonAppConfig {
+	appConfig := d.DeamonAppConfig{App: app.app}
+	appConfig.SetProperties(nil)
+	if section, ok := conf.DefaultApps[app.name]; ok && section != nil {
+		appConfig.SetProperties(section.Properties)
+		appConfig.DependsOn = section.DependsOn
+		appConfig.Trace = section.Trace
+	}
+	return appConfig
+}
+
+// peopleConfigured returns true if there are people to track
+func peopleConfigured(conf *config.Config) bool {
+	return len(conf.People) > 0 || conf.Settings != nil && conf.Settings.TrackingSettings != nil &&
+		conf.Settings.TrackingSettings.PersonEntities
+}
+
+func init() {
+	registerDefaultApp(&defaultApp{
+		name:         "people_app",
+		app:          "people_app",
+		title:        "people app",
+		configuredBy: "people config",
+		newApp:       func() d.DaemonApplication { return &defaultapps.PeopleApp{} },
+		enabled:      peopleConfigured})
+	registerDefaultApp(&defaultApp{
+		name:         "rules_app",
+		app:          "rules",
+		title:        "rules app",
+		configuredBy: "default_apps",
+		newApp:       func() d.DaemonApplication { return &defaultapps.RulesApp{} },
+		enabled:      func(conf *config.Config) bool { return false }})
+}
@@ -0,0 +1,36 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/helto4real/go-daemon/daemon/config"
+	h "github.com/helto4real/go-daemon/daemon/test"
+)
+
+func TestDefaultAppInstances(t *testing.T) {
+	conf := &config.Config{}
+	h.Equals(t, []string{}, instanceNames(defaultAppInstances(conf)))
+
+	conf.People = map[string]*config.PeopleConfig{"thomas": {}}
+	h.Equals(t, []string{"people_app"}, instanceNames(defaultAppInstances(conf)))
+
+	enabled, disabled := true, false
+	conf.DefaultApps = map[string]*config.DefaultAppConfig{
+		"people_app": {Enabled: &disabled},
+		"rules_app": {
+			Enabled:    &enabled,
+			DependsOn:  []string{"other_app"},
+			Properties: map[string]interface{}{"rules": []interface{}{}}}}
+	instances := defaultAppInstances(conf)
+	h.Equals(t, []string{"rules_app"}, instanceNames(instances))
+	h.Equals(t, "rules", instances[0].config.App)
+	h.Equals(t, []string{"other_app"}, instances[0].config.DependsOn)
+	h.Equals(t, []interface{}{}, instances[0].config.RawProperties["rules"])
+}
+
+func TestRegisterDefaultAppDuplicate(t *testing.T) {
+	defer func() {
+		h.Assert(t, recover() != nil, "expected panic registering people_app twice")
+	}()
+	registerDefaultApp(&defaultApp{name: "people_app"})
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// orderApplications sorts the instances so each instance comes after the
+// instances in its depends_on. Instances without dependencies between them
+// keep the order they have in instances so the start order is deterministic.
+//
+// Instances that can not be started, missing dependency, a dependency that
+// can not be started or part of a dependency cycle, are returned in failed
+// with the reason
+func orderApplications(instances []*appInstance) (ordered []*appInstance, failed map[*appInstance]string) {
+	failed = map[*appInstance]string{}
+	byName := make(map[string]*appInstance, len(instances))
+	for _, instance := range instances {
+		byName[instance.name] = instance
+	}
+
+	for _, instance := range instances {
+		for _, dependency := range instance.config.DependsOn {
+			if _, ok := byName[dependency]; !ok {
+				failed[instance] = fmt.Sprintf("it depends on %s that is not configured", dependency)
+				break
+			}
+		}
+	}
+
+	placed := make(map[*appInstance]bool, len(instances))
+	remaining := append([]*appInstance{}, instances...)
+	for len(remaining) > 0 {
+		progress := false
+		next := remaining[:0]
+		for _, instance := range remaining {
+			if _, ok := failed[instance]; ok {
+				progress = true
+				continue
+			}
+			ready := true
+			for _, dependency := range instance.config.DependsOn {
+				dependencyInstance := byName[dependency]
+				if _, ok := failed[dependencyInstance]; ok {
+					failed[instance] = fmt.Sprintf("it depends on %s that can not be started", dependency)
+					ready = false
+					break
+				}
+				if !placed[dependencyInstance] {
+					ready = false
+				}
+			}
+			if _, ok := failed[instance]; ok {
+				progress = true
+				continue
+			}
+			if ready {
+				placed[instance] = true
+				ordered = append(ordered, instance)
+				progress = true
+				continue
+			}
+			next = append(next, instance)
+		}
+		remaining = next
+		if !progress {
+			// All remaining instances are in or depends on a cycle
+			names := make([]string, 0, len(remaining))
+			for _, instance := range remaining {
+				names = append(names, instance.name)
+			}
+			sort.Strings(names)
+			for _, instance := range remaining {
+				failed[instance] = "it is in or depends on a dependency cycle between " + strings.Join(names, ", ")
+			}
+			break
+		}
+	}
+	return ordered, failed
+}
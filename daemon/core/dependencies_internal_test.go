@@ -0,0 +1,172 @@
+package core
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	"github.com/helto4real/go-daemon/daemon/config"
+	h "github.com/helto4real/go-daemon/daemon/test"
+)
+
+// orderLog records the order applications are initialized and cancelled
+var orderLog []string
+
+type ordertestapp struct {
+	name string
+}
+
+func (a *ordertestapp) Initialize(helper d.DaemonAppHelper, config d.DeamonAppConfig) bool {
+	a.name = config.Name
+	orderLog = append(orderLog, "start "+a.name)
+	return true
+}
+
+func (a *ordertestapp) Cancel() {
+	orderLog = append(orderLog, "stop "+a.name)
+}
+
+func newOrderTestInstance(name string, dependsOn ...string) *appInstance {
+	return newAppInstance(name, "", d.DeamonAppConfig{DependsOn: dependsOn}, nil)
+}
+
+func instanceNames(instances []*appInstance) []string {
+	names := []string{}
+	for _, instance := range instances {
+		names = append(names, instance.name)
+	}
+	return names
+}
+
+func TestOrderApplications(t *testing.T) {
+	a := newOrderTestInstance("a", "c")
+	b := newOrderTestInstance("b")
+	c := newOrderTestInstance("c", "b")
+	e := newOrderTestInstance("e")
+
+	ordered, failed := orderApplications([]*appInstance{a, b, c, e})
+	h.Equals(t, 0, len(failed))
+	h.Equals(t, []string{"b", "c", "e", "a"}, instanceNames(ordered))
+}
+
+func TestOrderApplicationsFailures(t *testing.T) {
+	missing := newOrderTestInstance("missing", "not_configured")
+	dependent := newOrderTestInstance("dependent", "missing")
+	cycle1 := newOrderTestInstance("cycle1", "cycle2")
+	cycle2 := newOrderTestInstance("cycle2", "cycle1")
+	ok := newOrderTestInstance("ok")
+
+	ordered, failed := orderApplications([]*appInstance{missing, dependent, cycle1, cycle2, ok})
+	h.Equals(t, []string{"ok"}, instanceNames(ordered))
+	h.Equals(t, "it depends on not_configured that is not configured", failed[missing])
+	h.Equals(t, "it depends on missing that can not be started", failed[dependent])
+	h.Equals(t, "it is in or depends on a dependency cycle between cycle1, cycle2", failed[cycle1])
+	h.Equals(t, failed[cycle1], failed[cycle2])
+}
+
+func TestLoadApplicationsInDependencyOrder(t *testing.T) {
+	orderLog = nil
+	daemon := NewApplicationDaemon()
+	daemon.configPath = "testdata/dependencies"
+	daemon.config = &config.Config{}
+	daemon.availableApps = map[string]interface{}{"ordertestapp": ordertestapp{}}
+
+	daemon.loadDaemonApplications()
+	h.Equals(t, []string{"start b_instance", "start c_instance", "start a_instance"}, orderLog)
+	h.Equals(t, []string{"b_instance", "c_instance", "a_instance", "missing_instance"}, instanceNames(daemon.applications))
+
+	missing, _ := daemon.getApplication("missing_instance")
+	h.Equals(t, appStateFailed, missing.state)
+	h.Equals(t, "missing_instance", missing.config.Name)
+
+	orderLog = nil
+	daemon.unloadDaemonApplications()
+	h.Equals(t, []string{"stop a_instance", "stop c_instance", "stop b_instance"}, orderLog)
+}
+
+func TestSingleApplicationInDependencyOrder(t *testing.T) {
+	daemon := NewApplicationDaemon()
+	daemon.configPath = "testdata/dependencies"
+	daemon.config = &config.Config{}
+	daemon.availableApps = map[string]interface{}{"ordertestapp": ordertestapp{}}
+	daemon.loadDaemonApplications()
+	defer daemon.unloadDaemonApplications()
+
+	// Instances depending on the stopped instance are stopped first
+	orderLog = nil
+	h.Equals(t, true, daemon.StopApplication("b_instance"))
+	h.Equals(t, []string{"stop a_instance", "stop c_instance", "stop b_instance"}, orderLog)
+
+	// Dependencies are started first
+	orderLog = nil
+	h.Equals(t, true, daemon.StartApplication("a_instance"))
+	h.Equals(t, []string{"start b_instance", "start c_instance", "start a_instance"}, orderLog)
+
+	// Running dependents are restarted too
+	orderLog = nil
+	h.Equals(t, true, daemon.RestartApplication("c_instance"))
+	h.Equals(t, []string{"stop a_instance", "stop c_instance", "start c_instance", "start a_instance"}, orderLog)
+
+	orderLog = nil
+	h.Equals(t, true, daemon.StopApplication("a_instance"))
+	h.Equals(t, true, daemon.RestartApplication("c_instance"))
+	h.Equals(t, []string{"stop a_instance", "stop c_instance", "start c_instance"}, orderLog)
+
+	// Instances with missing dependencies are not started
+	orderLog = nil
+	h.Equals(t, true, daemon.StartApplication("missing_instance"))
+	h.Equals(t, 0, len(orderLog))
+	missing, _ := daemon.getApplication("missing_instance")
+	h.Equals(t, appStateFailed, missing.state)
+}
+
+// statustestapp reads the status of the applications while initialized and cancelled
+type statustestapp struct {
+	daemon *ApplicationDaemon
+}
+
+func (a *statustestapp) Initialize(helper d.DaemonAppHelper, config d.DeamonAppConfig) bool {
+	a.daemon.getApplicationStatus()
+	return true
+}
+
+func (a *statustestapp) Cancel() {
+	a.daemon.getApplicationStatus()
+}
+
+func TestSingleApplicationInitializedWithoutAppLock(t *testing.T) {
+	daemon := NewApplicationDaemon()
+	daemon.applications = []*appInstance{newAppInstance("status_instance", "", d.DeamonAppConfig{},
+		func() (d.DaemonApplication, bool) { return &statustestapp{daemon: daemon}, true })}
+
+	done := make(chan bool)
+	go func() {
+		daemon.StartApplication("status_instance")
+		daemon.RestartApplication("status_instance")
+		daemon.StopApplication("status_instance")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the status to be available while the app is started and stopped")
+	}
+	h.Equals(t, appStateStopped, daemon.applications[0].state)
+}
+
+func TestValidateDependencies(t *testing.T) {
+	out := &bytes.Buffer{}
+	h.Equals(t, 1, Validate("testdata/validate/dependencies", validateTestApps, out))
+
+	appFile := filepath.Join("testdata/validate/dependencies", "app", "app.yaml")
+	expected := []string{
+		appFile + ":3: app instance a_instance can not be started, it is in or depends on a dependency cycle between a_instance, b_instance",
+		appFile + ":8: app instance b_instance can not be started, it is in or depends on a dependency cycle between a_instance, b_instance",
+		appFile + ":13: app instance c_instance can not be started, it depends on people_app that is not configured",
+		"Found 3 error(s) in configuration",
+	}
+	h.Equals(t, strings.Join(expected, "\n")+"\n", out.String())
+}
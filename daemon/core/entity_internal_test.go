@@ -12,6 +12,7 @@ import (
 	"github.com/helto4real/go-daemon/daemon/config"
 	h "github.com/helto4real/go-daemon/daemon/test"
 	"github.com/helto4real/go-hassclient/client"
+	"github.com/sirupsen/logrus"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -147,6 +148,22 @@ func (a *fakeDaemonAppHelper) ListenCallServiceEvent(domain string, service stri
 	panic("not implemented")
 }
 
+func (a *fakeDaemonAppHelper) ListenEvent(eventType string, eventChannel chan d.HassEvent) {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) UnlistenState(entity string, stateChannel chan client.HassEntity) {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) UnlistenCallServiceEvent(domain string, service string, callServiceChannel chan client.HassCallServiceEvent) {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) UnlistenEvent(eventType string, eventChannel chan d.HassEvent) {
+	panic("not implemented")
+}
+
 func (a *fakeDaemonAppHelper) ListenState(entity string, stateChannel chan client.HassEntity) {
 	a.listenState = a.listenState + 1
 	a.stateChannel = stateChannel
@@ -194,6 +211,60 @@ func (a *fakeDaemonAppHelper) GetLocation() d.Location {
 	}
 }
 
+func (a *fakeDaemonAppHelper) GetLogger() *logrus.Entry {
+	return logrus.WithField("prefix", "fake")
+}
+
+func (a *fakeDaemonAppHelper) Publish(topic string, message interface{}) error {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) Subscribe(topic string, channel interface{}) error {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) HandleRequest(topic string, handler func(request interface{}) (interface{}, error)) error {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) Request(topic string, request interface{}, timeout time.Duration) (interface{}, error) {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) RegisterService(domain string, service string, schema interface{},
+	handler func(data interface{}) (interface{}, error)) error {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) WaitForState(ctx context.Context, entity string,
+	predicate func(entity client.HassEntity) bool, timeout time.Duration) (client.HassEntity, error) {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) History(entity string, since time.Time) []client.HassEntityState {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) HistoryStats(entity string, since time.Time) (d.HistoryStats, bool) {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) ListenThreshold(entity string, trigger d.ThresholdTrigger, channel chan d.ThresholdEvent) error {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) CallService(domain string, service string, data map[string]interface{}) error {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) GetEntities(domain string) ([]*client.HassEntity, error) {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) FireEvent(eventType string, data map[string]interface{}) error {
+	panic("not implemented")
+}
+
 func (a *fakeDaemonAppHelper) loadTestCase(filename string) {
 	a.confMutex.Lock()
 	defer a.confMutex.Unlock()
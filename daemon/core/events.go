@@ -0,0 +1,274 @@
+package core
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+	d "github.com/helto4real/go-daemon/daemon"
+)
+
+// eventStreamRetryDelay is the time to wait before connecting the event stream again
+var eventStreamRetryDelay = 5 * time.Second
+
+// websocketMessage is a message from the Home Assistant websocket API
+type websocketMessage struct {
+	ID      int    `json:"id"`
+	Type    string `json:"type"`
+	Success bool   `json:"success"`
+	Error   struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	Event struct {
+		EventType string                 `json:"event_type"`
+		Data      map[string]interface{} `json:"data"`
+		TimeFired time.Time              `json:"time_fired"`
+	} `json:"event"`
+}
+
+// ListenEvent listens to events of eventType fired in Home Assistant
+//
+// Any events is reported back to the provided channel
+func (a *ApplicationDaemon) ListenEvent(eventType string, eventChannel chan d.HassEvent) {
+	a.listenEvent(eventType, eventChannel)
+}
+
+// listenEvent registers the channel and returns false if already registered
+func (a *ApplicationDaemon) listenEvent(eventType string, eventChannel chan d.HassEvent) bool {
+	a.listenerMutex.Lock()
+	for _, ch := range a.eventListeners[eventType] {
+		if ch == eventChannel {
+			a.listenerMutex.Unlock()
+			return false
+		}
+	}
+	if a.eventListeners == nil {
+		a.eventListeners = make(map[string][]chan d.HassEvent)
+	}
+	a.eventListeners[eventType] = append(a.eventListeners[eventType], eventChannel)
+	a.listenerMutex.Unlock()
+	a.eventTypesChanged()
+	return true
+}
+
+// UnlistenEvent stops sending the events of eventType to the channel
+func (a *ApplicationDaemon) UnlistenEvent(eventType string, eventChannel chan d.HassEvent) {
+	a.removeEventListener(eventType, eventChannel, nil)
+}
+
+// removeEventListener removes the channel registered with listenEvent
+func (a *ApplicationDaemon) removeEventListener(eventType string, eventChannel chan d.HassEvent, owner *appInstance) {
+	a.listenerMutex.Lock()
+	a.eventListeners[eventType] = removeEventChannel(a.eventListeners[eventType], eventChannel)
+	if len(a.eventListeners[eventType]) == 0 {
+		delete(a.eventListeners, eventType)
+	}
+	if owner != nil {
+		owner.eventSubscriptions[eventType] = removeEventChannel(owner.eventSubscriptions[eventType], eventChannel)
+		if len(owner.eventSubscriptions[eventType]) == 0 {
+			delete(owner.eventSubscriptions, eventType)
+		}
+	}
+	// The channel can be used for other event types by the same owner
+	if owner == nil || !owner.hasEventChannel(eventChannel) {
+		delete(a.eventChannelOwners, eventChannel)
+	}
+	a.listenerMutex.Unlock()
+	a.eventTypesChanged()
+}
+
+// eventTypesChanged tells the event stream to subscribe to new event types
+func (a *ApplicationDaemon) eventTypesChanged() {
+	select {
+	case a.eventTypesChannel <- true:
+	default:
+		// The event stream has not read the last change yet
+	}
+}
+
+// listenedEventTypes returns the event types with listeners
+func (a *ApplicationDaemon) listenedEventTypes() []string {
+	a.listenerMutex.RLock()
+	defer a.listenerMutex.RUnlock()
+	eventTypes := []string{}
+	for eventType := range a.eventListeners {
+		eventTypes = append(eventTypes, eventType)
+	}
+	sort.Strings(eventTypes)
+	return eventTypes
+}
+
+func (a *ApplicationDaemon) handleEvent(event *d.HassEvent) {
+	start := time.Now()
+	defer func() { dispatchLatency.Observe(time.Since(start).Seconds(), "event") }()
+
+	// Copy so we do not hold the lock while sending on channels
+	a.listenerMutex.RLock()
+	listeners := append([]chan d.HassEvent(nil), a.eventListeners[event.EventType]...)
+	owners := make([]*appInstance, len(listeners))
+	for i, ch := range listeners {
+		owners[i] = a.eventChannelOwners[ch]
+	}
+	a.listenerMutex.RUnlock()
+
+	for i, eventChannel := range listeners {
+		select {
+		case eventChannel <- *event:
+			owners[i].traceCause(traceEvent, "%s %v", event.EventType, event.Data)
+		case <-time.After(time.Second * time.Duration(defaultTimeoutForFullChannel)):
+			// This should never happen incase the app does not read the messages
+			channelFullTimeouts.Inc("event")
+			log.Errorf("Channel full, please check recevicer channel: %s", event.EventType)
+		case <-a.cancelContext.Done():
+			// Exit cause of exit to os
+			return
+		}
+	}
+}
+
+func removeEventChannel(channels []chan d.HassEvent, channel chan d.HassEvent) []chan d.HassEvent {
+	result := channels[:0]
+	for _, ch := range channels {
+		if ch != channel {
+			result = append(result, ch)
+		}
+	}
+	return result
+}
+
+// eventStreamLoop streams the listened event types from the Home Assistant
+// websocket API while there are listeners. The Home Assistant client only
+// sends state changes and service calls
+func (a *ApplicationDaemon) eventStreamLoop() {
+	for {
+		select {
+		case <-a.eventTypesChannel:
+		case <-a.cancelContext.Done():
+			return
+		}
+		if len(a.listenedEventTypes()) == 0 {
+			continue
+		}
+		if err := a.streamEvents(); err != nil {
+			log.Warnf("Event stream from Home Assistant failed, retrying: %v", err)
+			select {
+			case <-time.After(eventStreamRetryDelay):
+				a.eventTypesChanged()
+			case <-a.cancelContext.Done():
+				return
+			}
+		}
+	}
+}
+
+// streamEvents connects to the websocket API and sends the events to the
+// listeners until the connection fails or there are no listeners left
+func (a *ApplicationDaemon) streamEvents() error {
+	u := a.hassWebsocketURL()
+	conn, _, err := websocket.DefaultDialer.DialContext(a.cancelContext, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := authenticateWebsocket(conn, a.getConfig().HomeAssistant.Token); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	messages := make(chan websocketMessage)
+	readErrors := make(chan error, 1)
+	go func() {
+		for {
+			message := websocketMessage{}
+			if err := conn.ReadJSON(&message); err != nil {
+				readErrors <- err
+				return
+			}
+			select {
+			case messages <- message:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	id := 0
+	subscribed := map[string]bool{}
+	for {
+		eventTypes := a.listenedEventTypes()
+		if len(eventTypes) == 0 {
+			// Subscriptions are dropped with the connection
+			log.Debugln("No event listeners, closing the event stream")
+			return nil
+		}
+		for _, eventType := range eventTypes {
+			if subscribed[eventType] {
+				continue
+			}
+			id++
+			err := conn.WriteJSON(map[string]interface{}{
+				"id": id, "type": "subscribe_events", "event_type": eventType})
+			if err != nil {
+				return err
+			}
+			subscribed[eventType] = true
+		}
+
+		select {
+		case <-a.eventTypesChannel:
+		case message := <-messages:
+			if message.Type == "event" {
+				go a.handleEvent(&d.HassEvent{EventType: message.Event.EventType,
+					Data: message.Event.Data, TimeFired: message.Event.TimeFired})
+			} else if message.Type == "result" && !message.Success {
+				log.Errorf("Failed to subscribe to events: %s", message.Error.Message)
+			}
+		case err := <-readErrors:
+			return err
+		case <-a.cancelContext.Done():
+			return nil
+		}
+	}
+}
+
+// authenticateWebsocket sends the token when Home Assistant asks for it
+func authenticateWebsocket(conn *websocket.Conn, token string) error {
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	message := websocketMessage{}
+	if err := conn.ReadJSON(&message); err != nil {
+		return err
+	}
+	if message.Type != "auth_required" {
+		return fmt.Errorf("expected auth_required, got %s", message.Type)
+	}
+	if err := conn.WriteJSON(map[string]string{"type": "auth", "access_token": token}); err != nil {
+		return err
+	}
+	message = websocketMessage{}
+	if err := conn.ReadJSON(&message); err != nil {
+		return err
+	}
+	if message.Type != "auth_ok" {
+		return fmt.Errorf("authentication failed: %s", message.Type)
+	}
+	return nil
+}
+
+// hassWebsocketURL returns the url to the Home Assistant websocket API
+func (a *ApplicationDaemon) hassWebsocketURL() url.URL {
+	ha := a.getConfig().HomeAssistant
+	scheme := "ws"
+	if ha.SSL {
+		scheme = "wss"
+	}
+	if ha.IP == "hassio" {
+		return url.URL{Scheme: scheme, Host: "hassio", Path: "/homeassistant/websocket"}
+	}
+	return url.URL{Scheme: scheme, Host: ha.IP, Path: "/api/websocket"}
+}
@@ -0,0 +1,139 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	d "github.com/helto4real/go-daemon/daemon"
+	"github.com/helto4real/go-daemon/daemon/config"
+	h "github.com/helto4real/go-daemon/daemon/test"
+	"github.com/helto4real/go-hassclient/client"
+)
+
+func TestListenEventDelivered(t *testing.T) {
+	daemon := NewApplicationDaemon()
+	helper := newBusTestHelper(daemon, "remote_app")
+	ch := make(chan d.HassEvent, 2)
+	helper.ListenEvent("zha_event", ch)
+	helper.ListenEvent("zha_event", ch)
+	h.Equals(t, 1, len(daemon.eventListeners["zha_event"]))
+
+	daemon.handleEvent(&d.HassEvent{EventType: "other_event"})
+	daemon.handleEvent(&d.HassEvent{EventType: "zha_event", Data: map[string]interface{}{"command": "on"}})
+	h.Equals(t, "on", (<-ch).Data["command"])
+	h.Equals(t, 0, len(ch))
+
+	// The subscriptions are removed when the app is stopped
+	daemon.stopApplication(helper.instance)
+	h.Equals(t, 0, len(daemon.eventListeners))
+	h.Equals(t, 0, len(daemon.eventChannelOwners))
+}
+
+func TestUnlistenKeepsOtherSubscriptions(t *testing.T) {
+	daemon := NewApplicationDaemon()
+	helper := newBusTestHelper(daemon, "external_app")
+	stateChannel := make(chan client.HassEntity, 1)
+	helper.ListenState("light.kitchen", stateChannel)
+	helper.ListenState("light.hallway", stateChannel)
+	callServiceChannel := make(chan client.HassCallServiceEvent, 1)
+	helper.ListenCallServiceEvent("script", "one", callServiceChannel)
+	helper.ListenCallServiceEvent("script", "two", callServiceChannel)
+	eventChannel := make(chan d.HassEvent, 1)
+	helper.ListenEvent("zha_event", eventChannel)
+	helper.ListenEvent("go_daemon_presence", eventChannel)
+
+	helper.UnlistenState("Light.Kitchen", stateChannel)
+	helper.UnlistenCallServiceEvent("script", "one", callServiceChannel)
+	helper.UnlistenEvent("zha_event", eventChannel)
+	h.Equals(t, 0, len(daemon.stateListeners["light.kitchen"]))
+	h.Equals(t, 0, len(daemon.callServiceEventListeners["script"]["one"]))
+	h.Equals(t, []string{"go_daemon_presence"}, daemon.listenedEventTypes())
+	// The owner is kept for the other subscriptions on the channels
+	h.Equals(t, helper.instance, daemon.stateChannelOwners[stateChannel])
+	h.Equals(t, helper.instance, daemon.callServiceChannelOwners[callServiceChannel])
+	h.Equals(t, helper.instance, daemon.eventChannelOwners[eventChannel])
+
+	helper.UnlistenState("light.hallway", stateChannel)
+	helper.UnlistenCallServiceEvent("script", "two", callServiceChannel)
+	helper.UnlistenEvent("go_daemon_presence", eventChannel)
+	h.Equals(t, 0, len(daemon.stateListeners))
+	h.Equals(t, 0, len(helper.instance.stateSubscriptions))
+	h.Equals(t, 0, len(helper.instance.callServiceSubscriptions))
+	h.Equals(t, 0, len(helper.instance.eventSubscriptions))
+	h.Equals(t, 0, len(daemon.stateChannelOwners))
+	h.Equals(t, 0, len(daemon.callServiceChannelOwners))
+	h.Equals(t, 0, len(daemon.eventChannelOwners))
+}
+
+func TestEventStreamFromHomeAssistant(t *testing.T) {
+	subscribed := make(chan string, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/websocket" {
+			http.NotFound(w, r)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteJSON(map[string]string{"type": "auth_required"})
+		auth := map[string]string{}
+		if conn.ReadJSON(&auth) != nil || auth["access_token"] != "token" {
+			conn.WriteJSON(map[string]string{"type": "auth_invalid"})
+			return
+		}
+		conn.WriteJSON(map[string]string{"type": "auth_ok"})
+		for {
+			subscribe := map[string]interface{}{}
+			if conn.ReadJSON(&subscribe) != nil {
+				return
+			}
+			subscribed <- subscribe["event_type"].(string)
+			conn.WriteJSON(map[string]interface{}{"id": subscribe["id"], "type": "result", "success": true})
+			conn.WriteJSON(map[string]interface{}{"id": subscribe["id"], "type": "event", "event": map[string]interface{}{
+				"event_type": "zha_event", "data": map[string]interface{}{"command": "on"},
+				"time_fired": "2020-01-01T10:00:00.123456+00:00"}})
+		}
+	}))
+	defer server.Close()
+
+	daemon := NewApplicationDaemon()
+	defer daemon.cancel()
+	daemon.config = &config.Config{
+		HomeAssistant: config.HomeAssistantConfig{IP: strings.TrimPrefix(server.URL, "http://"), Token: "token"}}
+	go daemon.eventStreamLoop()
+
+	ch := make(chan d.HassEvent, 1)
+	daemon.ListenEvent("zha_event", ch)
+	select {
+	case eventType := <-subscribed:
+		h.Equals(t, "zha_event", eventType)
+	case <-time.After(time.Second):
+		t.Fatal("expected the event type to be subscribed")
+	}
+	select {
+	case event := <-ch:
+		h.Equals(t, "zha_event", event.EventType)
+		h.Equals(t, "on", event.Data["command"])
+		h.Equals(t, time.Date(2020, 1, 1, 10, 0, 0, 123456000, time.UTC), event.TimeFired.UTC())
+	case <-time.After(time.Second):
+		t.Fatal("expected the event from Home Assistant")
+	}
+}
+
+func TestHassWebsocketURL(t *testing.T) {
+	daemon := NewApplicationDaemon()
+	daemon.config = &config.Config{HomeAssistant: config.HomeAssistantConfig{IP: "192.168.1.5:8123", SSL: true}}
+	u := daemon.hassWebsocketURL()
+	h.Equals(t, "wss://192.168.1.5:8123/api/websocket", u.String())
+
+	daemon.config.HomeAssistant = config.HomeAssistantConfig{IP: "hassio"}
+	u = daemon.hassWebsocketURL()
+	h.Equals(t, "ws://hassio/homeassistant/websocket", u.String())
+}
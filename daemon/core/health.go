@@ -0,0 +1,143 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/helto4real/go-daemon/daemon/config"
+)
+
+// defaultStaleEventTimeout is the seconds without events before the daemon is unhealthy
+const defaultStaleEventTimeout = 900
+
+// healthStatus is the body returned from the health and readiness endpoints
+type healthStatus struct {
+	Healthy         bool      `json:"healthy"`
+	Connected       bool      `json:"connected"`
+	AppsInitialized bool      `json:"apps_initialized"`
+	LastEvent       time.Time `json:"last_event"`
+	EventsStale     bool      `json:"events_stale"`
+}
+
+// setConnected updates the connection status to Home Assistant
+func (a *ApplicationDaemon) setConnected(connected bool) {
+	a.healthMutex.Lock()
+	defer a.healthMutex.Unlock()
+	a.connected = connected
+	if connected {
+		// Count the connection as an event so staleness starts from here
+		a.lastEventTime = time.Now()
+	}
+}
+
+// setAppsInitialized updates if the applications has been initialized
+func (a *ApplicationDaemon) setAppsInitialized(initialized bool) {
+	a.healthMutex.Lock()
+	defer a.healthMutex.Unlock()
+	a.appsInitialized = initialized
+}
+
+// eventReceived records the time of last event from Home Assistant
+func (a *ApplicationDaemon) eventReceived() {
+	a.healthMutex.Lock()
+	defer a.healthMutex.Unlock()
+	a.lastEventTime = time.Now()
+}
+
+// getHealthStatus returns the current health, readiness also requires
+// the applications to be initialized
+func (a *ApplicationDaemon) getHealthStatus(readiness bool) healthStatus {
+	a.healthMutex.Lock()
+	defer a.healthMutex.Unlock()
+
+	status := healthStatus{
+		Connected:       a.connected,
+		AppsInitialized: a.appsInitialized,
+		LastEvent:       a.lastEventTime}
+
+	if timeout := staleEventTimeout(a.getConfig()); timeout > 0 && a.connected {
+		maxAge := time.Duration(timeout) * time.Second
+		status.EventsStale = time.Since(a.lastEventTime) > maxAge
+	}
+	status.Healthy = status.Connected && !status.EventsStale
+	if readiness {
+		status.Healthy = status.Healthy && status.AppsInitialized
+	}
+	return status
+}
+
+// staleEventTimeout returns the seconds without events before the daemon
+// is unhealthy, 0 if disabled
+func staleEventTimeout(conf *config.Config) int {
+	if conf == nil || conf.HTTP == nil || conf.HTTP.StaleEventTimeout == 0 {
+		return defaultStaleEventTimeout
+	}
+	if conf.HTTP.StaleEventTimeout < 0 {
+		return 0
+	}
+	return conf.HTTP.StaleEventTimeout
+}
+
+// handleHealthz reports if the daemon is connected and receiving events
+func (a *statusServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	a.writeHealth(w, a.daemon.getHealthStatus(false))
+}
+
+// handleReadyz reports if the daemon is healthy and all applications are initialized
+func (a *statusServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	a.writeHealth(w, a.daemon.getHealthStatus(true))
+}
+
+func (a *statusServer) writeHealth(w http.ResponseWriter, status healthStatus) {
+	if !status.Healthy {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, status)
+}
+
+// HealthCheck calls the health endpoint of a running daemon using the
+// configuration in configPath. Returns the exit code to use, 0 if healthy
+func HealthCheck(configPath string) int {
+	configuration := config.NewConfiguration(filepath.Join(configPath, "config", "go-daemon.yaml"))
+	conf, err := configuration.Open()
+	if err != nil {
+		fmt.Println("Failed to open config file: ", err)
+		return 1
+	}
+	if conf.HTTP == nil || !conf.HTTP.Enabled {
+		// Nothing to check, containers without the http api are not unhealthy
+		fmt.Println("The http api is not enabled, health is not checked")
+		return 0
+	}
+	url := localURL(conf.HTTP.Address) + "/healthz"
+
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		fmt.Println("Health check failed: ", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Health check failed with status %d\n", resp.StatusCode)
+		return 1
+	}
+	return 0
+}
+
+// localURL returns the local base url to the http api from the listen address
+func localURL(address string) string {
+	if address == "" {
+		address = defaultHTTPAddress
+	}
+	if strings.HasPrefix(address, ":") {
+		address = "127.0.0.1" + address
+	} else if strings.HasPrefix(address, "0.0.0.0:") {
+		address = "127.0.0.1" + strings.TrimPrefix(address, "0.0.0.0")
+	}
+	return "http://" + address
+}
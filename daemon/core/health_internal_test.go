@@ -0,0 +1,100 @@
+package core
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/helto4real/go-daemon/daemon/config"
+	h "github.com/helto4real/go-daemon/daemon/test"
+)
+
+func TestHealthStatus(t *testing.T) {
+	daemon := NewApplicationDaemon()
+	daemon.config = &config.Config{HTTP: &config.HTTPConfig{StaleEventTimeout: 60}}
+
+	h.Equals(t, false, daemon.getHealthStatus(false).Healthy)
+
+	daemon.setConnected(true)
+	h.Equals(t, true, daemon.getHealthStatus(false).Healthy)
+	h.Equals(t, false, daemon.getHealthStatus(true).Healthy)
+
+	daemon.setAppsInitialized(true)
+	h.Equals(t, true, daemon.getHealthStatus(true).Healthy)
+
+	// Fake no events for two minutes
+	daemon.lastEventTime = time.Now().Add(-2 * time.Minute)
+	status := daemon.getHealthStatus(false)
+	h.Equals(t, true, status.EventsStale)
+	h.Equals(t, false, status.Healthy)
+
+	daemon.eventReceived()
+	h.Equals(t, true, daemon.getHealthStatus(true).Healthy)
+
+	daemon.setConnected(false)
+	h.Equals(t, false, daemon.getHealthStatus(false).Healthy)
+}
+
+func TestStaleEventTimeout(t *testing.T) {
+	h.Equals(t, defaultStaleEventTimeout, staleEventTimeout(&config.Config{}))
+	h.Equals(t, defaultStaleEventTimeout, staleEventTimeout(&config.Config{HTTP: &config.HTTPConfig{}}))
+	h.Equals(t, 60, staleEventTimeout(&config.Config{HTTP: &config.HTTPConfig{StaleEventTimeout: 60}}))
+	h.Equals(t, 0, staleEventTimeout(&config.Config{HTTP: &config.HTTPConfig{StaleEventTimeout: -1}}))
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	server := newTestStatusServer()
+
+	rec := httptest.NewRecorder()
+	server.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	h.Equals(t, http.StatusServiceUnavailable, rec.Code)
+
+	server.daemon.setConnected(true)
+	rec = httptest.NewRecorder()
+	server.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	h.Equals(t, http.StatusOK, rec.Code)
+
+	// Applications was loaded when the test server was created
+	rec = httptest.NewRecorder()
+	server.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	h.Equals(t, http.StatusOK, rec.Code)
+	h.Equals(t, true, strings.Contains(rec.Body.String(), `"apps_initialized":true`))
+}
+
+func TestLocalURL(t *testing.T) {
+	h.Equals(t, "http://127.0.0.1:8099", localURL(""))
+	h.Equals(t, "http://127.0.0.1:9000", localURL(":9000"))
+	h.Equals(t, "http://127.0.0.1:9000", localURL("0.0.0.0:9000"))
+	h.Equals(t, "http://localhost:9000", localURL("localhost:9000"))
+}
+
+func writeHealthCheckConfig(t *testing.T, dir string, address string) {
+	yml := "http:\n  enabled: true\n  address: '" + strings.TrimPrefix(address, "http://") + "'\n"
+	h.Ok(t, ioutil.WriteFile(filepath.Join(dir, "config", "go-daemon.yaml"), []byte(yml), 0644))
+}
+
+func TestHealthCheck(t *testing.T) {
+	healthyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthyServer.Close()
+	unhealthyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthyServer.Close()
+
+	dir, err := ioutil.TempDir("", "healthcheck")
+	h.Ok(t, err)
+	defer os.RemoveAll(dir)
+	h.Ok(t, os.Mkdir(filepath.Join(dir, "config"), 0755))
+
+	writeHealthCheckConfig(t, dir, healthyServer.URL)
+	h.Equals(t, 0, HealthCheck(dir))
+	writeHealthCheckConfig(t, dir, unhealthyServer.URL)
+	h.Equals(t, 1, HealthCheck(dir))
+	// Http api not enabled in config, nothing to check
+	h.Equals(t, 0, HealthCheck("testdata/ok"))
+}
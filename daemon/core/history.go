@@ -0,0 +1,276 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	"github.com/helto4real/go-hassclient/client"
+)
+
+const defaultHistorySize = 100
+
+// stateHistory keeps the recent states of subscribed entities. The zero value is ready to use
+type stateHistory struct {
+	mutex    sync.RWMutex
+	entities map[string][]client.HassEntityState
+	// generation is increased on reset so seeds read before are dropped
+	generation int
+}
+
+// recordTime is the time the state was recorded in Home Assistant
+func recordTime(state client.HassEntityState) time.Time {
+	if !state.LastUpdated.IsZero() {
+		return state.LastUpdated
+	}
+	return state.LastChanged
+}
+
+// record adds the new state of entity and removes states over size or older than maxAge
+func (a *stateHistory) record(entity string, state client.HassEntityState, size int, maxAge time.Duration) {
+	if state.LastUpdated.IsZero() {
+		state.LastUpdated = time.Now()
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.entities == nil {
+		a.entities = map[string][]client.HassEntityState{}
+	}
+	a.entities[entity] = trimHistory(append(a.entities[entity], state), size, maxAge)
+}
+
+// seed adds states from Home Assistant that are older than the recorded states, the
+// states are dropped if the history was reset after generation
+func (a *stateHistory) seed(entity string, states []client.HassEntityState, generation int, size int, maxAge time.Duration) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if generation != a.generation {
+		return
+	}
+	if a.entities == nil {
+		a.entities = map[string][]client.HassEntityState{}
+	}
+	existing := a.entities[entity]
+	older := []client.HassEntityState{}
+	for _, state := range states {
+		if len(existing) == 0 || recordTime(state).Before(recordTime(existing[0])) {
+			older = append(older, state)
+		}
+	}
+	sort.SliceStable(older, func(i, j int) bool { return recordTime(older[i]).Before(recordTime(older[j])) })
+	a.entities[entity] = trimHistory(append(older, existing...), size, maxAge)
+}
+
+func trimHistory(states []client.HassEntityState, size int, maxAge time.Duration) []client.HassEntityState {
+	start := 0
+	if len(states) > size {
+		start = len(states) - size
+	}
+	if maxAge > 0 {
+		oldest := time.Now().Add(-maxAge)
+		for start < len(states) && recordTime(states[start]).Before(oldest) {
+			start++
+		}
+	}
+	if start == 0 {
+		return states
+	}
+	return append([]client.HassEntityState(nil), states[start:]...)
+}
+
+// since returns a copy of the states recorded at or after since, oldest first
+func (a *stateHistory) since(entity string, since time.Time) []client.HassEntityState {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	result := []client.HassEntityState{}
+	for _, state := range a.entities[strings.ToLower(entity)] {
+		if !recordTime(state).Before(since) {
+			result = append(result, state)
+		}
+	}
+	return result
+}
+
+func (a *stateHistory) reset() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.entities = nil
+	a.generation++
+}
+
+// currentGeneration returns the generation to seed the history with
+func (a *stateHistory) currentGeneration() int {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.generation
+}
+
+// historyStats returns the aggregates of states, false if there are no states
+func historyStats(states []client.HassEntityState) (d.HistoryStats, bool) {
+	if len(states) == 0 {
+		return d.HistoryStats{}, false
+	}
+	stats := d.HistoryStats{Count: len(states), Last: states[len(states)-1]}
+	sum := 0.0
+	for _, state := range states {
+		value, err := strconv.ParseFloat(state.State, 64)
+		if err != nil {
+			continue
+		}
+		if stats.Numeric == 0 || value < stats.Min {
+			stats.Min = value
+		}
+		if stats.Numeric == 0 || value > stats.Max {
+			stats.Max = value
+		}
+		sum += value
+		stats.Numeric++
+	}
+	if stats.Numeric > 0 {
+		stats.Avg = sum / float64(stats.Numeric)
+	}
+	stats.LastChanged = stats.Last.LastChanged
+	if stats.LastChanged.IsZero() {
+		// Find when the state last changed value from the recorded states
+		stats.LastChanged = recordTime(stats.Last)
+		for i := len(states) - 2; i >= 0 && states[i].State == stats.Last.State; i-- {
+			stats.LastChanged = recordTime(states[i])
+		}
+	}
+	return stats, true
+}
+
+// historyConfig returns the configured size and max age of the history
+func (a *ApplicationDaemon) historyConfig() (int, time.Duration) {
+	conf := a.getConfig()
+	if conf == nil || conf.History == nil {
+		return defaultHistorySize, 0
+	}
+	size := conf.History.Size
+	if size <= 0 {
+		size = defaultHistorySize
+	}
+	return size, time.Duration(conf.History.MaxAge) * time.Second
+}
+
+// recordHistory records the new state of entity if it or its platform has state listeners
+func (a *ApplicationDaemon) recordHistory(entity *client.HassEntity) {
+	a.listenerMutex.RLock()
+	_, exists := a.stateListeners[entity.ID]
+	_, plExists := a.stateListeners[strings.Split(entity.ID, ".")[0]]
+	a.listenerMutex.RUnlock()
+	if !exists && !plExists {
+		return
+	}
+	size, maxAge := a.historyConfig()
+	a.history.record(strings.ToLower(entity.ID), entity.New, size, maxAge)
+}
+
+// History returns the recorded states of entity since the time, oldest first
+func (a *ApplicationDaemon) History(entity string, since time.Time) []client.HassEntityState {
+	return a.history.since(entity, since)
+}
+
+// HistoryStats returns aggregates of the recorded states of entity since the time
+func (a *ApplicationDaemon) HistoryStats(entity string, since time.Time) (d.HistoryStats, bool) {
+	return historyStats(a.history.since(entity, since))
+}
+
+// historyEntities returns the entities with state listeners
+func (a *ApplicationDaemon) historyEntities() []string {
+	a.listenerMutex.RLock()
+	defer a.listenerMutex.RUnlock()
+	entities := []string{}
+	for entity := range a.stateListeners {
+		if strings.Contains(entity, ".") {
+			entities = append(entities, entity)
+		}
+	}
+	sort.Strings(entities)
+	return entities
+}
+
+// hassAPIURL returns the url to the Home Assistant REST API path
+func (a *ApplicationDaemon) hassAPIURL(path string) url.URL {
+	ha := a.getConfig().HomeAssistant
+	scheme := "http"
+	if ha.SSL {
+		scheme = "https"
+	}
+	if ha.IP == "hassio" {
+		return url.URL{Scheme: scheme, Host: "hassio", Path: "/homeassistant/api" + path}
+	}
+	return url.URL{Scheme: scheme, Host: ha.IP, Path: "/api" + path}
+}
+
+// historyState is a state returned from the Home Assistant history API
+type historyState struct {
+	State       string                 `json:"state"`
+	Attributes  map[string]interface{} `json:"attributes"`
+	LastChanged time.Time              `json:"last_changed"`
+	LastUpdated time.Time              `json:"last_updated"`
+}
+
+// seedHistory reads the history of the entities from Home Assistant, nothing is
+// seeded if the applications are unloaded after generation
+func (a *ApplicationDaemon) seedHistory(entities []string, generation int) {
+	size, maxAge := a.historyConfig()
+	period := maxAge
+	if period == 0 {
+		// Home Assistant returns one day of history by default, limit it
+		period = time.Hour
+	}
+	for _, entity := range entities {
+		if a.history.currentGeneration() != generation {
+			return
+		}
+		states, err := a.fetchHistory(hassHTTPClient, entity, time.Now().Add(-period))
+		if err != nil {
+			log.Warnf("Failed to read history of %s from Home Assistant: %v", entity, err)
+			continue
+		}
+		a.history.seed(entity, states, generation, size, maxAge)
+	}
+}
+
+func (a *ApplicationDaemon) fetchHistory(httpClient *http.Client, entity string, start time.Time) ([]client.HassEntityState, error) {
+	u := a.hassAPIURL("/history/period/" + start.UTC().Format(time.RFC3339))
+	u.RawQuery = url.Values{"filter_entity_id": []string{entity}}.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.getConfig().HomeAssistant.Token)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	result := [][]historyState{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	states := []client.HassEntityState{}
+	for _, list := range result {
+		for _, s := range list {
+			states = append(states, client.HassEntityState{
+				State:       s.State,
+				Attributes:  s.Attributes,
+				LastChanged: s.LastChanged,
+				LastUpdated: s.LastUpdated})
+		}
+	}
+	return states, nil
+}
@@ -0,0 +1,141 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/helto4real/go-daemon/daemon/config"
+	h "github.com/helto4real/go-daemon/daemon/test"
+	"github.com/helto4real/go-hassclient/client"
+)
+
+func sensorState(state string, updated time.Time) client.HassEntityState {
+	return client.HassEntityState{State: state, LastUpdated: updated}
+}
+
+func TestHistoryRecordsSubscribedEntities(t *testing.T) {
+	daemon := NewApplicationDaemon()
+	daemon.config = &config.Config{History: &config.HistoryConfig{Size: 3}}
+	ch := make(chan client.HassEntity, 10)
+	daemon.ListenState("sensor.humidity", ch)
+
+	start := time.Now()
+	for _, state := range []string{"40", "45", "50", "55"} {
+		daemon.handleStateChanged(&client.HassEntity{ID: "sensor.humidity",
+			Old: client.HassEntityState{State: "35"}, New: client.HassEntityState{State: state}})
+	}
+	daemon.handleStateChanged(&client.HassEntity{ID: "sensor.not_subscribed",
+		Old: client.HassEntityState{State: "0"}, New: client.HassEntityState{State: "1"}})
+	// The listener gets the changes in own go-routines, wait for them
+	for i := 0; i < 4; i++ {
+		<-ch
+	}
+
+	history := daemon.History("sensor.humidity", start)
+	h.Equals(t, 3, len(history))
+	h.Equals(t, "45", history[0].State)
+	h.Equals(t, "55", history[2].State)
+	h.Equals(t, 0, len(daemon.History("sensor.not_subscribed", start)))
+
+	// The history is cleared with the applications
+	daemon.unloadDaemonApplications()
+	h.Equals(t, 0, len(daemon.History("sensor.humidity", start)))
+}
+
+func TestHistoryKeepsOrderOfRapidChanges(t *testing.T) {
+	daemon := NewApplicationDaemon()
+	daemon.config = &config.Config{History: &config.HistoryConfig{Size: 100}}
+	ch := make(chan client.HassEntity, 100)
+	daemon.ListenState("sensor.counter", ch)
+
+	start := time.Now()
+	for i := 1; i <= 50; i++ {
+		daemon.handleStateChanged(&client.HassEntity{ID: "sensor.counter",
+			Old: client.HassEntityState{State: strconv.Itoa(i - 1)}, New: client.HassEntityState{State: strconv.Itoa(i)}})
+	}
+	for i := 0; i < 50; i++ {
+		<-ch
+	}
+
+	history := daemon.History("sensor.counter", start)
+	h.Equals(t, 50, len(history))
+	for i, state := range history {
+		h.Equals(t, strconv.Itoa(i+1), state.State)
+	}
+}
+
+func TestHistoryMaxAgeAndSince(t *testing.T) {
+	history := stateHistory{}
+	now := time.Now()
+	history.record("sensor.power", sensorState("100", now.Add(-2*time.Hour)), 10, time.Hour)
+	history.record("sensor.power", sensorState("200", now.Add(-30*time.Minute)), 10, time.Hour)
+	history.record("sensor.power", sensorState("300", now.Add(-time.Minute)), 10, time.Hour)
+
+	h.Equals(t, 2, len(history.since("sensor.power", time.Time{})))
+	h.Equals(t, 1, len(history.since("sensor.power", now.Add(-10*time.Minute))))
+}
+
+func TestHistoryStats(t *testing.T) {
+	now := time.Now()
+	stats, ok := historyStats([]client.HassEntityState{
+		sensorState("10", now.Add(-4*time.Minute)),
+		sensorState("unavailable", now.Add(-3*time.Minute)),
+		sensorState("30", now.Add(-2*time.Minute)),
+		sensorState("30", now.Add(-time.Minute))})
+	h.Equals(t, true, ok)
+	h.Equals(t, 4, stats.Count)
+	h.Equals(t, 3, stats.Numeric)
+	h.Equals(t, 10.0, stats.Min)
+	h.Equals(t, 30.0, stats.Max)
+	h.Equals(t, 70.0/3, stats.Avg)
+	h.Equals(t, now.Add(-2*time.Minute), stats.LastChanged)
+	h.Equals(t, "30", stats.Last.State)
+
+	_, ok = historyStats(nil)
+	h.Equals(t, false, ok)
+}
+
+func TestHistorySeedFromHomeAssistant(t *testing.T) {
+	var request *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		w.Write([]byte(`[[
+			{"entity_id": "sensor.power", "state": "100", "last_changed": "2020-01-01T10:00:00Z", "last_updated": "2020-01-01T10:00:00Z"},
+			{"entity_id": "sensor.power", "state": "200", "last_changed": "2020-01-01T10:05:00Z", "last_updated": "2020-01-01T10:05:00Z"}
+		]]`))
+	}))
+	defer server.Close()
+
+	daemon := NewApplicationDaemon()
+	daemon.config = &config.Config{
+		HomeAssistant: config.HomeAssistantConfig{IP: strings.TrimPrefix(server.URL, "http://"), Token: "token"},
+		History:       &config.HistoryConfig{Seed: true}}
+	daemon.history.record("sensor.power", sensorState("300", time.Now()), 10, 0)
+
+	daemon.seedHistory([]string{"sensor.power"}, daemon.history.currentGeneration())
+
+	h.Equals(t, "Bearer token", request.Header.Get("Authorization"))
+	h.Equals(t, "sensor.power", request.URL.Query().Get("filter_entity_id"))
+	h.Assert(t, strings.HasPrefix(request.URL.Path, "/api/history/period/"), "Wrong path %s", request.URL.Path)
+	history := daemon.History("sensor.power", time.Time{})
+	h.Equals(t, 3, len(history))
+	h.Equals(t, "100", history[0].State)
+	h.Equals(t, "300", history[2].State)
+}
+
+func TestHistorySeedAfterUnloadIsDropped(t *testing.T) {
+	daemon := NewApplicationDaemon()
+	generation := daemon.history.currentGeneration()
+	daemon.unloadDaemonApplications()
+
+	daemon.history.seed("sensor.power", []client.HassEntityState{sensorState("100", time.Now())}, generation, 10, 0)
+	h.Equals(t, 0, len(daemon.History("sensor.power", time.Time{})))
+
+	daemon.history.seed("sensor.power", []client.HassEntityState{sensorState("100", time.Now())},
+		daemon.history.currentGeneration(), 10, 0)
+	h.Equals(t, 1, len(daemon.History("sensor.power", time.Time{})))
+}
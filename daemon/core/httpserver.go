@@ -0,0 +1,282 @@
+package core
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	"github.com/helto4real/go-daemon/daemon/config"
+)
+
+const defaultHTTPAddress = "127.0.0.1:8099"
+
+const redacted = config.Redacted
+
+// statusServer is the embedded http server that exposes status and control API
+type statusServer struct {
+	daemon *ApplicationDaemon
+	server *http.Server
+}
+
+type appStatus struct {
+	Name          string              `json:"name"`
+	App           string              `json:"app"`
+	ConfigFile    string              `json:"config_file"`
+	State         string              `json:"state"`
+	Config        d.DeamonAppConfig   `json:"config"`
+	Subscriptions appSubscriptionInfo `json:"subscriptions"`
+}
+
+type appSubscriptionInfo struct {
+	States       []string `json:"states"`
+	CallServices []string `json:"call_services"`
+	Events       []string `json:"events"`
+	Services     []string `json:"services"`
+}
+
+func newStatusServer(daemon *ApplicationDaemon, address string) *statusServer {
+	if address == "" {
+		address = defaultHTTPAddress
+	}
+	s := &statusServer{daemon: daemon}
+	s.server = &http.Server{Addr: address, Handler: s.handler()}
+	return s
+}
+
+func (a *statusServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/apps", a.handleApps)
+	mux.HandleFunc("/api/apps/", a.handleApp)
+	mux.HandleFunc("/api/people", a.handlePeople)
+	mux.HandleFunc("/api/config", a.handleConfig)
+	mux.HandleFunc("/api/config/reload", a.handleConfigReload)
+	mux.Handle("/metrics", metricsRegistry.Handler())
+	mux.HandleFunc("/healthz", a.handleHealthz)
+	mux.HandleFunc("/readyz", a.handleReadyz)
+	return mux
+}
+
+func (a *statusServer) start() {
+	log.Infof("Starting http api on %s", a.server.Addr)
+	go func() {
+		if err := a.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorln("Http api failed: ", err)
+		}
+	}()
+}
+
+func (a *statusServer) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	a.server.Shutdown(ctx)
+}
+
+// handleApps returns all application instances
+func (a *statusServer) handleApps(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, a.daemon.getApplicationStatus())
+}
+
+// handleApp handles /api/apps/{name}, /api/apps/{name}/trace and /api/apps/{name}/{start|stop|restart}
+func (a *statusServer) handleApp(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/apps/"), "/"), "/")
+	name := parts[0]
+
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		for _, status := range a.daemon.getApplicationStatus() {
+			if status.Name == name {
+				writeJSON(w, status)
+				return
+			}
+		}
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	if parts[1] == "trace" && r.Method == http.MethodGet {
+		a.handleAppTrace(w, r, name)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.authorized(w, r) {
+		return
+	}
+	var ok bool
+	switch parts[1] {
+	case "start":
+		ok = a.daemon.StartApplication(name)
+	case "stop":
+		ok = a.daemon.StopApplication(name)
+	case "restart":
+		ok = a.daemon.RestartApplication(name)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	log.Infof("Application %s: %s from http api", name, parts[1])
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePeople returns the people and their current states
+func (a *statusServer) handlePeople(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.authorized(w, r) {
+		return
+	}
+	writeJSON(w, a.daemon.getPeopleStatus())
+}
+
+// handleConfig returns current configuration with the token redacted
+func (a *statusServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	conf := *a.daemon.getConfig()
+	if conf.HomeAssistant.Token != "" {
+		conf.HomeAssistant.Token = redacted
+	}
+	if conf.HTTP != nil && conf.HTTP.Token != "" {
+		httpConfig := *conf.HTTP
+		httpConfig.Token = redacted
+		conf.HTTP = &httpConfig
+	}
+	writeJSON(w, conf)
+}
+
+// handleConfigReload reloads the configuration and restarts the applications
+func (a *statusServer) handleConfigReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.authorized(w, r) {
+		return
+	}
+	if err := a.daemon.reloadConfig(); err != nil {
+		log.Errorln("Failed to reload config: ", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infoln("Configuration reloaded from http api")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorized returns true if the request has the token of the http config as
+// bearer token, else the request is forbidden. Requests are always forbidden
+// if no token is configured
+func (a *statusServer) authorized(w http.ResponseWriter, r *http.Request) bool {
+	token := ""
+	if conf := a.daemon.getConfig(); conf != nil && conf.HTTP != nil {
+		token = conf.HTTP.Token
+	}
+	if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		http.Error(w, "forbidden, the token in the http config is needed as bearer token", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// getApplicationStatus returns a snapshot of the status of all applications
+func (a *ApplicationDaemon) getApplicationStatus() []appStatus {
+	a.appMutex.Lock()
+	defer a.appMutex.Unlock()
+	a.listenerMutex.RLock()
+	defer a.listenerMutex.RUnlock()
+
+	result := []appStatus{}
+	for _, instance := range a.applications {
+		status := appStatus{
+			Name:       instance.name,
+			App:        instance.config.App,
+			ConfigFile: instance.configFile,
+			State:      string(instance.state),
+			Config:     instance.config,
+			Subscriptions: appSubscriptionInfo{
+				States:       []string{},
+				CallServices: []string{},
+				Events:       []string{},
+				Services:     a.services.list(instance)}}
+		for entity := range instance.stateSubscriptions {
+			status.Subscriptions.States = append(status.Subscriptions.States, entity)
+		}
+		for service := range instance.callServiceSubscriptions {
+			status.Subscriptions.CallServices = append(status.Subscriptions.CallServices, service)
+		}
+		for eventType := range instance.eventSubscriptions {
+			status.Subscriptions.Events = append(status.Subscriptions.Events, eventType)
+		}
+		sort.Strings(status.Subscriptions.States)
+		sort.Strings(status.Subscriptions.CallServices)
+		sort.Strings(status.Subscriptions.Events)
+		result = append(result, status)
+	}
+	return result
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	// Never expose secrets from secrets.yaml in the api
+	value, err := redactJSON(value)
+	if err == nil {
+		err = json.NewEncoder(w).Encode(value)
+	}
+	if err != nil {
+		log.Errorln("Failed to encode json response: ", err)
+	}
+}
+
+// redactJSON returns the json representation of value with registered
+// secrets redacted in all string values
+func redactJSON(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	return redactValue(generic), nil
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return config.Redact(v)
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = redactValue(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(item)
+		}
+	}
+	return value
+}
@@ -0,0 +1,209 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	"github.com/helto4real/go-daemon/daemon/config"
+	h "github.com/helto4real/go-daemon/daemon/test"
+	"github.com/helto4real/go-hassclient/client"
+)
+
+// listeningtestapp listens to a state so we can test the subscriptions
+type listeningtestapp struct {
+	cancelled bool
+}
+
+func (a *listeningtestapp) Initialize(helper d.DaemonAppHelper, config d.DeamonAppConfig) bool {
+	helper.ListenState(config.Properties["thelight"], make(chan client.HassEntity, 1))
+	return true
+}
+
+func (a *listeningtestapp) Cancel() {
+	a.cancelled = true
+}
+
+func newTestStatusServer() *statusServer {
+	daemon := NewApplicationDaemon()
+	daemon.configPath = "testdata/ok"
+	daemon.config = &config.Config{
+		HomeAssistant: config.HomeAssistantConfig{IP: "127.0.0.1", Token: "secret_token"},
+		HTTP:          &config.HTTPConfig{Token: "api_token"}}
+	daemon.availableApps = map[string]interface{}{
+		"testapp":  listeningtestapp{},
+		"testapp2": listeningtestapp{}}
+	daemon.loadDaemonApplications()
+	return newStatusServer(daemon, "")
+}
+
+// authorizedRequest returns a request with the token of the test status server
+func authorizedRequest(method string, target string) *http.Request {
+	request := httptest.NewRequest(method, target, nil)
+	request.Header.Set("Authorization", "Bearer api_token")
+	return request
+}
+
+func TestStatusServerApps(t *testing.T) {
+	server := newTestStatusServer()
+
+	rec := httptest.NewRecorder()
+	server.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/apps", nil))
+	h.Equals(t, http.StatusOK, rec.Code)
+
+	apps := []appStatus{}
+	h.Ok(t, json.Unmarshal(rec.Body.Bytes(), &apps))
+	h.Equals(t, 3, len(apps))
+
+	rec = httptest.NewRecorder()
+	server.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/apps/testapp_instance", nil))
+	h.Equals(t, http.StatusOK, rec.Code)
+	app := appStatus{}
+	h.Ok(t, json.Unmarshal(rec.Body.Bytes(), &app))
+	h.Equals(t, "running", app.State)
+	h.Equals(t, "testapp", app.App)
+	h.Equals(t, []string{"light.light1"}, app.Subscriptions.States)
+
+	rec = httptest.NewRecorder()
+	server.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/apps/not_exist", nil))
+	h.Equals(t, http.StatusNotFound, rec.Code)
+}
+
+func TestStatusServerStopStartApp(t *testing.T) {
+	server := newTestStatusServer()
+	daemon := server.daemon
+
+	h.Equals(t, 3, len(daemon.stateListeners["light.light1"]))
+
+	rec := httptest.NewRecorder()
+	server.handler().ServeHTTP(rec, authorizedRequest(http.MethodPost, "/api/apps/testapp_instance/stop"))
+	h.Equals(t, http.StatusNoContent, rec.Code)
+
+	instance, _ := daemon.getApplication("testapp_instance")
+	h.Equals(t, appStateStopped, instance.state)
+	h.Equals(t, 2, len(daemon.stateListeners["light.light1"]))
+
+	rec = httptest.NewRecorder()
+	server.handler().ServeHTTP(rec, authorizedRequest(http.MethodPost, "/api/apps/testapp_instance/start"))
+	h.Equals(t, http.StatusNoContent, rec.Code)
+	h.Equals(t, appStateRunning, instance.state)
+	h.Equals(t, 3, len(daemon.stateListeners["light.light1"]))
+
+	rec = httptest.NewRecorder()
+	server.handler().ServeHTTP(rec, authorizedRequest(http.MethodPost, "/api/apps/testapp_instance/restart"))
+	h.Equals(t, http.StatusNoContent, rec.Code)
+	h.Equals(t, appStateRunning, instance.state)
+	h.Equals(t, 3, len(daemon.stateListeners["light.light1"]))
+
+	rec = httptest.NewRecorder()
+	server.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/apps/testapp_instance/stop", nil))
+	h.Equals(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestStatusServerNeedsToken(t *testing.T) {
+	server := newTestStatusServer()
+	instance, _ := server.daemon.getApplication("testapp_instance")
+
+	for _, request := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/api/apps/testapp_instance/stop", nil),
+		httptest.NewRequest(http.MethodPost, "/api/config/reload", nil),
+		httptest.NewRequest(http.MethodGet, "/api/people", nil),
+	} {
+		rec := httptest.NewRecorder()
+		server.handler().ServeHTTP(rec, request)
+		h.Equals(t, http.StatusForbidden, rec.Code)
+
+		request.Header.Set("Authorization", "Bearer wrong_token")
+		rec = httptest.NewRecorder()
+		server.handler().ServeHTTP(rec, request)
+		h.Equals(t, http.StatusForbidden, rec.Code)
+	}
+	h.Equals(t, appStateRunning, instance.state)
+
+	// Without a configured token the requests are always forbidden
+	server.daemon.config.HTTP.Token = ""
+	rec := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/api/apps/testapp_instance/stop", nil)
+	request.Header.Set("Authorization", "Bearer ")
+	server.handler().ServeHTTP(rec, request)
+	h.Equals(t, http.StatusForbidden, rec.Code)
+	h.Equals(t, appStateRunning, instance.state)
+}
+
+func TestStatusServerConfigRedactsToken(t *testing.T) {
+	server := newTestStatusServer()
+
+	rec := httptest.NewRecorder()
+	server.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/config", nil))
+	h.Equals(t, http.StatusOK, rec.Code)
+
+	conf := config.Config{}
+	h.Ok(t, json.Unmarshal(rec.Body.Bytes(), &conf))
+	h.Equals(t, "127.0.0.1", conf.HomeAssistant.IP)
+	h.Equals(t, redacted, conf.HomeAssistant.Token)
+	h.Equals(t, redacted, conf.HTTP.Token)
+	h.Equals(t, "secret_token", server.daemon.config.HomeAssistant.Token)
+	h.Equals(t, "api_token", server.daemon.config.HTTP.Token)
+}
+
+func TestStatusServerRedactsSecrets(t *testing.T) {
+	server := newTestStatusServer()
+	config.RegisterSecret("switch.switch1")
+	defer config.ClearSecrets()
+
+	rec := httptest.NewRecorder()
+	server.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/apps/testapp_instance", nil))
+	h.Equals(t, http.StatusOK, rec.Code)
+
+	app := appStatus{}
+	h.Ok(t, json.Unmarshal(rec.Body.Bytes(), &app))
+	h.Equals(t, redacted, app.Config.RawProperties["theswitch"])
+}
+
+func TestStatusServerPeople(t *testing.T) {
+	server := newTestStatusServer()
+	server.daemon.config.People = map[string]*config.PeopleConfig{"thomas": {FriendlyName: "Thomas"}}
+
+	// Apps get their own copy of the configured people
+	people := server.daemon.GetPeople()
+	people["thomas"].State = "Home"
+	people["thomas"].Attributes["source_type"] = "gps"
+	h.Equals(t, "", server.daemon.config.People["thomas"].State)
+
+	get := func() map[string]*config.PeopleConfig {
+		rec := httptest.NewRecorder()
+		server.handler().ServeHTTP(rec, authorizedRequest(http.MethodGet, "/api/people"))
+		h.Equals(t, http.StatusOK, rec.Code)
+		result := map[string]*config.PeopleConfig{}
+		h.Ok(t, json.Unmarshal(rec.Body.Bytes(), &result))
+		return result
+	}
+	h.Equals(t, "", get()["thomas"].State)
+
+	// Only running apps with people status are used
+	peopleApp := newAppInstance("people_instance", "", d.DeamonAppConfig{App: "people"}, nil)
+	peopleApp.app = &peopleStatusTestApp{status: people}
+	server.daemon.applications = append(server.daemon.applications, peopleApp)
+	h.Equals(t, "", get()["thomas"].State)
+
+	peopleApp.state = appStateRunning
+	h.Equals(t, "Home", get()["thomas"].State)
+	h.Equals(t, "gps", get()["thomas"].Attributes["source_type"])
+}
+
+// peopleStatusTestApp is an app with the current states of people like the people app
+type peopleStatusTestApp struct {
+	status map[string]*config.PeopleConfig
+}
+
+func (a *peopleStatusTestApp) Initialize(helper d.DaemonAppHelper, config d.DeamonAppConfig) bool {
+	return true
+}
+
+func (a *peopleStatusTestApp) Cancel() {}
+
+func (a *peopleStatusTestApp) PeopleStatus() map[string]*config.PeopleConfig {
+	return a.status
+}
@@ -0,0 +1,32 @@
+package core
+
+import (
+	"github.com/helto4real/go-daemon/daemon/metrics"
+)
+
+// metricsRegistry holds all metrics exposed on the /metrics endpoint
+var metricsRegistry = metrics.NewRegistry()
+
+var (
+	eventsReceived = metrics.NewCounterVec("godaemon_events_received_total",
+		"Number of events received from Home Assistant", "type", "domain")
+	dispatchLatency = metrics.NewHistogramVec("godaemon_event_dispatch_seconds",
+		"Time to dispatch an event to all listening applications", nil, "type")
+	channelFullTimeouts = metrics.NewCounterVec("godaemon_channel_full_timeouts_total",
+		"Number of times an event was dropped because the receiving channel was full", "type")
+	serviceCalls = metrics.NewCounterVec("godaemon_service_calls_total",
+		"Number of service calls made by applications", "app", "service")
+	hassConnected = metrics.NewGaugeVec("godaemon_hass_connected",
+		"Connection state to Home Assistant, 1 if connected")
+	hassReconnects = metrics.NewCounterVec("godaemon_hass_reconnects_total",
+		"Number of times the connection to Home Assistant was re-established")
+	appRestarts = metrics.NewCounterVec("godaemon_app_restarts_total",
+		"Number of times an application was restarted", "app")
+	appPanics = metrics.NewCounterVec("godaemon_app_panics_total",
+		"Number of panics recovered from applications", "app")
+)
+
+func init() {
+	metricsRegistry.MustRegister(eventsReceived, dispatchLatency, channelFullTimeouts,
+		serviceCalls, hassConnected, hassReconnects, appRestarts, appPanics)
+}
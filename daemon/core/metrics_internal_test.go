@@ -0,0 +1,93 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	h "github.com/helto4real/go-daemon/daemon/test"
+	"github.com/helto4real/go-hassclient/client"
+)
+
+type panictestapp struct{}
+
+func (a *panictestapp) Initialize(helper d.DaemonAppHelper, config d.DeamonAppConfig) bool {
+	panic("initialize failed")
+}
+
+func (a *panictestapp) Cancel() {}
+
+func TestMetricsChannelFullTimeouts(t *testing.T) {
+	oldTimeout := defaultTimeoutForFullChannel
+	defaultTimeoutForFullChannel = 0
+	defer func() { defaultTimeoutForFullChannel = oldTimeout }()
+
+	before := channelFullTimeouts.Value("state")
+	daemon := ApplicationDaemon{
+		stateListeners: map[string][]chan client.HassEntity{
+			"light.metrics": []chan client.HassEntity{
+				make(chan client.HassEntity)}},
+		cancelContext: context.Background()}
+
+	daemon.handleEntity(&client.HassEntity{ID: "light.metrics"})
+
+	h.Equals(t, before+1, channelFullTimeouts.Value("state"))
+}
+
+func TestMetricsAppPanicIsRecovered(t *testing.T) {
+	daemon := NewApplicationDaemon()
+	daemon.availableApps = map[string]interface{}{"panicapp": panictestapp{}}
+	instance := newAppInstance("panic_instance", "", d.DeamonAppConfig{App: "panicapp"},
+		func() (d.DaemonApplication, bool) { return daemon.NewDaemonApp("panicapp") })
+
+	daemon.startApplication(instance)
+
+	h.Equals(t, appStateFailed, instance.state)
+	h.Equals(t, 1.0, appPanics.Value("panic_instance"))
+}
+
+func TestMetricsServiceCallsPerApp(t *testing.T) {
+	daemon := NewApplicationDaemon()
+	daemon.hassClient = &fakeHassClient{}
+	helper := &appHelper{ApplicationDaemon: daemon,
+		instance: newAppInstance("service_instance", "", d.DeamonAppConfig{}, nil)}
+
+	helper.TurnOn("light.light1")
+	helper.TurnOn("light.light1")
+	helper.Toggle("light.light1")
+
+	h.Equals(t, 2.0, serviceCalls.Value("service_instance", "turn_on"))
+	h.Equals(t, 1.0, serviceCalls.Value("service_instance", "toggle"))
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	server := newTestStatusServer()
+
+	rec := httptest.NewRecorder()
+	server.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	h.Equals(t, http.StatusOK, rec.Code)
+	h.Equals(t, true, strings.Contains(rec.Body.String(), "# TYPE godaemon_events_received_total counter"))
+	h.Equals(t, true, strings.Contains(rec.Body.String(), "# TYPE godaemon_event_dispatch_seconds histogram"))
+}
+
+// fakeHassClient is a minimal Home Assistant client used in internal tests
+type fakeHassClient struct {
+	calledServices []string
+}
+
+func (a *fakeHassClient) Start(host string, ssl bool, token string) bool { return true }
+func (a *fakeHassClient) Stop()                                          {}
+func (a *fakeHassClient) GetEntity(entity string) (*client.HassEntity, bool) {
+	return nil, false
+}
+func (a *fakeHassClient) SetEntity(entity *client.HassEntity) bool { return true }
+func (a *fakeHassClient) CallService(service string, serviceData map[string]string) {
+	a.calledServices = append(a.calledServices, service)
+}
+func (a *fakeHassClient) GetHassChannel() chan interface{} { return nil }
+func (a *fakeHassClient) GetStatusChannel() chan bool      { return nil }
+func (a *fakeHassClient) GetConfig() *client.HassConfig    { return &client.HassConfig{} }
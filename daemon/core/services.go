@@ -0,0 +1,180 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/helto4real/go-daemon/daemon/config"
+	c "github.com/helto4real/go-hassclient/client"
+)
+
+// serviceResultEvent is the event fired with the result of an app service call
+const serviceResultEvent = "go_daemon_service_result"
+
+// appService is a service provided by an application, owner is nil for
+// services registered directly on the daemon
+type appService struct {
+	domain  string
+	service string
+	schema  reflect.Type
+	handler func(data interface{}) (interface{}, error)
+	owner   *appInstance
+}
+
+// serviceRegistry keeps the services provided by applications. The zero value
+// is ready to use. Services are removed when the application owning them is stopped
+type serviceRegistry struct {
+	mutex    sync.RWMutex
+	services map[string]*appService
+}
+
+func (a *serviceRegistry) register(service *appService) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	key := service.domain + "." + service.service
+	if existing, ok := a.services[key]; ok {
+		name := "daemon"
+		if existing.owner != nil {
+			name = existing.owner.name
+		}
+		return fmt.Errorf("service %s is already provided by %s", key, name)
+	}
+	if a.services == nil {
+		a.services = map[string]*appService{}
+	}
+	a.services[key] = service
+	return nil
+}
+
+func (a *serviceRegistry) lookup(domain string, service string) (*appService, bool) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	s, ok := a.services[domain+"."+service]
+	return s, ok
+}
+
+// list returns the sorted services provided by the application instance
+func (a *serviceRegistry) list(owner *appInstance) []string {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	services := []string{}
+	for key, service := range a.services {
+		if service.owner == owner {
+			services = append(services, key)
+		}
+	}
+	sort.Strings(services)
+	return services
+}
+
+// removeOwner removes all services provided by the application instance
+func (a *serviceRegistry) removeOwner(owner *appInstance) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for key, service := range a.services {
+		if service.owner == owner {
+			delete(a.services, key)
+		}
+	}
+}
+
+func (a *serviceRegistry) reset() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.services = nil
+}
+
+// newAppService checks the schema and returns the service to register
+func newAppService(domain string, service string, schema interface{},
+	handler func(data interface{}) (interface{}, error), owner *appInstance) (*appService, error) {
+	if domain == "" || service == "" {
+		return nil, fmt.Errorf("service needs both domain and service, got %s.%s", domain, service)
+	}
+	if handler == nil {
+		return nil, fmt.Errorf("handler of service %s.%s is nil", domain, service)
+	}
+	var schemaType reflect.Type
+	if schema != nil {
+		schemaType = reflect.TypeOf(schema)
+		if schemaType.Kind() == reflect.Ptr {
+			schemaType = schemaType.Elem()
+		}
+		if schemaType.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("schema of service %s.%s has to be a struct, got %T", domain, service, schema)
+		}
+	}
+	return &appService{
+		domain:  domain,
+		service: service,
+		schema:  schemaType,
+		handler: handler,
+		owner:   owner}, nil
+}
+
+// RegisterService handles calls to domain.service from Home Assistant
+func (a *ApplicationDaemon) RegisterService(domain string, service string, schema interface{},
+	handler func(data interface{}) (interface{}, error)) error {
+	s, err := newAppService(domain, service, schema, handler, nil)
+	if err != nil {
+		return err
+	}
+	return a.services.register(s)
+}
+
+// handleServiceCall calls the app service matching the call service event, if any
+func (a *ApplicationDaemon) handleServiceCall(callServiceEvent *c.HassCallServiceEvent) {
+	service, ok := a.services.lookup(callServiceEvent.Domain, callServiceEvent.Service)
+	if !ok {
+		return
+	}
+	name := callServiceEvent.Domain + "." + callServiceEvent.Service
+	service.owner.traceCause(traceCallService, "service %s %v", name, callServiceEvent.ServiceData)
+
+	var data interface{} = callServiceEvent.ServiceData
+	if service.schema != nil {
+		value := reflect.New(service.schema)
+		if err := config.DecodeProperties(callServiceEvent.ServiceData, value.Interface()); err != nil {
+			log.Errorf("Invalid service_data in call to service %s: %v", name, err)
+			a.fireServiceResult(callServiceEvent, nil, err)
+			return
+		}
+		data = value.Interface()
+	}
+
+	result, err := a.callServiceHandler(service, name, data)
+	if err != nil {
+		log.Errorf("Service %s failed: %v", name, err)
+	}
+	a.fireServiceResult(callServiceEvent, result, err)
+}
+
+// callServiceHandler calls the handler and recovers if it panics
+func (a *ApplicationDaemon) callServiceHandler(service *appService, name string, data interface{}) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if service.owner != nil {
+				appPanics.Inc(service.owner.name)
+			}
+			err = fmt.Errorf("service handler panicked: %v", r)
+		}
+	}()
+	return service.handler(data)
+}
+
+// fireServiceResult fires the result event of the service call in Home Assistant
+func (a *ApplicationDaemon) fireServiceResult(callServiceEvent *c.HassCallServiceEvent, result interface{}, err error) {
+	eventData := map[string]interface{}{
+		"domain":  callServiceEvent.Domain,
+		"service": callServiceEvent.Service,
+		"success": err == nil}
+	if err != nil {
+		eventData["error"] = err.Error()
+	} else if result != nil {
+		eventData["result"] = result
+	}
+	if err := a.FireEvent(serviceResultEvent, eventData); err != nil {
+		log.Errorf("Failed to send result of %s.%s: %v", callServiceEvent.Domain, callServiceEvent.Service, err)
+	}
+}
@@ -0,0 +1,129 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	"github.com/helto4real/go-daemon/daemon/config"
+	h "github.com/helto4real/go-daemon/daemon/test"
+	"github.com/helto4real/go-hassclient/client"
+)
+
+var _ d.EventFirer = &firingHassClient{}
+
+// firingHassClient is a fake client that supports firing events
+type firingHassClient struct {
+	fakeHassClient
+	events []map[string]interface{}
+}
+
+func (a *firingHassClient) FireEvent(eventType string, eventData map[string]interface{}) bool {
+	eventData["event_type"] = eventType
+	a.events = append(a.events, eventData)
+	return true
+}
+
+type sceneServiceData struct {
+	Light      config.EntityID `yaml:"light" validate:"required"`
+	Brightness int             `yaml:"brightness" default:"255"`
+}
+
+func newServiceTestDaemon() (*ApplicationDaemon, *firingHassClient) {
+	hass := &firingHassClient{}
+	daemon := NewApplicationDaemon()
+	daemon.hassClient = hass
+	return daemon, hass
+}
+
+func TestServiceCallRoutedToApp(t *testing.T) {
+	daemon, hass := newServiceTestDaemon()
+	helper := newBusTestHelper(daemon, "scene_app")
+
+	var called *sceneServiceData
+	h.Ok(t, helper.RegisterService("go_daemon", "scene_evening", sceneServiceData{},
+		func(data interface{}) (interface{}, error) {
+			called = data.(*sceneServiceData)
+			return "done", nil
+		}))
+
+	daemon.handleCallServiceEvent(client.NewHassCallServiceEvent(
+		time.Now(), "go_daemon", "scene_evening", map[string]interface{}{"light": "light.livingroom"}))
+
+	h.Equals(t, &sceneServiceData{Light: "light.livingroom", Brightness: 255}, called)
+	h.Equals(t, 1, len(hass.events))
+	h.Equals(t, serviceResultEvent, hass.events[0]["event_type"])
+	h.Equals(t, true, hass.events[0]["success"])
+	h.Equals(t, "done", hass.events[0]["result"])
+	h.Equals(t, []string{"go_daemon.scene_evening"}, daemon.services.list(helper.instance))
+}
+
+func TestServiceCallInvalidData(t *testing.T) {
+	daemon, hass := newServiceTestDaemon()
+	helper := newBusTestHelper(daemon, "scene_app")
+
+	called := false
+	h.Ok(t, helper.RegisterService("go_daemon", "scene_evening", &sceneServiceData{},
+		func(data interface{}) (interface{}, error) {
+			called = true
+			return nil, nil
+		}))
+
+	daemon.handleCallServiceEvent(client.NewHassCallServiceEvent(
+		time.Now(), "go_daemon", "scene_evening", map[string]interface{}{"light": "livingroom"}))
+
+	h.Equals(t, false, called)
+	h.Equals(t, false, hass.events[0]["success"])
+	h.Equals(t, `property "light": invalid entity id "livingroom", expected format domain.object_id`, hass.events[0]["error"])
+}
+
+func TestServiceRegistration(t *testing.T) {
+	daemon, _ := newServiceTestDaemon()
+	first := newBusTestHelper(daemon, "first")
+	second := newBusTestHelper(daemon, "second")
+	daemon.applications = []*appInstance{first.instance}
+	handler := func(data interface{}) (interface{}, error) { return nil, nil }
+
+	h.Ok(t, first.RegisterService("go_daemon", "raw", nil, handler))
+	h.Assert(t, second.RegisterService("go_daemon", "raw", nil, handler) != nil, "Expected error on duplicate service")
+	h.Assert(t, second.RegisterService("go_daemon", "bad_schema", "not a struct", handler) != nil, "Expected error on invalid schema")
+
+	// Services are removed when the app is stopped
+	h.Equals(t, true, daemon.StopApplication("first"))
+	h.Ok(t, second.RegisterService("go_daemon", "raw", nil, handler))
+}
+
+func TestServiceCallWithoutEventSupport(t *testing.T) {
+	var path string
+	body := map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	// The result is fired with the REST API
+	daemon := NewApplicationDaemon()
+	daemon.hassClient = &fakeHassClient{}
+	daemon.config = &config.Config{
+		HomeAssistant: config.HomeAssistantConfig{IP: strings.TrimPrefix(server.URL, "http://"), Token: "token"}}
+	helper := newBusTestHelper(daemon, "raw_app")
+
+	var received interface{}
+	h.Ok(t, helper.RegisterService("go_daemon", "raw", nil, func(data interface{}) (interface{}, error) {
+		received = data
+		panic("handler failed")
+	}))
+	daemon.handleCallServiceEvent(client.NewHassCallServiceEvent(
+		time.Now(), "go_daemon", "raw", map[string]interface{}{"any": 1}))
+
+	h.Equals(t, map[string]interface{}{"any": 1}, received)
+	h.Equals(t, 1.0, appPanics.Value("raw_app"))
+	h.Equals(t, "/api/events/"+serviceResultEvent, path)
+	h.Equals(t, false, body["success"])
+	h.Equals(t, "service handler panicked: handler failed", body["error"])
+}
@@ -0,0 +1,170 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/helto4real/go-daemon/daemon/config"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultTraceSize = 200
+
+type traceKind string
+
+const (
+	traceEvent       traceKind = "event"
+	traceCallService traceKind = "call_service_event"
+	traceTimer       traceKind = "timer"
+	traceCall        traceKind = "call"
+	traceMessage     traceKind = "message"
+)
+
+// traceIDCounter makes correlation ids unique over all traced applications
+var traceIDCounter uint64
+
+// traceEntry is one recorded decision point of an application. Cause is the
+// id of the last event or timer delivered to the application before the entry
+// was recorded, linking outgoing calls to what most likely triggered them
+type traceEntry struct {
+	ID     uint64    `json:"id"`
+	Cause  uint64    `json:"cause,omitempty"`
+	Time   time.Time `json:"time"`
+	Kind   traceKind `json:"kind"`
+	Detail string    `json:"detail"`
+}
+
+func (a traceEntry) String() string {
+	cause := ""
+	if a.Cause != 0 {
+		cause = fmt.Sprintf(" (cause #%d)", a.Cause)
+	}
+	return fmt.Sprintf("%s #%d %-18s %s%s", a.Time.Format("2006-01-02 15:04:05.000"), a.ID, a.Kind, a.Detail, cause)
+}
+
+// traceBuffer is a bounded ring buffer of trace entries for an application instance
+type traceBuffer struct {
+	mutex     sync.Mutex
+	entries   []traceEntry
+	next      int
+	full      bool
+	lastCause uint64
+	logger    *logrus.Entry
+}
+
+func newTraceBuffer(size int, logger *logrus.Entry) *traceBuffer {
+	if size <= 0 {
+		size = defaultTraceSize
+	}
+	return &traceBuffer{entries: make([]traceEntry, size), logger: logger}
+}
+
+// recordCause records an incoming event or timer and makes it the cause of
+// following calls
+func (a *traceBuffer) recordCause(kind traceKind, detail string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	entry := a.add(kind, detail, 0)
+	a.lastCause = entry.ID
+}
+
+// recordCall records an outgoing call from the application
+func (a *traceBuffer) recordCall(detail string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.add(traceCall, detail, a.lastCause)
+}
+
+// add adds the entry to the ring, mutex must be held
+func (a *traceBuffer) add(kind traceKind, detail string, cause uint64) traceEntry {
+	entry := traceEntry{
+		ID:     atomic.AddUint64(&traceIDCounter, 1),
+		Cause:  cause,
+		Time:   time.Now(),
+		Kind:   kind,
+		Detail: detail}
+	a.entries[a.next] = entry
+	a.next = (a.next + 1) % len(a.entries)
+	if a.next == 0 {
+		a.full = true
+	}
+	if a.logger != nil {
+		a.logger.WithFields(logrus.Fields{"trace_id": entry.ID, "trace_cause": entry.Cause}).
+			Debugf("trace %s: %s", kind, detail)
+	}
+	return entry
+}
+
+// snapshot returns the entries oldest first
+func (a *traceBuffer) snapshot() []traceEntry {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if !a.full {
+		return append([]traceEntry{}, a.entries[:a.next]...)
+	}
+	return append(append([]traceEntry{}, a.entries[a.next:]...), a.entries[:a.next]...)
+}
+
+// handleAppTrace returns the trace of an application instance
+func (a *statusServer) handleAppTrace(w http.ResponseWriter, r *http.Request, name string) {
+	a.daemon.appMutex.Lock()
+	instance, ok := a.daemon.getApplication(name)
+	var trace *traceBuffer
+	if ok {
+		trace = instance.trace
+	}
+	a.daemon.appMutex.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if trace == nil {
+		http.Error(w, "trace is not enabled for application, set trace: true in app config", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, trace.snapshot())
+}
+
+// PrintTrace prints the trace of an application instance from a running daemon
+// using the configuration in configPath. Returns the exit code to use
+func PrintTrace(configPath string, instance string, out io.Writer) int {
+	configuration := config.NewConfiguration(filepath.Join(configPath, "config", "go-daemon.yaml"))
+	conf, err := configuration.Open()
+	if err != nil {
+		fmt.Fprintln(out, "Failed to open config file: ", err)
+		return 1
+	}
+	if conf.HTTP == nil || !conf.HTTP.Enabled {
+		fmt.Fprintln(out, "The http api has to be enabled to read traces")
+		return 1
+	}
+	url := localURL(conf.HTTP.Address) + "/api/apps/" + instance + "/trace"
+
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		fmt.Fprintln(out, "Failed to get trace: ", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(out, "Failed to get trace for %s, status %d\n", instance, resp.StatusCode)
+		return 1
+	}
+	entries := []traceEntry{}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		fmt.Fprintln(out, "Failed to read trace: ", err)
+		return 1
+	}
+	for _, entry := range entries {
+		fmt.Fprintln(out, entry)
+	}
+	return 0
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	h "github.com/helto4real/go-daemon/daemon/test"
+	"github.com/helto4real/go-hassclient/client"
+)
+
+func TestTraceBufferIsBounded(t *testing.T) {
+	trace := newTraceBuffer(3, nil)
+	trace.recordCause(traceEvent, "first")
+	trace.recordCall("second")
+	trace.recordCall("third")
+	trace.recordCall("fourth")
+
+	entries := trace.snapshot()
+	h.Equals(t, 3, len(entries))
+	h.Equals(t, "second", entries[0].Detail)
+	h.Equals(t, "fourth", entries[2].Detail)
+}
+
+func TestTraceCorrelatesCallsWithCause(t *testing.T) {
+	trace := newTraceBuffer(10, nil)
+	trace.recordCall("before any event")
+	trace.recordCause(traceEvent, "binary_sensor.motion: off -> on")
+	trace.recordCall("turn_on light.light1")
+
+	entries := trace.snapshot()
+	h.Equals(t, uint64(0), entries[0].Cause)
+	h.Equals(t, entries[1].ID, entries[2].Cause)
+}
+
+func TestTraceRecordsDeliveredEventsAndCalls(t *testing.T) {
+	daemon := NewApplicationDaemon()
+	daemon.hassClient = &fakeHassClient{}
+	instance := newAppInstance("traced_instance", "", d.DeamonAppConfig{Trace: true}, nil)
+	instance.trace = newTraceBuffer(10, nil)
+	helper := &appHelper{ApplicationDaemon: daemon, instance: instance}
+
+	ch := make(chan client.HassEntity, 1)
+	helper.ListenState("binary_sensor.motion", ch)
+
+	daemon.handleEntity(&client.HassEntity{ID: "binary_sensor.motion",
+		Old: client.HassEntityState{State: "off"},
+		New: client.HassEntityState{State: "on"}})
+	<-ch
+	helper.TurnOn("light.light1")
+
+	entries := instance.trace.snapshot()
+	h.Equals(t, 2, len(entries))
+	h.Equals(t, traceEvent, entries[0].Kind)
+	h.Equals(t, "binary_sensor.motion: off -> on", entries[0].Detail)
+	h.Equals(t, traceCall, entries[1].Kind)
+	h.Equals(t, "turn_on light.light1", entries[1].Detail)
+	h.Equals(t, entries[0].ID, entries[1].Cause)
+}
+
+func TestTraceEndpoint(t *testing.T) {
+	server := newTestStatusServer()
+
+	rec := httptest.NewRecorder()
+	server.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/apps/testapp_instance/trace", nil))
+	h.Equals(t, http.StatusBadRequest, rec.Code)
+
+	instance, _ := server.daemon.getApplication("testapp_instance")
+	instance.trace = newTraceBuffer(10, nil)
+	instance.trace.recordCall("turn_on light.light1")
+
+	rec = httptest.NewRecorder()
+	server.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/apps/testapp_instance/trace", nil))
+	h.Equals(t, http.StatusOK, rec.Code)
+	entries := []traceEntry{}
+	h.Ok(t, json.Unmarshal(rec.Body.Bytes(), &entries))
+	h.Equals(t, 1, len(entries))
+	h.Equals(t, "turn_on light.light1", entries[0].Detail)
+
+	rec = httptest.NewRecorder()
+	server.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/apps/not_exist/trace", nil))
+	h.Equals(t, http.StatusNotFound, rec.Code)
+}
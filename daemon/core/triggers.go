@@ -0,0 +1,288 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	"github.com/helto4real/go-hassclient/client"
+)
+
+// thresholdTrigger keeps track of which side of the thresholds the value of
+// an entity is on and the crossing waiting for the hold time to pass
+type thresholdTrigger struct {
+	entity  string
+	trigger d.ThresholdTrigger
+	channel chan d.ThresholdEvent
+	owner   *appInstance
+	// queue has the crossings waiting to be sent to channel by deliverThresholds
+	queue chan d.ThresholdEvent
+	// done is closed when the trigger is stopped
+	done chan struct{}
+
+	mutex        sync.Mutex
+	side         d.Crossing
+	pending      d.Crossing
+	pendingEvent d.ThresholdEvent
+	timer        *time.Timer
+	stopped      bool
+}
+
+// numericValue returns the state or attribute of state as number
+func numericValue(state client.HassEntityState, attribute string) (float64, bool) {
+	if attribute == "" {
+		value, err := strconv.ParseFloat(strings.TrimSpace(state.State), 64)
+		return value, err == nil
+	}
+	switch value := state.Attributes[attribute].(type) {
+	case float64:
+		return value, true
+	case int:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case string:
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return number, err == nil
+	}
+	return 0, false
+}
+
+// sideOf returns the side of the thresholds value is on, empty if between them
+func (a *thresholdTrigger) sideOf(value float64) d.Crossing {
+	switch {
+	case value > a.trigger.Above:
+		return d.CrossedAbove
+	case value < a.trigger.Below:
+		return d.CrossedBelow
+	}
+	return ""
+}
+
+// cancelPending stops the hold timer, mutex must be held
+func (a *thresholdTrigger) cancelPending() {
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	a.pending = ""
+}
+
+// update checks the new state and returns the event to deliver, if any
+func (a *thresholdTrigger) update(entity client.HassEntity, fire func(*thresholdTrigger, d.ThresholdEvent)) (d.ThresholdEvent, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.stopped {
+		return d.ThresholdEvent{}, false
+	}
+	value, ok := numericValue(entity.New, a.trigger.Attribute)
+	if !ok {
+		// Unknown or unavailable values does not keep a crossing
+		a.cancelPending()
+		return d.ThresholdEvent{}, false
+	}
+	side := a.sideOf(value)
+	if side == "" || side == a.side {
+		a.cancelPending()
+		return d.ThresholdEvent{}, false
+	}
+	event := d.ThresholdEvent{Entity: entity, Value: value, Crossing: side}
+	if a.trigger.For <= 0 {
+		a.side = side
+		return event, true
+	}
+	if a.pending == side {
+		// Still crossed, the hold time counts from the first crossing
+		a.pendingEvent = event
+		return d.ThresholdEvent{}, false
+	}
+	a.cancelPending()
+	a.pending = side
+	a.pendingEvent = event
+	var timer *time.Timer
+	timer = time.AfterFunc(a.trigger.For, func() {
+		a.mutex.Lock()
+		if a.timer != timer || a.stopped {
+			a.mutex.Unlock()
+			return
+		}
+		a.side = a.pending
+		a.timer = nil
+		a.pending = ""
+		event := a.pendingEvent
+		a.mutex.Unlock()
+		fire(a, event)
+	})
+	a.timer = timer
+	return d.ThresholdEvent{}, false
+}
+
+func (a *thresholdTrigger) stop() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if !a.stopped {
+		a.stopped = true
+		close(a.done)
+	}
+	a.cancelPending()
+}
+
+func (a *thresholdTrigger) isStopped() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.stopped
+}
+
+// triggerRegistry keeps the threshold triggers of entities. The zero value is
+// ready to use. Triggers are removed when the application owning them is stopped
+type triggerRegistry struct {
+	mutex    sync.RWMutex
+	triggers map[string][]*thresholdTrigger
+}
+
+func (a *triggerRegistry) add(trigger *thresholdTrigger) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.triggers == nil {
+		a.triggers = map[string][]*thresholdTrigger{}
+	}
+	a.triggers[trigger.entity] = append(a.triggers[trigger.entity], trigger)
+}
+
+// lookup returns a copy of the triggers of entity
+func (a *triggerRegistry) lookup(entity string) []*thresholdTrigger {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return append([]*thresholdTrigger(nil), a.triggers[strings.ToLower(entity)]...)
+}
+
+// removeOwner stops and removes all triggers of the application instance
+func (a *triggerRegistry) removeOwner(owner *appInstance) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for entity, triggers := range a.triggers {
+		kept := []*thresholdTrigger{}
+		for _, trigger := range triggers {
+			if trigger.owner == owner {
+				trigger.stop()
+			} else {
+				kept = append(kept, trigger)
+			}
+		}
+		if len(kept) == 0 {
+			delete(a.triggers, entity)
+		} else {
+			a.triggers[entity] = kept
+		}
+	}
+}
+
+func (a *triggerRegistry) reset() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, triggers := range a.triggers {
+		for _, trigger := range triggers {
+			trigger.stop()
+		}
+	}
+	a.triggers = nil
+}
+
+// ListenThreshold sends an event on channel when the value of entity crosses the thresholds
+func (a *ApplicationDaemon) ListenThreshold(entity string, trigger d.ThresholdTrigger, channel chan d.ThresholdEvent) error {
+	return a.listenThreshold(entity, trigger, channel, nil)
+}
+
+// listenThreshold adds the trigger, owner is the application instance
+// listening or nil if called on the daemon
+func (a *ApplicationDaemon) listenThreshold(entity string, trigger d.ThresholdTrigger,
+	channel chan d.ThresholdEvent, owner *appInstance) error {
+	if entity == "" || channel == nil {
+		return fmt.Errorf("threshold trigger needs both entity and channel")
+	}
+	if trigger.Below > trigger.Above {
+		return fmt.Errorf("threshold trigger of %s has below %v over above %v", entity, trigger.Below, trigger.Above)
+	}
+	t := &thresholdTrigger{
+		entity:  strings.ToLower(entity),
+		trigger: trigger,
+		channel: channel,
+		owner:   owner,
+		queue:   make(chan d.ThresholdEvent, thresholdQueueSize),
+		done:    make(chan struct{})}
+	// The current value sets the side so only real crossings are delivered
+	if a.hassClient != nil {
+		if current, ok := a.hassClient.GetEntity(entity); ok {
+			if value, ok := numericValue(current.New, trigger.Attribute); ok {
+				t.side = t.sideOf(value)
+			}
+		}
+	}
+	a.triggers.add(t)
+	go a.deliverThresholds(t)
+	return nil
+}
+
+// thresholdQueueSize is the crossings of a trigger that can wait to be
+// delivered before new are dropped
+const thresholdQueueSize = 100
+
+// handleThresholds updates the threshold triggers of entity and queues the
+// crossings. Called from the receive loop so the updates are handled in order
+func (a *ApplicationDaemon) handleThresholds(entity *client.HassEntity) {
+	for _, trigger := range a.triggers.lookup(entity.ID) {
+		if event, ok := trigger.update(*entity, a.queueThresholdEvent); ok {
+			a.queueThresholdEvent(trigger, event)
+		}
+	}
+}
+
+// queueThresholdEvent queues the crossing to be delivered by deliverThresholds
+// without blocking the receive loop
+func (a *ApplicationDaemon) queueThresholdEvent(trigger *thresholdTrigger, event d.ThresholdEvent) {
+	select {
+	case trigger.queue <- event:
+	default:
+		channelFullTimeouts.Inc("threshold")
+		log.Errorf("Too many threshold crossings waiting, dropping crossing of %s", event.Entity.ID)
+	}
+}
+
+// deliverThresholds sends the queued crossings of trigger in order until the
+// trigger is stopped. Each trigger has its own delivery so an application not
+// reading its channel does not delay the crossings of other applications
+func (a *ApplicationDaemon) deliverThresholds(trigger *thresholdTrigger) {
+	for {
+		select {
+		case event := <-trigger.queue:
+			a.sendThresholdEvent(trigger, event)
+		case <-trigger.done:
+			return
+		case <-a.cancelContext.Done():
+			return
+		}
+	}
+}
+
+// sendThresholdEvent delivers the crossing to the channel of the trigger
+func (a *ApplicationDaemon) sendThresholdEvent(trigger *thresholdTrigger, event d.ThresholdEvent) {
+	if trigger.isStopped() {
+		// The application has stopped while the crossing was queued
+		return
+	}
+	select {
+	case trigger.channel <- event:
+		trigger.owner.traceCause(traceEvent, "%s: crossed %s %v", event.Entity.ID, event.Crossing, event.Value)
+	case <-time.After(time.Second * time.Duration(defaultTimeoutForFullChannel)):
+		// This should never happen incase the app does not read the messages
+		channelFullTimeouts.Inc("threshold")
+		log.Errorf("Threshold channel full, please check receiver channel: %s", event.Entity.ID)
+	case <-trigger.done:
+		// The application stopped while waiting for the receiver
+	case <-a.cancelContext.Done():
+		// Exit cause of exit to os
+	}
+}
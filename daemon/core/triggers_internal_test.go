@@ -0,0 +1,171 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	h "github.com/helto4real/go-daemon/daemon/test"
+	"github.com/helto4real/go-hassclient/client"
+)
+
+func newTriggerTestDaemon(humidity string) *ApplicationDaemon {
+	daemon := NewApplicationDaemon()
+	daemon.hassClient = &stateHassClient{entities: map[string]*client.HassEntity{
+		"sensor.humidity": &client.HassEntity{ID: "sensor.humidity", New: client.HassEntityState{State: humidity}}}}
+	return daemon
+}
+
+func humidityChanged(daemon *ApplicationDaemon, humidity interface{}) {
+	daemon.handleThresholds(&client.HassEntity{ID: "sensor.humidity",
+		New: client.HassEntityState{State: fmt.Sprint(humidity)}})
+}
+
+// receivedThresholds returns the crossings sent on channel until no more
+// crossings are sent
+func receivedThresholds(channel chan d.ThresholdEvent) []d.Crossing {
+	crossings := []d.Crossing{}
+	for {
+		select {
+		case event := <-channel:
+			crossings = append(crossings, event.Crossing)
+		case <-time.After(20 * time.Millisecond):
+			return crossings
+		}
+	}
+}
+
+func TestListenThresholdHysteresis(t *testing.T) {
+	daemon := newTriggerTestDaemon("50")
+	channel := make(chan d.ThresholdEvent, 10)
+	h.Ok(t, daemon.ListenThreshold("sensor.humidity", d.ThresholdTrigger{Above: 70, Below: 60}, channel))
+
+	humidityChanged(daemon, 65)
+	humidityChanged(daemon, 55)
+	h.Equals(t, []d.Crossing{}, receivedThresholds(channel))
+
+	humidityChanged(daemon, 71)
+	humidityChanged(daemon, 75)
+	humidityChanged(daemon, 65)
+	humidityChanged(daemon, "unavailable")
+	h.Equals(t, []d.Crossing{d.CrossedAbove}, receivedThresholds(channel))
+
+	humidityChanged(daemon, 59.5)
+	event := <-channel
+	h.Equals(t, d.CrossedBelow, event.Crossing)
+	h.Equals(t, 59.5, event.Value)
+	h.Equals(t, "sensor.humidity", event.Entity.ID)
+}
+
+func TestListenThresholdCurrentValueSetsSide(t *testing.T) {
+	daemon := newTriggerTestDaemon("80")
+	channel := make(chan d.ThresholdEvent, 10)
+	h.Ok(t, daemon.ListenThreshold("sensor.humidity", d.ThresholdTrigger{Above: 70, Below: 60}, channel))
+
+	humidityChanged(daemon, 85)
+	h.Equals(t, []d.Crossing{}, receivedThresholds(channel))
+	humidityChanged(daemon, 50)
+	h.Equals(t, []d.Crossing{d.CrossedBelow}, receivedThresholds(channel))
+}
+
+func TestListenThresholdHoldTime(t *testing.T) {
+	daemon := newTriggerTestDaemon("50")
+	channel := make(chan d.ThresholdEvent, 10)
+	h.Ok(t, daemon.ListenThreshold("sensor.humidity",
+		d.ThresholdTrigger{Above: 70, Below: 70, For: 50 * time.Millisecond}, channel))
+
+	// Falling back before the hold time cancels the crossing
+	humidityChanged(daemon, 71)
+	humidityChanged(daemon, 69)
+	time.Sleep(100 * time.Millisecond)
+	h.Equals(t, []d.Crossing{}, receivedThresholds(channel))
+
+	humidityChanged(daemon, 71)
+	humidityChanged(daemon, 72)
+	select {
+	case event := <-channel:
+		h.Equals(t, d.CrossedAbove, event.Crossing)
+		h.Equals(t, 72.0, event.Value)
+	case <-time.After(time.Second):
+		t.Fatal("crossing not sent after hold time")
+	}
+}
+
+func TestListenThresholdAttribute(t *testing.T) {
+	daemon := newTriggerTestDaemon("50")
+	channel := make(chan d.ThresholdEvent, 10)
+	h.Ok(t, daemon.ListenThreshold("climate.heater",
+		d.ThresholdTrigger{Attribute: "current_temperature", Above: 21, Below: 21}, channel))
+
+	heaterChanged(daemon, 22)
+	h.Equals(t, []d.Crossing{d.CrossedAbove}, receivedThresholds(channel))
+	heaterChanged(daemon, 20)
+	h.Equals(t, []d.Crossing{d.CrossedBelow}, receivedThresholds(channel))
+}
+
+func TestListenThresholdOrder(t *testing.T) {
+	daemon := newTriggerTestDaemon("50")
+	channel := make(chan d.ThresholdEvent)
+	h.Ok(t, daemon.ListenThreshold("sensor.humidity", d.ThresholdTrigger{Above: 70, Below: 60}, channel))
+
+	// The updates are handled without waiting for the receiver
+	for i := 0; i < 3; i++ {
+		humidityChanged(daemon, 75)
+		humidityChanged(daemon, 50)
+	}
+	h.Equals(t, []d.Crossing{d.CrossedAbove, d.CrossedBelow, d.CrossedAbove, d.CrossedBelow,
+		d.CrossedAbove, d.CrossedBelow}, receivedThresholds(channel))
+}
+
+func TestListenThresholdInvalid(t *testing.T) {
+	daemon := newTriggerTestDaemon("50")
+	channel := make(chan d.ThresholdEvent, 10)
+	h.NotEquals(t, nil, daemon.ListenThreshold("sensor.humidity", d.ThresholdTrigger{Above: 60, Below: 70}, channel))
+	h.NotEquals(t, nil, daemon.ListenThreshold("sensor.humidity", d.ThresholdTrigger{}, nil))
+	h.NotEquals(t, nil, daemon.ListenThreshold("", d.ThresholdTrigger{}, channel))
+}
+
+func TestListenThresholdRemovedWhenAppStops(t *testing.T) {
+	daemon := newTriggerTestDaemon("50")
+	helper := newBusTestHelper(daemon, "humidity_app")
+	channel := make(chan d.ThresholdEvent, 10)
+	h.Ok(t, helper.ListenThreshold("sensor.humidity",
+		d.ThresholdTrigger{Above: 70, Below: 60, For: 50 * time.Millisecond}, channel))
+
+	humidityChanged(daemon, 75)
+	daemon.triggers.removeOwner(helper.instance)
+	time.Sleep(100 * time.Millisecond)
+	humidityChanged(daemon, 50)
+	h.Equals(t, []d.Crossing{}, receivedThresholds(channel))
+	h.Equals(t, 0, len(daemon.triggers.lookup("sensor.humidity")))
+}
+
+func TestListenThresholdSlowReceiverDoesNotDelayOthers(t *testing.T) {
+	daemon := newTriggerTestDaemon("50")
+	slow := make(chan d.ThresholdEvent)
+	h.Ok(t, newBusTestHelper(daemon, "slow_app").ListenThreshold("sensor.humidity",
+		d.ThresholdTrigger{Above: 70, Below: 60}, slow))
+	channel := make(chan d.ThresholdEvent, 10)
+	h.Ok(t, newBusTestHelper(daemon, "fan_app").ListenThreshold("sensor.humidity",
+		d.ThresholdTrigger{Above: 70, Below: 60}, channel))
+
+	// The slow app never reads its channel
+	humidityChanged(daemon, 75)
+	humidityChanged(daemon, 50)
+	h.Equals(t, []d.Crossing{d.CrossedAbove, d.CrossedBelow}, receivedThresholds(channel))
+}
+
+func TestListenThresholdNotSentAfterAppStops(t *testing.T) {
+	daemon := newTriggerTestDaemon("50")
+	helper := newBusTestHelper(daemon, "humidity_app")
+	channel := make(chan d.ThresholdEvent)
+	h.Ok(t, helper.ListenThreshold("sensor.humidity", d.ThresholdTrigger{Above: 70, Below: 60}, channel))
+
+	// Both crossings are queued while the app is not reading
+	humidityChanged(daemon, 75)
+	humidityChanged(daemon, 50)
+	time.Sleep(20 * time.Millisecond)
+	daemon.triggers.removeOwner(helper.instance)
+	h.Equals(t, []d.Crossing{}, receivedThresholds(channel))
+}
@@ -0,0 +1,485 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	"github.com/helto4real/go-daemon/daemon/config"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// maxTrackingTime is the max seconds allowed for the just arrived and just left times
+const maxTrackingTime = 86400
+
+// validationError is a problem found in a configuration file, Line is 0 if unknown
+type validationError struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (a validationError) String() string {
+	if a.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", a.File, a.Line, a.Message)
+	}
+	return fmt.Sprintf("%s: %s", a.File, a.Message)
+}
+
+// configFile is a configuration file split in lines to find line numbers of keys
+type configFile struct {
+	path  string
+	lines []string
+}
+
+func newConfigFile(path string, data []byte) *configFile {
+	return &configFile{path: path, lines: strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")}
+}
+
+// keyLine returns the first line at or after line from that defines key, 0 if not found
+func (a *configFile) keyLine(key string, from int) int {
+	for i := maxInt(from, 1); i <= len(a.lines); i++ {
+		text := strings.TrimSpace(a.lines[i-1])
+		text = strings.TrimSpace(strings.TrimPrefix(text, "-"))
+		for _, prefix := range []string{key + ":", "'" + key + "':", "\"" + key + "\":", "\"" + key + "\" :"} {
+			if strings.HasPrefix(text, prefix) {
+				return i
+			}
+		}
+	}
+	return 0
+}
+
+// valueLine returns the first line at or after line from that contains value, 0 if not found
+func (a *configFile) valueLine(value string, from int) int {
+	for i := maxInt(from, 1); i <= len(a.lines); i++ {
+		if strings.Contains(a.lines[i-1], value) {
+			return i
+		}
+	}
+	return 0
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// configValidator collects the errors found when validating the configuration
+type configValidator struct {
+	availableApps map[string]interface{}
+	secrets       config.Secrets
+	errors        []validationError
+	// instances is where each app instance is defined to find duplicates
+	instances map[string]string
+	// apps is all app instances in order to check the dependencies
+	apps []*appInstance
+	// dependsOnLines is the line of depends_on per instance
+	dependsOnLines map[*appInstance]validationError
+}
+
+func (a *configValidator) addError(file string, line int, format string, args ...interface{}) {
+	a.errors = append(a.errors, validationError{File: file, Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+var yamlLinePattern = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// addYamlError adds the errors from yaml parsing with line numbers if available
+func (a *configValidator) addYamlError(file string, err error) {
+	messages := []string{err.Error()}
+	if typeError, ok := err.(*yaml.TypeError); ok {
+		messages = typeError.Errors
+	}
+	for _, message := range messages {
+		if match := yamlLinePattern.FindStringSubmatch(message); match != nil {
+			line, _ := strconv.Atoi(match[1])
+			a.addError(file, line, "%s", match[2])
+		} else {
+			a.addError(file, 0, "%s", message)
+		}
+	}
+}
+
+// Validate validates the configuration in configPath without connecting to
+// Home Assistant. The errors are written to out. Returns the exit code to use,
+// 0 if the configuration is valid
+func Validate(configPath string, availableApps map[string]interface{}, out io.Writer) int {
+	validator := &configValidator{
+		availableApps:  availableApps,
+		instances:      map[string]string{},
+		dependsOnLines: map[*appInstance]validationError{}}
+
+	secretsPath := filepath.Join(configPath, "config", "secrets.yaml")
+	secrets, err := config.LoadSecrets(secretsPath)
+	if err != nil {
+		validator.addError(secretsPath, 0, "%v", err)
+	}
+	validator.secrets = secrets
+	validator.validateAvailableApps()
+
+	conf := validator.validateConfig(filepath.Join(configPath, "config", "go-daemon.yaml"))
+	if conf != nil && conf.HomeAssistant.IP == "hassio" {
+		validator.validateHassioOptions(optionsPath)
+	}
+
+	daemon := &ApplicationDaemon{configPath: configPath, availableApps: availableApps}
+	for _, file := range daemon.getAllApplicationConfigFilePaths() {
+		validator.validateAppConfig(file)
+	}
+	validator.validateDependencies()
+
+	for _, err := range validator.errors {
+		fmt.Fprintln(out, err)
+	}
+	if len(validator.errors) > 0 {
+		fmt.Fprintf(out, "Found %d error(s) in configuration\n", len(validator.errors))
+		return 1
+	}
+	fmt.Fprintln(out, "Configuration is valid")
+	return 0
+}
+
+// validateAvailableApps validates that the available apps can be created
+func (a *configValidator) validateAvailableApps() {
+	names := make([]string, 0, len(a.availableApps))
+	for name := range a.availableApps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := d.NewAppFactory(a.availableApps[name]); err != nil {
+			a.addError("available apps", 0, "app %s: %v", name, err)
+		}
+	}
+}
+
+// validateConfig validates the go-daemon.yaml file, returns nil if it could not be parsed
+func (a *configValidator) validateConfig(path string) *config.Config {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		a.addError(path, 0, "failed to read config file: %v", err)
+		return nil
+	}
+	file := newConfigFile(path, data)
+	if data, err = a.expand(file, data); err != nil {
+		return nil
+	}
+	conf := &config.Config{}
+	if err := yaml.UnmarshalStrict(data, conf); err != nil {
+		a.addYamlError(path, err)
+		if _, ok := err.(*yaml.TypeError); !ok {
+			return nil
+		}
+	}
+
+	if conf.HomeAssistant.IP == "" {
+		a.addError(path, file.keyLine("home_assistant", 1), "home_assistant ip is missing")
+	}
+	if conf.Settings != nil && conf.Settings.TrackingSettings != nil {
+		line := file.keyLine("tracking", file.keyLine("settings", 1))
+		tracking := conf.Settings.TrackingSettings
+		a.validateTrackingTime(file, line, "just_arrived_time", tracking.JustArrivedTime)
+		a.validateTrackingTime(file, line, "just_left_time", tracking.JustLeftTime)
+		zonesLine := file.keyLine("zones", line)
+		for _, id := range sortedZones(tracking.Zones) {
+			if err := config.EntityID(id).Validate(); err != nil || config.EntityID(id).Domain() != "zone" {
+				a.addError(path, file.keyLine(id, zonesLine), "zone %s has to be a zone entity id like zone.work", id)
+			}
+		}
+		if fusion := tracking.Fusion; fusion != nil && fusion.HomeThreshold != nil &&
+			(*fusion.HomeThreshold < 0 || *fusion.HomeThreshold > 1) {
+			a.addError(path, file.keyLine("home_threshold", file.keyLine("fusion", line)),
+				"home_threshold has to be between 0 and 1, got %v", *fusion.HomeThreshold)
+		}
+		if tracking.Units != "" && tracking.Units != "metric" && tracking.Units != "imperial" {
+			a.addError(path, file.keyLine("units", line), "units has to be metric or imperial, got %s", tracking.Units)
+		}
+		proximityLine := file.keyLine("proximity", line)
+		for _, proximity := range tracking.Proximity {
+			proximityLine = file.keyLine("name", proximityLine)
+			if proximity.Distance <= 0 {
+				a.addError(path, proximityLine, "proximity %s needs a distance over 0", proximity.Name)
+			}
+			switch proximity.Direction {
+			case "", "any", "towards", "away_from":
+			default:
+				a.addError(path, proximityLine, "proximity %s direction has to be towards, away_from or any, got %s",
+					proximity.Name, proximity.Direction)
+			}
+			proximityLine++
+		}
+		regionsLine := file.keyLine("regions", line)
+		for _, name := range sortedRegions(tracking.Regions) {
+			polygon := tracking.Regions[name].Polygon
+			valid := len(polygon) >= 3
+			for _, corner := range polygon {
+				valid = valid && len(corner) == 2
+			}
+			if !valid {
+				a.addError(path, file.keyLine(name, regionsLine),
+					"region %s polygon needs at least 3 corners of [latitude, longitude]", name)
+			}
+		}
+		if tracking.RegionsFile != "" {
+			regionsFile := config.NewConfiguration(path).RegionsPath(tracking.RegionsFile)
+			if _, err := config.LoadRegions(regionsFile); err != nil {
+				a.addError(path, file.keyLine("regions_file", line), "invalid regions_file: %v", err)
+			}
+		}
+	}
+
+	// People from person entities can have their devices in Home Assistant only
+	personEntities := conf.Settings != nil && conf.Settings.TrackingSettings != nil &&
+		conf.Settings.TrackingSettings.PersonEntities
+	peopleLine := file.keyLine("people", 1)
+	for _, id := range sortedPeople(conf.People) {
+		personLine := file.keyLine(id, peopleLine)
+		a.validatePerson(file, personLine, id, conf.People[id].Devices, !personEntities)
+	}
+	if conf.Settings != nil && conf.Settings.Household != nil && !personEntities {
+		groupsLine := file.keyLine("groups", file.keyLine("household", file.keyLine("settings", 1)))
+		groups := conf.Settings.Household.Groups
+		names := make([]string, 0, len(groups))
+		for name := range groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			groupLine := file.keyLine(name, groupsLine)
+			for _, person := range groups[name] {
+				if _, ok := conf.People[person]; !ok {
+					a.addError(path, file.valueLine(person, groupLine), "household group %s has unknown person %s", name, person)
+				}
+			}
+		}
+	}
+	a.validateDefaultApps(file, conf)
+	return conf
+}
+
+// validateDefaultApps validates default_apps and reserves the instance names of the enabled default apps
+func (a *configValidator) validateDefaultApps(file *configFile, conf *config.Config) {
+	defaultAppsLine := file.keyLine("default_apps", 1)
+	names := make([]string, 0, len(conf.DefaultApps))
+	for name := range conf.DefaultApps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := findDefaultApp(name); !ok {
+			a.addError(file.path, file.keyLine(name, defaultAppsLine), "%s is not a default app", name)
+		}
+	}
+
+	for _, app := range defaultApps {
+		if !defaultAppEnabled(app, conf) {
+			continue
+		}
+		line := file.keyLine(app.name, defaultAppsLine)
+		if section, ok := conf.DefaultApps[app.name]; ok && section != nil && section.Enabled != nil {
+			a.instances[app.name] = fmt.Sprintf("%s:%d, reserved for the default %s", file.path, line, app.title)
+		} else {
+			a.instances[app.name] = fmt.Sprintf("%s, reserved for the default %s", app.configuredBy, app.title)
+		}
+		instance := newAppInstance(app.name, file.path, defaultAppConfig(app, conf), nil)
+		a.apps = append(a.apps, instance)
+		if len(instance.config.DependsOn) > 0 {
+			a.dependsOnLines[instance] = validationError{File: file.path, Line: file.keyLine("depends_on", line)}
+		}
+		if configurable, ok := app.newApp().(d.ConfigurableApplication); ok {
+			if err := config.DecodeProperties(instance.config.RawProperties, configurable.Config()); err != nil {
+				a.addError(file.path, file.keyLine("properties", line), "default app %s: %v", app.name, err)
+			}
+		}
+	}
+}
+
+// validateHassioOptions validates the options.json used when running as hassio add-on
+func (a *configValidator) validateHassioOptions(path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		a.addError(path, 0, "failed to read hassio options: %v", err)
+		return
+	}
+	file := newConfigFile(path, data)
+	options := &config.HassioOptionsConfig{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(options); err != nil {
+		line := 0
+		switch e := err.(type) {
+		case *json.SyntaxError:
+			line = bytes.Count(data[:e.Offset], []byte("\n")) + 1
+		case *json.UnmarshalTypeError:
+			line = bytes.Count(data[:e.Offset], []byte("\n")) + 1
+		}
+		a.addError(path, line, "%v", err)
+		return
+	}
+
+	if options.Tracking != nil {
+		line := file.keyLine("tracking", 1)
+		a.validateTrackingTime(file, line, "just_arrived_time", options.Tracking.JustArrivedTime)
+		a.validateTrackingTime(file, line, "just_left_time", options.Tracking.JustLeftTime)
+	}
+
+	ids := map[string]bool{}
+	personLine := file.keyLine("persons", 1)
+	for _, person := range options.Persons {
+		if person.ID != "" {
+			personLine = file.valueLine(strconv.Quote(person.ID), personLine+1)
+		}
+		switch {
+		case person.ID == "":
+			a.addError(path, personLine, "person is missing id")
+		case ids[person.ID]:
+			a.addError(path, personLine, "duplicate person id %s", person.ID)
+		}
+		ids[person.ID] = true
+		a.validatePerson(file, personLine, person.ID, person.Devices, true)
+	}
+}
+
+// validateAppConfig validates an app yaml file
+func (a *configValidator) validateAppConfig(path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		a.addError(path, 0, "failed to read app config file: %v", err)
+		return
+	}
+	file := newConfigFile(path, data)
+	if data, err = a.expand(file, data); err != nil {
+		return
+	}
+	configs := map[string]d.DeamonAppConfig{}
+	if err := yaml.UnmarshalStrict(data, configs); err != nil {
+		a.addYamlError(path, err)
+		return
+	}
+
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return file.keyLine(names[i], 1) < file.keyLine(names[j], 1) })
+
+	for _, name := range names {
+		appConfig := configs[name]
+		line := file.keyLine(name, 1)
+		if existing, ok := a.instances[name]; ok {
+			a.addError(path, line, "duplicate app instance name %s, also defined in %s", name, existing)
+		} else {
+			a.instances[name] = fmt.Sprintf("%s:%d", path, line)
+			instance := newAppInstance(name, path, appConfig, nil)
+			a.apps = append(a.apps, instance)
+			if len(appConfig.DependsOn) > 0 {
+				a.dependsOnLines[instance] = validationError{File: path, Line: file.keyLine("depends_on", line)}
+			}
+		}
+
+		if appConfig.App == "" {
+			a.addError(path, line, "app instance %s is missing app", name)
+			continue
+		}
+		appLine := file.keyLine("app", line)
+		daemon := &ApplicationDaemon{availableApps: a.availableApps}
+		app, ok := daemon.NewDaemonApp(appConfig.App)
+		if !ok {
+			a.addError(path, appLine, "app {%s} of instance %s is not an available app", appConfig.App, name)
+			continue
+		}
+		if configurable, ok := app.(d.ConfigurableApplication); ok {
+			err := config.DecodeProperties(appConfig.RawProperties, configurable.Config())
+			if fieldError, ok := err.(*config.FieldError); ok {
+				key := strings.FieldsFunc(fieldError.Field, func(r rune) bool { return r == '.' || r == '[' })[0]
+				propertyLine := file.keyLine(key, file.keyLine("properties", line))
+				if propertyLine == 0 {
+					propertyLine = line
+				}
+				a.addError(path, propertyLine, "%v", err)
+			} else if err != nil {
+				a.addError(path, line, "%v", err)
+			}
+		}
+	}
+}
+
+// validateDependencies reports missing dependencies and dependency cycles
+func (a *configValidator) validateDependencies() {
+	_, failed := orderApplications(a.apps)
+	for _, instance := range a.apps {
+		if reason, ok := failed[instance]; ok {
+			location := a.dependsOnLines[instance]
+			a.addError(location.File, location.Line, "app instance %s can not be started, %s", instance.name, reason)
+		}
+	}
+}
+
+// expand replaces secrets and environment variables, errors are reported
+// at the line of the first secret or variable that is missing
+func (a *configValidator) expand(file *configFile, data []byte) ([]byte, error) {
+	data, err := config.Expand(data, a.secrets)
+	if err != nil {
+		line := 0
+		if expandError, ok := err.(*config.ExpandError); ok {
+			line = file.valueLine(expandError.Reference, 1)
+		}
+		a.addError(file.path, line, "%v", err)
+	}
+	return data, err
+}
+
+func (a *configValidator) validateTrackingTime(file *configFile, from int, key string, value int) {
+	if value < 0 || value > maxTrackingTime {
+		a.addError(file.path, file.keyLine(key, from), "%s has to be between 0 and %d seconds, got %d",
+			key, maxTrackingTime, value)
+	}
+}
+
+func (a *configValidator) validatePerson(file *configFile, from int, id string, devices []string, needsDevices bool) {
+	if len(devices) == 0 && needsDevices {
+		a.addError(file.path, from, "person %s has no devices", id)
+	}
+	for _, device := range devices {
+		if err := config.EntityID(device).Validate(); err != nil {
+			a.addError(file.path, file.valueLine(device, from), "device of person %s: %v", id, err)
+		}
+	}
+}
+
+func sortedZones(zones map[string]*config.ZoneConfig) []string {
+	ids := make([]string, 0, len(zones))
+	for id := range zones {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func sortedRegions(regions map[string]*config.RegionConfig) []string {
+	names := make([]string, 0, len(regions))
+	for name := range regions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedPeople(people map[string]*config.PeopleConfig) []string {
+	ids := make([]string, 0, len(people))
+	for id := range people {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
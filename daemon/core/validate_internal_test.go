@@ -0,0 +1,80 @@
+package core
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	h "github.com/helto4real/go-daemon/daemon/test"
+)
+
+var validateTestApps = map[string]interface{}{
+	"testapp":   testapp{},
+	"configapp": configtestapp{}}
+
+func TestValidateOk(t *testing.T) {
+	out := &bytes.Buffer{}
+	h.Equals(t, 0, Validate("testdata/validate/ok", validateTestApps, out))
+	h.Equals(t, "Configuration is valid\n", out.String())
+}
+
+func TestValidateReportsInvalidAvailableApps(t *testing.T) {
+	out := &bytes.Buffer{}
+	apps := map[string]interface{}{"testapp": testapp{}, "notanapp": struct{}{}}
+	h.Equals(t, 1, Validate("testdata/validate/ok", apps, out))
+	h.Equals(t, "available apps: app notanapp: *struct {} does not implement DaemonApplication, "+
+		"it needs Initialize(DaemonAppHelper, DeamonAppConfig) bool and Cancel()\n"+
+		"Found 1 error(s) in configuration\n", out.String())
+}
+
+func TestValidateReportsErrorsWithLines(t *testing.T) {
+	out := &bytes.Buffer{}
+	h.Equals(t, 1, Validate("testdata/validate/errors", validateTestApps, out))
+
+	configFile := filepath.Join("testdata/validate/errors", "config", "go-daemon.yaml")
+	appFile := filepath.Join("testdata/validate/errors", "app", "app.yaml")
+	folderFile := filepath.Join("testdata/validate/errors", "app", "folder", "myapp.yaml")
+	expected := []string{
+		configFile + ":3: field tokn not found in type config.HomeAssistantConfig",
+		configFile + ":7: just_arrived_time has to be between 0 and 86400 seconds, got -1",
+		configFile + ":12: zone light.school has to be a zone entity id like zone.work",
+		configFile + ":14: home_threshold has to be between 0 and 1, got 2",
+		configFile + ":15: units has to be metric or imperial, got metres",
+		configFile + ":17: proximity near_home needs a distance over 0",
+		configFile + ":17: proximity near_home direction has to be towards, away_from or any, got closer",
+		configFile + ":21: region park polygon needs at least 3 corners of [latitude, longitude]",
+		configFile + ":19: invalid regions_file: open " + filepath.Join("testdata/validate/errors", "config", "missing.geojson") +
+			": no such file or directory",
+		configFile + `:32: device of person thomas: invalid entity id "thomas_phone_gps", expected format domain.object_id`,
+		configFile + ":25: household group adults has unknown person anna",
+		configFile + ":35: lights_app is not a default app",
+		configFile + `:39: default app rules_app: property "rules": cannot use all (string) as []defaultapps.Rule`,
+		appFile + ":7: app {testap} of instance misspelled_instance is not an available app",
+		appFile + ":9: duplicate app instance name people_app, also defined in people config, reserved for the default people app",
+		folderFile + ":1: duplicate app instance name testapp_instance, also defined in " + appFile + ":1",
+		folderFile + `:8: property "lights[1]": invalid entity id "not valid", expected format domain.object_id`,
+		"Found 17 error(s) in configuration",
+	}
+	h.Equals(t, strings.Join(expected, "\n")+"\n", out.String())
+}
+
+func TestValidateHassioOptions(t *testing.T) {
+	oldOptionsPath := optionsPath
+	defer func() { optionsPath = oldOptionsPath }()
+	optionsPath = "testdata/options/options-invalid.json"
+
+	out := &bytes.Buffer{}
+	h.Equals(t, 1, Validate("testdata/validate/hassio", validateTestApps, out))
+	expected := []string{
+		optionsPath + ":5: just_left_time has to be between 0 and 86400 seconds, got 100000",
+		optionsPath + ":16: duplicate person id thomas",
+		optionsPath + `:19: device of person thomas: invalid entity id "device_tracker.Dawn", expected format domain.object_id`,
+		"Found 3 error(s) in configuration",
+	}
+	h.Equals(t, strings.Join(expected, "\n")+"\n", out.String())
+
+	optionsPath = "testdata/options/options.json"
+	out.Reset()
+	h.Equals(t, 0, Validate("testdata/validate/hassio", validateTestApps, out))
+}
@@ -0,0 +1,125 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	"github.com/helto4real/go-hassclient/client"
+)
+
+// WaitForState blocks until the state of entity matches predicate
+func (a *ApplicationDaemon) WaitForState(ctx context.Context, entity string,
+	predicate func(entity client.HassEntity) bool, timeout time.Duration) (client.HassEntity, error) {
+	return a.waitForState(ctx, entity, predicate, timeout, nil)
+}
+
+// waitForState listens to entity until predicate matches, owner is the
+// application instance waiting or nil if called on the daemon
+func (a *ApplicationDaemon) waitForState(ctx context.Context, entity string,
+	predicate func(entity client.HassEntity) bool, timeout time.Duration, owner *appInstance) (client.HassEntity, error) {
+	if predicate == nil {
+		return client.HassEntity{}, fmt.Errorf("wait for state of %s needs a predicate", entity)
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	// Only the latest change is kept, see sendWaiter
+	stateChannel := make(chan client.HassEntity, 1)
+	a.addStateListener(entity, stateChannel, owner)
+	defer a.removeStateListener(entity, stateChannel, owner)
+
+	// Check the current state after listening so no change is missed
+	if a.hassClient != nil {
+		if current, ok := a.hassClient.GetEntity(strings.ToLower(entity)); ok && predicate(*current) {
+			return *current, nil
+		}
+	}
+
+	var timeoutChannel <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutChannel = timer.C
+	}
+	var daemonDone <-chan struct{}
+	if a.cancelContext != nil {
+		daemonDone = a.cancelContext.Done()
+	}
+
+	for {
+		select {
+		case changed := <-stateChannel:
+			if predicate(changed) {
+				return changed, nil
+			}
+		case <-timeoutChannel:
+			return client.HassEntity{}, d.ErrWaitTimeout
+		case <-ctx.Done():
+			return client.HassEntity{}, ctx.Err()
+		case <-daemonDone:
+			return client.HassEntity{}, a.cancelContext.Err()
+		}
+	}
+}
+
+// addStateListener registers the waiting channel for entity and the owner of the channel
+func (a *ApplicationDaemon) addStateListener(entity string, stateChannel chan client.HassEntity, owner *appInstance) {
+	a.listenState(entity, stateChannel)
+	a.listenerMutex.Lock()
+	defer a.listenerMutex.Unlock()
+	if a.waitChannels == nil {
+		a.waitChannels = make(map[chan client.HassEntity]bool)
+	}
+	a.waitChannels[stateChannel] = true
+	if owner == nil {
+		return
+	}
+	entityLower := strings.ToLower(entity)
+	owner.stateSubscriptions[entityLower] = append(owner.stateSubscriptions[entityLower], stateChannel)
+	if a.stateChannelOwners == nil {
+		a.stateChannelOwners = make(map[chan client.HassEntity]*appInstance)
+	}
+	a.stateChannelOwners[stateChannel] = owner
+}
+
+// sendWaiter sends the change to the channel of a waiter without blocking,
+// a change the waiter has not read yet is replaced by the latest change
+func sendWaiter(stateChannel chan client.HassEntity, entity client.HassEntity) {
+	for {
+		select {
+		case stateChannel <- entity:
+			return
+		default:
+		}
+		select {
+		case <-stateChannel:
+		default:
+		}
+	}
+}
+
+// removeStateListener removes the channel registered with addStateListener
+func (a *ApplicationDaemon) removeStateListener(entity string, stateChannel chan client.HassEntity, owner *appInstance) {
+	a.listenerMutex.Lock()
+	defer a.listenerMutex.Unlock()
+	entityLower := strings.ToLower(entity)
+	a.stateListeners[entityLower] = removeStateChannel(a.stateListeners[entityLower], stateChannel)
+	if len(a.stateListeners[entityLower]) == 0 {
+		delete(a.stateListeners, entityLower)
+	}
+	delete(a.waitChannels, stateChannel)
+	if owner != nil {
+		owner.stateSubscriptions[entityLower] = removeStateChannel(owner.stateSubscriptions[entityLower], stateChannel)
+		if len(owner.stateSubscriptions[entityLower]) == 0 {
+			delete(owner.stateSubscriptions, entityLower)
+		}
+	}
+	// The channel can be used for other entities by the same owner
+	if owner == nil || !owner.hasStateChannel(stateChannel) {
+		delete(a.stateChannelOwners, stateChannel)
+	}
+}
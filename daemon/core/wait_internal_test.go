@@ -0,0 +1,164 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	h "github.com/helto4real/go-daemon/daemon/test"
+	"github.com/helto4real/go-hassclient/client"
+)
+
+// stateHassClient is a fake client that returns current states of entities
+type stateHassClient struct {
+	fakeHassClient
+	entities map[string]*client.HassEntity
+}
+
+func (a *stateHassClient) GetEntity(entity string) (*client.HassEntity, bool) {
+	e, ok := a.entities[entity]
+	return e, ok
+}
+
+func newWaitTestDaemon() *ApplicationDaemon {
+	daemon := NewApplicationDaemon()
+	daemon.hassClient = &stateHassClient{entities: map[string]*client.HassEntity{
+		"climate.heater": &client.HassEntity{ID: "climate.heater",
+			New: client.HassEntityState{State: "heat", Attributes: map[string]interface{}{"current_temperature": 18.0}}}}}
+	return daemon
+}
+
+func temperatureAtLeast(temperature float64) func(client.HassEntity) bool {
+	return func(entity client.HassEntity) bool {
+		current, ok := entity.New.Attributes["current_temperature"].(float64)
+		return ok && current >= temperature
+	}
+}
+
+// heaterChanged handles the update like the receive loop
+func heaterChanged(daemon *ApplicationDaemon, temperature float64) {
+	entity := &client.HassEntity{ID: "climate.heater",
+		New: client.HassEntityState{State: "heat", Attributes: map[string]interface{}{"current_temperature": temperature}}}
+	daemon.handleThresholds(entity)
+	daemon.handleEntity(entity)
+}
+
+// waitForListeners waits until count listeners are registered on entity
+func waitForListeners(daemon *ApplicationDaemon, entity string, count int) {
+	for {
+		daemon.listenerMutex.RLock()
+		registered := len(daemon.stateListeners[entity])
+		daemon.listenerMutex.RUnlock()
+		if registered >= count {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWaitForStateCurrentStateMatches(t *testing.T) {
+	daemon := newWaitTestDaemon()
+	entity, err := daemon.WaitForState(context.Background(), "climate.heater", temperatureAtLeast(18), time.Second)
+	h.Ok(t, err)
+	h.Equals(t, "climate.heater", entity.ID)
+	h.Equals(t, 0, len(daemon.stateListeners["climate.heater"]))
+
+	_, err = daemon.WaitForState(context.Background(), "Climate.Heater", temperatureAtLeast(18), time.Millisecond)
+	h.Ok(t, err)
+}
+
+func TestWaitForStateDoesNotBlock(t *testing.T) {
+	daemon := newWaitTestDaemon()
+	stateChannel := make(chan client.HassEntity, 1)
+	daemon.addStateListener("climate.heater", stateChannel, nil)
+
+	// Changes are sent without waiting for the waiter to read them
+	start := time.Now()
+	for temperature := 0; temperature < 20; temperature++ {
+		heaterChanged(daemon, float64(temperature))
+	}
+	h.Assert(t, time.Since(start) < time.Second, "expected changes to not block, took %v", time.Since(start))
+	h.Equals(t, 19.0, (<-stateChannel).New.Attributes["current_temperature"])
+
+	daemon.removeStateListener("climate.heater", stateChannel, nil)
+	h.Equals(t, 0, len(daemon.waitChannels))
+}
+
+func TestWaitForStatePlatformDoesNotBlock(t *testing.T) {
+	daemon := newWaitTestDaemon()
+	stateChannel := make(chan client.HassEntity, 1)
+	daemon.addStateListener("climate", stateChannel, nil)
+
+	// Waiters on the platform get the changes without blocking too
+	start := time.Now()
+	for temperature := 0; temperature < 20; temperature++ {
+		heaterChanged(daemon, float64(temperature))
+	}
+	h.Assert(t, time.Since(start) < time.Second, "expected changes to not block, took %v", time.Since(start))
+	h.Equals(t, 19.0, (<-stateChannel).New.Attributes["current_temperature"])
+
+	go func() {
+		waitForListeners(daemon, "climate", 2)
+		heaterChanged(daemon, 21)
+	}()
+	entity, err := daemon.WaitForState(context.Background(), "climate", temperatureAtLeast(21), time.Second)
+	h.Ok(t, err)
+	h.Equals(t, 21.0, entity.New.Attributes["current_temperature"])
+}
+
+func TestWaitForStateChange(t *testing.T) {
+	daemon := newWaitTestDaemon()
+	go func() {
+		waitForListeners(daemon, "climate.heater", 1)
+		heaterChanged(daemon, 19)
+		heaterChanged(daemon, 21)
+	}()
+
+	entity, err := daemon.WaitForState(context.Background(), "climate.heater", temperatureAtLeast(21), time.Second)
+	h.Ok(t, err)
+	h.Equals(t, 21.0, entity.New.Attributes["current_temperature"])
+	h.Equals(t, 0, len(daemon.stateListeners["climate.heater"]))
+}
+
+func TestWaitForStateTimeoutAndCancel(t *testing.T) {
+	daemon := newWaitTestDaemon()
+	helper := newBusTestHelper(daemon, "heater_app")
+
+	_, err := helper.WaitForState(context.Background(), "climate.heater", temperatureAtLeast(21), 10*time.Millisecond)
+	h.Equals(t, d.ErrWaitTimeout, err)
+	h.Equals(t, 0, len(helper.instance.stateSubscriptions))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		waitForListeners(daemon, "climate.heater", 1)
+		cancel()
+	}()
+	_, err = helper.WaitForState(ctx, "climate.heater", temperatureAtLeast(21), 0)
+	h.Equals(t, context.Canceled, err)
+	h.Equals(t, 0, len(daemon.stateListeners["climate.heater"]))
+}
+
+func TestWaitForStateConcurrent(t *testing.T) {
+	daemon := newWaitTestDaemon()
+	const waiters = 20
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, waiters)
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := daemon.WaitForState(context.Background(), "climate.heater", temperatureAtLeast(21), 5*time.Second)
+			errs <- err
+		}()
+	}
+	waitForListeners(daemon, "climate.heater", waiters)
+	heaterChanged(daemon, 21)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		h.Ok(t, err)
+	}
+}
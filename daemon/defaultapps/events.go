@@ -0,0 +1,84 @@
+package defaultapps
+
+import (
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// eventQueueSize is the events that can wait to be sent before new are dropped
+const eventQueueSize = 100
+
+// peopleEvent is an event of the people app waiting to be sent
+type peopleEvent struct {
+	topic     string
+	eventType string
+	event     interface{}
+}
+
+// sendEvent queues event to be published on topic to other apps and fired as
+// eventType in Home Assistant. The events are sent from sendEvents so the
+// people loop never waits on subscribers or Home Assistant
+func (a *PeopleApp) sendEvent(topic string, eventType string, event interface{}) {
+	select {
+	case a.eventChannel <- peopleEvent{topic: topic, eventType: eventType, event: event}:
+	default:
+		log.Errorf("Too many events waiting to be sent, dropping %s event", eventType)
+	}
+}
+
+// sendEvents sends the queued events in order until the app is canceled
+func (a *PeopleApp) sendEvents() {
+	for {
+		select {
+		case e := <-a.eventChannel:
+			if err := a.deamon.Publish(e.topic, e.event); err != nil {
+				log.Errorf("Failed to publish %s event: %v", e.topic, err)
+			}
+			if err := a.deamon.FireEvent(e.eventType, eventData(e.event)); err != nil {
+				log.Errorf("Failed to fire %s event: %v", e.eventType, err)
+			}
+		case <-a.cancelContext.Done():
+			return
+		}
+	}
+}
+
+// eventData returns the fields of the event struct as Home Assistant event
+// data, FriendlyName becomes friendly_name and times are RFC3339 strings
+func eventData(event interface{}) map[string]interface{} {
+	value := reflect.ValueOf(event)
+	data := make(map[string]interface{}, value.NumField())
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		var item interface{}
+		switch v := field.Interface().(type) {
+		case time.Time:
+			item = v.Format(time.RFC3339)
+		default:
+			if field.Kind() == reflect.String {
+				item = field.String()
+			} else {
+				item = v
+			}
+		}
+		data[snakeCase(value.Type().Field(i).Name)] = item
+	}
+	return data
+}
+
+// snakeCase returns the field name like FromZone as from_zone
+func snakeCase(name string) string {
+	var result strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				result.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		result.WriteRune(r)
+	}
+	return result.String()
+}
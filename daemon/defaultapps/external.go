@@ -0,0 +1,657 @@
+package defaultapps
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	"github.com/helto4real/go-hassclient/client"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultRestartDelay is the time to wait before the command is started again
+	defaultRestartDelay = 5 * time.Second
+	// externalStopTimeout is the time the process has to exit before it is killed
+	externalStopTimeout = 5 * time.Second
+	// externalWriteTimeout is the time to send to a process before it is disconnected
+	externalWriteTimeout = 5 * time.Second
+)
+
+// defaultSocketFolder is the private folder of the sockets, relative to the
+// folder the daemon runs in
+var defaultSocketFolder = filepath.Join("config", "run")
+
+// JSON-RPC 2.0 error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcServerError    = -32000
+)
+
+// ExternalConfig is the configuration of an app running in its own process
+type ExternalConfig struct {
+	// Socket is the unix socket the process connects to, default is
+	// <instance>.sock in the config/run folder
+	Socket string `yaml:"socket"`
+	// Command is started and restarted when it exits, if empty the process
+	// is started some other way and connects to the socket by itself
+	Command      string        `yaml:"command"`
+	Args         []string      `yaml:"args"`
+	RestartDelay time.Duration `yaml:"restart_delay"`
+	// Config is returned to the process from get_config
+	Config map[string]interface{} `yaml:"config"`
+}
+
+// ExternalApp lets an app in another process use the daemon through JSON-RPC 2.0
+// over a unix socket, one request or notification per line. The methods mirror
+// DaemonAppHelper so the app can be developed and restarted without rebuilding
+// the daemon
+type ExternalApp struct {
+	daemon        d.DaemonAppHelper
+	config        ExternalConfig
+	name          string
+	log           *logrus.Entry
+	cancel        context.CancelFunc
+	cancelContext context.Context
+	listener      net.Listener
+
+	stateChannel       chan client.HassEntity
+	callServiceChannel chan client.HassCallServiceEvent
+	eventChannel       chan d.HassEvent
+
+	mutex   sync.Mutex
+	clients map[*externalClient]bool
+	// listening is the entities, services and events the app listens to for
+	// all clients, they are unlistened when the last subscribed client disconnects
+	listening map[string]bool
+	running   sync.WaitGroup
+}
+
+// externalClient is a process connected to the socket
+type externalClient struct {
+	conn       net.Conn
+	writeMutex sync.Mutex
+	encoder    *json.Encoder
+	// states, services and events are the subscriptions of the process
+	states   map[string]bool
+	services map[string]bool
+	events   map[string]bool
+	// listenKeys are the keys in listening of the subscriptions
+	listenKeys map[string]bool
+}
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResult struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result"`
+}
+
+type rpcErrorResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   *rpcError       `json:"error"`
+}
+
+type rpcNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// externalState is the state of an entity like in the Home Assistant API
+type externalState struct {
+	EntityID    string                 `json:"entity_id"`
+	State       string                 `json:"state"`
+	Attributes  map[string]interface{} `json:"attributes"`
+	LastChanged time.Time              `json:"last_changed"`
+	LastUpdated time.Time              `json:"last_updated"`
+}
+
+type externalParams struct {
+	EntityID   string                 `json:"entity_id"`
+	Domain     string                 `json:"domain"`
+	Service    string                 `json:"service"`
+	EventType  string                 `json:"event_type"`
+	State      string                 `json:"state"`
+	Attributes map[string]interface{} `json:"attributes"`
+	Data       map[string]interface{} `json:"data"`
+	Level      string                 `json:"level"`
+	Message    string                 `json:"message"`
+}
+
+func init() {
+	// External apps are configured as "app: external" in the app yaml
+	d.Register("external", func() d.DaemonApplication { return &ExternalApp{} })
+}
+
+// Config returns the configuration the properties are decoded into
+func (a *ExternalApp) Config() interface{} {
+	return &a.config
+}
+
+// Initialize listens on the socket and starts the command if configured
+func (a *ExternalApp) Initialize(helper d.DaemonAppHelper, config d.DeamonAppConfig) bool {
+	a.daemon = helper
+	a.log = helper.GetLogger()
+	a.name = config.Name
+	if a.config.Socket == "" {
+		socket, err := filepath.Abs(filepath.Join(defaultSocketFolder, a.name+".sock"))
+		if err != nil {
+			a.log.Errorf("Failed to find the socket folder: %v", err)
+			return false
+		}
+		a.config.Socket = socket
+	}
+	if a.config.RestartDelay <= 0 {
+		a.config.RestartDelay = defaultRestartDelay
+	}
+
+	listener, err := listenUnix(a.config.Socket)
+	if err != nil {
+		a.log.Errorf("Failed to listen on %s: %v", a.config.Socket, err)
+		return false
+	}
+	a.listener = listener
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+	a.cancelContext = ctx
+	a.clients = map[*externalClient]bool{}
+	a.listening = map[string]bool{}
+	a.stateChannel = make(chan client.HassEntity, 10)
+	a.callServiceChannel = make(chan client.HassCallServiceEvent, 10)
+	a.eventChannel = make(chan d.HassEvent, 10)
+
+	a.running.Add(2)
+	go a.acceptLoop()
+	go a.loop()
+	if a.config.Command != "" {
+		a.running.Add(1)
+		go a.commandLoop()
+	}
+	a.log.Infof("External app listening on %s", a.config.Socket)
+	return true
+}
+
+// Cancel disconnects the processes and stops the command
+func (a *ExternalApp) Cancel() {
+	if a.cancel == nil {
+		return
+	}
+	a.cancel()
+	a.listener.Close()
+	a.mutex.Lock()
+	for client := range a.clients {
+		client.conn.Close()
+	}
+	a.mutex.Unlock()
+	a.running.Wait()
+	// The listener removes the socket it was created as, not the renamed one
+	os.Remove(a.config.Socket)
+}
+
+// listenUnix listens on the socket, an old socket file is removed first. The
+// socket is created in a private folder and moved in place when only the
+// user running the daemon can connect to it
+func listenUnix(socket string) (net.Listener, error) {
+	if info, err := os.Stat(socket); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socket)
+		}
+		if err := os.Remove(socket); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		return nil, err
+	}
+	private, err := ioutil.TempDir(filepath.Dir(socket), ".go-daemon-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(private)
+	created := filepath.Join(private, "s")
+	listener, err := net.Listen("unix", created)
+	if err != nil {
+		return nil, err
+	}
+	// Only the user running the daemon can connect
+	if err := os.Chmod(created, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(created, socket); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (a *ExternalApp) acceptLoop() {
+	defer a.running.Done()
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			if a.cancelContext.Err() == nil {
+				a.log.Errorf("Failed to accept connection: %v", err)
+			}
+			return
+		}
+		a.running.Add(1)
+		go a.serve(conn)
+	}
+}
+
+// serve handles the requests of a connected process until it disconnects
+func (a *ExternalApp) serve(conn net.Conn) {
+	defer a.running.Done()
+	defer conn.Close()
+	defer func() {
+		// One bad process must not stop the daemon
+		if r := recover(); r != nil {
+			a.log.Errorf("External process disconnected, handling its request panicked: %v", r)
+		}
+	}()
+	c := &externalClient{
+		conn:       conn,
+		encoder:    json.NewEncoder(conn),
+		states:     map[string]bool{},
+		services:   map[string]bool{},
+		events:     map[string]bool{},
+		listenKeys: map[string]bool{}}
+	a.mutex.Lock()
+	if a.cancelContext.Err() != nil {
+		a.mutex.Unlock()
+		return
+	}
+	a.clients[c] = true
+	a.mutex.Unlock()
+	defer a.disconnect(c)
+	a.log.Info("External process connected")
+
+	decoder := json.NewDecoder(conn)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if _, ok := err.(*json.SyntaxError); ok {
+				// The stream can not be read after invalid json
+				c.send(rpcErrorResponse{JSONRPC: "2.0", Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+			}
+			if err != io.EOF && a.cancelContext.Err() == nil {
+				a.log.Infof("External process disconnected: %v", err)
+			} else {
+				a.log.Info("External process disconnected")
+			}
+			return
+		}
+		request := rpcRequest{}
+		if err := json.Unmarshal(raw, &request); err != nil || request.JSONRPC != "2.0" || request.Method == "" {
+			c.send(rpcErrorResponse{JSONRPC: "2.0", ID: request.ID,
+				Error: &rpcError{Code: rpcInvalidRequest, Message: "invalid request, expected a JSON-RPC 2.0 request object"}})
+			continue
+		}
+		result, err := a.safeHandleRequest(c, request.Method, request.Params)
+		if len(request.ID) == 0 {
+			// Notifications have no response
+			if err != nil {
+				a.log.Errorf("Failed notification %s: %v", request.Method, err)
+			}
+			continue
+		}
+		if err != nil {
+			rpcErr, ok := err.(*rpcError)
+			if !ok {
+				rpcErr = &rpcError{Code: rpcServerError, Message: err.Error()}
+			}
+			c.send(rpcErrorResponse{JSONRPC: "2.0", ID: request.ID, Error: rpcErr})
+			continue
+		}
+		c.send(rpcResult{JSONRPC: "2.0", ID: request.ID, Result: result})
+	}
+}
+
+// send writes a message to the process, the process is disconnected if it
+// does not read its messages
+func (c *externalClient) send(message interface{}) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(externalWriteTimeout))
+	if err := c.encoder.Encode(message); err != nil {
+		c.conn.Close()
+	}
+}
+
+// safeHandleRequest handles the request, a panic is returned as error
+func (a *ExternalApp) safeHandleRequest(c *externalClient, method string,
+	rawParams json.RawMessage) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, fmt.Errorf("method %s panicked: %v", method, r)
+		}
+	}()
+	return a.handleRequest(c, method, rawParams)
+}
+
+// handleRequest calls the DaemonAppHelper function of the method
+func (a *ExternalApp) handleRequest(c *externalClient, method string, rawParams json.RawMessage) (interface{}, error) {
+	params := externalParams{}
+	if len(rawParams) > 0 && string(rawParams) != "null" {
+		if err := json.Unmarshal(rawParams, &params); err != nil {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("invalid params: %v", err)}
+		}
+	}
+	required := func(names ...string) error {
+		values := map[string]string{"entity_id": params.EntityID, "domain": params.Domain,
+			"service": params.Service, "event_type": params.EventType}
+		for _, name := range names {
+			if values[name] == "" {
+				return &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("invalid params: %s is required", name)}
+			}
+		}
+		return nil
+	}
+
+	switch method {
+	case "get_entity":
+		if err := required("entity_id"); err != nil {
+			return nil, err
+		}
+		entity, ok := a.daemon.GetEntity(params.EntityID)
+		if !ok || entity == nil {
+			return nil, nil
+		}
+		return newExternalState(entity.ID, entity.New), nil
+	case "get_entities":
+		if err := required("domain"); err != nil {
+			return nil, err
+		}
+		entities, err := a.daemon.GetEntities(params.Domain)
+		if err != nil {
+			return nil, err
+		}
+		states := []externalState{}
+		for _, entity := range entities {
+			states = append(states, newExternalState(entity.ID, entity.New))
+		}
+		return states, nil
+	case "set_entity":
+		if err := required("entity_id"); err != nil {
+			return nil, err
+		}
+		if params.Attributes == nil {
+			params.Attributes = map[string]interface{}{}
+		}
+		return a.daemon.SetEntity(client.NewHassEntity(params.EntityID, params.EntityID, client.HassEntityState{},
+			client.HassEntityState{State: params.State, Attributes: params.Attributes})), nil
+	case "call_service":
+		if err := required("domain", "service"); err != nil {
+			return nil, err
+		}
+		return nil, a.daemon.CallService(params.Domain, params.Service, params.Data)
+	case "fire_event":
+		if err := required("event_type"); err != nil {
+			return nil, err
+		}
+		return nil, a.daemon.FireEvent(params.EventType, params.Data)
+	case "turn_on", "turn_off", "toggle":
+		if err := required("entity_id"); err != nil {
+			return nil, err
+		}
+		switch method {
+		case "turn_on":
+			a.daemon.TurnOn(params.EntityID)
+		case "turn_off":
+			a.daemon.TurnOff(params.EntityID)
+		default:
+			a.daemon.Toggle(params.EntityID)
+		}
+		return nil, nil
+	case "listen_state":
+		if err := required("entity_id"); err != nil {
+			return nil, err
+		}
+		entity := strings.ToLower(params.EntityID)
+		if a.subscribe(c, c.states, entity, "state:"+entity) {
+			a.daemon.ListenState(params.EntityID, a.stateChannel)
+		}
+		return nil, nil
+	case "listen_call_service":
+		if err := required("domain", "service"); err != nil {
+			return nil, err
+		}
+		service := params.Domain + "." + params.Service
+		if a.subscribe(c, c.services, service, "call_service:"+service) {
+			a.daemon.ListenCallServiceEvent(params.Domain, params.Service, a.callServiceChannel)
+		}
+		return nil, nil
+	case "listen_event":
+		if err := required("event_type"); err != nil {
+			return nil, err
+		}
+		if a.subscribe(c, c.events, params.EventType, "event:"+params.EventType) {
+			a.daemon.ListenEvent(params.EventType, a.eventChannel)
+		}
+		return nil, nil
+	case "get_location":
+		location := a.daemon.GetLocation()
+		return map[string]float64{
+			"latitude":  location.Latitude,
+			"longitude": location.Longitude,
+			"elevation": location.Elevation}, nil
+	case "get_config":
+		config := a.config.Config
+		if config == nil {
+			config = map[string]interface{}{}
+		}
+		return map[string]interface{}{"name": a.name, "config": config}, nil
+	case "log":
+		level, err := logrus.ParseLevel(params.Level)
+		if params.Level == "" {
+			level, err = logrus.InfoLevel, nil
+		}
+		if err != nil {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("invalid params: %v", err)}
+		}
+		// Panic and fatal levels would stop the daemon
+		if level < logrus.ErrorLevel {
+			return nil, &rpcError{Code: rpcInvalidParams,
+				Message: fmt.Sprintf("invalid params: level has to be trace, debug, info, warning or error, got %s", params.Level)}
+		}
+		a.log.Log(level, params.Message)
+		return nil, nil
+	}
+	return nil, &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("method %s not found", method)}
+}
+
+// subscribe adds the subscription of the client, returns true if the app
+// is not yet listening for any client
+func (a *ExternalApp) subscribe(c *externalClient, subscriptions map[string]bool, key string, listenKey string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	subscriptions[key] = true
+	c.listenKeys[listenKey] = true
+	if a.listening[listenKey] {
+		return false
+	}
+	a.listening[listenKey] = true
+	return true
+}
+
+// disconnect removes the client and unlistens the subscriptions no other
+// client has
+func (a *ExternalApp) disconnect(c *externalClient) {
+	a.mutex.Lock()
+	delete(a.clients, c)
+	unused := []string{}
+	for listenKey := range c.listenKeys {
+		if !a.clientListens(listenKey) {
+			delete(a.listening, listenKey)
+			unused = append(unused, listenKey)
+		}
+	}
+	a.mutex.Unlock()
+	if a.cancelContext.Err() != nil {
+		// All subscriptions are removed when the app is stopped
+		return
+	}
+	for _, listenKey := range unused {
+		parts := strings.SplitN(listenKey, ":", 2)
+		switch parts[0] {
+		case "state":
+			a.daemon.UnlistenState(parts[1], a.stateChannel)
+		case "call_service":
+			domain, service, _ := splitService(parts[1])
+			a.daemon.UnlistenCallServiceEvent(domain, service, a.callServiceChannel)
+		case "event":
+			a.daemon.UnlistenEvent(parts[1], a.eventChannel)
+		}
+	}
+}
+
+// clientListens returns true if any client has the subscription, a.mutex must be held
+func (a *ExternalApp) clientListens(listenKey string) bool {
+	for c := range a.clients {
+		if c.listenKeys[listenKey] {
+			return true
+		}
+	}
+	return false
+}
+
+func newExternalState(entityID string, state client.HassEntityState) externalState {
+	attributes := state.Attributes
+	if attributes == nil {
+		attributes = map[string]interface{}{}
+	}
+	return externalState{
+		EntityID:    entityID,
+		State:       state.State,
+		Attributes:  attributes,
+		LastChanged: state.LastChanged,
+		LastUpdated: state.LastUpdated}
+}
+
+// loop sends the state changes and call_service events to the subscribed processes
+func (a *ExternalApp) loop() {
+	defer a.running.Done()
+	for {
+		select {
+		case entity := <-a.stateChannel:
+			a.notify(func(c *externalClient) bool { return c.states[strings.ToLower(entity.ID)] },
+				rpcNotification{JSONRPC: "2.0", Method: "state_changed", Params: map[string]interface{}{
+					"entity_id": entity.ID,
+					"old_state": newExternalState(entity.ID, entity.Old),
+					"new_state": newExternalState(entity.ID, entity.New)}})
+		case event := <-a.callServiceChannel:
+			a.notify(func(c *externalClient) bool { return c.services[event.Domain+"."+event.Service] },
+				rpcNotification{JSONRPC: "2.0", Method: "call_service", Params: map[string]interface{}{
+					"domain":       event.Domain,
+					"service":      event.Service,
+					"service_data": event.ServiceData,
+					"time_fired":   event.TimeFired}})
+		case event := <-a.eventChannel:
+			a.notify(func(c *externalClient) bool { return c.events[event.EventType] },
+				rpcNotification{JSONRPC: "2.0", Method: "event", Params: map[string]interface{}{
+					"event_type": event.EventType,
+					"data":       event.Data,
+					"time_fired": event.TimeFired}})
+		// Listen to the cancelation context and leave when canceled
+		case <-a.cancelContext.Done():
+			return
+		}
+	}
+}
+
+// notify sends the notification to the clients that subscribed
+func (a *ExternalApp) notify(subscribed func(c *externalClient) bool, notification rpcNotification) {
+	a.mutex.Lock()
+	clients := []*externalClient{}
+	for c := range a.clients {
+		if subscribed(c) {
+			clients = append(clients, c)
+		}
+	}
+	a.mutex.Unlock()
+	for _, c := range clients {
+		c.send(notification)
+	}
+}
+
+// commandLoop runs the command and starts it again when it exits
+func (a *ExternalApp) commandLoop() {
+	defer a.running.Done()
+	for {
+		err := a.runCommand()
+		if a.cancelContext.Err() != nil {
+			return
+		}
+		a.log.Warnf("External process %s exited (%v), restarting in %v", a.config.Command, err, a.config.RestartDelay)
+		select {
+		case <-time.After(a.config.RestartDelay):
+		case <-a.cancelContext.Done():
+			return
+		}
+	}
+}
+
+// runCommand runs the command until it exits or the app is canceled, the
+// output of the process is logged
+func (a *ExternalApp) runCommand() error {
+	cmd := exec.Command(a.config.Command, a.config.Args...)
+	cmd.Env = append(os.Environ(), "GO_DAEMON_SOCKET="+a.config.Socket, "GO_DAEMON_APP="+a.name)
+	stdout := a.log.WriterLevel(logrus.InfoLevel)
+	defer stdout.Close()
+	stderr := a.log.WriterLevel(logrus.WarnLevel)
+	defer stderr.Close()
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	select {
+	case err := <-exited:
+		return err
+	case <-a.cancelContext.Done():
+		// Ask the process to exit, kill it if it does not
+		if err := cmd.Process.Signal(os.Interrupt); err != nil {
+			cmd.Process.Kill()
+		}
+		select {
+		case <-exited:
+		case <-time.After(externalStopTimeout):
+			cmd.Process.Kill()
+			<-exited
+		}
+		return nil
+	}
+}
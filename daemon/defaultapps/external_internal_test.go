@@ -0,0 +1,301 @@
+package defaultapps
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	h "github.com/helto4real/go-daemon/daemon/test"
+	"github.com/helto4real/go-hassclient/client"
+)
+
+// externalTestClient is a process connected to the external app
+type externalTestClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (c *externalTestClient) send(t *testing.T, line string) {
+	_, err := c.conn.Write([]byte(line + "\n"))
+	h.Ok(t, err)
+}
+
+func (c *externalTestClient) receive(t *testing.T) map[string]interface{} {
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := c.reader.ReadString('\n')
+	h.Ok(t, err)
+	message := map[string]interface{}{}
+	h.Ok(t, json.Unmarshal([]byte(line), &message))
+	return message
+}
+
+func newExternalTestApp(t *testing.T, config ExternalConfig, helper d.DaemonAppHelper) (*ExternalApp, string) {
+	dir, err := ioutil.TempDir("", "external")
+	h.Ok(t, err)
+	if config.Socket == "" {
+		config.Socket = filepath.Join(dir, "app.sock")
+	}
+	app := &ExternalApp{config: config}
+	h.Equals(t, true, app.Initialize(helper, d.DeamonAppConfig{Name: "external_test"}))
+	return app, dir
+}
+
+func connectExternal(t *testing.T, app *ExternalApp) *externalTestClient {
+	conn, err := net.Dial("unix", app.config.Socket)
+	h.Ok(t, err)
+	return &externalTestClient{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func TestExternalApp(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets")
+	}
+	helper := newFakeRulesHelper(client.NewHassEntity("light.kitchen", "light.kitchen", client.HassEntityState{},
+		client.HassEntityState{State: "on", Attributes: map[string]interface{}{"brightness": 128.0}}))
+	app, dir := newExternalTestApp(t, ExternalConfig{Config: map[string]interface{}{"light": "light.kitchen"}}, helper)
+	defer os.RemoveAll(dir)
+	defer app.Cancel()
+	c := connectExternal(t, app)
+	defer c.conn.Close()
+
+	c.send(t, `{"jsonrpc":"2.0","id":1,"method":"get_entity","params":{"entity_id":"light.kitchen"}}`)
+	response := c.receive(t)
+	h.Equals(t, 1.0, response["id"])
+	result := response["result"].(map[string]interface{})
+	h.Equals(t, "on", result["state"])
+	h.Equals(t, map[string]interface{}{"brightness": 128.0}, result["attributes"])
+
+	c.send(t, `{"jsonrpc":"2.0","id":2,"method":"get_entity","params":{"entity_id":"light.missing"}}`)
+	response = c.receive(t)
+	h.Equals(t, nil, response["result"])
+	_, hasResult := response["result"]
+	h.Equals(t, true, hasResult)
+
+	c.send(t, `{"jsonrpc":"2.0","id":"config","method":"get_config"}`)
+	h.Equals(t, map[string]interface{}{"name": "external_test", "config": map[string]interface{}{"light": "light.kitchen"}},
+		c.receive(t)["result"])
+
+	c.send(t, `{"jsonrpc":"2.0","id":3,"method":"set_entity","params":{"entity_id":"sensor.external","state":"5"}}`)
+	h.Equals(t, true, c.receive(t)["result"])
+	c.send(t, `{"jsonrpc":"2.0","id":4,"method":"call_service","params":{"domain":"light","service":"turn_on","data":{"entity_id":"light.kitchen"}}}`)
+	c.receive(t)
+	// Notifications are handled without response
+	c.send(t, `{"jsonrpc":"2.0","method":"call_service","params":{"domain":"light","service":"turn_off"}}`)
+	h.Equals(t, []string{
+		"set sensor.external 5 map[]",
+		"light.turn_on map[entity_id:light.kitchen]",
+		"light.turn_off map[]"}, helper.waitForCalls(t, 3))
+
+	c.send(t, `{"jsonrpc":"2.0","id":5,"method":"listen_state","params":{"entity_id":"light.kitchen"}}`)
+	c.receive(t)
+	helper.stateChannel <- client.HassEntity{ID: "light.kitchen",
+		Old: client.HassEntityState{State: "on"}, New: client.HassEntityState{State: "off"}}
+	notification := c.receive(t)
+	h.Equals(t, "state_changed", notification["method"])
+	params := notification["params"].(map[string]interface{})
+	h.Equals(t, "light.kitchen", params["entity_id"])
+	h.Equals(t, "on", params["old_state"].(map[string]interface{})["state"])
+	h.Equals(t, "off", params["new_state"].(map[string]interface{})["state"])
+
+	c.send(t, `{"jsonrpc":"2.0","id":6,"method":"listen_call_service","params":{"domain":"script","service":"external"}}`)
+	c.receive(t)
+	helper.callServiceChannel <- client.HassCallServiceEvent{Domain: "script", Service: "external",
+		ServiceData: map[string]interface{}{"value": 1.0}}
+	notification = c.receive(t)
+	h.Equals(t, "call_service", notification["method"])
+	h.Equals(t, map[string]interface{}{"value": 1.0}, notification["params"].(map[string]interface{})["service_data"])
+}
+
+func TestExternalAppEvents(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets")
+	}
+	helper := newFakeRulesHelper()
+	app, dir := newExternalTestApp(t, ExternalConfig{}, helper)
+	defer os.RemoveAll(dir)
+	defer app.Cancel()
+	c := connectExternal(t, app)
+	defer c.conn.Close()
+
+	c.send(t, `{"jsonrpc":"2.0","id":1,"method":"listen_event","params":{}}`)
+	h.Equals(t, rpcInvalidParams, int(c.receive(t)["error"].(map[string]interface{})["code"].(float64)))
+
+	c.send(t, `{"jsonrpc":"2.0","id":2,"method":"listen_event","params":{"event_type":"zha_event"}}`)
+	c.receive(t)
+	h.Equals(t, []string{"zha_event"}, helper.eventTypes)
+	helper.eventChannel <- d.HassEvent{EventType: "zha_event", Data: map[string]interface{}{"command": "on"}}
+	notification := c.receive(t)
+	h.Equals(t, "event", notification["method"])
+	params := notification["params"].(map[string]interface{})
+	h.Equals(t, "zha_event", params["event_type"])
+	h.Equals(t, map[string]interface{}{"command": "on"}, params["data"])
+}
+
+func TestExternalAppUnlistensWhenLastClientDisconnects(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets")
+	}
+	helper := newFakeRulesHelper()
+	app, dir := newExternalTestApp(t, ExternalConfig{}, helper)
+	defer os.RemoveAll(dir)
+	defer app.Cancel()
+
+	first := connectExternal(t, app)
+	first.send(t, `{"jsonrpc":"2.0","id":1,"method":"listen_state","params":{"entity_id":"light.kitchen"}}`)
+	first.receive(t)
+	first.send(t, `{"jsonrpc":"2.0","id":2,"method":"listen_event","params":{"event_type":"zha_event"}}`)
+	first.receive(t)
+	second := connectExternal(t, app)
+	defer second.conn.Close()
+	second.send(t, `{"jsonrpc":"2.0","id":1,"method":"listen_state","params":{"entity_id":"Light.Kitchen"}}`)
+	second.receive(t)
+	second.send(t, `{"jsonrpc":"2.0","id":2,"method":"listen_call_service","params":{"domain":"script","service":"external"}}`)
+	second.receive(t)
+
+	unlistened := func(count int) []string {
+		deadline := time.Now().Add(time.Second)
+		for {
+			helper.mutex.Lock()
+			result := append([]string(nil), helper.unlistened...)
+			helper.mutex.Unlock()
+			if len(result) >= count || time.Now().After(deadline) {
+				sort.Strings(result)
+				return result
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// The state is still used by the second client
+	first.conn.Close()
+	h.Equals(t, []string{"event zha_event"}, unlistened(1))
+
+	second.conn.Close()
+	h.Equals(t, []string{"call_service script.external", "event zha_event", "state light.kitchen"}, unlistened(3))
+
+	// The subscriptions are made again for new clients
+	third := connectExternal(t, app)
+	defer third.conn.Close()
+	third.send(t, `{"jsonrpc":"2.0","id":1,"method":"listen_event","params":{"event_type":"zha_event"}}`)
+	third.receive(t)
+	h.Equals(t, []string{"zha_event", "zha_event"}, helper.eventTypes)
+}
+
+func TestExternalAppErrors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets")
+	}
+	app, dir := newExternalTestApp(t, ExternalConfig{}, newFakeRulesHelper())
+	defer os.RemoveAll(dir)
+	defer app.Cancel()
+	c := connectExternal(t, app)
+	defer c.conn.Close()
+
+	// Only the socket is left in the folder and only the user can connect
+	files, err := ioutil.ReadDir(dir)
+	h.Ok(t, err)
+	h.Equals(t, 1, len(files))
+	h.Equals(t, "app.sock", files[0].Name())
+	h.Equals(t, os.FileMode(0600), files[0].Mode().Perm())
+
+	errorCode := func(response map[string]interface{}) float64 {
+		return response["error"].(map[string]interface{})["code"].(float64)
+	}
+	c.send(t, `{"jsonrpc":"2.0","id":1,"method":"unknown"}`)
+	h.Equals(t, float64(rpcMethodNotFound), errorCode(c.receive(t)))
+	c.send(t, `{"jsonrpc":"2.0","id":2,"method":"get_entity","params":{}}`)
+	response := c.receive(t)
+	h.Equals(t, float64(rpcInvalidParams), errorCode(response))
+	h.Equals(t, "invalid params: entity_id is required", response["error"].(map[string]interface{})["message"])
+	c.send(t, `{"jsonrpc":"2.0","id":3,"method":"get_entity","params":[1]}`)
+	h.Equals(t, float64(rpcInvalidParams), errorCode(c.receive(t)))
+	c.send(t, `{"jsonrpc":"2.0","id":"panic","method":"log","params":{"level":"panic","message":"stop"}}`)
+	h.Equals(t, float64(rpcInvalidParams), errorCode(c.receive(t)))
+	c.send(t, `{"jsonrpc":"2.0","id":"fatal","method":"log","params":{"level":"fatal","message":"stop"}}`)
+	h.Equals(t, float64(rpcInvalidParams), errorCode(c.receive(t)))
+	// The helper panics on turn_on, the process gets an error and can continue
+	c.send(t, `{"jsonrpc":"2.0","id":"turn_on","method":"turn_on","params":{"entity_id":"light.kitchen"}}`)
+	h.Equals(t, float64(rpcServerError), errorCode(c.receive(t)))
+	c.send(t, `{"id":4,"method":"get_entity"}`)
+	h.Equals(t, float64(rpcInvalidRequest), errorCode(c.receive(t)))
+	c.send(t, `[{"jsonrpc":"2.0","id":5,"method":"get_config"}]`)
+	h.Equals(t, float64(rpcInvalidRequest), errorCode(c.receive(t)))
+
+	c.send(t, `{"jsonrpc":`)
+	c.send(t, `}`)
+	response = c.receive(t)
+	h.Equals(t, float64(rpcParseError), errorCode(response))
+	h.Equals(t, nil, response["id"])
+}
+
+func TestExternalAppCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets")
+	}
+	dir, err := ioutil.TempDir("", "external")
+	h.Ok(t, err)
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	app, appDir := newExternalTestApp(t, ExternalConfig{
+		Command:      "sh",
+		Args:         []string{"-c", `echo "$GO_DAEMON_APP $GO_DAEMON_SOCKET" >> ` + out},
+		RestartDelay: 10 * time.Millisecond}, newFakeRulesHelper())
+	defer os.RemoveAll(appDir)
+
+	// The command exits at once and is restarted
+	var lines []string
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && len(lines) < 2 {
+		data, _ := ioutil.ReadFile(out)
+		lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+		time.Sleep(5 * time.Millisecond)
+	}
+	app.Cancel()
+	h.Assert(t, len(lines) >= 2, "expected the command to restart, got %v", lines)
+	h.Equals(t, "external_test "+app.config.Socket, lines[0])
+	_, err = os.Stat(app.config.Socket)
+	h.Assert(t, os.IsNotExist(err), "expected the socket to be removed, got %v", err)
+}
+
+func TestExternalAppDefaultSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets")
+	}
+	dir, err := ioutil.TempDir("", "external")
+	h.Ok(t, err)
+	defer os.RemoveAll(dir)
+	folder := defaultSocketFolder
+	defaultSocketFolder = filepath.Join(dir, "run")
+	defer func() { defaultSocketFolder = folder }()
+
+	app := &ExternalApp{}
+	h.Equals(t, true, app.Initialize(newFakeRulesHelper(), d.DeamonAppConfig{Name: "external_test"}))
+	defer app.Cancel()
+	h.Equals(t, filepath.Join(dir, "run", "external_test.sock"), app.config.Socket)
+	info, err := os.Stat(filepath.Join(dir, "run"))
+	h.Ok(t, err)
+	h.Equals(t, os.FileMode(0700), info.Mode().Perm())
+}
+
+func TestExternalAppSocketNotReplaced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "external")
+	h.Ok(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "file")
+	h.Ok(t, ioutil.WriteFile(socket, []byte("keep"), 0644))
+
+	app := &ExternalApp{config: ExternalConfig{Socket: socket}}
+	h.Equals(t, false, app.Initialize(newFakeRulesHelper(), d.DeamonAppConfig{Name: "external_test"}))
+	data, err := ioutil.ReadFile(socket)
+	h.Ok(t, err)
+	h.Equals(t, "keep", string(data))
+}
@@ -0,0 +1,152 @@
+package defaultapps
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/helto4real/go-hassclient/client"
+
+	c "github.com/helto4real/go-daemon/daemon/config"
+)
+
+// defaultStaleTimes are the seconds after the last update that devices of
+// the source type are ignored. A gps device that is not reporting should not
+// keep the person home
+var defaultStaleTimes = map[string]int{"gps": 3600}
+
+// fusionSettings are the fusion settings of a person with the tracking
+// settings and defaults applied
+type fusionSettings struct {
+	weights        map[string]float64
+	staleTimes     map[string]int
+	maxGPSAccuracy float64
+	homeThreshold  float64
+}
+
+// fusionConfig returns the fusion settings of person, the person settings
+// override the tracking settings
+func (a *PeopleApp) fusionConfig(person string) fusionSettings {
+	fusion := fusionSettings{weights: map[string]float64{}, staleTimes: map[string]int{}}
+	for sourceType, seconds := range defaultStaleTimes {
+		fusion.staleTimes[sourceType] = seconds
+	}
+	merge := func(from *c.FusionConfig) {
+		if from == nil {
+			return
+		}
+		for key, weight := range from.Weights {
+			fusion.weights[key] = weight
+		}
+		for sourceType, seconds := range from.StaleTimes {
+			fusion.staleTimes[sourceType] = seconds
+		}
+		// Set values override, also 0 that turns the setting off for the person
+		if from.MaxGPSAccuracy != nil {
+			fusion.maxGPSAccuracy = *from.MaxGPSAccuracy
+		}
+		if from.HomeThreshold != nil {
+			fusion.homeThreshold = *from.HomeThreshold
+		}
+	}
+	if a.settings != nil && a.settings.TrackingSettings != nil {
+		merge(a.settings.TrackingSettings.Fusion)
+	}
+	if personConfig, ok := a.conf[person]; ok {
+		merge(personConfig.Fusion)
+	}
+	return fusion
+}
+
+// sourceType returns the source_type attribute of the device, empty if not set
+func sourceType(device *client.HassEntity) string {
+	sourceType, _ := device.New.Attributes["source_type"].(string)
+	return sourceType
+}
+
+// deviceWeight returns the weight of the device, 0 if the device is ignored
+// cause it is stale or the gps accuracy is too low
+func deviceWeight(fusion fusionSettings, device *client.HassEntity, now time.Time) float64 {
+	weight := 1.0
+	if w, ok := fusion.weights[device.ID]; ok {
+		weight = w
+	} else if w, ok := fusion.weights[sourceType(device)]; ok {
+		weight = w
+	}
+	if weight <= 0 {
+		return 0
+	}
+	if seconds, ok := fusion.staleTimes[sourceType(device)]; ok && seconds > 0 &&
+		now.Sub(device.New.LastUpdated) > time.Duration(seconds)*time.Second {
+		return 0
+	}
+	if sourceType(device) == "gps" && fusion.maxGPSAccuracy > 0 {
+		if accuracy, ok := device.New.Attributes["gps_accuracy"].(float64); ok && accuracy > fusion.maxGPSAccuracy {
+			return 0
+		}
+	}
+	return weight
+}
+
+// lastChangedAwayDevice returns the last changed device that is not home and not ignored
+func lastChangedAwayDevice(sortedDevices []*client.HassEntity, weights map[*client.HassEntity]float64) *client.HassEntity {
+	for _, device := range sortedDevices {
+		if weights[device] > 0 && translateState(device.New.State) != "home" {
+			return device
+		}
+	}
+	return nil
+}
+
+// getHassDeviceState combines the states of the devices of person into
+// "home", "not_home" or the zone, and the confidence 0 to 1 that is the
+// share of the weight of the devices agreeing with the state
+func (a *PeopleApp) getHassDeviceState(person string, devices []*client.HassEntity) (string, float64) {
+	sortedDevices := devices
+	// Get devices
+	sort.Slice(sortedDevices, func(i, j int) bool { return devices[i].New.LastChanged.After(devices[j].New.LastChanged) })
+
+	fusion := a.fusionConfig(person)
+	now := time.Now().UTC()
+	weights := make(map[*client.HassEntity]float64, len(sortedDevices))
+	total, home := 0.0, 0.0
+	for _, device := range sortedDevices {
+		weight := deviceWeight(fusion, device, now)
+		weights[device] = weight
+		total += weight
+		if translateState(device.New.State) == "home" {
+			home += weight
+		}
+	}
+
+	state := "not_home"
+	gpsDevice := getGpsSourceTypeDevice(sortedDevices)
+	if home > 0 && home/total >= fusion.homeThreshold {
+		// Ether bt or wifi are home, device always home, this will make
+		// the tracking alot more stable
+		state = "home"
+	} else if gpsDevice != nil && (weights[gpsDevice] > 0 || translateState(gpsDevice.New.State) != "home") {
+		// If we reached this point the person is considered not home
+		// Get the state from gps device, a stale gps still knows the zone
+		state = translateState(gpsDevice.New.State)
+	} else if device := lastChangedAwayDevice(sortedDevices, weights); device != nil {
+		// Just return the last changed device state
+		state = translateState(device.New.State)
+	} else if len(sortedDevices) > 0 {
+		// All devices are ignored, use the last changed
+		state = translateState(sortedDevices[0].New.State)
+	}
+	agreeing := 0.0
+	for _, device := range sortedDevices {
+		deviceState := translateState(device.New.State)
+		// Devices not home agrees with the person being away or in another zone
+		if deviceState == state || (state != "home" && deviceState == "not_home") {
+			agreeing += weights[device]
+		}
+	}
+	confidence := 0.0
+	if total > 0 {
+		confidence = math.Round(agreeing/total*100) / 100
+	}
+	return state, confidence
+}
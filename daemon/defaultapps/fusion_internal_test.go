@@ -0,0 +1,103 @@
+package defaultapps
+
+import (
+	"testing"
+	"time"
+
+	"github.com/helto4real/go-daemon/daemon/config"
+	h "github.com/helto4real/go-daemon/daemon/test"
+	"github.com/helto4real/go-hassclient/client"
+)
+
+func fusionDevice(id string, state string, sourceType string, updated time.Time) *client.HassEntity {
+	attributes := map[string]interface{}{}
+	if sourceType != "" {
+		attributes["source_type"] = sourceType
+	}
+	return &client.HassEntity{ID: id, New: client.HassEntityState{
+		State: state, LastUpdated: updated, Attributes: attributes}}
+}
+
+func newFusionApp(tracking *config.FusionConfig, person *config.FusionConfig) *PeopleApp {
+	fake := newFakeDaemonHelper()
+	settings := fake.GetSettings()
+	settings.TrackingSettings.Fusion = tracking
+	return &PeopleApp{
+		deamon:   fake,
+		settings: settings,
+		conf:     map[string]*config.PeopleConfig{"person1": &config.PeopleConfig{Fusion: person}}}
+}
+
+func TestFusionDefaultAnyHomeWins(t *testing.T) {
+	app := newFusionApp(nil, nil)
+	now := time.Now().UTC()
+	state, confidence := app.getHassDeviceState("person1", []*client.HassEntity{
+		fusionDevice("device_tracker.bt", "home", "bluetooth", time.Time{}),
+		fusionDevice("device_tracker.wifi", "not_home", "router", time.Time{}),
+		fusionDevice("device_tracker.gps", "not_home", "gps", now)})
+	h.Equals(t, "home", state)
+	h.Equals(t, 0.33, confidence)
+
+	// Stale gps home does not count
+	state, confidence = app.getHassDeviceState("person1", []*client.HassEntity{
+		fusionDevice("device_tracker.wifi", "not_home", "router", time.Time{}),
+		fusionDevice("device_tracker.gps", "home", "gps", now.Add(-2*time.Hour))})
+	h.Equals(t, "not_home", state)
+	h.Equals(t, 1.0, confidence)
+}
+
+func TestFusionWeightsAndThreshold(t *testing.T) {
+	threshold := 0.5
+	app := newFusionApp(
+		&config.FusionConfig{Weights: map[string]float64{"router": 2}, HomeThreshold: &threshold},
+		&config.FusionConfig{Weights: map[string]float64{"device_tracker.beacon": 3}})
+	now := time.Now().UTC()
+	devices := []*client.HassEntity{
+		fusionDevice("device_tracker.bt", "home", "bluetooth", time.Time{}),
+		fusionDevice("device_tracker.wifi", "not_home", "router", time.Time{})}
+	state, confidence := app.getHassDeviceState("person1", devices)
+	h.Equals(t, "not_home", state)
+	h.Equals(t, 0.67, confidence)
+
+	// The person weight of the beacon makes home over the threshold
+	devices = append(devices, fusionDevice("device_tracker.beacon", "home", "bluetooth_le", now))
+	state, confidence = app.getHassDeviceState("person1", devices)
+	h.Equals(t, "home", state)
+	h.Equals(t, 0.67, confidence)
+}
+
+func TestFusionPersonZeroOverrides(t *testing.T) {
+	threshold, accuracy, zero := 0.5, 100.0, 0.0
+	app := newFusionApp(&config.FusionConfig{HomeThreshold: &threshold, MaxGPSAccuracy: &accuracy},
+		&config.FusionConfig{HomeThreshold: &zero, MaxGPSAccuracy: &zero})
+	now := time.Now().UTC()
+	gps := fusionDevice("device_tracker.gps", "home", "gps", now)
+	gps.New.Attributes["gps_accuracy"] = 500.0
+
+	// Any device home is enough and the gps accuracy has no limit for the person
+	state, confidence := app.getHassDeviceState("person1", []*client.HassEntity{
+		gps,
+		fusionDevice("device_tracker.wifi", "not_home", "router", time.Time{}),
+		fusionDevice("device_tracker.bt", "not_home", "bluetooth", time.Time{})})
+	h.Equals(t, "home", state)
+	h.Equals(t, 0.33, confidence)
+}
+
+func TestFusionGpsAccuracyAndStaleTimes(t *testing.T) {
+	accuracy := 100.0
+	app := newFusionApp(&config.FusionConfig{MaxGPSAccuracy: &accuracy, StaleTimes: map[string]int{"router": 60}}, nil)
+	now := time.Now().UTC()
+	gps := fusionDevice("device_tracker.gps", "home", "gps", now)
+	gps.New.Attributes["gps_accuracy"] = 500.0
+	router := fusionDevice("device_tracker.wifi", "home", "router", now.Add(-2*time.Minute))
+	bt := fusionDevice("device_tracker.bt", "not_home", "bluetooth", now)
+
+	state, confidence := app.getHassDeviceState("person1", []*client.HassEntity{gps, router, bt})
+	h.Equals(t, "not_home", state)
+	h.Equals(t, 1.0, confidence)
+
+	gps.New.Attributes["gps_accuracy"] = 20.0
+	state, confidence = app.getHassDeviceState("person1", []*client.HassEntity{gps, router, bt})
+	h.Equals(t, "home", state)
+	h.Equals(t, 0.5, confidence)
+}
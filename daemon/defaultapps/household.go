@@ -0,0 +1,225 @@
+package defaultapps
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/helto4real/go-hassclient/client"
+)
+
+// defaultHouseholdName is the prefix of the household entities if not configured
+const defaultHouseholdName = "household"
+
+// presenceGroup is the aggregated presence of a group of people
+type presenceGroup struct {
+	name    string
+	members []string
+	// home is true for the members that are home, members without state are not in the map
+	home           map[string]bool
+	lastLeft       string
+	lastLeftAt     time.Time
+	firstArrived   string
+	firstArrivedAt time.Time
+}
+
+// household keeps the groups and the last published state of the aggregated entities
+type household struct {
+	groups    []*presenceGroup
+	published map[string]string
+	// initialized is set when all people has a state, entities are not set before
+	initialized bool
+}
+
+// newHousehold returns the household with the configured groups, nil if not enabled
+func (a *PeopleApp) newHousehold() *household {
+	if a.settings == nil || a.settings.Household == nil || !a.peopleConfigured() {
+		return nil
+	}
+	config := a.settings.Household
+	name := config.Name
+	if name == "" {
+		name = defaultHouseholdName
+	}
+	h := &household{published: map[string]string{}}
+	h.groups = append(h.groups, newPresenceGroup(name, a.sortedPeople()))
+
+	names := make([]string, 0, len(config.Groups))
+	for group := range config.Groups {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+	for _, group := range names {
+		members := []string{}
+		for _, person := range config.Groups[group] {
+			// People from person entities can be added later
+			if _, ok := a.conf[person]; !ok && !a.usePersonEntities() {
+				log.Errorf("Person [%s] in household group [%s] is not configured", person, group)
+				continue
+			}
+			members = append(members, person)
+		}
+		h.groups = append(h.groups, newPresenceGroup(group, members))
+	}
+	return h
+}
+
+// setEveryone sets the people of the household when people are added or removed
+func (h *household) setEveryone(people []string) {
+	h.groups[0].members = people
+	for _, group := range h.groups {
+		for person := range group.home {
+			if !containsPerson(people, person) {
+				delete(group.home, person)
+			}
+		}
+	}
+}
+
+func containsPerson(people []string, person string) bool {
+	for _, p := range people {
+		if p == person {
+			return true
+		}
+	}
+	return false
+}
+
+func newPresenceGroup(name string, members []string) *presenceGroup {
+	return &presenceGroup{name: name, members: members, home: map[string]bool{}}
+}
+
+// peopleHome returns the members that are home
+func (g *presenceGroup) peopleHome() []string {
+	people := []string{}
+	for _, person := range g.members {
+		if g.home[person] {
+			people = append(people, person)
+		}
+	}
+	return people
+}
+
+// update sets if the person is home and keeps track of the last person
+// to leave and the first to arrive
+func (g *presenceGroup) update(person string, isHome bool, now time.Time) {
+	if !g.isMember(person) {
+		return
+	}
+	wasHome, known := g.home[person]
+	g.home[person] = isHome
+	if !known || wasHome == isHome {
+		return
+	}
+	count := len(g.peopleHome())
+	if !isHome && count == 0 {
+		g.lastLeft, g.lastLeftAt = person, now
+	} else if isHome && count == 1 {
+		g.firstArrived, g.firstArrivedAt = person, now
+	}
+}
+
+func (g *presenceGroup) isMember(person string) bool {
+	for _, member := range g.members {
+		if member == person {
+			return true
+		}
+	}
+	return false
+}
+
+// isPersonHome returns true if the person is home or just arrived home
+func (a *PeopleApp) isPersonHome(person string) bool {
+	tracking := a.settings.TrackingSettings
+	state := a.conf[person].State
+	if state == tracking.HomeState {
+		return true
+	}
+	if state == tracking.JustArrivedState {
+		zones, ok := a.zones[person]
+		return ok && (zones.arriving == "" || zones.arriving == "home")
+	}
+	return false
+}
+
+// updateHousehold updates the groups of person and sets the aggregated
+// entities that changed, called every time the state of person is set
+func (a *PeopleApp) updateHousehold(person string) {
+	if a.household == nil {
+		return
+	}
+	now := time.Now()
+	isHome := a.isPersonHome(person)
+	for _, group := range a.household.groups {
+		group.update(person, isHome, now)
+	}
+	if a.household.initialized {
+		a.publishHousehold()
+	}
+}
+
+// publishHousehold sets the aggregated entities that changed since last published
+func (a *PeopleApp) publishHousehold() {
+	for _, group := range a.household.groups {
+		for _, entity := range a.groupEntities(group) {
+			published := fmt.Sprint(entity.New.State, entity.New.Attributes)
+			if a.household.published[entity.ID] == published {
+				continue
+			}
+			a.household.published[entity.ID] = published
+			a.deamon.SetEntity(entity)
+		}
+	}
+}
+
+// groupEntities returns the aggregated entities of the group
+func (a *PeopleApp) groupEntities(group *presenceGroup) []*client.HassEntity {
+	peopleHome := group.peopleHome()
+	names := make([]string, 0, len(peopleHome))
+	for _, person := range peopleHome {
+		names = append(names, a.personName(person))
+	}
+	friendlyName := strings.Title(strings.ReplaceAll(group.name, "_", " "))
+
+	entity := func(id string, name string, state string, attributes map[string]interface{}) *client.HassEntity {
+		attributes["friendly_name"] = friendlyName + " " + name
+		return client.NewHassEntity(id, id, client.HassEntityState{}, client.HassEntityState{
+			State:      state,
+			Attributes: attributes})
+	}
+	onOff := func(on bool) string {
+		if on {
+			return "on"
+		}
+		return "off"
+	}
+	personAt := func(person string, at time.Time) (string, map[string]interface{}) {
+		if person == "" {
+			return "unknown", map[string]interface{}{}
+		}
+		return a.personName(person), map[string]interface{}{"person": person, "time": at.Format(time.RFC3339)}
+	}
+	lastLeft, lastLeftAttributes := personAt(group.lastLeft, group.lastLeftAt)
+	firstArrived, firstArrivedAttributes := personAt(group.firstArrived, group.firstArrivedAt)
+
+	prefix := strings.ToLower(group.name)
+	return []*client.HassEntity{
+		entity("binary_sensor."+prefix+"_anyone_home", "anyone home", onOff(len(peopleHome) > 0),
+			map[string]interface{}{"people": names}),
+		entity("binary_sensor."+prefix+"_everyone_away", "everyone away", onOff(len(peopleHome) == 0),
+			map[string]interface{}{"people": names}),
+		entity("sensor."+prefix+"_people_home", "people home", fmt.Sprint(len(peopleHome)),
+			map[string]interface{}{"people": names}),
+		entity("sensor."+prefix+"_last_left", "last left", lastLeft, lastLeftAttributes),
+		entity("sensor."+prefix+"_first_arrived", "first arrived", firstArrived, firstArrivedAttributes),
+	}
+}
+
+// personName returns the friendly name of person, the id if not set
+func (a *PeopleApp) personName(person string) string {
+	if name := a.conf[person].FriendlyName; name != "" {
+		return name
+	}
+	return person
+}
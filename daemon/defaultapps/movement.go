@@ -0,0 +1,192 @@
+package defaultapps
+
+import (
+	"math"
+	"time"
+
+	d "github.com/helto4real/go-daemon/daemon"
+)
+
+const (
+	// kilometersPerMile converts kilometers to the imperial units
+	kilometersPerMile = 1.609344
+	// minMovement is the kilometers a person has to move between two gps
+	// fixes to not be stationary, smaller moves are gps noise
+	minMovement = 0.05
+)
+
+// Directions of travel relative to home
+const (
+	directionUnknown    = "unknown"
+	directionTowards    = "towards"
+	directionAwayFrom   = "away_from"
+	directionStationary = "stationary"
+)
+
+// personMovement is the movement of a person calculated from the gps fixes
+type personMovement struct {
+	latitude  float64
+	longitude float64
+	fixTime   time.Time
+	// homeDistance is the kilometers to home at the last fix
+	homeDistance float64
+	direction    string
+	// speed is the kilometers per hour between the last two fixes
+	speed float64
+	// eta is the estimated time to reach home, 0 if not approaching
+	eta time.Duration
+	// proximity is true for the proximity triggers the person is within
+	proximity map[string]bool
+}
+
+// imperial returns true if distances are in miles
+func (a *PeopleApp) imperial() bool {
+	return a.settings != nil && a.settings.TrackingSettings != nil && a.settings.TrackingSettings.Units == "imperial"
+}
+
+// toUnits converts kilometers to the configured units
+func (a *PeopleApp) toUnits(kilometers float64) float64 {
+	if a.imperial() {
+		return kilometers / kilometersPerMile
+	}
+	return kilometers
+}
+
+// distanceUnit returns the unit of distances, km or mi
+func (a *PeopleApp) distanceUnit() string {
+	if a.imperial() {
+		return "mi"
+	}
+	return "km"
+}
+
+// updateMovement updates the movement of person with a new gps fix and
+// sets the distance, direction, speed, eta and nearest zone attributes
+func (a *PeopleApp) updateMovement(person string, latitude float64, longitude float64, fixTime time.Time) {
+	if a.movements == nil {
+		a.movements = map[string]*personMovement{}
+	}
+	if fixTime.IsZero() {
+		fixTime = time.Now()
+	}
+	home := a.deamon.GetLocation()
+	homeDistance := distance(latitude, longitude, home.Latitude, home.Longitude, "K")
+
+	movement, ok := a.movements[person]
+	if !ok {
+		movement = &personMovement{direction: directionUnknown, proximity: map[string]bool{}}
+		a.movements[person] = movement
+	} else if !fixTime.After(movement.fixTime) {
+		// Same or older fix than last time, nothing moved
+		a.setMovementAttributes(person)
+		return
+	} else {
+		hours := fixTime.Sub(movement.fixTime).Hours()
+		moved := distance(latitude, longitude, movement.latitude, movement.longitude, "K")
+		approached := movement.homeDistance - homeDistance
+		movement.speed = moved / hours
+		movement.eta = 0
+		switch {
+		case moved < minMovement || math.Abs(approached) < minMovement:
+			movement.direction = directionStationary
+		case approached > 0:
+			movement.direction = directionTowards
+			movement.eta = time.Duration(homeDistance / (approached / hours) * float64(time.Hour))
+		default:
+			movement.direction = directionAwayFrom
+		}
+	}
+	movement.latitude, movement.longitude = latitude, longitude
+	movement.fixTime = fixTime
+	movement.homeDistance = homeDistance
+	a.setMovementAttributes(person)
+}
+
+// setMovementAttributes sets the movement attributes of person
+func (a *PeopleApp) setMovementAttributes(person string) {
+	movement := a.movements[person]
+	attributes := a.conf[person].Attributes
+	attributes["distance"] = math.Round(a.toUnits(movement.homeDistance))
+	attributes["distance_unit"] = a.distanceUnit()
+	attributes["direction"] = movement.direction
+	attributes["speed"] = math.Round(a.toUnits(movement.speed)*10) / 10
+	if movement.eta > 0 {
+		attributes["eta"] = math.Round(movement.eta.Minutes())
+	} else {
+		delete(attributes, "eta")
+	}
+	zone, kilometers := a.nearestZone(movement.latitude, movement.longitude)
+	attributes["nearest_zone"] = zone
+	attributes["nearest_zone_distance"] = math.Round(a.toUnits(kilometers)*10) / 10
+}
+
+// nearestZone returns home or the tracked zone with the nearest edge to the
+// coordinates and the kilometers to the edge, 0 if inside the zone
+func (a *PeopleApp) nearestZone(latitude float64, longitude float64) (string, float64) {
+	home := a.deamon.GetLocation()
+	nearest := "home"
+	nearestDistance := distance(latitude, longitude, home.Latitude, home.Longitude, "K")
+	for _, id := range a.zoneIDs() {
+		zone, ok := a.deamon.GetEntity(id)
+		if !ok || zone == nil {
+			continue
+		}
+		zoneLatitude, latOk := zone.New.Attributes["latitude"].(float64)
+		zoneLongitude, lngOk := zone.New.Attributes["longitude"].(float64)
+		if !latOk || !lngOk {
+			continue
+		}
+		radius, _ := zone.New.Attributes["radius"].(float64)
+		edge := math.Max(0, distance(latitude, longitude, zoneLatitude, zoneLongitude, "K")-radius/1000)
+		if edge < nearestDistance {
+			nearest, nearestDistance = id, edge
+		}
+	}
+	return nearest, nearestDistance
+}
+
+// checkProximity sends the proximity events of the triggers person got within
+func (a *PeopleApp) checkProximity(person string) {
+	movement, ok := a.movements[person]
+	if !ok || a.settings == nil || a.settings.TrackingSettings == nil {
+		return
+	}
+	for _, trigger := range a.settings.TrackingSettings.Proximity {
+		if !proximityIncludes(trigger.People, person) {
+			continue
+		}
+		homeDistance := a.toUnits(movement.homeDistance)
+		// Only leaving the distance resets the trigger, a stationary fix
+		// within the distance does not send the event again
+		if homeDistance > trigger.Distance {
+			movement.proximity[trigger.Name] = false
+			continue
+		}
+		if movement.proximity[trigger.Name] ||
+			(trigger.Direction != "" && trigger.Direction != "any" && trigger.Direction != movement.direction) {
+			continue
+		}
+		movement.proximity[trigger.Name] = true
+		event := d.ProximityEvent{
+			Name:         trigger.Name,
+			Person:       person,
+			FriendlyName: a.personName(person),
+			Distance:     math.Round(homeDistance*10) / 10,
+			Direction:    movement.direction,
+			Time:         time.Now()}
+		a.sendEvent(d.ProximityTopic, d.ProximityEventType, event)
+	}
+}
+
+// proximityIncludes returns true if person is in people or people is empty
+func proximityIncludes(people []string, person string) bool {
+	if len(people) == 0 {
+		return true
+	}
+	for _, p := range people {
+		if p == person {
+			return true
+		}
+	}
+	return false
+}
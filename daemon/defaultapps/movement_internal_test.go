@@ -0,0 +1,104 @@
+package defaultapps
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	"github.com/helto4real/go-daemon/daemon/config"
+	h "github.com/helto4real/go-daemon/daemon/test"
+)
+
+func newMovementApp(tracking *config.TrackingStateSettingsConfig) (*PeopleApp, *fakeDaemonAppHelper) {
+	fake := newFakeDaemonHelper()
+	settings := fake.GetSettings()
+	settings.TrackingSettings.Units = tracking.Units
+	settings.TrackingSettings.Proximity = tracking.Proximity
+	app := &PeopleApp{
+		deamon:       fake,
+		settings:     settings,
+		eventChannel: make(chan peopleEvent, eventQueueSize),
+		conf: map[string]*config.PeopleConfig{"person1": &config.PeopleConfig{
+			FriendlyName: "Person 1", Attributes: map[string]interface{}{}}}}
+	app.cancelContext, app.cancel = context.WithCancel(context.Background())
+	go app.sendEvents()
+	return app, fake
+}
+
+func TestMovementTowardsHome(t *testing.T) {
+	app, _ := newMovementApp(&config.TrackingStateSettingsConfig{})
+	attributes := app.conf["person1"].Attributes
+	start := time.Date(2020, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	app.updateMovement("person1", 1.1, 1.0, start)
+	h.Equals(t, 11.0, attributes["distance"])
+	h.Equals(t, "km", attributes["distance_unit"])
+	h.Equals(t, directionUnknown, attributes["direction"])
+	h.Equals(t, "home", attributes["nearest_zone"])
+
+	app.updateMovement("person1", 1.05, 1.0, start.Add(10*time.Minute))
+	h.Equals(t, 6.0, attributes["distance"])
+	h.Equals(t, directionTowards, attributes["direction"])
+	h.Equals(t, 33.4, attributes["speed"])
+	h.Equals(t, 10.0, attributes["eta"])
+
+	// Older fixes are ignored
+	app.updateMovement("person1", 2.0, 1.0, start)
+	h.Equals(t, 6.0, attributes["distance"])
+
+	app.updateMovement("person1", 1.0503, 1.0, start.Add(20*time.Minute))
+	h.Equals(t, directionStationary, attributes["direction"])
+	_, ok := attributes["eta"]
+	h.Equals(t, false, ok)
+
+	app.updateMovement("person1", 1.2, 1.0, start.Add(30*time.Minute))
+	h.Equals(t, directionAwayFrom, attributes["direction"])
+}
+
+func TestMovementImperialUnits(t *testing.T) {
+	app, _ := newMovementApp(&config.TrackingStateSettingsConfig{Units: "imperial"})
+	attributes := app.conf["person1"].Attributes
+	app.updateMovement("person1", 1.1, 1.0, time.Now())
+	h.Equals(t, 7.0, attributes["distance"])
+	h.Equals(t, "mi", attributes["distance_unit"])
+}
+
+func TestProximityTrigger(t *testing.T) {
+	app, fake := newMovementApp(&config.TrackingStateSettingsConfig{Proximity: []*config.ProximityConfig{
+		{Name: "near_home", Distance: 8, Direction: "towards"},
+		{Name: "other_person", Distance: 100, People: []string{"person2"}}}})
+	defer app.Cancel()
+	start := time.Date(2020, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	app.updateMovement("person1", 1.1, 1.0, start)
+	app.checkProximity("person1")
+	app.updateMovement("person1", 1.05, 1.0, start.Add(10*time.Minute))
+	app.checkProximity("person1")
+	app.updateMovement("person1", 1.03, 1.0, start.Add(15*time.Minute))
+	app.checkProximity("person1")
+
+	messages, events := fake.waitForEvents(t, 1)
+	event := messages[0].(d.ProximityEvent)
+	h.Equals(t, "near_home", event.Name)
+	h.Equals(t, "Person 1", event.FriendlyName)
+	h.Equals(t, 5.6, event.Distance)
+	h.Equals(t, directionTowards, event.Direction)
+	h.Equals(t, "near_home", events[0]["name"])
+	h.Equals(t, "towards", events[0]["direction"])
+
+	// A stationary fix within the distance does not trigger again
+	app.updateMovement("person1", 1.03, 1.0, start.Add(17*time.Minute))
+	app.checkProximity("person1")
+	h.Equals(t, directionStationary, app.conf["person1"].Attributes["direction"])
+	app.updateMovement("person1", 1.02, 1.0, start.Add(19*time.Minute))
+	app.checkProximity("person1")
+	fake.waitForEvents(t, 1)
+
+	// Moving out of the distance and back triggers again
+	app.updateMovement("person1", 1.1, 1.0, start.Add(20*time.Minute))
+	app.checkProximity("person1")
+	app.updateMovement("person1", 1.02, 1.0, start.Add(25*time.Minute))
+	app.checkProximity("person1")
+	fake.waitForEvents(t, 2)
+}
@@ -6,6 +6,8 @@ Applications
 The following applications are implemented
 - presence:
 	Implements the people app that keeps track of people like presence information
+- rules:
+	Runs rules with triggers, conditions and actions from the app yaml
 */
 package defaultapps
 
@@ -14,6 +16,7 @@ import (
 	"math"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/helto4real/go-hassclient/client"
 
@@ -47,7 +50,36 @@ type PeopleApp struct {
 	timer         *time.Timer
 	// trackerChannel is the channel where tracker updates will come
 	trackerChannel      chan client.HassEntity
-	stateChangedChannel chan string
+	stateChangedChannel chan personTimeout
+	// eventChannel is the events waiting to be sent by sendEvents
+	eventChannel chan peopleEvent
+	// listening is the entities the app listens to, each only once
+	listening map[string]bool
+	// zones keeps the zone of each person and the zones visited
+	zones map[string]*personZones
+	// movements keeps the movement of each person from the gps fixes
+	movements map[string]*personMovement
+	// regions keeps the polygon regions each person is in
+	regions map[string]*personRegions
+	// manualDevices are the devices of people in go-daemon.yaml when person
+	// entities are used, personEntities the devices of the person entities
+	manualDevices  map[string][]string
+	personEntities map[string][]string
+	// personChannel is where person entity updates will come
+	personChannel chan client.HassEntity
+	syncTicker    *time.Ticker
+	// household is the aggregated presence of all people, nil if not enabled
+	household *household
+	// status is a copy of the people with their current states for the status api
+	status      map[string]*c.PeopleConfig
+	statusMutex sync.Mutex
+}
+
+// personTimeout is sent when the just arrived or just left time of a person is out
+type personTimeout struct {
+	person string
+	// state is the state the person had when the timer started
+	state string
 }
 
 // Initialize is called when an application is started
@@ -66,13 +98,25 @@ func (a *PeopleApp) Initialize(helper d.DaemonAppHelper, config d.DeamonAppConfi
 	a.cancelContext = ctx
 
 	a.trackerChannel = make(chan client.HassEntity, 10)
-	a.stateChangedChannel = make(chan string, 2)
+	a.stateChangedChannel = make(chan personTimeout, 2)
+	a.eventChannel = make(chan peopleEvent, eventQueueSize)
+	go a.sendEvents()
+	a.listening = map[string]bool{}
+	a.initPersonEntities()
+	a.household = a.newHousehold()
 	// Update state for all persons
 	for name := range a.conf {
 		a.handleUpdatedDeviceForPerson(name, false)
 	}
+	if a.household != nil {
+		a.household.initialized = true
+		a.publishHousehold()
+	}
 
-	a.listenToDevices()
+	if !a.usePersonEntities() {
+		// The devices are listened to when the person entities are read
+		a.listenToDevices()
+	}
 
 	// Run loop in own goroutine
 	go a.loop()
@@ -82,6 +126,10 @@ func (a *PeopleApp) Initialize(helper d.DaemonAppHelper, config d.DeamonAppConfi
 }
 
 func (a *PeopleApp) loop() {
+	var syncChannel <-chan time.Time
+	if a.syncTicker != nil {
+		syncChannel = a.syncTicker.C
+	}
 
 	for {
 		select {
@@ -91,11 +139,23 @@ func (a *PeopleApp) loop() {
 			}
 			a.handleUpdatedDevice(entity.ID, false)
 
-		case person, ok := <-a.stateChangedChannel:
+		case timeout, ok := <-a.stateChangedChannel:
 			if !ok {
 				return
 			}
-			a.handleUpdatedDeviceForPerson(person, true)
+			// The person can be removed or have changed state since the timer started
+			if person, exists := a.conf[timeout.person]; exists && person.State == timeout.state {
+				a.handleUpdatedDeviceForPerson(timeout.person, true)
+			}
+
+		case entity, ok := <-a.personChannel:
+			if !ok {
+				return
+			}
+			a.applyPersonEntity(&entity, true)
+
+		case <-syncChannel:
+			a.syncPersonEntities(true)
 		// Listen to the cancelation context and leave when canceled
 		case <-a.cancelContext.Done():
 			return
@@ -105,67 +165,96 @@ func (a *PeopleApp) loop() {
 func (a *PeopleApp) handleUpdatedDevice(entityID string, isFromTimeout bool) {
 	// Get the person owning device
 	person := a.getPersonOwningDevice(entityID)
+	if person == "" {
+		return
+	}
 	a.handleUpdatedDeviceForPerson(person, isFromTimeout)
 }
 
 func (a *PeopleApp) handleUpdatedDeviceForPerson(person string, isFromTimeout bool) {
+	if _, ok := a.conf[person]; !ok {
+		// Removed person
+		return
+	}
 	// Get devices
 	devices := a.getDeviceEntities(person)
 
-	state := a.getHassDeviceState(devices)
-
-	if state != "home" {
-		if a.conf[person].State == "" {
-			a.setState(person, state, devices)
-		} else if a.conf[person].State == a.settings.TrackingSettings.JustLeftState {
-			if isFromTimeout {
-				a.setState(person, state, devices)
-			} else {
-				// Use same state since we are not setting from timeout
-				a.setState(person, a.conf[person].State, devices)
-			}
-
-		} else if a.conf[person].State == a.settings.TrackingSettings.HomeState {
-			// We were home and just left
-			a.setState(person, a.settings.TrackingSettings.JustLeftState, devices)
-
-			time.AfterFunc(time.Second*time.Duration(a.settings.TrackingSettings.JustLeftTime), func() {
-				if a.conf[person].State == a.settings.TrackingSettings.JustLeftState {
-					a.stateChangedChannel <- person
-				}
-			})
-
+	zone, confidence := a.getZone(person, devices)
+	a.updateZoneHistory(person, zone)
+	a.zones[person].confidence = confidence
+
+	tracking := a.settings.TrackingSettings
+	currentState := a.conf[person].State
+	switch currentState {
+	case "":
+		a.setState(person, zone, devices)
+	case tracking.JustLeftState:
+		if a.isTrackedZone(zone) {
+			a.setJustArrived(person, zone, devices)
+		} else if isFromTimeout {
+			a.setState(person, zone, devices)
 		} else {
-			a.setState(person, state, devices)
+			// Use same state since we are not setting from timeout
+			a.setState(person, currentState, devices)
 		}
-	} else {
-		//Home
-
-		if a.conf[person].State == "" {
-			a.setState(person, state, devices)
-		} else if a.conf[person].State == a.settings.TrackingSettings.JustArrivedState {
+	case tracking.JustArrivedState:
+		arriving := a.zones[person].arriving
+		if arriving == "" {
+			arriving = "home"
+		}
+		if zone == arriving {
 			if isFromTimeout {
-				a.setState(person, state, devices)
+				a.setState(person, zone, devices)
 			} else {
 				// Use same state since we are not setting from timeout
-				a.setState(person, a.conf[person].State, devices)
-
+				a.setState(person, currentState, devices)
 			}
-		} else if a.conf[person].State != a.settings.TrackingSettings.HomeState {
-			// We were home and just left
-			a.setState(person, a.settings.TrackingSettings.JustArrivedState, devices)
-
-			time.AfterFunc(time.Second*time.Duration(a.settings.TrackingSettings.JustArrivedTime), func() {
-				if a.conf[person].State == a.settings.TrackingSettings.JustArrivedState {
-					a.stateChangedChannel <- person
-				}
-			})
+		} else if a.isTrackedZone(zone) {
+			a.setJustArrived(person, zone, devices)
+		} else {
+			a.setState(person, zone, devices)
+		}
+	default:
+		settled := a.settledZone(currentState)
+		if settled != "" && zone == settled {
+			a.setState(person, zone, devices)
+		} else if a.isTrackedZone(zone) {
+			a.setJustArrived(person, zone, devices)
+		} else if settled != "" {
+			// We were in a zone and just left
+			a.setJustLeft(person, devices)
 		} else {
-			a.setState(person, state, devices)
+			a.setState(person, zone, devices)
 		}
 	}
+}
+
+// setJustArrived sets the just arrived state and the zone state after the just arrived time
+func (a *PeopleApp) setJustArrived(person string, zone string, devices []*client.HassEntity) {
+	a.zones[person].arriving = zone
+	a.setState(person, a.settings.TrackingSettings.JustArrivedState, devices)
+
+	a.startTimeout(person, a.settings.TrackingSettings.JustArrivedState, a.settings.TrackingSettings.JustArrivedTime)
+}
 
+// setJustLeft sets the just left state and the new state after the just left time
+func (a *PeopleApp) setJustLeft(person string, devices []*client.HassEntity) {
+	a.setState(person, a.settings.TrackingSettings.JustLeftState, devices)
+
+	a.startTimeout(person, a.settings.TrackingSettings.JustLeftState, a.settings.TrackingSettings.JustLeftTime)
 }
+
+// startTimeout sends the timeout of state to the loop after seconds, the
+// state is checked in the loop that owns the people
+func (a *PeopleApp) startTimeout(person string, state string, seconds int) {
+	time.AfterFunc(time.Second*time.Duration(seconds), func() {
+		select {
+		case a.stateChangedChannel <- personTimeout{person: person, state: state}:
+		case <-a.cancelContext.Done():
+		}
+	})
+}
+
 func (a *PeopleApp) setState(person string, state string, devices []*client.HassEntity) {
 
 	var personState string
@@ -173,14 +262,18 @@ func (a *PeopleApp) setState(person string, state string, devices []*client.Hass
 		personState = a.settings.TrackingSettings.HomeState
 	} else if state == "not_home" {
 		personState = a.settings.TrackingSettings.AwayState
+	} else if zoneState, ok := a.zoneState(state); ok {
+		personState = zoneState
 	} else {
 		personState = state
 	}
+	previousState := a.conf[person].State
 	a.conf[person].State = personState
 
 	sortedDevices := devices
 	sort.Slice(sortedDevices, func(i, j int) bool { return devices[i].New.LastChanged.After(devices[j].New.LastUpdated) })
 	hasLocation := false
+	var fixTime time.Time
 	for _, device := range sortedDevices {
 		if device.New.Attributes["source_type"] == "gps" {
 			// Copy attributes if exists
@@ -194,6 +287,7 @@ func (a *PeopleApp) setState(person string, state string, devices []*client.Hass
 				hasLocation = true
 				a.conf[person].Attributes["latitude"] = latitude
 			}
+			fixTime = device.New.LastUpdated
 			picture, ok := device.New.Attributes["entity_picture"]
 			if ok {
 				a.conf[person].Attributes["entity_picture"] = picture
@@ -214,13 +308,12 @@ func (a *PeopleApp) setState(person string, state string, devices []*client.Hass
 		}
 	}
 	a.conf[person].Attributes["friendly_name"] = a.conf[person].FriendlyName
+	a.setZoneAttributes(person)
 	if hasLocation {
 		longitude := a.conf[person].Attributes["longitude"].(float64)
 		latitude := a.conf[person].Attributes["latitude"].(float64)
-
-		homeLocation := a.deamon.GetLocation()
-		distance := distance(latitude, longitude, homeLocation.Latitude, homeLocation.Longitude, "K")
-		a.conf[person].Attributes["distance"] = math.Round(distance)
+		a.updateMovement(person, latitude, longitude, fixTime)
+		a.updateRegions(person, latitude, longitude)
 
 		a.conf[person].Attributes["source_type"] = "gps"
 	}
@@ -232,51 +325,31 @@ func (a *PeopleApp) setState(person string, state string, devices []*client.Hass
 	})
 	a.deamon.SetEntity(entity)
 	log.Debugln(entity)
+	a.setPeopleStatus()
+	a.updateHousehold(person)
+	a.sendPresenceEvent(person, previousState)
+	a.checkProximity(person)
+	a.sendRegionEvents(person)
 }
-func getDeviceID(person string) string {
-	return "device_tracker." + strings.ToLower(person) + "_presence"
+// setPeopleStatus copies the current states of people for the status api
+func (a *PeopleApp) setPeopleStatus() {
+	status := c.CopyPeople(a.conf)
+	a.statusMutex.Lock()
+	defer a.statusMutex.Unlock()
+	a.status = status
 }
-func (a *PeopleApp) getHassDeviceState(devices []*client.HassEntity) string {
-	sortedDevices := devices
-	// Get devices
-	sort.Slice(sortedDevices, func(i, j int) bool { return devices[i].New.LastChanged.After(devices[j].New.LastChanged) })
 
-	for _, device := range sortedDevices {
-		if translateState(device.New.State) == "home" {
-			sourceType, ok := device.New.Attributes["source_type"]
-			if ok {
-				if sourceType != "gps" {
-					// Ether bt or wifi are home, device always home, this will make
-					// the tracking alot more stable
-					return "home"
-				} else if time.Now().UTC().Sub(device.New.LastUpdated).Minutes() < 60 {
-					// If the gps device was updated recently if the gps is not reporting
-					// and last state was "home" we want to avoid getting stuck at home
-					return "home"
-				}
-			} else {
-				// No attributes, it is not a gps device
-				return "home"
-			}
-		}
-	}
-
-	// If we reached this point all devices are considered not_home
-	// Get the state from gps device
-	gpsDevice := getGpsSourceTypeDevice(sortedDevices)
-
-	if gpsDevice != nil {
-		// Return the gps device state
-		return translateState(gpsDevice.New.State)
-	}
-	if len(sortedDevices) > 0 {
-		// Just return the last changed device state
-		return translateState(sortedDevices[0].New.State)
-	} else {
-		return "not_home"
-	}
+// PeopleStatus returns the people with their current states, nil before the
+// first state is set. The daemon shows them in the status api
+func (a *PeopleApp) PeopleStatus() map[string]*c.PeopleConfig {
+	a.statusMutex.Lock()
+	defer a.statusMutex.Unlock()
+	return a.status
 }
 
+func getDeviceID(person string) string {
+	return "device_tracker." + strings.ToLower(person) + "_presence"
+}
 func getGpsSourceTypeDevice(devices []*client.HassEntity) *client.HassEntity {
 	// None of the devices is home, take value from gps device
 	for _, device := range devices {
@@ -325,10 +398,19 @@ func (a *PeopleApp) listenToDevices() {
 	}
 	for _, person := range a.conf {
 		for _, device := range person.Devices {
-			a.deamon.ListenState(device, a.trackerChannel)
+			a.listenState(device, a.trackerChannel)
 		}
 	}
 }
+
+// listenState listens to the entity if not already listening
+func (a *PeopleApp) listenState(entity string, channel chan client.HassEntity) {
+	if a.listening[entity] {
+		return
+	}
+	a.listening[entity] = true
+	a.deamon.ListenState(entity, channel)
+}
 func (a *PeopleApp) getDeviceEntities(person string) []*client.HassEntity {
 	if !a.peopleConfigured() {
 		return nil
@@ -358,6 +440,9 @@ func (a *PeopleApp) peopleConfigured() bool {
 func (a *PeopleApp) Cancel() {
 	// Cancel the goroutine select
 	a.cancel()
+	if a.syncTicker != nil {
+		a.syncTicker.Stop()
+	}
 }
 
 func distance(lat1 float64, lng1 float64, lat2 float64, lng2 float64, unit ...string) float64 {
@@ -14,6 +14,7 @@ import (
 	"github.com/helto4real/go-daemon/daemon/config"
 	h "github.com/helto4real/go-daemon/daemon/test"
 	"github.com/helto4real/go-hassclient/client"
+	"github.com/sirupsen/logrus"
 )
 
 func TestInitialize(t *testing.T) {
@@ -29,6 +30,11 @@ func TestInitialize(t *testing.T) {
 
 	h.Equals(t, fake.fakePeopleConfig["person1"].State, "Home")
 	h.Equals(t, fake.fakePeopleConfig["person2"].State, "Home")
+
+	// The status is a copy of the people
+	status := app.PeopleStatus()
+	fake.fakePeopleConfig["person1"].State = "Away"
+	h.Equals(t, "Home", status["person1"].State)
 }
 
 func TestInitializeAway(t *testing.T) {
@@ -237,6 +243,185 @@ func TestPeopleConfigured(t *testing.T) {
 	h.Equals(t, app.peopleConfigured(), false)
 }
 
+func TestZones(t *testing.T) {
+	app := PeopleApp{}
+	fake := newFakeDaemonHelperTestCase("testcase11.yml")
+	fake.fakeDevices["device_tracker.gps1"].New.LastUpdated = time.Now().UTC()
+	fake.timeChangedState = 0
+	app.Initialize(fake, d.DeamonAppConfig{
+		App:        "fake_app",
+		Properties: make(map[string]string),
+	})
+	time.Sleep(time.Millisecond * 100)
+	fake.confMutex.Lock()
+	h.Equals(t, "Work", fake.fakePeopleConfig["person1"].State)
+	h.Equals(t, "zone.work", fake.fakePeopleConfig["person1"].Attributes["zone"])
+	h.Equals(t, "School", fake.fakePeopleConfig["person2"].State)
+	h.Equals(t, "zone.school", fake.fakePeopleConfig["person2"].Attributes["zone"])
+
+	// Leaving work by gps coordinates
+	fake.fakeDevices["device_tracker.gps1"].New.Attributes["latitude"] = 2.0
+	fake.confMutex.Unlock()
+	app.handleUpdatedDevice("device_tracker.gps1", false)
+	fake.confMutex.Lock()
+	defer fake.confMutex.Unlock()
+	h.Equals(t, "Just left", fake.fakePeopleConfig["person1"].State)
+	h.Equals(t, "not_home", fake.fakePeopleConfig["person1"].Attributes["zone"])
+	history := fake.fakePeopleConfig["person1"].Attributes["zone_history"].([]map[string]interface{})
+	h.Equals(t, 1, len(history))
+	h.Equals(t, "zone.work", history[0]["zone"])
+}
+
+func TestZoneToZone(t *testing.T) {
+	app := PeopleApp{}
+	fake := newFakeDaemonHelperTestCase("testcase11.yml")
+	app.Initialize(fake, d.DeamonAppConfig{
+		App:        "fake_app",
+		Properties: make(map[string]string),
+	})
+	h.Equals(t, "Just arrived", fake.fakePeopleConfig["person2"].State)
+
+	// Going directly to another tracked zone is just arrived there
+	fake.fakeDevices["device_tracker.gps2"].New.State = "home"
+	app.handleUpdatedDevice("device_tracker.gps2", false)
+	h.Equals(t, "Just arrived", fake.fakePeopleConfig["person2"].State)
+	h.Equals(t, "home", app.zones["person2"].arriving)
+	app.handleUpdatedDevice("device_tracker.gps2", true)
+	h.Equals(t, "Home", fake.fakePeopleConfig["person2"].State)
+}
+
+func TestHousehold(t *testing.T) {
+	app := PeopleApp{}
+	fake := newFakeDaemonHelperTestCase("testcase1.yml")
+	fake.fakeHousehold = &config.HouseholdConfig{Groups: map[string][]string{"adults": {"person1"}}}
+	fake.fakeEntities = map[string]*client.HassEntity{}
+	app.Initialize(fake, d.DeamonAppConfig{
+		App:        "fake_app",
+		Properties: make(map[string]string),
+	})
+	fake.confMutex.Lock()
+	// Two people and ten household entities
+	h.Equals(t, 12, fake.setEntity)
+	h.Equals(t, "on", fake.fakeEntities["binary_sensor.household_anyone_home"].New.State)
+	h.Equals(t, "off", fake.fakeEntities["binary_sensor.household_everyone_away"].New.State)
+	h.Equals(t, "2", fake.fakeEntities["sensor.household_people_home"].New.State)
+	h.Equals(t, "1", fake.fakeEntities["sensor.adults_people_home"].New.State)
+	h.Equals(t, "Adults anyone home", fake.fakeEntities["binary_sensor.adults_anyone_home"].New.Attributes["friendly_name"])
+	h.Equals(t, "unknown", fake.fakeEntities["sensor.adults_last_left"].New.State)
+
+	fake.fakeDevices["device_tracker.bt"].New.State = "not_home"
+	fake.fakeDevices["device_tracker.gps"].New.State = "not_home"
+	fake.fakeDevices["device_tracker.wifi"].New.State = "not_home"
+	fake.confMutex.Unlock()
+	app.handleUpdatedDevice("device_tracker.bt", false)
+
+	fake.confMutex.Lock()
+	defer fake.confMutex.Unlock()
+	h.Equals(t, "Just left", fake.fakePeopleConfig["person1"].State)
+	h.Equals(t, "on", fake.fakeEntities["binary_sensor.adults_everyone_away"].New.State)
+	h.Equals(t, "person1Friendly", fake.fakeEntities["sensor.adults_last_left"].New.State)
+	h.Equals(t, "1", fake.fakeEntities["sensor.household_people_home"].New.State)
+	h.Equals(t, []string{"person2Friendly"}, fake.fakeEntities["sensor.household_people_home"].New.Attributes["people"])
+	h.Equals(t, "unknown", fake.fakeEntities["sensor.household_last_left"].New.State)
+}
+
+func TestPresenceEvents(t *testing.T) {
+	app := PeopleApp{}
+	fake := newFakeDaemonHelperTestCase("testcase1.yml")
+	app.Initialize(fake, d.DeamonAppConfig{
+		App:        "fake_app",
+		Properties: make(map[string]string),
+	})
+	defer app.Cancel()
+	// No events for the initial states
+	h.Equals(t, 0, len(fake.fakeMessages))
+
+	fake.fakeDevices["device_tracker.bt"].New.State = "not_home"
+	fake.fakeDevices["device_tracker.gps"].New.State = "not_home"
+	fake.fakeDevices["device_tracker.wifi"].New.State = "not_home"
+	app.handleUpdatedDevice("device_tracker.bt", false)
+	// Same state does not send events
+	app.handleUpdatedDevice("device_tracker.bt", false)
+	app.handleUpdatedDevice("device_tracker.bt", true)
+
+	messages, events := fake.waitForEvents(t, 2)
+	h.Equals(t, 2, len(messages))
+	left := messages[0].(d.PresenceEvent)
+	h.Equals(t, "person1", left.Person)
+	h.Equals(t, "Home", left.From)
+	h.Equals(t, "Just left", left.To)
+	h.Equals(t, "home", left.FromZone)
+	h.Equals(t, "not_home", left.Zone)
+	h.Equals(t, d.PresenceLeft, left.Change)
+	h.Equals(t, 157.0, left.Distance)
+
+	away := messages[1].(d.PresenceEvent)
+	h.Equals(t, "Away", away.To)
+	h.Equals(t, d.PresenceChanged, away.Change)
+
+	h.Equals(t, "left", events[0]["change"])
+	h.Equals(t, "person1Friendly", events[0]["friendly_name"])
+	h.Equals(t, "not_home", events[0]["zone"])
+	h.Equals(t, 157.0, events[0]["distance"])
+
+	fake.fakeDevices["device_tracker.wifi"].New.State = "home"
+	app.handleUpdatedDevice("device_tracker.wifi", false)
+	messages, _ = fake.waitForEvents(t, 3)
+	h.Equals(t, d.PresenceArrived, messages[2].(d.PresenceEvent).Change)
+	h.Equals(t, "Just arrived", messages[2].(d.PresenceEvent).To)
+}
+
+func TestPersonEntities(t *testing.T) {
+	app := PeopleApp{}
+	fake := newFakeDaemonHelperTestCase("testcase1.yml")
+	fake.fakeDevices["device_tracker.phone3"] = &client.HassEntity{ID: "device_tracker.phone3",
+		New: client.HassEntityState{State: "not_home", Attributes: map[string]interface{}{}}}
+	person1 := &client.HassEntity{ID: "person.person1", New: client.HassEntityState{Attributes: map[string]interface{}{
+		"friendly_name":   "Person One",
+		"device_trackers": []interface{}{"device_tracker.bt", "device_tracker.phone3", "device_tracker.person1_presence"}}}}
+	person3 := &client.HassEntity{ID: "person.person3", New: client.HassEntityState{Attributes: map[string]interface{}{
+		"friendly_name":   "Person 3",
+		"device_trackers": []interface{}{"device_tracker.bt2"}}}}
+	fake.fakePersons = []*client.HassEntity{person1, person3}
+	app.Initialize(fake, d.DeamonAppConfig{
+		App:        "fake_app",
+		Properties: make(map[string]string),
+	})
+	defer app.Cancel()
+
+	// Devices of the person entity are added to the configured, the presence entity is ignored
+	h.Equals(t, []string{"device_tracker.bt", "device_tracker.gps", "device_tracker.wifi", "device_tracker.phone3"},
+		fake.fakePeopleConfig["person1"].Devices)
+	h.Equals(t, "person1Friendly", fake.fakePeopleConfig["person1"].FriendlyName)
+	h.Equals(t, []string{"device_tracker.bt2"}, fake.fakePeopleConfig["person3"].Devices)
+	h.Equals(t, "Person 3", fake.fakePeopleConfig["person3"].FriendlyName)
+	h.Equals(t, "Home", fake.fakePeopleConfig["person3"].State)
+
+	// Each entity is listened to once, also when synced again
+	listening := fake.listenState
+	app.syncPersonEntities(true)
+	h.Equals(t, listening, fake.listenState)
+
+	// Edited person in Home Assistant
+	person3.New.Attributes["device_trackers"] = []interface{}{"device_tracker.wifi2"}
+	app.applyPersonEntity(person3, true)
+	h.Equals(t, []string{"device_tracker.wifi2"}, fake.fakePeopleConfig["person3"].Devices)
+	h.Equals(t, "Just left", fake.fakePeopleConfig["person3"].State)
+	// device_tracker.wifi2 of person2 is already listened to
+	h.Equals(t, listening, fake.listenState)
+
+	// Removed persons are removed, configured people keep their devices
+	fake.fakePersons = []*client.HassEntity{}
+	app.syncPersonEntities(true)
+	_, ok := fake.fakePeopleConfig["person3"]
+	h.Equals(t, false, ok)
+	h.Equals(t, []string{"device_tracker.bt", "device_tracker.gps", "device_tracker.wifi"},
+		fake.fakePeopleConfig["person1"].Devices)
+
+	// The just left timeout of the removed person is ignored
+	app.handleUpdatedDeviceForPerson("person3", true)
+}
+
 func TestNewState(t *testing.T) {
 	stateData := newState("a state")
 	h.Equals(t, stateData.state, "a state")
@@ -260,7 +445,14 @@ type fakeDaemonAppHelper struct {
 	timeChangedState int
 	fakePeopleConfig map[string]*config.PeopleConfig
 	fakeDevices      map[string]*client.HassEntity
-	confMutex        *sync.Mutex
+	fakeZones        map[string]*config.ZoneConfig
+	fakeHousehold    *config.HouseholdConfig
+	fakeEntities     map[string]*client.HassEntity
+	fakeMessages     []interface{}
+	fakeEvents       []map[string]interface{}
+	// fakePersons are the person entities, used by the people app if not nil
+	fakePersons []*client.HassEntity
+	confMutex   *sync.Mutex
 }
 
 func newFakeDaemonHelper() *fakeDaemonAppHelper {
@@ -316,6 +508,9 @@ func (a *fakeDaemonAppHelper) SetEntity(entity *client.HassEntity) bool {
 	a.confMutex.Lock()
 	defer a.confMutex.Unlock()
 	a.setEntity = a.setEntity + 1
+	if a.fakeEntities != nil {
+		a.fakeEntities[entity.ID] = entity
+	}
 	return true
 }
 
@@ -335,6 +530,22 @@ func (a *fakeDaemonAppHelper) ListenCallServiceEvent(domain string, service stri
 	panic("not implemented")
 }
 
+func (a *fakeDaemonAppHelper) ListenEvent(eventType string, eventChannel chan d.HassEvent) {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) UnlistenState(entity string, stateChannel chan client.HassEntity) {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) UnlistenCallServiceEvent(domain string, service string, callServiceChannel chan client.HassCallServiceEvent) {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) UnlistenEvent(eventType string, eventChannel chan d.HassEvent) {
+	panic("not implemented")
+}
+
 func (a *fakeDaemonAppHelper) ListenState(entity string, stateChannel chan client.HassEntity) {
 	a.listenState = a.listenState + 1
 }
@@ -369,7 +580,10 @@ func (a *fakeDaemonAppHelper) GetSettings() *config.SettingsConfig {
 			JustArrivedState: "Just arrived",
 			JustLeftState:    "Just left",
 			AwayState:        "Away",
+			Zones:            a.fakeZones,
+			PersonEntities:   a.fakePersons != nil,
 		},
+		Household: a.fakeHousehold,
 	}
 }
 
@@ -381,6 +595,83 @@ func (a *fakeDaemonAppHelper) GetLocation() d.Location {
 	}
 }
 
+func (a *fakeDaemonAppHelper) GetLogger() *logrus.Entry {
+	return logrus.WithField("prefix", "fake")
+}
+
+func (a *fakeDaemonAppHelper) Publish(topic string, message interface{}) error {
+	a.confMutex.Lock()
+	defer a.confMutex.Unlock()
+	a.fakeMessages = append(a.fakeMessages, message)
+	return nil
+}
+
+func (a *fakeDaemonAppHelper) Subscribe(topic string, channel interface{}) error {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) HandleRequest(topic string, handler func(request interface{}) (interface{}, error)) error {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) Request(topic string, request interface{}, timeout time.Duration) (interface{}, error) {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) RegisterService(domain string, service string, schema interface{},
+	handler func(data interface{}) (interface{}, error)) error {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) WaitForState(ctx context.Context, entity string,
+	predicate func(entity client.HassEntity) bool, timeout time.Duration) (client.HassEntity, error) {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) History(entity string, since time.Time) []client.HassEntityState {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) HistoryStats(entity string, since time.Time) (d.HistoryStats, bool) {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) ListenThreshold(entity string, trigger d.ThresholdTrigger, channel chan d.ThresholdEvent) error {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) CallService(domain string, service string, data map[string]interface{}) error {
+	panic("not implemented")
+}
+
+func (a *fakeDaemonAppHelper) GetEntities(domain string) ([]*client.HassEntity, error) {
+	return a.fakePersons, nil
+}
+
+func (a *fakeDaemonAppHelper) FireEvent(eventType string, data map[string]interface{}) error {
+	a.confMutex.Lock()
+	defer a.confMutex.Unlock()
+	a.fakeEvents = append(a.fakeEvents, data)
+	return nil
+}
+
+// waitForEvents waits until count events are fired and returns the published
+// messages and the fired event data
+func (a *fakeDaemonAppHelper) waitForEvents(t *testing.T, count int) ([]interface{}, []map[string]interface{}) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		a.confMutex.Lock()
+		messages := append([]interface{}(nil), a.fakeMessages...)
+		events := append([]map[string]interface{}(nil), a.fakeEvents...)
+		a.confMutex.Unlock()
+		if len(events) >= count || time.Now().After(deadline) {
+			h.Equals(t, count, len(events))
+			return messages, events
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
 func (a *fakeDaemonAppHelper) loadTestCase(filename string) {
 	caseData := testCaseConfig{}
 	data, error := ioutil.ReadFile(path.Join("testdata/people", filename))
@@ -407,6 +698,8 @@ func (a *fakeDaemonAppHelper) loadTestCase(filename string) {
 		}
 	}
 
+	a.fakeZones = caseData.Zones
+
 	if caseData.Devices != nil {
 		for deviceID, device := range caseData.Devices {
 			a.fakeDevices[deviceID] = &client.HassEntity{
@@ -427,8 +720,9 @@ func (a *fakeDaemonAppHelper) loadTestCase(filename string) {
 
 // Config is the main configuration data structure
 type testCaseConfig struct {
-	People  map[string]*peopleConfig  `yaml:"people"`
-	Devices map[string]*devicesConfig `yaml:"devices"`
+	People  map[string]*peopleConfig      `yaml:"people"`
+	Devices map[string]*devicesConfig     `yaml:"devices"`
+	Zones   map[string]*config.ZoneConfig `yaml:"zones"`
 }
 
 // HomeAssistantConfig is the configuration for the Home Assistant platform integration
@@ -0,0 +1,192 @@
+package defaultapps
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/helto4real/go-hassclient/client"
+
+	c "github.com/helto4real/go-daemon/daemon/config"
+)
+
+// usePersonEntities returns true if people are read from the Home Assistant person entities
+func (a *PeopleApp) usePersonEntities() bool {
+	return a.settings != nil && a.settings.TrackingSettings != nil && a.settings.TrackingSettings.PersonEntities
+}
+
+// initPersonEntities reads the person entities and starts the sync of added and removed persons
+func (a *PeopleApp) initPersonEntities() {
+	if !a.usePersonEntities() {
+		return
+	}
+	// Keep the devices from go-daemon.yaml, the person entity devices are added to those
+	a.manualDevices = map[string][]string{}
+	for name, person := range a.conf {
+		a.manualDevices[name] = append([]string(nil), person.Devices...)
+		for _, device := range person.Devices {
+			a.listenState(device, a.trackerChannel)
+		}
+	}
+	a.personEntities = map[string][]string{}
+	a.personChannel = make(chan client.HassEntity, 10)
+	a.syncPersonEntities(false)
+
+	interval := a.settings.TrackingSettings.PersonSyncInterval
+	if interval <= 0 {
+		interval = 300
+	}
+	a.syncTicker = time.NewTicker(time.Duration(interval) * time.Second)
+}
+
+// syncPersonEntities reads all person entities, adds or updates their people
+// and removes the people of persons removed in Home Assistant
+func (a *PeopleApp) syncPersonEntities(update bool) {
+	entities, err := a.deamon.GetEntities("person")
+	if err != nil {
+		log.Errorf("Failed to read person entities: %v", err)
+		return
+	}
+	found := map[string]bool{}
+	for _, entity := range entities {
+		found[personOfEntity(entity.ID)] = true
+		a.applyPersonEntity(entity, update)
+	}
+	for person := range a.personEntities {
+		if !found[person] {
+			a.removePersonEntity(person)
+		}
+	}
+}
+
+// personOfEntity returns the person of a person entity id, the object id
+func personOfEntity(entityID string) string {
+	return strings.ToLower(strings.TrimPrefix(entityID, "person."))
+}
+
+// deviceTrackers returns the device_trackers attribute of the person entity
+// without presence entities of the people app that would track themselves
+func (a *PeopleApp) deviceTrackers(person string, entity *client.HassEntity) []string {
+	devices := []string{}
+	add := func(device string) {
+		if device == getDeviceID(person) || a.isPresenceEntity(device) {
+			return
+		}
+		devices = append(devices, device)
+	}
+	switch trackers := entity.New.Attributes["device_trackers"].(type) {
+	case []interface{}:
+		for _, tracker := range trackers {
+			if device, ok := tracker.(string); ok {
+				add(device)
+			}
+		}
+	case []string:
+		for _, device := range trackers {
+			add(device)
+		}
+	}
+	return devices
+}
+
+// isPresenceEntity returns true if device is the presence entity of a person
+func (a *PeopleApp) isPresenceEntity(device string) bool {
+	for person := range a.conf {
+		if getDeviceID(person) == device {
+			return true
+		}
+	}
+	return false
+}
+
+// applyPersonEntity adds or updates the person of the person entity, update
+// sets the state of the person if the devices changed
+func (a *PeopleApp) applyPersonEntity(entity *client.HassEntity, update bool) {
+	person := personOfEntity(entity.ID)
+	trackers := a.deviceTrackers(person, entity)
+	if existing, ok := a.personEntities[person]; ok && equalDevices(existing, trackers) {
+		return
+	}
+	a.personEntities[person] = trackers
+
+	conf, ok := a.conf[person]
+	if !ok {
+		conf = &c.PeopleConfig{Attributes: map[string]interface{}{}}
+		a.conf[person] = conf
+		log.Infof("Person [%s] added from %s", person, entity.ID)
+	}
+	if friendlyName, ok := entity.New.Attributes["friendly_name"].(string); ok && conf.FriendlyName == "" {
+		conf.FriendlyName = friendlyName
+	}
+	conf.Devices = mergeDevices(a.manualDevices[person], trackers)
+
+	a.listenState(entity.ID, a.personChannel)
+	for _, device := range conf.Devices {
+		a.listenState(device, a.trackerChannel)
+	}
+	if a.household != nil {
+		a.household.setEveryone(a.sortedPeople())
+	}
+	if update {
+		a.handleUpdatedDeviceForPerson(person, false)
+	}
+}
+
+// removePersonEntity removes the person of a removed person entity, people
+// in go-daemon.yaml are kept with their devices from there
+func (a *PeopleApp) removePersonEntity(person string) {
+	delete(a.personEntities, person)
+	if devices, ok := a.manualDevices[person]; ok {
+		a.conf[person].Devices = append([]string(nil), devices...)
+		a.handleUpdatedDeviceForPerson(person, false)
+		return
+	}
+	delete(a.conf, person)
+	delete(a.zones, person)
+	delete(a.movements, person)
+	delete(a.regions, person)
+	if a.household != nil {
+		a.household.setEveryone(a.sortedPeople())
+	}
+	log.Infof("Person [%s] removed", person)
+}
+
+// sortedPeople returns the sorted ids of the people
+func (a *PeopleApp) sortedPeople() []string {
+	people := make([]string, 0, len(a.conf))
+	for person := range a.conf {
+		people = append(people, person)
+	}
+	sort.Strings(people)
+	return people
+}
+
+// mergeDevices returns the devices of both lists without duplicates
+func mergeDevices(devices []string, more []string) []string {
+	merged := append([]string(nil), devices...)
+	for _, device := range more {
+		found := false
+		for _, existing := range merged {
+			if existing == device {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, device)
+		}
+	}
+	return merged
+}
+
+func equalDevices(devices []string, other []string) bool {
+	if len(devices) != len(other) {
+		return false
+	}
+	for i := range devices {
+		if devices[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
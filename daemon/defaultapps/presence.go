@@ -0,0 +1,47 @@
+package defaultapps
+
+import (
+	"time"
+
+	d "github.com/helto4real/go-daemon/daemon"
+)
+
+// presenceChange returns how the zone of a person changed
+func (a *PeopleApp) presenceChange(fromZone string, zone string) d.PresenceChange {
+	switch {
+	case fromZone == zone:
+		return d.PresenceChanged
+	case a.isTrackedZone(zone):
+		return d.PresenceArrived
+	case a.isTrackedZone(fromZone):
+		return d.PresenceLeft
+	}
+	return d.PresenceChanged
+}
+
+// sendPresenceEvent sends the presence event to other apps and Home Assistant if the state of person changed from the state from
+func (a *PeopleApp) sendPresenceEvent(person string, from string) {
+	zones, ok := a.zones[person]
+	if !ok {
+		return
+	}
+	fromZone := zones.eventZone
+	zones.eventZone = zones.current
+	to := a.conf[person].State
+	// No events for the first state, the person did not change state
+	if from == "" || from == to {
+		return
+	}
+	distance, _ := a.conf[person].Attributes["distance"].(float64)
+	event := d.PresenceEvent{
+		Person:       person,
+		FriendlyName: a.personName(person),
+		From:         from,
+		To:           to,
+		FromZone:     fromZone,
+		Zone:         zones.current,
+		Change:       a.presenceChange(fromZone, zones.current),
+		Distance:     distance,
+		Time:         time.Now()}
+	a.sendEvent(d.PresenceTopic, d.PresenceEventType, event)
+}
@@ -0,0 +1,95 @@
+package defaultapps
+
+import (
+	"sort"
+	"time"
+
+	d "github.com/helto4real/go-daemon/daemon"
+)
+
+// personRegions keeps the regions a person is in and the transitions not sent yet
+type personRegions struct {
+	current     map[string]bool
+	transitions []d.RegionEvent
+}
+
+// regionNames returns the sorted names of the regions
+func (a *PeopleApp) regionNames() []string {
+	if a.settings == nil || a.settings.TrackingSettings == nil {
+		return nil
+	}
+	names := make([]string, 0, len(a.settings.TrackingSettings.Regions))
+	for name := range a.settings.TrackingSettings.Regions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// inPolygon returns true if the coordinates are inside the polygon of
+// [latitude, longitude] corners, using ray casting
+func inPolygon(latitude float64, longitude float64, polygon [][]float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		if len(polygon[i]) < 2 || len(polygon[j]) < 2 {
+			return false
+		}
+		latI, lngI := polygon[i][0], polygon[i][1]
+		latJ, lngJ := polygon[j][0], polygon[j][1]
+		if (lngI > longitude) != (lngJ > longitude) &&
+			latitude < (latJ-latI)*(longitude-lngI)/(lngJ-lngI)+latI {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// updateRegions sets the region attribute of person from the coordinates
+// and keeps the regions entered and left for sendRegionEvents
+func (a *PeopleApp) updateRegions(person string, latitude float64, longitude float64) {
+	names := a.regionNames()
+	if len(names) == 0 {
+		return
+	}
+	if a.regions == nil {
+		a.regions = map[string]*personRegions{}
+	}
+	regions, known := a.regions[person]
+	if !known {
+		regions = &personRegions{current: map[string]bool{}}
+		a.regions[person] = regions
+	}
+	region := ""
+	now := time.Now()
+	for _, name := range names {
+		inside := inPolygon(latitude, longitude, a.settings.TrackingSettings.Regions[name].Polygon)
+		if inside && region == "" {
+			region = name
+		}
+		// No transitions for the first location, the person did not move
+		if known && inside != regions.current[name] {
+			transition := d.RegionLeave
+			if inside {
+				transition = d.RegionEnter
+			}
+			regions.transitions = append(regions.transitions, d.RegionEvent{
+				Region: name, Person: person, FriendlyName: a.personName(person),
+				Transition: transition, Time: now})
+		}
+		regions.current[name] = inside
+	}
+	a.conf[person].Attributes["region"] = region
+}
+
+// sendRegionEvents sends the region transitions of person to other apps and
+// Home Assistant
+func (a *PeopleApp) sendRegionEvents(person string) {
+	regions, ok := a.regions[person]
+	if !ok {
+		return
+	}
+	for _, event := range regions.transitions {
+		a.sendEvent(d.RegionTopic, d.RegionEventType, event)
+	}
+	regions.transitions = nil
+}
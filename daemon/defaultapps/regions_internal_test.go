@@ -0,0 +1,55 @@
+package defaultapps
+
+import (
+	"testing"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	"github.com/helto4real/go-daemon/daemon/config"
+	h "github.com/helto4real/go-daemon/daemon/test"
+)
+
+func TestInPolygon(t *testing.T) {
+	square := [][]float64{{0, 0}, {0, 2}, {2, 2}, {2, 0}}
+	h.Equals(t, true, inPolygon(1, 1, square))
+	h.Equals(t, false, inPolygon(3, 1, square))
+	h.Equals(t, false, inPolygon(1, -1, square))
+
+	triangle := [][]float64{{0, 0}, {0, 2}, {2, 0}}
+	h.Equals(t, true, inPolygon(0.5, 0.5, triangle))
+	h.Equals(t, false, inPolygon(1.5, 1.5, triangle))
+	h.Equals(t, false, inPolygon(1, 1, [][]float64{{0, 0}, {1}}))
+}
+
+func TestRegionTransitions(t *testing.T) {
+	app, fake := newMovementApp(&config.TrackingStateSettingsConfig{})
+	app.settings.TrackingSettings.Regions = map[string]*config.RegionConfig{
+		"park":   {Polygon: [][]float64{{0, 0}, {0, 2}, {2, 2}, {2, 0}}},
+		"school": {Polygon: [][]float64{{1, 1}, {1, 3}, {3, 3}, {3, 1}}}}
+	defer app.Cancel()
+	attributes := app.conf["person1"].Attributes
+
+	// No events for the first location
+	app.updateRegions("person1", 0.5, 0.5)
+	app.sendRegionEvents("person1")
+	h.Equals(t, "park", attributes["region"])
+	h.Equals(t, 0, len(fake.fakeMessages))
+
+	app.updateRegions("person1", 2.5, 2.5)
+	app.sendRegionEvents("person1")
+	h.Equals(t, "school", attributes["region"])
+	messages, events := fake.waitForEvents(t, 2)
+	h.Equals(t, d.RegionLeave, messages[0].(d.RegionEvent).Transition)
+	h.Equals(t, "park", messages[0].(d.RegionEvent).Region)
+	h.Equals(t, d.RegionEnter, messages[1].(d.RegionEvent).Transition)
+	h.Equals(t, "school", messages[1].(d.RegionEvent).Region)
+	h.Equals(t, "enter", events[1]["transition"])
+	h.Equals(t, "school", events[1]["region"])
+
+	app.updateRegions("person1", 5, 5)
+	app.sendRegionEvents("person1")
+	h.Equals(t, "", attributes["region"])
+	fake.waitForEvents(t, 3)
+	// Sent transitions are not sent again
+	app.sendRegionEvents("person1")
+	fake.waitForEvents(t, 3)
+}
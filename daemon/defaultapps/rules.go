@@ -0,0 +1,525 @@
+package defaultapps
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	c "github.com/helto4real/go-daemon/daemon/config"
+	"github.com/helto4real/go-hassclient/client"
+	"github.com/sirupsen/logrus"
+)
+
+// RulesConfig is the configuration of the rules app
+type RulesConfig struct {
+	Rules []Rule `yaml:"rules" validate:"required"`
+}
+
+// Rule runs the actions in order when any trigger fires and all conditions are true.
+// A rule that is already running ignores new triggers until the actions are done
+type Rule struct {
+	Name       string          `yaml:"name" validate:"required"`
+	Triggers   []RuleTrigger   `yaml:"triggers" validate:"required"`
+	Conditions []RuleCondition `yaml:"conditions"`
+	Actions    []RuleAction    `yaml:"actions" validate:"required"`
+}
+
+// RuleTrigger fires a rule, set one of state, call_service, event, time or sun
+type RuleTrigger struct {
+	// State is the entity that fires when the state changes, From and To
+	// limits the old and new states that fires
+	State string `yaml:"state"`
+	From  string `yaml:"from"`
+	To    string `yaml:"to"`
+	// CallService is domain.service of call_service events that fires
+	CallService string `yaml:"call_service"`
+	// Event is the event type that fires, like zha_event. EventData limits
+	// the events to the ones with the same values in the event data
+	Event     string                 `yaml:"event"`
+	EventData map[string]interface{} `yaml:"event_data"`
+	// Time is the time of day that fires, like 07:30 or 07:30:15
+	Time string `yaml:"time"`
+	// Sun is sunrise or sunset, Offset is added to the time
+	Sun    string        `yaml:"sun"`
+	Offset time.Duration `yaml:"offset"`
+}
+
+// RuleCondition has to be true for the actions to run. Set state with is,
+// not, above or below to check an entity or after and before to check the
+// time of day
+type RuleCondition struct {
+	// State is the entity to check, Attribute checks an attribute instead of the state
+	State     string   `yaml:"state"`
+	Attribute string   `yaml:"attribute"`
+	Is        string   `yaml:"is"`
+	Not       string   `yaml:"not"`
+	Above     *float64 `yaml:"above"`
+	Below     *float64 `yaml:"below"`
+	// After and Before is the time of day, like 22:00. Before can be earlier
+	// than after to check a time over midnight
+	After  string `yaml:"after"`
+	Before string `yaml:"before"`
+}
+
+// RuleAction is one step of a rule, set one of service, set or delay
+type RuleAction struct {
+	// Service is domain.service to call with Data
+	Service string                 `yaml:"service"`
+	Data    map[string]interface{} `yaml:"data"`
+	// Set is the entity to set to State and Attributes
+	Set        string                 `yaml:"set"`
+	State      string                 `yaml:"state"`
+	Attributes map[string]interface{} `yaml:"attributes"`
+	// Delay waits before the next action
+	Delay time.Duration `yaml:"delay"`
+}
+
+// Validate checks that the rule has triggers and actions
+func (a Rule) Validate() error {
+	if len(a.Triggers) == 0 {
+		return fmt.Errorf("rule %s has no triggers", a.Name)
+	}
+	if len(a.Actions) == 0 {
+		return fmt.Errorf("rule %s has no actions", a.Name)
+	}
+	return nil
+}
+
+// Validate checks that exactly one kind of trigger is set
+func (a RuleTrigger) Validate() error {
+	kinds := []string{}
+	if a.State != "" {
+		kinds = append(kinds, "state")
+		if err := c.EntityID(a.State).Validate(); err != nil {
+			return err
+		}
+	}
+	if a.CallService != "" {
+		kinds = append(kinds, "call_service")
+		if _, _, err := splitService(a.CallService); err != nil {
+			return err
+		}
+	}
+	if a.Event != "" {
+		kinds = append(kinds, "event")
+	}
+	if a.Time != "" {
+		kinds = append(kinds, "time")
+		if _, err := parseTimeOfDay(a.Time); err != nil {
+			return err
+		}
+	}
+	if a.Sun != "" {
+		kinds = append(kinds, "sun")
+		if a.Sun != "sunrise" && a.Sun != "sunset" {
+			return fmt.Errorf("sun has to be sunrise or sunset, got %q", a.Sun)
+		}
+	}
+	if len(kinds) != 1 {
+		return fmt.Errorf("trigger needs one of state, call_service, event, time or sun, got %d", len(kinds))
+	}
+	if (a.From != "" || a.To != "") && a.State == "" {
+		return fmt.Errorf("from and to can only be used with state")
+	}
+	if len(a.EventData) > 0 && a.Event == "" {
+		return fmt.Errorf("event_data can only be used with event")
+	}
+	return nil
+}
+
+// Validate checks that the condition checks an entity or the time of day
+func (a RuleCondition) Validate() error {
+	if a.State != "" {
+		if err := c.EntityID(a.State).Validate(); err != nil {
+			return err
+		}
+		if a.Is == "" && a.Not == "" && a.Above == nil && a.Below == nil {
+			return fmt.Errorf("condition on %s needs is, not, above or below", a.State)
+		}
+		if a.After != "" || a.Before != "" {
+			return fmt.Errorf("after and before can not be used with state")
+		}
+		return nil
+	}
+	if a.After == "" && a.Before == "" {
+		return fmt.Errorf("condition needs state or after and before")
+	}
+	for _, value := range []string{a.After, a.Before} {
+		if value == "" {
+			continue
+		}
+		if _, err := parseTimeOfDay(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks that exactly one kind of action is set
+func (a RuleAction) Validate() error {
+	count := 0
+	if a.Service != "" {
+		count++
+		if _, _, err := splitService(a.Service); err != nil {
+			return err
+		}
+	}
+	if a.Set != "" {
+		count++
+		if err := c.EntityID(a.Set).Validate(); err != nil {
+			return err
+		}
+	}
+	if a.Delay != 0 {
+		count++
+		if a.Delay < 0 {
+			return fmt.Errorf("delay can not be negative, got %v", a.Delay)
+		}
+	}
+	if count != 1 {
+		return fmt.Errorf("action needs one of service, set or delay, got %d", count)
+	}
+	return nil
+}
+
+// splitService splits domain.service
+func splitService(value string) (string, string, error) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid service %q, expected format domain.service", value)
+	}
+	return parts[0], parts[1], nil
+}
+
+// parseTimeOfDay returns the duration since midnight of a time like 07:30 or 07:30:15
+func parseTimeOfDay(value string) (time.Duration, error) {
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+				time.Duration(t.Second())*time.Second, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time of day %q, use format like 07:30 or 07:30:15", value)
+}
+
+// nextTimeOfDay returns the next time after now at the time of day
+func nextTimeOfDay(now time.Time, timeOfDay time.Duration) time.Time {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	next := midnight.Add(timeOfDay)
+	if !next.After(now) {
+		next = time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location()).Add(timeOfDay)
+	}
+	return next
+}
+
+// RulesApp runs rules from the app yaml so simple automations can be made
+// without writing Go
+type RulesApp struct {
+	daemon        d.DaemonAppHelper
+	config        RulesConfig
+	log           *logrus.Entry
+	cancel        context.CancelFunc
+	cancelContext context.Context
+
+	stateChannel       chan client.HassEntity
+	callServiceChannel chan client.HassCallServiceEvent
+	eventChannel       chan d.HassEvent
+	running            sync.Map
+}
+
+func init() {
+	// The rules app can be used as "app: rules" in the app yaml
+	d.Register("rules", func() d.DaemonApplication { return &RulesApp{} })
+}
+
+// Config returns the configuration the rules are decoded into
+func (a *RulesApp) Config() interface{} {
+	return &a.config
+}
+
+// Initialize listens to the triggers of all rules
+func (a *RulesApp) Initialize(helper d.DaemonAppHelper, config d.DeamonAppConfig) bool {
+	a.daemon = helper
+	a.log = helper.GetLogger()
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+	a.cancelContext = ctx
+
+	a.stateChannel = make(chan client.HassEntity, 10)
+	a.callServiceChannel = make(chan client.HassCallServiceEvent, 10)
+	a.eventChannel = make(chan d.HassEvent, 10)
+	listening := map[string]bool{}
+	for i := range a.config.Rules {
+		rule := &a.config.Rules[i]
+		for _, trigger := range rule.Triggers {
+			switch {
+			case trigger.State != "":
+				if !listening[trigger.State] {
+					listening[trigger.State] = true
+					helper.ListenState(trigger.State, a.stateChannel)
+				}
+			case trigger.CallService != "":
+				if !listening[trigger.CallService] {
+					listening[trigger.CallService] = true
+					domain, service, _ := splitService(trigger.CallService)
+					helper.ListenCallServiceEvent(domain, service, a.callServiceChannel)
+				}
+			case trigger.Event != "":
+				if !listening["event "+trigger.Event] {
+					listening["event "+trigger.Event] = true
+					helper.ListenEvent(trigger.Event, a.eventChannel)
+				}
+			case trigger.Time != "":
+				go a.timeLoop(rule, trigger)
+			case trigger.Sun != "":
+				go a.sunLoop(rule, trigger)
+			}
+		}
+	}
+
+	go a.loop()
+	a.log.Infof("Rules app initialized with %d rules", len(a.config.Rules))
+	return true
+}
+
+func (a *RulesApp) loop() {
+	for {
+		select {
+		case entity, ok := <-a.stateChannel:
+			if !ok {
+				return
+			}
+			a.handleState(entity)
+		case event, ok := <-a.callServiceChannel:
+			if !ok {
+				return
+			}
+			a.handleCallService(event)
+		case event, ok := <-a.eventChannel:
+			if !ok {
+				return
+			}
+			a.handleEvent(event)
+		// Listen to the cancelation context and leave when canceled
+		case <-a.cancelContext.Done():
+			return
+		}
+	}
+}
+
+func (a *RulesApp) handleState(entity client.HassEntity) {
+	if entity.Old.State == entity.New.State {
+		// Only attributes changed
+		return
+	}
+	for i := range a.config.Rules {
+		rule := &a.config.Rules[i]
+		for _, trigger := range rule.Triggers {
+			if !strings.EqualFold(trigger.State, entity.ID) ||
+				(trigger.From != "" && trigger.From != entity.Old.State) ||
+				(trigger.To != "" && trigger.To != entity.New.State) {
+				continue
+			}
+			a.fire(rule, fmt.Sprintf("%s changed from %s to %s", entity.ID, entity.Old.State, entity.New.State))
+			break
+		}
+	}
+}
+
+func (a *RulesApp) handleCallService(event client.HassCallServiceEvent) {
+	name := event.Domain + "." + event.Service
+	for i := range a.config.Rules {
+		rule := &a.config.Rules[i]
+		for _, trigger := range rule.Triggers {
+			if strings.EqualFold(trigger.CallService, name) {
+				a.fire(rule, "call_service "+name)
+				break
+			}
+		}
+	}
+}
+
+func (a *RulesApp) handleEvent(event d.HassEvent) {
+	for i := range a.config.Rules {
+		rule := &a.config.Rules[i]
+		for _, trigger := range rule.Triggers {
+			if trigger.Event == event.EventType && eventDataMatches(trigger.EventData, event.Data) {
+				a.fire(rule, "event "+event.EventType)
+				break
+			}
+		}
+	}
+}
+
+// eventDataMatches returns true if data has the same values as expected, values
+// are compared as text so numbers from yaml and json are equal
+func eventDataMatches(expected map[string]interface{}, data map[string]interface{}) bool {
+	for key, value := range expected {
+		actual, ok := data[key]
+		if !ok || fmt.Sprint(actual) != fmt.Sprint(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// timeLoop fires the rule at the time of day until the app is canceled
+func (a *RulesApp) timeLoop(rule *Rule, trigger RuleTrigger) {
+	timeOfDay, _ := parseTimeOfDay(trigger.Time)
+	for {
+		now := time.Now()
+		timer := time.NewTimer(nextTimeOfDay(now, timeOfDay).Sub(now))
+		select {
+		case <-timer.C:
+			a.fire(rule, "time "+trigger.Time)
+		case <-a.cancelContext.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// sunLoop fires the rule at sunrise or sunset until the app is canceled
+func (a *RulesApp) sunLoop(rule *Rule, trigger RuleTrigger) {
+	sunChannel := make(chan bool, 1)
+	for {
+		var timer *time.Timer
+		if trigger.Sun == "sunset" {
+			timer = a.daemon.AtSunset(trigger.Offset, sunChannel)
+		} else {
+			timer = a.daemon.AtSunrise(trigger.Offset, sunChannel)
+		}
+		if timer == nil {
+			a.log.Errorf("Rule %s can not be triggered at %s", rule.Name, trigger.Sun)
+			return
+		}
+		select {
+		case <-sunChannel:
+			a.fire(rule, trigger.Sun)
+		case <-a.cancelContext.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// fire runs the actions of rule if the conditions are true and it is not already running
+func (a *RulesApp) fire(rule *Rule, cause string) {
+	if !a.conditionsTrue(rule) {
+		a.log.Debugf("Rule %s triggered by %s, conditions not true", rule.Name, cause)
+		return
+	}
+	if _, running := a.running.LoadOrStore(rule, true); running {
+		a.log.Debugf("Rule %s triggered by %s, already running", rule.Name, cause)
+		return
+	}
+	a.log.Infof("Rule %s triggered by %s", rule.Name, cause)
+	go func() {
+		defer a.running.Delete(rule)
+		a.runActions(rule)
+	}()
+}
+
+func (a *RulesApp) conditionsTrue(rule *Rule) bool {
+	for _, condition := range rule.Conditions {
+		if !a.conditionTrue(condition, time.Now()) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *RulesApp) conditionTrue(condition RuleCondition, now time.Time) bool {
+	if condition.State == "" {
+		return timeOfDayBetween(now, condition.After, condition.Before)
+	}
+	entity, ok := a.daemon.GetEntity(condition.State)
+	if !ok {
+		return false
+	}
+	value := entity.New.State
+	if condition.Attribute != "" {
+		attribute, ok := entity.New.Attributes[condition.Attribute]
+		if !ok {
+			return false
+		}
+		value = fmt.Sprint(attribute)
+	}
+	if condition.Is != "" && value != condition.Is {
+		return false
+	}
+	if condition.Not != "" && value == condition.Not {
+		return false
+	}
+	if condition.Above != nil || condition.Below != nil {
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+		if condition.Above != nil && number <= *condition.Above {
+			return false
+		}
+		if condition.Below != nil && number >= *condition.Below {
+			return false
+		}
+	}
+	return true
+}
+
+// timeOfDayBetween returns true if now is at or after after and before before,
+// empty after or before has no limit
+func timeOfDayBetween(now time.Time, after string, before string) bool {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	current := now.Sub(midnight)
+	start, end := time.Duration(0), 24*time.Hour
+	if after != "" {
+		start, _ = parseTimeOfDay(after)
+	}
+	if before != "" {
+		end, _ = parseTimeOfDay(before)
+	}
+	if start <= end {
+		return current >= start && current < end
+	}
+	// Over midnight, like after 22:00 and before 06:00
+	return current >= start || current < end
+}
+
+func (a *RulesApp) runActions(rule *Rule) {
+	for _, action := range rule.Actions {
+		switch {
+		case action.Service != "":
+			domain, service, _ := splitService(action.Service)
+			if err := a.daemon.CallService(domain, service, action.Data); err != nil {
+				a.log.Errorf("Rule %s: %v", rule.Name, err)
+			}
+		case action.Set != "":
+			attributes := action.Attributes
+			if attributes == nil {
+				attributes = map[string]interface{}{}
+			}
+			entity := client.NewHassEntity(action.Set, action.Set, client.HassEntityState{},
+				client.HassEntityState{State: action.State, Attributes: attributes})
+			if !a.daemon.SetEntity(entity) {
+				a.log.Errorf("Rule %s failed to set %s", rule.Name, action.Set)
+			}
+		case action.Delay > 0:
+			timer := time.NewTimer(action.Delay)
+			select {
+			case <-timer.C:
+			case <-a.cancelContext.Done():
+				timer.Stop()
+				return
+			}
+		}
+	}
+}
+
+// Cancel stops all triggers and running rules
+func (a *RulesApp) Cancel() {
+	a.cancel()
+}
@@ -0,0 +1,280 @@
+package defaultapps
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	d "github.com/helto4real/go-daemon/daemon"
+	"github.com/helto4real/go-daemon/daemon/config"
+	h "github.com/helto4real/go-daemon/daemon/test"
+	"github.com/helto4real/go-hassclient/client"
+)
+
+// fakeRulesHelper records the calls from the rules app
+type fakeRulesHelper struct {
+	*fakeDaemonAppHelper
+	mutex              sync.Mutex
+	entities           map[string]*client.HassEntity
+	calls              []string
+	stateChannel       chan client.HassEntity
+	callServiceChannel chan client.HassCallServiceEvent
+	eventChannel       chan d.HassEvent
+	eventTypes         []string
+	// unlistened is the subscriptions removed
+	unlistened []string
+}
+
+func newFakeRulesHelper(entities ...*client.HassEntity) *fakeRulesHelper {
+	helper := &fakeRulesHelper{fakeDaemonAppHelper: newFakeDaemonHelper(), entities: map[string]*client.HassEntity{}}
+	for _, entity := range entities {
+		helper.entities[entity.ID] = entity
+	}
+	return helper
+}
+
+func (a *fakeRulesHelper) GetEntity(entity string) (*client.HassEntity, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	e, ok := a.entities[entity]
+	return e, ok
+}
+
+func (a *fakeRulesHelper) SetEntity(entity *client.HassEntity) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.calls = append(a.calls, fmt.Sprintf("set %s %s %v", entity.ID, entity.New.State, entity.New.Attributes))
+	return true
+}
+
+func (a *fakeRulesHelper) CallService(domain string, service string, data map[string]interface{}) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.calls = append(a.calls, fmt.Sprintf("%s.%s %v", domain, service, data))
+	return nil
+}
+
+func (a *fakeRulesHelper) ListenState(entity string, stateChannel chan client.HassEntity) {
+	a.stateChannel = stateChannel
+}
+
+func (a *fakeRulesHelper) ListenCallServiceEvent(domain string, service string, callServiceChannel chan client.HassCallServiceEvent) {
+	a.callServiceChannel = callServiceChannel
+}
+
+func (a *fakeRulesHelper) ListenEvent(eventType string, eventChannel chan d.HassEvent) {
+	a.eventChannel = eventChannel
+	a.eventTypes = append(a.eventTypes, eventType)
+}
+
+func (a *fakeRulesHelper) UnlistenState(entity string, stateChannel chan client.HassEntity) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.unlistened = append(a.unlistened, "state "+entity)
+}
+
+func (a *fakeRulesHelper) UnlistenCallServiceEvent(domain string, service string, callServiceChannel chan client.HassCallServiceEvent) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.unlistened = append(a.unlistened, "call_service "+domain+"."+service)
+}
+
+func (a *fakeRulesHelper) UnlistenEvent(eventType string, eventChannel chan d.HassEvent) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.unlistened = append(a.unlistened, "event "+eventType)
+}
+
+// waitForCalls waits until count calls are made and returns them
+func (a *fakeRulesHelper) waitForCalls(t *testing.T, count int) []string {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		a.mutex.Lock()
+		calls := append([]string(nil), a.calls...)
+		a.mutex.Unlock()
+		if len(calls) >= count {
+			return calls
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d calls, got %v", count, a.calls)
+	return nil
+}
+
+func newRulesApp(t *testing.T, rules string) (*RulesApp, error) {
+	properties := map[string]interface{}{}
+	h.Ok(t, yaml.Unmarshal([]byte(rules), &properties))
+	app := &RulesApp{}
+	err := config.DecodeProperties(config.NormalizeYAML(properties).(map[string]interface{}), app.Config())
+	return app, err
+}
+
+func TestRulesStateTriggerWithConditions(t *testing.T) {
+	app, err := newRulesApp(t, `
+rules:
+  - name: hallway light
+    triggers:
+      - state: binary_sensor.hallway_motion
+        to: "on"
+    conditions:
+      - state: sensor.hallway_lux
+        below: 50
+      - state: input_boolean.guest_mode
+        not: "on"
+    actions:
+      - service: light.turn_on
+        data:
+          entity_id: light.hallway
+          brightness: 128
+`)
+	h.Ok(t, err)
+	lux := &client.HassEntity{ID: "sensor.hallway_lux", New: client.HassEntityState{State: "20"}}
+	helper := newFakeRulesHelper(lux,
+		&client.HassEntity{ID: "input_boolean.guest_mode", New: client.HassEntityState{State: "off"}})
+	h.Equals(t, true, app.Initialize(helper, d.DeamonAppConfig{}))
+	defer app.Cancel()
+
+	// Attribute changes and other states does not trigger
+	helper.stateChannel <- client.HassEntity{ID: "binary_sensor.hallway_motion",
+		Old: client.HassEntityState{State: "on"}, New: client.HassEntityState{State: "on"}}
+	helper.stateChannel <- client.HassEntity{ID: "binary_sensor.hallway_motion",
+		Old: client.HassEntityState{State: "on"}, New: client.HassEntityState{State: "off"}}
+	helper.stateChannel <- client.HassEntity{ID: "binary_sensor.hallway_motion",
+		Old: client.HassEntityState{State: "off"}, New: client.HassEntityState{State: "on"}}
+
+	calls := helper.waitForCalls(t, 1)
+	h.Equals(t, []string{"light.turn_on map[brightness:128 entity_id:light.hallway]"}, calls)
+
+	// Too bright, condition is not true
+	helper.mutex.Lock()
+	lux.New.State = "80"
+	helper.mutex.Unlock()
+	h.Equals(t, false, app.conditionsTrue(&app.config.Rules[0]))
+}
+
+func TestRulesCallServiceTriggerWithDelay(t *testing.T) {
+	app, err := newRulesApp(t, `
+rules:
+  - name: evening
+    triggers:
+      - call_service: go_daemon.evening
+    actions:
+      - set: input_select.house_mode
+        state: evening
+        attributes:
+          source: rules
+      - delay: 0.05
+      - service: light.turn_off
+`)
+	h.Ok(t, err)
+	helper := newFakeRulesHelper()
+	h.Equals(t, true, app.Initialize(helper, d.DeamonAppConfig{}))
+	defer app.Cancel()
+
+	helper.callServiceChannel <- client.HassCallServiceEvent{Domain: "go_daemon", Service: "evening"}
+	calls := helper.waitForCalls(t, 1)
+	h.Equals(t, []string{"set input_select.house_mode evening map[source:rules]"}, calls)
+
+	// Running rules ignores new triggers
+	helper.callServiceChannel <- client.HassCallServiceEvent{Domain: "go_daemon", Service: "evening"}
+	calls = helper.waitForCalls(t, 2)
+	h.Equals(t, "light.turn_off map[]", calls[1])
+	time.Sleep(20 * time.Millisecond)
+	h.Equals(t, 2, len(helper.waitForCalls(t, 2)))
+}
+
+func TestRulesEventTriggerWithEventData(t *testing.T) {
+	app, err := newRulesApp(t, `
+rules:
+  - name: remote
+    triggers:
+      - event: zha_event
+        event_data:
+          device_ieee: "00:0d:6f"
+          command: "on"
+          endpoint_id: 1
+    actions:
+      - service: light.toggle
+  - name: arrived
+    triggers:
+      - event: go_daemon_presence
+        event_data:
+          change: arrived
+      - event: zha_event
+        event_data:
+          command: "off"
+    actions:
+      - set: input_boolean.someone_home
+        state: "on"
+`)
+	h.Ok(t, err)
+	helper := newFakeRulesHelper()
+	h.Equals(t, true, app.Initialize(helper, d.DeamonAppConfig{}))
+	defer app.Cancel()
+	h.Equals(t, []string{"zha_event", "go_daemon_presence"}, helper.eventTypes)
+
+	// Events with other event data does not trigger
+	helper.eventChannel <- d.HassEvent{EventType: "zha_event",
+		Data: map[string]interface{}{"device_ieee": "00:0d:6f", "command": "on", "endpoint_id": 2.0}}
+	helper.eventChannel <- d.HassEvent{EventType: "go_daemon_presence",
+		Data: map[string]interface{}{"person": "person1", "change": "left"}}
+	helper.eventChannel <- d.HassEvent{EventType: "zha_event",
+		Data: map[string]interface{}{"device_ieee": "00:0d:6f", "command": "on", "endpoint_id": 1.0}}
+	calls := helper.waitForCalls(t, 1)
+	h.Equals(t, []string{"light.toggle map[]"}, calls)
+
+	helper.eventChannel <- d.HassEvent{EventType: "go_daemon_presence",
+		Data: map[string]interface{}{"person": "person1", "change": "arrived"}}
+	calls = helper.waitForCalls(t, 2)
+	h.Equals(t, "set input_boolean.someone_home on map[]", calls[1])
+}
+
+func TestRulesInvalidConfig(t *testing.T) {
+	tests := []struct {
+		rules string
+		err   string
+	}{
+		{`rules: [{name: a, triggers: [{state: light.a, time: "07:00"}], actions: [{service: light.turn_on}]}]`,
+			`property "rules[0].triggers[0]": trigger needs one of state, call_service, event, time or sun, got 2`},
+		{`rules: [{name: a, triggers: [{state: light.a, event_data: {command: "on"}}], actions: [{service: light.turn_on}]}]`,
+			`property "rules[0].triggers[0]": event_data can only be used with event`},
+		{`rules: [{name: a, triggers: [{time: "25:00"}], actions: [{service: light.turn_on}]}]`,
+			`property "rules[0].triggers[0]": invalid time of day "25:00", use format like 07:30 or 07:30:15`},
+		{`rules: [{name: a, triggers: [{sun: noon}], actions: [{service: light.turn_on}]}]`,
+			`property "rules[0].triggers[0]": sun has to be sunrise or sunset, got "noon"`},
+		{`rules: [{name: a, triggers: [{state: light.a}], conditions: [{state: light.b}], actions: [{service: light.turn_on}]}]`,
+			`property "rules[0].conditions[0]": condition on light.b needs is, not, above or below`},
+		{`rules: [{name: a, triggers: [{state: light.a}], actions: [{service: turn_on}]}]`,
+			`property "rules[0].actions[0]": invalid service "turn_on", expected format domain.service`},
+		{`rules: [{name: a, triggers: [{state: light.a}], actions: []}]`,
+			`property "rules[0]": rule a has no actions`},
+		{`rules: [{name: a, triggers: [{state: light.a}], actions: [{service: light.turn_on, delay: 5s}]}]`,
+			`property "rules[0].actions[0]": action needs one of service, set or delay, got 2`},
+	}
+	for _, test := range tests {
+		_, err := newRulesApp(t, test.rules)
+		h.Assert(t, err != nil, "Expected error for %s", test.rules)
+		h.Equals(t, test.err, err.Error())
+	}
+}
+
+func TestRulesTimeOfDay(t *testing.T) {
+	now := time.Date(2020, 1, 1, 8, 0, 0, 0, time.Local)
+	sevenThirty, err := parseTimeOfDay("07:30")
+	h.Ok(t, err)
+	h.Equals(t, time.Date(2020, 1, 2, 7, 30, 0, 0, time.Local), nextTimeOfDay(now, sevenThirty))
+	eightFifteen, err := parseTimeOfDay("08:00:15")
+	h.Ok(t, err)
+	h.Equals(t, time.Date(2020, 1, 1, 8, 0, 15, 0, time.Local), nextTimeOfDay(now, eightFifteen))
+
+	h.Equals(t, true, timeOfDayBetween(now, "07:00", "09:00"))
+	h.Equals(t, false, timeOfDayBetween(now, "09:00", ""))
+	h.Equals(t, true, timeOfDayBetween(now, "", "08:01"))
+	h.Equals(t, false, timeOfDayBetween(now, "22:00", "06:00"))
+	h.Equals(t, true, timeOfDayBetween(now.Add(15*time.Hour), "22:00", "06:00"))
+	h.Assert(t, strings.HasPrefix(fmt.Sprint(nextTimeOfDay(now, 0)), "2020-01-02 00:00:00"), "Midnight is next day")
+}
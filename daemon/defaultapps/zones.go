@@ -0,0 +1,193 @@
+package defaultapps
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/helto4real/go-hassclient/client"
+)
+
+// maxZoneHistory is the number of zone visits kept in the zone_history attribute
+const maxZoneHistory = 10
+
+// zoneVisit is a stay of a person in a zone
+type zoneVisit struct {
+	zone    string
+	entered time.Time
+	left    time.Time
+}
+
+// personZones keeps the zone a person is in and the zones visited before
+type personZones struct {
+	// current is "home", "not_home", a tracked zone id or the raw state of
+	// a zone that is not tracked
+	current string
+	entered time.Time
+	// arriving is the tracked zone of a person in the just arrived state
+	arriving string
+	history  []zoneVisit
+	// confidence is the share of the device weights agreeing with the zone
+	confidence float64
+	// eventZone is the zone when the last presence event was sent
+	eventZone string
+}
+
+// zoneIDs returns the sorted ids of the tracked zones
+func (a *PeopleApp) zoneIDs() []string {
+	if a.settings == nil || a.settings.TrackingSettings == nil {
+		return nil
+	}
+	ids := make([]string, 0, len(a.settings.TrackingSettings.Zones))
+	for id := range a.settings.TrackingSettings.Zones {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// isTrackedZone returns true for home and the configured zones, just
+// arrived and just left are used when entering and leaving those
+func (a *PeopleApp) isTrackedZone(zone string) bool {
+	if zone == "home" {
+		return true
+	}
+	if a.settings == nil || a.settings.TrackingSettings == nil {
+		return false
+	}
+	_, ok := a.settings.TrackingSettings.Zones[zone]
+	return ok
+}
+
+// zoneFriendlyName returns the friendly name of the zone entity, the object id if not available
+func (a *PeopleApp) zoneFriendlyName(zoneID string) string {
+	if entity, ok := a.deamon.GetEntity(zoneID); ok && entity != nil {
+		if name, ok := entity.New.Attributes["friendly_name"].(string); ok && name != "" {
+			return name
+		}
+	}
+	return strings.TrimPrefix(zoneID, "zone.")
+}
+
+// zoneState returns the state of people in the tracked zone
+func (a *PeopleApp) zoneState(zoneID string) (string, bool) {
+	if !a.isTrackedZone(zoneID) || zoneID == "home" {
+		return "", false
+	}
+	if zone := a.settings.TrackingSettings.Zones[zoneID]; zone != nil && zone.State != "" {
+		return zone.State, true
+	}
+	return a.zoneFriendlyName(zoneID), true
+}
+
+// settledZone returns the tracked zone of a person state, empty if the state is not a zone state
+func (a *PeopleApp) settledZone(state string) string {
+	if state == a.settings.TrackingSettings.HomeState {
+		return "home"
+	}
+	for _, id := range a.zoneIDs() {
+		if zoneState, _ := a.zoneState(id); zoneState == state {
+			return id
+		}
+	}
+	return ""
+}
+
+// getZone returns the zone of the devices of person, "home", "not_home", a
+// tracked zone id or the raw state of a zone that is not tracked, and the
+// confidence of the state
+func (a *PeopleApp) getZone(person string, devices []*client.HassEntity) (string, float64) {
+	state, confidence := a.getHassDeviceState(person, devices)
+	if state == "home" {
+		return "home", confidence
+	}
+	for _, id := range a.zoneIDs() {
+		if strings.EqualFold(state, strings.TrimPrefix(id, "zone.")) || strings.EqualFold(state, a.zoneFriendlyName(id)) {
+			return id, confidence
+		}
+	}
+	if state == "not_home" {
+		gpsDevice := getGpsSourceTypeDevice(devices)
+		if gpsDevice != nil && deviceWeight(a.fusionConfig(person), gpsDevice, time.Now().UTC()) > 0 {
+			if zoneID, ok := a.zoneOfLocation(gpsDevice); ok {
+				return zoneID, confidence
+			}
+		}
+	}
+	return state, confidence
+}
+
+// zoneOfLocation returns the smallest tracked zone that contains the
+// coordinates of the gps device, using the zone radius in meters
+func (a *PeopleApp) zoneOfLocation(device *client.HassEntity) (string, bool) {
+	if device == nil {
+		return "", false
+	}
+	latitude, latOk := device.New.Attributes["latitude"].(float64)
+	longitude, lngOk := device.New.Attributes["longitude"].(float64)
+	if !latOk || !lngOk {
+		return "", false
+	}
+	found, foundRadius := "", 0.0
+	for _, id := range a.zoneIDs() {
+		zone, ok := a.deamon.GetEntity(id)
+		if !ok || zone == nil {
+			continue
+		}
+		zoneLatitude, latOk := zone.New.Attributes["latitude"].(float64)
+		zoneLongitude, lngOk := zone.New.Attributes["longitude"].(float64)
+		radius, radiusOk := zone.New.Attributes["radius"].(float64)
+		if !latOk || !lngOk || !radiusOk {
+			continue
+		}
+		meters := distance(latitude, longitude, zoneLatitude, zoneLongitude, "K") * 1000
+		if meters <= radius && (found == "" || radius < foundRadius) {
+			found, foundRadius = id, radius
+		}
+	}
+	return found, found != ""
+}
+
+// updateZoneHistory records that the person is in zone
+func (a *PeopleApp) updateZoneHistory(person string, zone string) {
+	if a.zones == nil {
+		a.zones = map[string]*personZones{}
+	}
+	zones, ok := a.zones[person]
+	if !ok {
+		zones = &personZones{}
+		a.zones[person] = zones
+	}
+	if zones.current == zone {
+		return
+	}
+	now := time.Now()
+	if zones.current != "" && zones.current != "not_home" {
+		zones.history = append(zones.history, zoneVisit{zone: zones.current, entered: zones.entered, left: now})
+		if len(zones.history) > maxZoneHistory {
+			zones.history = zones.history[len(zones.history)-maxZoneHistory:]
+		}
+	}
+	zones.current = zone
+	zones.entered = now
+}
+
+// setZoneAttributes sets the zone, zone_entered, zone_history and confidence attributes of person
+func (a *PeopleApp) setZoneAttributes(person string) {
+	zones, ok := a.zones[person]
+	if !ok {
+		return
+	}
+	attributes := a.conf[person].Attributes
+	attributes["zone"] = zones.current
+	attributes["zone_entered"] = zones.entered.Format(time.RFC3339)
+	history := make([]map[string]interface{}, 0, len(zones.history))
+	for _, visit := range zones.history {
+		history = append(history, map[string]interface{}{
+			"zone":    visit.zone,
+			"entered": visit.entered.Format(time.RFC3339),
+			"left":    visit.left.Format(time.RFC3339)})
+	}
+	attributes["zone_history"] = history
+	attributes["confidence"] = zones.confidence
+}
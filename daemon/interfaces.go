@@ -2,11 +2,14 @@ package interfaces
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/helto4real/go-daemon/daemon/config"
 	"github.com/helto4real/go-hassclient/client"
 	c "github.com/helto4real/go-hassclient/client"
+	"github.com/sirupsen/logrus"
 )
 
 // DaemonApplication represents an application
@@ -23,6 +26,17 @@ type DaemonAppHelper interface {
 	// SetEntity creates or updates existing entity
 	SetEntity(entity *client.HassEntity) bool
 
+	// GetEntities reads the states of all entities in domain, like person,
+	// from Home Assistant
+	GetEntities(domain string) ([]*client.HassEntity, error)
+
+	// CallService calls domain.service in Home Assistant with service data,
+	// like light.turn_on with brightness
+	CallService(domain string, service string, data map[string]interface{}) error
+
+	// FireEvent fires an event in Home Assistant with the event data
+	FireEvent(eventType string, data map[string]interface{}) error
+
 	// TurnsOn turns on an entity with no attributes
 	TurnOn(entity string)
 
@@ -37,6 +51,22 @@ type DaemonAppHelper interface {
 	// Any events is reported back to the provided channel
 	ListenCallServiceEvent(domain string, service string, callServiceChannel chan client.HassCallServiceEvent)
 
+	// ListenEvent listens to events of eventType fired in Home Assistant, like
+	// zha_event or go_daemon_presence
+	//
+	// Any events is reported back to the provided channel
+	ListenEvent(eventType string, eventChannel chan HassEvent)
+
+	// UnlistenState stops sending the state changes of entity to the channel
+	UnlistenState(entity string, stateChannel chan client.HassEntity)
+
+	// UnlistenCallServiceEvent stops sending the call_service events of
+	// domain.service to the channel
+	UnlistenCallServiceEvent(domain string, service string, callServiceChannel chan client.HassCallServiceEvent)
+
+	// UnlistenEvent stops sending the events of eventType to the channel
+	UnlistenEvent(eventType string, eventChannel chan HassEvent)
+
 	// ListenState start listen to state changes from entity
 	//
 	// Any changes is reported back to the provided channel
@@ -56,7 +86,7 @@ type DaemonAppHelper interface {
 	NewEntity(id string, daemonHelper DaemonAppHelper, autoRespondServiceCall bool,
 		changedEntityChannel chan DaemonEntity) DaemonEntity
 
-	// GetPeople returns the configuration of people and their devices
+	// GetPeople returns a copy of the configuration of people and their devices
 	GetPeople() map[string]*config.PeopleConfig
 
 	// GetSettings returns the settings for the deamon
@@ -64,8 +94,225 @@ type DaemonAppHelper interface {
 
 	// GetLocation returns the home location of the hass instance
 	GetLocation() Location
+
+	// GetLogger returns a logger tagged with the application name and instance
+	//
+	// The level can be overridden per application in go-daemon.yaml
+	GetLogger() *logrus.Entry
+
+	// Publish sends message to all running applications subscribed to topic
+	//
+	// The first Publish or Subscribe sets the message type of the topic,
+	// publishing messages of other types returns error
+	Publish(topic string, message interface{}) error
+
+	// Subscribe receives the messages published to topic on channel
+	//
+	// The channel has to be a channel of the message type of the topic,
+	// like chan PresenceMessage
+	Subscribe(topic string, channel interface{}) error
+
+	// HandleRequest handles the requests sent to topic with Request
+	//
+	// Only one application can handle the requests of a topic
+	HandleRequest(topic string, handler func(request interface{}) (interface{}, error)) error
+
+	// Request sends request to the application handling topic and waits for the reply
+	//
+	// Returns ErrRequestTimeout if there are no reply within timeout
+	Request(topic string, request interface{}, timeout time.Duration) (interface{}, error)
+
+	// RegisterService handles calls to domain.service from Home Assistant,
+	// like go_daemon.scene_evening
+	//
+	// The service_data of each call is decoded into a new value of the struct
+	// type of schema, see config.DecodeProperties for the supported tags. The
+	// handler gets a pointer to the decoded value, or the raw service_data
+	// if schema is nil. The result is fired as a go_daemon_service_result
+	// event if the Home Assistant client supports firing events
+	RegisterService(domain string, service string, schema interface{},
+		handler func(data interface{}) (interface{}, error)) error
+
+	// WaitForState blocks until the state of entity matches predicate and
+	// returns the matching entity. The current state is checked first.
+	//
+	// Returns ErrWaitTimeout if no match within timeout, a timeout of zero waits
+	// until ctx is done. Safe to use from many goroutines at the same time
+	WaitForState(ctx context.Context, entity string, predicate func(entity client.HassEntity) bool,
+		timeout time.Duration) (client.HassEntity, error)
+
+	// History returns the recorded states of entity since the time, oldest first
+	//
+	// States are recorded for entities that are listened to, see history in
+	// go-daemon.yaml for how many states are kept
+	History(entity string, since time.Time) []client.HassEntityState
+
+	// HistoryStats returns aggregates of the recorded states of entity since
+	// the time, false if there are no recorded states
+	HistoryStats(entity string, since time.Time) (HistoryStats, bool)
+
+	// ListenThreshold sends an event on channel when the numeric state or
+	// attribute of entity crosses the thresholds of trigger
+	//
+	// The current value sets which side of the thresholds the entity is on,
+	// only crossings from then on are sent. Values that are not numbers are ignored
+	ListenThreshold(entity string, trigger ThresholdTrigger, channel chan ThresholdEvent) error
+}
+
+// ThresholdTrigger is the thresholds of ListenThreshold. Use Above 70 and
+// Below 60 for "fan on above 70%, off below 60%" or the same value for a
+// single threshold without hysteresis
+type ThresholdTrigger struct {
+	// Attribute is the attribute with the value, the state is used if empty
+	Attribute string
+	// Above is the value to rise above to cross above
+	Above float64
+	// Below is the value to fall below to cross below, can not be over Above
+	Below float64
+	// For is the time the value has to stay crossed before the event is sent
+	For time.Duration
 }
 
+// Crossing is the threshold an entity crossed
+type Crossing string
+
+const (
+	// CrossedAbove is sent when the value rises above ThresholdTrigger.Above
+	CrossedAbove Crossing = "above"
+	// CrossedBelow is sent when the value falls below ThresholdTrigger.Below
+	CrossedBelow Crossing = "below"
+)
+
+// ThresholdEvent is sent when an entity crosses the thresholds of a ThresholdTrigger
+type ThresholdEvent struct {
+	// Entity is the latest state change of the entity
+	Entity   client.HassEntity
+	Value    float64
+	Crossing Crossing
+}
+
+// HistoryStats is aggregates of the recorded states of an entity
+type HistoryStats struct {
+	// Count is the number of states
+	Count int
+	// Numeric is the number of states that are numbers, Min, Max and Avg
+	// are calculated from those
+	Numeric int
+	Min     float64
+	Max     float64
+	Avg     float64
+	// LastChanged is when the state last changed value
+	LastChanged time.Time
+	// Last is the latest state
+	Last client.HassEntityState
+}
+
+// PresenceTopic is the topic of the PresenceEvent messages published by the people app
+const PresenceTopic = "presence"
+
+// PresenceEventType is the Home Assistant event fired by the people app with
+// the fields of PresenceEvent as event data
+const PresenceEventType = "go_daemon_presence"
+
+// PresenceChange is how the presence of a person changed
+type PresenceChange string
+
+const (
+	// PresenceArrived is sent when a person enters home or a tracked zone
+	PresenceArrived PresenceChange = "arrived"
+	// PresenceLeft is sent when a person leaves home or a tracked zone
+	PresenceLeft PresenceChange = "left"
+	// PresenceChanged is sent when the state changes in the same zone,
+	// like from just arrived to home
+	PresenceChanged PresenceChange = "changed"
+)
+
+// PresenceEvent is sent by the people app when the state of a person changes
+type PresenceEvent struct {
+	Person       string
+	FriendlyName string
+	// From and To are the states of the person, like "Just arrived" and "Home"
+	From string
+	To   string
+	// FromZone and Zone are "home", "not_home" or the zone id like zone.work
+	FromZone string
+	Zone     string
+	Change   PresenceChange
+	// Distance is the distance from home in the units of the tracking
+	// settings, 0 if not known
+	Distance float64
+	Time     time.Time
+}
+
+// ProximityTopic is the topic of the ProximityEvent messages published by the people app
+const ProximityTopic = "proximity"
+
+// ProximityEventType is the Home Assistant event fired by the people app with
+// the fields of ProximityEvent as event data
+const ProximityEventType = "go_daemon_proximity"
+
+// ProximityEvent is sent by the people app when a person gets within the
+// distance of a proximity trigger, moving in the direction of the trigger
+type ProximityEvent struct {
+	// Name is the name of the proximity trigger
+	Name         string
+	Person       string
+	FriendlyName string
+	// Distance is the distance from home in the units of the tracking settings
+	Distance float64
+	// Direction is towards, away_from or stationary
+	Direction string
+	Time      time.Time
+}
+
+// RegionTopic is the topic of the RegionEvent messages published by the people app
+const RegionTopic = "region"
+
+// RegionEventType is the Home Assistant event fired by the people app with
+// the fields of RegionEvent as event data
+const RegionEventType = "go_daemon_region"
+
+// RegionTransition is if a person entered or left a region
+type RegionTransition string
+
+const (
+	// RegionEnter is sent when a person enters a region
+	RegionEnter RegionTransition = "enter"
+	// RegionLeave is sent when a person leaves a region
+	RegionLeave RegionTransition = "leave"
+)
+
+// RegionEvent is sent by the people app when a person enters or leaves a
+// polygon region of the tracking settings
+type RegionEvent struct {
+	Region       string
+	Person       string
+	FriendlyName string
+	Transition   RegionTransition
+	Time         time.Time
+}
+
+// HassEvent is an event fired in Home Assistant
+type HassEvent struct {
+	EventType string
+	Data      map[string]interface{}
+	TimeFired time.Time
+}
+
+// EventFirer is implemented by Home Assistant clients that can fire events
+type EventFirer interface {
+	FireEvent(eventType string, eventData map[string]interface{}) bool
+}
+
+var (
+	// ErrNoRequestHandler is returned from Request if no running application handles the topic
+	ErrNoRequestHandler = errors.New("no application handles requests on topic")
+	// ErrRequestTimeout is returned from Request if there are no reply within timeout
+	ErrRequestTimeout = errors.New("request timed out")
+	// ErrWaitTimeout is returned from WaitForState if the state does not match within timeout
+	ErrWaitTimeout = errors.New("timed out waiting for state")
+)
+
 type Location struct {
 	Longitude float64
 	Latitude  float64
@@ -86,9 +333,61 @@ type DaemonApplication interface {
 	Cancel()
 }
 
+// ConfigurableApplication is an application with typed configuration
+//
+// The daemon decodes the properties of the app yaml into the struct returned
+// from Config before Initialize is called, see config.DecodeProperties for
+// the supported tags. The application fails to load if the decoding fails
+type ConfigurableApplication interface {
+	DaemonApplication
+	// Config returns a pointer to the struct to decode the properties into
+	Config() interface{}
+}
+
 type DeamonAppConfig struct {
-	App        string            `yaml:"app"`
-	Properties map[string]string `yaml:"properties"`
+	// Name is the instance name, the key of the app in the yaml file
+	Name string `yaml:"-" json:"name"`
+	App  string `yaml:"app" json:"app"`
+	// DependsOn is the app instances that has to be started before this instance
+	DependsOn []string `yaml:"depends_on" json:"depends_on,omitempty"`
+	// Properties contains the properties with single values as strings
+	Properties map[string]string `yaml:"properties" json:"-"`
+	// RawProperties contains all properties including lists and nested values
+	RawProperties map[string]interface{} `yaml:"-" json:"properties"`
+	// Trace records events, calls and timers of the instance, see the trace command
+	Trace bool `yaml:"trace" json:"trace"`
+}
+
+// UnmarshalYAML keeps all properties in RawProperties and the single values
+// as strings in Properties
+func (a *DeamonAppConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	raw := struct {
+		App        string                 `yaml:"app"`
+		DependsOn  []string               `yaml:"depends_on"`
+		Properties map[string]interface{} `yaml:"properties"`
+		Trace      bool                   `yaml:"trace"`
+	}{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	a.App = raw.App
+	a.DependsOn = raw.DependsOn
+	a.Trace = raw.Trace
+	a.SetProperties(raw.Properties)
+	return nil
+}
+
+// SetProperties sets RawProperties to properties and Properties to the single values as strings
+func (a *DeamonAppConfig) SetProperties(properties map[string]interface{}) {
+	a.Properties = map[string]string{}
+	a.RawProperties = map[string]interface{}{}
+	for key, value := range properties {
+		a.RawProperties[key] = config.NormalizeYAML(value)
+		switch value.(type) {
+		case string, int, float64, bool:
+			a.Properties[key] = fmt.Sprint(value)
+		}
+	}
 }
 
 type DaemonEntity interface {
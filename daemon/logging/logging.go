@@ -0,0 +1,138 @@
+// Package logging sets up the logging of go-daemon from configuration and
+// hands out loggers tagged with the application name and instance
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/helto4real/go-daemon/daemon/config"
+	"github.com/sirupsen/logrus"
+	prefixed "github.com/x-cray/logrus-prefixed-formatter"
+)
+
+const timestampFormat = "2006-01-02 15:04:05"
+
+var logFile io.Closer
+
+var addRedactHook sync.Once
+
+// Init sets the default text logging used before the configuration is read
+func Init() {
+	logrus.SetFormatter(newTextFormatter())
+	logrus.SetOutput(os.Stdout)
+	logrus.SetLevel(logrus.InfoLevel)
+	addRedactHook.Do(func() { logrus.AddHook(redactHook{}) })
+}
+
+// redactHook replaces secret values in the message and fields before logging
+type redactHook struct{}
+
+func (a redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (a redactHook) Fire(entry *logrus.Entry) error {
+	entry.Message = config.Redact(entry.Message)
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			entry.Data[key] = config.Redact(v)
+		case error:
+			entry.Data[key] = config.Redact(v.Error())
+		}
+	}
+	return nil
+}
+
+// Setup configures the standard logger from configuration, nil config
+// keeps the current logging settings
+func Setup(conf *config.LoggingConfig) error {
+	if conf == nil {
+		return nil
+	}
+	switch strings.ToLower(conf.Format) {
+	case "", "text":
+		logrus.SetFormatter(newTextFormatter())
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{TimestampFormat: timestampFormat})
+	default:
+		return fmt.Errorf("unknown log format %q, use text or json", conf.Format)
+	}
+
+	if conf.Level != "" {
+		level, err := logrus.ParseLevel(conf.Level)
+		if err != nil {
+			return err
+		}
+		logrus.SetLevel(level)
+	}
+
+	previous := logFile
+	if conf.File != "" {
+		file, err := newRotatingFile(conf.File, int64(conf.MaxSize)*1024*1024, conf.MaxBackups)
+		if err != nil {
+			return err
+		}
+		logFile = file
+		logrus.SetOutput(file)
+	} else {
+		// The file was removed from the config, log to stdout again
+		logFile = nil
+		logrus.SetOutput(os.Stdout)
+	}
+	// Closed after the new output is set so no entry is written to a closed file
+	if previous != nil {
+		previous.Close()
+	}
+	return nil
+}
+
+// NewAppLogger returns a logger tagged with the application name and instance.
+// If a log level is configured for the instance or the app name, the returned
+// logger uses that level instead of the global one
+func NewAppLogger(app string, instance string, conf *config.LoggingConfig) *logrus.Entry {
+	logger := logrus.StandardLogger()
+
+	if levelName, ok := appLevel(app, instance, conf); ok {
+		level, err := logrus.ParseLevel(levelName)
+		if err != nil {
+			logrus.WithField("prefix", instance).Errorf("Invalid log level %q, using default level", levelName)
+		} else {
+			std := logrus.StandardLogger()
+			logger = logrus.New()
+			logger.Out = std.Out
+			logger.Formatter = std.Formatter
+			logger.Hooks = std.Hooks
+			logger.SetLevel(level)
+		}
+	}
+	return logger.WithFields(logrus.Fields{
+		"prefix":   instance,
+		"app":      app,
+		"instance": instance})
+}
+
+func appLevel(app string, instance string, conf *config.LoggingConfig) (string, bool) {
+	if conf == nil || conf.Apps == nil {
+		return "", false
+	}
+	if level, ok := conf.Apps[instance]; ok {
+		return level, true
+	}
+	level, ok := conf.Apps[app]
+	return level, ok
+}
+
+func newTextFormatter() logrus.Formatter {
+	formatter := new(prefixed.TextFormatter)
+	formatter.FullTimestamp = true
+	formatter.TimestampFormat = timestampFormat
+	formatter.DisableColors = true
+	formatter.ForceColors = false
+	formatter.ForceFormatting = true
+	return formatter
+}
@@ -0,0 +1,142 @@
+package logging
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/helto4real/go-daemon/daemon/config"
+	h "github.com/helto4real/go-daemon/daemon/test"
+	"github.com/sirupsen/logrus"
+)
+
+// restoreLogging restores the standard logger after test
+func restoreLogging() func() {
+	std := logrus.StandardLogger()
+	out, formatter, level := std.Out, std.Formatter, std.Level
+	return func() {
+		logrus.SetOutput(out)
+		logrus.SetFormatter(formatter)
+		logrus.SetLevel(level)
+		if logFile != nil {
+			logFile.Close()
+			logFile = nil
+		}
+	}
+}
+
+func TestSetupJSONToFile(t *testing.T) {
+	defer restoreLogging()()
+	dir, err := ioutil.TempDir("", "logging")
+	h.Ok(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "go-daemon.log")
+
+	err = Setup(&config.LoggingConfig{Format: "json", Level: "debug", File: path})
+	h.Ok(t, err)
+	h.Equals(t, logrus.DebugLevel, logrus.GetLevel())
+
+	logrus.WithField("prefix", "test").Debug("hello json")
+
+	data, err := ioutil.ReadFile(path)
+	h.Ok(t, err)
+	entry := map[string]interface{}{}
+	h.Ok(t, json.Unmarshal(data, &entry))
+	h.Equals(t, "hello json", entry["msg"])
+	h.Equals(t, "test", entry["prefix"])
+}
+
+func TestSetupFileRemoved(t *testing.T) {
+	defer restoreLogging()()
+	dir, err := ioutil.TempDir("", "logging")
+	h.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	h.Ok(t, Setup(&config.LoggingConfig{File: filepath.Join(dir, "daemon.log")}))
+	file := logFile.(*rotatingFile)
+	h.Equals(t, file, logrus.StandardLogger().Out)
+
+	h.Ok(t, Setup(&config.LoggingConfig{}))
+	h.Equals(t, nil, logFile)
+	h.Equals(t, os.Stdout, logrus.StandardLogger().Out)
+	_, err = file.Write([]byte("closed\n"))
+	h.Assert(t, err != nil, "Expected the previous file to be closed")
+}
+
+func TestSetupErrors(t *testing.T) {
+	defer restoreLogging()()
+	h.Ok(t, Setup(nil))
+	h.Assert(t, Setup(&config.LoggingConfig{Format: "xml"}) != nil, "Expected error on unknown format")
+	h.Assert(t, Setup(&config.LoggingConfig{Level: "verbose"}) != nil, "Expected error on unknown level")
+}
+
+func TestNewAppLogger(t *testing.T) {
+	defer restoreLogging()()
+	out := strings.Builder{}
+	logrus.SetOutput(&out)
+	logrus.SetFormatter(&logrus.JSONFormatter{})
+	logrus.SetLevel(logrus.InfoLevel)
+
+	conf := &config.LoggingConfig{Apps: map[string]string{
+		"debug_instance": "debug",
+		"quiet_app":      "error"}}
+
+	logger := NewAppLogger("some_app", "debug_instance", conf)
+	h.Equals(t, "some_app", logger.Data["app"])
+	h.Equals(t, "debug_instance", logger.Data["instance"])
+	logger.Debug("debug from instance")
+	h.Equals(t, true, strings.Contains(out.String(), "debug from instance"))
+
+	// Level from app name when instance not configured
+	logger = NewAppLogger("quiet_app", "any_instance", conf)
+	logger.Warn("should not show")
+	h.Equals(t, false, strings.Contains(out.String(), "should not show"))
+
+	// Use global level if not configured
+	logger = NewAppLogger("other_app", "other_instance", conf)
+	logger.Debug("global debug")
+	logger.Info("global info")
+	h.Equals(t, false, strings.Contains(out.String(), "global debug"))
+	h.Equals(t, true, strings.Contains(out.String(), "global info"))
+}
+
+func TestRedactHook(t *testing.T) {
+	out := strings.Builder{}
+	logger := logrus.New()
+	logger.SetOutput(&out)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.AddHook(redactHook{})
+	config.RegisterSecret("hook-secret-value")
+
+	logger.WithField("token", "hook-secret-value").Info("connecting with hook-secret-value")
+	h.Equals(t, false, strings.Contains(out.String(), "hook-secret-value"))
+	h.Equals(t, 2, strings.Count(out.String(), config.Redacted))
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	h.Ok(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rotate.log")
+
+	file, err := newRotatingFile(path, 10, 2)
+	h.Ok(t, err)
+	defer file.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err = file.Write([]byte(line))
+		h.Ok(t, err)
+	}
+
+	current, _ := ioutil.ReadFile(path)
+	backup1, _ := ioutil.ReadFile(path + ".1")
+	backup2, _ := ioutil.ReadFile(path + ".2")
+	h.Equals(t, "fourth\n", string(current))
+	h.Equals(t, "third\n", string(backup1))
+	h.Equals(t, "second\n", string(backup2))
+	_, err = os.Stat(path + ".3")
+	h.Equals(t, true, os.IsNotExist(err))
+}
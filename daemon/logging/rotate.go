@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile is a log file that is rotated when it grows over max size.
+// Rotated files are named file.1 (newest) to file.<maxBackups> (oldest)
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	mutex      sync.Mutex
+	file       *os.File
+	size       int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (a *rotatingFile) open() error {
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// Write writes to the log file and rotates it first if the write makes it too big
+func (a *rotatingFile) Write(p []byte) (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(p)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := a.file.Write(p)
+	a.size += int64(n)
+	return n, err
+}
+
+// rotate moves the backups one step and starts a new file, mutex must be held
+func (a *rotatingFile) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	if a.maxBackups > 0 {
+		os.Remove(backupName(a.path, a.maxBackups))
+		for i := a.maxBackups - 1; i > 0; i-- {
+			os.Rename(backupName(a.path, i), backupName(a.path, i+1))
+		}
+		if err := os.Rename(a.path, backupName(a.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(a.path); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// Close closes the log file
+func (a *rotatingFile) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.file.Close()
+}
+
+func backupName(path string, index int) string {
+	return fmt.Sprintf("%s.%d", path, index)
+}
@@ -0,0 +1,300 @@
+// Package metrics implements a minimal metrics registry with counters, gauges
+// and histograms that is exposed in the Prometheus text exposition format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the default histogram buckets in seconds
+var DefaultBuckets = []float64{.0005, .001, .005, .01, .05, .1, .5, 1, 5}
+
+// Collector is implemented by all metric types
+type Collector interface {
+	// Name returns the full name of the metric
+	Name() string
+	// Write writes the metric in the text exposition format
+	Write(w io.Writer)
+}
+
+// Registry holds all collectors that should be exposed
+type Registry struct {
+	mutex      sync.Mutex
+	collectors map[string]Collector
+}
+
+// NewRegistry returns a new empty registry
+func NewRegistry() *Registry {
+	return &Registry{collectors: map[string]Collector{}}
+}
+
+// MustRegister registers the collectors, panics if the name is already registered
+func (a *Registry) MustRegister(collectors ...Collector) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, c := range collectors {
+		if _, exists := a.collectors[c.Name()]; exists {
+			panic(fmt.Sprintf("metrics: collector %s already registered", c.Name()))
+		}
+		a.collectors[c.Name()] = c
+	}
+}
+
+// Write writes all registered metrics sorted by name
+func (a *Registry) Write(w io.Writer) {
+	a.mutex.Lock()
+	names := make([]string, 0, len(a.collectors))
+	for name := range a.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	collectors := make([]Collector, 0, len(names))
+	for _, name := range names {
+		collectors = append(collectors, a.collectors[name])
+	}
+	a.mutex.Unlock()
+
+	for _, c := range collectors {
+		c.Write(w)
+	}
+}
+
+// Handler returns a http handler that exposes the registry
+func (a *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		a.Write(w)
+	})
+}
+
+// vec keeps values per unique combination of label values
+type vec struct {
+	name       string
+	help       string
+	metricType string
+	labels     []string
+	mutex      sync.Mutex
+	values     map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// Used for histograms only
+	bucketCounts []uint64
+	count        uint64
+}
+
+func newVec(name, help, metricType string, labels []string) vec {
+	return vec{name: name, help: help, metricType: metricType, labels: labels, values: map[string]*series{}}
+}
+
+func (a *vec) Name() string {
+	return a.name
+}
+
+// get returns the series for the label values, mutex must be held
+func (a *vec) get(labelValues []string) *series {
+	if len(labelValues) != len(a.labels) {
+		panic(fmt.Sprintf("metrics: %s expected %d label values, got %d", a.name, len(a.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := a.values[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		a.values[key] = s
+	}
+	return s
+}
+
+// sortedSeries returns the series sorted by labels, mutex must be held
+func (a *vec) sortedSeries() []*series {
+	keys := make([]string, 0, len(a.values))
+	for key := range a.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]*series, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, a.values[key])
+	}
+	return result
+}
+
+func (a *vec) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", a.name, escapeHelp(a.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", a.name, a.metricType)
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	vec
+}
+
+// NewCounterVec returns a new counter with the provided label names
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{vec: newVec(name, help, "counter", labels)}
+}
+
+// Inc increments the counter with one
+func (a *CounterVec) Inc(labelValues ...string) {
+	a.Add(1, labelValues...)
+}
+
+// Add adds the value to the counter, negative values are ignored
+func (a *CounterVec) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.get(labelValues).value += value
+}
+
+// Value returns the current value of the counter
+func (a *CounterVec) Value(labelValues ...string) float64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.get(labelValues).value
+}
+
+func (a *CounterVec) Write(w io.Writer) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.writeHeader(w)
+	for _, s := range a.sortedSeries() {
+		fmt.Fprintf(w, "%s%s %s\n", a.name, formatLabels(a.labels, s.labelValues), formatValue(s.value))
+	}
+}
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct {
+	vec
+}
+
+// NewGaugeVec returns a new gauge with the provided label names
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{vec: newVec(name, help, "gauge", labels)}
+}
+
+// Set sets the value of the gauge
+func (a *GaugeVec) Set(value float64, labelValues ...string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.get(labelValues).value = value
+}
+
+// Value returns the current value of the gauge
+func (a *GaugeVec) Value(labelValues ...string) float64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.get(labelValues).value
+}
+
+func (a *GaugeVec) Write(w io.Writer) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.writeHeader(w)
+	for _, s := range a.sortedSeries() {
+		fmt.Fprintf(w, "%s%s %s\n", a.name, formatLabels(a.labels, s.labelValues), formatValue(s.value))
+	}
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+// NewHistogramVec returns a new histogram, uses DefaultBuckets if buckets is nil
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return &HistogramVec{vec: newVec(name, help, "histogram", labels), buckets: sorted}
+}
+
+// Observe adds an observation to the histogram
+func (a *HistogramVec) Observe(value float64, labelValues ...string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	s := a.get(labelValues)
+	if s.bucketCounts == nil {
+		s.bucketCounts = make([]uint64, len(a.buckets))
+	}
+	for i, upperBound := range a.buckets {
+		if value <= upperBound {
+			s.bucketCounts[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// Count returns the number of observations
+func (a *HistogramVec) Count(labelValues ...string) uint64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.get(labelValues).count
+}
+
+func (a *HistogramVec) Write(w io.Writer) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.writeHeader(w)
+	labels := append(append([]string(nil), a.labels...), "le")
+	for _, s := range a.sortedSeries() {
+		for i, upperBound := range a.buckets {
+			var count uint64
+			if s.bucketCounts != nil {
+				count = s.bucketCounts[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", a.name,
+				formatLabels(labels, append(append([]string(nil), s.labelValues...), formatValue(upperBound))), count)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", a.name,
+			formatLabels(labels, append(append([]string(nil), s.labelValues...), "+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", a.name, formatLabels(a.labels, s.labelValues), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", a.name, formatLabels(a.labels, s.labelValues), s.count)
+	}
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names))
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(values[i])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	} else if math.IsInf(value, -1) {
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return helpReplacer.Replace(help)
+}
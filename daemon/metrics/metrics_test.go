@@ -0,0 +1,98 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/helto4real/go-daemon/daemon/metrics"
+	h "github.com/helto4real/go-daemon/daemon/test"
+)
+
+func TestCounter(t *testing.T) {
+	counter := metrics.NewCounterVec("test_events_total", "Number of events", "type")
+	counter.Inc("state_changed")
+	counter.Inc("state_changed")
+	counter.Add(3, "call_service")
+	counter.Add(-1, "call_service")
+
+	h.Equals(t, 2.0, counter.Value("state_changed"))
+	h.Equals(t, 3.0, counter.Value("call_service"))
+
+	out := strings.Builder{}
+	counter.Write(&out)
+	h.Equals(t, `# HELP test_events_total Number of events
+# TYPE test_events_total counter
+test_events_total{type="call_service"} 3
+test_events_total{type="state_changed"} 2
+`, out.String())
+}
+
+func TestGauge(t *testing.T) {
+	gauge := metrics.NewGaugeVec("test_connected", "Connection state")
+	gauge.Set(1)
+	gauge.Set(0)
+
+	out := strings.Builder{}
+	gauge.Write(&out)
+	h.Equals(t, `# HELP test_connected Connection state
+# TYPE test_connected gauge
+test_connected 0
+`, out.String())
+}
+
+func TestHistogram(t *testing.T) {
+	histogram := metrics.NewHistogramVec("test_latency_seconds", "Latency", []float64{1, 0.1}, "app")
+	histogram.Observe(0.05, "a")
+	histogram.Observe(0.5, "a")
+	histogram.Observe(2, "a")
+
+	h.Equals(t, uint64(3), histogram.Count("a"))
+
+	out := strings.Builder{}
+	histogram.Write(&out)
+	h.Equals(t, `# HELP test_latency_seconds Latency
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{app="a",le="0.1"} 1
+test_latency_seconds_bucket{app="a",le="1"} 2
+test_latency_seconds_bucket{app="a",le="+Inf"} 3
+test_latency_seconds_sum{app="a"} 2.55
+test_latency_seconds_count{app="a"} 3
+`, out.String())
+}
+
+func TestLabelEscaping(t *testing.T) {
+	counter := metrics.NewCounterVec("test_total", "Escaping", "name")
+	counter.Inc("with \"quotes\"\n")
+
+	out := strings.Builder{}
+	counter.Write(&out)
+	h.Equals(t, true, strings.Contains(out.String(), `test_total{name="with \"quotes\"\n"} 1`))
+}
+
+func TestRegistryHandler(t *testing.T) {
+	registry := metrics.NewRegistry()
+	second := metrics.NewCounterVec("b_total", "Second")
+	first := metrics.NewGaugeVec("a_value", "First")
+	registry.MustRegister(second, first)
+	second.Inc()
+	first.Set(5)
+
+	rec := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	h.Equals(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	h.Equals(t, true, strings.Index(body, "a_value 5") < strings.Index(body, "b_total 1"))
+	h.Equals(t, true, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain"))
+}
+
+func TestRegistryDuplicatePanics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.MustRegister(metrics.NewCounterVec("dup_total", "Dup"))
+	defer func() {
+		h.NotEquals(t, nil, recover())
+	}()
+	registry.MustRegister(metrics.NewCounterVec("dup_total", "Dup"))
+}
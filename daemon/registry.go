@@ -0,0 +1,88 @@
+package interfaces
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// AppFactory returns a new instance of an application, called for every app
+// instance in the app yaml files
+type AppFactory func() DaemonApplication
+
+var (
+	registryMutex sync.RWMutex
+	registry      = map[string]AppFactory{}
+)
+
+// Register makes an application available as "app: name" in the app yaml
+// files. Call it from the init function of the app package:
+//
+//	func init() {
+//		daemon.Register("my_app", func() daemon.DaemonApplication { return &MyApp{} })
+//	}
+//
+// Register panics if name is empty, factory is nil or name is already registered
+func Register(name string, factory AppFactory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if name == "" {
+		panic("daemon: Register with empty app name")
+	}
+	if factory == nil {
+		panic(fmt.Sprintf("daemon: Register of app %s with nil factory", name))
+	}
+	if _, exist := registry[name]; exist {
+		panic(fmt.Sprintf("daemon: Register called twice for app %s", name))
+	}
+	registry[name] = factory
+}
+
+// RegisteredApp returns the factory of the registered application
+func RegisteredApp(name string) (AppFactory, bool) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	factory, exist := registry[name]
+	return factory, exist
+}
+
+// RegisteredApps returns the sorted names of the registered applications
+func RegisteredApps() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var daemonApplicationType = reflect.TypeOf((*DaemonApplication)(nil)).Elem()
+
+// NewAppFactory returns a factory that creates new instances of the type of
+// app, like the values of the available apps map given to Start. Returns an
+// error if a pointer to the type does not implement DaemonApplication
+func NewAppFactory(app interface{}) (AppFactory, error) {
+	if factory, ok := app.(AppFactory); ok && factory != nil {
+		return factory, nil
+	}
+	if factory, ok := app.(func() DaemonApplication); ok && factory != nil {
+		return factory, nil
+	}
+	if app == nil {
+		return nil, fmt.Errorf("app is nil")
+	}
+	appType := reflect.TypeOf(app)
+	if appType.Kind() == reflect.Ptr {
+		appType = appType.Elem()
+	}
+	if !reflect.PtrTo(appType).Implements(daemonApplicationType) {
+		return nil, fmt.Errorf("%s does not implement DaemonApplication, it needs Initialize(DaemonAppHelper, DeamonAppConfig) bool and Cancel()",
+			reflect.PtrTo(appType))
+	}
+	return func() DaemonApplication {
+		return reflect.New(appType).Interface().(DaemonApplication)
+	}, nil
+}
@@ -0,0 +1,91 @@
+package interfaces
+
+import (
+	"strings"
+	"testing"
+
+	h "github.com/helto4real/go-daemon/daemon/test"
+)
+
+type registrytestapp struct {
+	initialized bool
+}
+
+func (a *registrytestapp) Initialize(helper DaemonAppHelper, config DeamonAppConfig) bool {
+	a.initialized = true
+	return true
+}
+
+func (a *registrytestapp) Cancel() {}
+
+type notanapp struct{}
+
+func TestRegister(t *testing.T) {
+	Register("registry_test_app", func() DaemonApplication { return &registrytestapp{} })
+	defer func() {
+		registryMutex.Lock()
+		delete(registry, "registry_test_app")
+		registryMutex.Unlock()
+	}()
+
+	factory, ok := RegisteredApp("registry_test_app")
+	h.Equals(t, true, ok)
+	_, isTestApp := factory().(*registrytestapp)
+	h.Equals(t, true, isTestApp)
+	h.Assert(t, factory() != factory(), "expected a new instance each call")
+
+	_, ok = RegisteredApp("missing_app")
+	h.Equals(t, false, ok)
+
+	found := false
+	for _, name := range RegisteredApps() {
+		found = found || name == "registry_test_app"
+	}
+	h.Equals(t, true, found)
+}
+
+func TestRegisterPanics(t *testing.T) {
+	Register("registry_twice_app", func() DaemonApplication { return &registrytestapp{} })
+	defer func() {
+		registryMutex.Lock()
+		delete(registry, "registry_twice_app")
+		registryMutex.Unlock()
+	}()
+
+	for _, register := range []func(){
+		func() { Register("registry_twice_app", func() DaemonApplication { return &registrytestapp{} }) },
+		func() { Register("", func() DaemonApplication { return &registrytestapp{} }) },
+		func() { Register("registry_nil_app", nil) },
+	} {
+		func() {
+			defer func() {
+				h.Assert(t, recover() != nil, "expected Register to panic")
+			}()
+			register()
+		}()
+	}
+}
+
+func TestNewAppFactory(t *testing.T) {
+	factory, err := NewAppFactory(registrytestapp{})
+	h.Ok(t, err)
+	_, ok := factory().(*registrytestapp)
+	h.Equals(t, true, ok)
+
+	factory, err = NewAppFactory(&registrytestapp{})
+	h.Ok(t, err)
+	_, ok = factory().(*registrytestapp)
+	h.Equals(t, true, ok)
+
+	factory, err = NewAppFactory(func() DaemonApplication { return &registrytestapp{} })
+	h.Ok(t, err)
+	_, ok = factory().(*registrytestapp)
+	h.Equals(t, true, ok)
+
+	_, err = NewAppFactory(notanapp{})
+	h.Assert(t, err != nil && strings.Contains(err.Error(), "*interfaces.notanapp does not implement DaemonApplication"),
+		"unexpected error %v", err)
+
+	_, err = NewAppFactory(nil)
+	h.Assert(t, err != nil, "expected error for nil app")
+}
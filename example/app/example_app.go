@@ -5,8 +5,9 @@ Applications
 
 Applications in go-daemon implements any functionality provided by go-language
 in home control software compatible with Home Assistant websocket API. All
-applications need to be pre-added in the "apps.go" file since go is a compiled
-language and does not support dynamic loading.
+applications register themselves in the init function with "daemon.Register" and
+the package is imported in the "apps.go" file since go is a compiled language and
+does not support dynamic loading.
 
 You can use your own go routines to do work, make sure you exit them by using the
 "Cancel" function to provide the nescessary cancellation logic.
@@ -25,6 +26,7 @@ import (
 	"time"
 
 	d "github.com/helto4real/go-daemon/daemon"
+	"github.com/helto4real/go-daemon/daemon/config"
 	"github.com/helto4real/go-hassclient/client"
 	c "github.com/helto4real/go-hassclient/client"
 	"github.com/sirupsen/logrus"
@@ -44,6 +46,26 @@ type ExampleApp struct {
 	timer           *time.Timer
 	testEntity      d.DaemonEntity
 	entityChannel   chan d.DaemonEntity
+	log             *logrus.Entry
+	config          exampleAppConfig
+}
+
+// exampleAppConfig is the typed configuration of the app, the properties
+// in the app yaml file are decoded and validated before Initialize
+type exampleAppConfig struct {
+	MotionSensor config.EntityID `yaml:"tomas_motion_sensor" validate:"required"`
+	Light        config.EntityID `yaml:"tomas_room_light" validate:"required"`
+	OffDelay     time.Duration   `yaml:"off_delay" default:"2m"`
+}
+
+// Config returns the typed configuration to decode the properties into
+func (a *ExampleApp) Config() interface{} {
+	return &a.config
+}
+
+func init() {
+	// Makes the app available as "app: example_app" in the app yaml
+	d.Register("example_app", func() d.DaemonApplication { return &ExampleApp{} })
 }
 
 // Initialize is called when an application is started
@@ -54,6 +76,9 @@ func (a *ExampleApp) Initialize(helper d.DaemonAppHelper, config d.DeamonAppConf
 	// Save the daemon helper and config to variables for later use
 	a.deamon = helper
 	a.cfg = config
+	// The logger is tagged with app name and instance, the level can be set
+	// per app under logging in go-daemon.yaml
+	a.log = helper.GetLogger()
 	// Make the channel all state changes we listen too will be sent to
 	// I will use 5 deep channel so we can handle more incoming before
 	// blocking the channel
@@ -82,7 +107,7 @@ func (a *ExampleApp) Initialize(helper d.DaemonAppHelper, config d.DeamonAppConf
 	// Do state change logic in own go-routine and return from initializaiotn
 	// Initialize function should never block
 	go a.handleStateChanges()
-	log.Println("Example app initialized!")
+	a.log.Println("Example app initialized!")
 	return true
 }
 
@@ -101,20 +126,20 @@ func (a *ExampleApp) handleStateChanges() {
 			if !ok {
 				return
 			}
-			log.Print(callServiceEvent)
+			a.log.Print(callServiceEvent)
 		case <-a.sunrise:
-			log.Println("SUNRISE!")
+			a.log.Println("SUNRISE!")
 			// Reschedule
 			a.deamon.AtSunrise(time.Duration(30)*time.Minute, a.sunrise)
 		case <-a.sunset:
-			log.Println("SUNSET!")
+			a.log.Println("SUNSET!")
 			// Reschedule
 			a.deamon.AtSunset(time.Duration(-1)*time.Hour, a.sunset)
 		case myentity, ok := <-a.entityChannel:
 			if !ok {
 				return
 			}
-			log.Errorf("Entity %s changed state to: %s", myentity.ID(), myentity.State())
+			a.log.Errorf("Entity %s changed state to: %s", myentity.ID(), myentity.State())
 
 		// Listen to the cancelation context and leave when canceled
 		case <-a.cancelContext.Done():
@@ -124,20 +149,21 @@ func (a *ExampleApp) handleStateChanges() {
 }
 
 func (a *ExampleApp) handleEntityState(entity client.HassEntity) {
-	motionsensor := a.cfg.Properties["tomas_motion_sensor"]
-	light := a.cfg.Properties["tomas_room_light"]
+	motionsensor := string(a.config.MotionSensor)
+	light := string(a.config.Light)
+	offDelay := a.config.OffDelay
 
 	if entity.ID == motionsensor && entity.New.State != entity.Old.State {
 		if entity.New.State == "on" {
 
 			a.deamon.TurnOn(light)
 			if a.timer != nil {
-				log.Printf("Retting timer off to %v", time.Now().Add(time.Minute*2).Local())
-				a.timer.Reset(time.Minute * 2)
+				a.log.Printf("Retting timer off to %v", time.Now().Add(offDelay).Local())
+				a.timer.Reset(offDelay)
 			} else {
-				log.Printf("Setting timer off to %v", time.Now().Add(time.Minute*2).Local())
-				// Call turn off in 2 minute
-				a.timer = time.AfterFunc(time.Minute*2, func() {
+				a.log.Printf("Setting timer off to %v", time.Now().Add(offDelay).Local())
+				// Call turn off after the configured delay
+				a.timer = time.AfterFunc(offDelay, func() {
 					a.deamon.TurnOff(light)
 				})
 			}
@@ -155,10 +181,3 @@ func (a *ExampleApp) Cancel() {
 	// Cancel the goroutine select
 	a.cancel()
 }
-
-var log *logrus.Entry
-
-// init is called first in all packages. This setup the logging to use prefix
-func init() {
-	log = logrus.WithField("prefix", "example_app")
-}
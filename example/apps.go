@@ -1,13 +1,13 @@
 package main
 
 import (
-	"github.com/helto4real/go-daemon/example/app"
+	// The example app registers itself as example_app
+	_ "github.com/helto4real/go-daemon/example/app"
 )
 
 // Since go is a compiled language the deamon have to know
-// what applications that are available and their configuration
-// name that will be referenced in yaml config "app: appname"
+// what applications that are available. Apps register with the
+// name that will be referenced in yaml config "app: appname" from
+// the init function of their package, see example/app/example_app.go
 //
-// Everytime you add a new app in go-daemon this list must be added
-var apps = map[string]interface{}{
-	"example_app": app.ExampleApp{}}
+// Everytime you add a new app package in go-daemon it must be imported here
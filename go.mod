@@ -3,7 +3,7 @@ module github.com/helto4real/go-daemon
 go 1.13
 
 require (
-	github.com/gorilla/websocket v1.4.2 // indirect
+	github.com/gorilla/websocket v1.4.2
 	github.com/helto4real/go-hassclient v0.0.1
 	github.com/konsorten/go-windows-terminal-sequences v1.0.3 // indirect
 	github.com/mattn/go-colorable v0.1.8 // indirect
@@ -1,25 +1,47 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
 	c "github.com/helto4real/go-daemon/daemon/core"
+	"github.com/helto4real/go-daemon/daemon/logging"
 	"github.com/helto4real/go-hassclient/client"
 	"github.com/sirupsen/logrus"
-	prefixed "github.com/x-cray/logrus-prefixed-formatter"
 )
 
 var log *logrus.Entry
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "healthcheck":
+			// Used from docker HEALTHCHECK, exit code tells the status
+			os.Exit(c.HealthCheck("."))
+		case "trace":
+			// Prints the trace of an app instance with trace: true in config
+			if len(os.Args) < 3 {
+				fmt.Println("usage: go-daemon trace <app instance>")
+				os.Exit(2)
+			}
+			os.Exit(c.PrintTrace(".", os.Args[2], os.Stdout))
+		case "validate":
+			// Validates the configuration without connecting to Home Assistant
+			configPath := "."
+			if len(os.Args) > 2 {
+				configPath = os.Args[2]
+			}
+			os.Exit(c.Validate(configPath, nil, os.Stdout))
+		}
+	}
 
 	log.Println("Starting go-daemon...")
 
 	osSignal := make(chan os.Signal, 1)
 	daemon := c.NewApplicationDaemonRunner()
 	hass := client.NewHassClient()
-	// Apps is defined in the apps.go file
-	daemon.Start(".", hass, apps)
+	// Apps register themselves, they are imported in the apps.go file
+	daemon.Start(".", hass, nil)
 
 	for {
 		select {
@@ -31,13 +53,6 @@ func main() {
 }
 func init() {
 	log = logrus.WithField("prefix", "go-appdaemon")
-	Formatter := new(prefixed.TextFormatter)
-	Formatter.FullTimestamp = true
-	Formatter.TimestampFormat = "2006-01-02 15:04:05"
-	Formatter.DisableColors = true
-	Formatter.ForceColors = false
-	Formatter.ForceFormatting = true
-	logrus.SetFormatter(Formatter)
-	logrus.SetLevel(logrus.InfoLevel)
-
+	// Default logging until configuration is read, see logging in go-daemon.yaml
+	logging.Init()
 }